@@ -1,23 +1,27 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha256"
-	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
+	"log/slog"
 	"os"
 	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
-	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/compress"
+	"httpffomtcp.pinglu.dev/internal/fileserver"
+	"httpffomtcp.pinglu.dev/internal/metrics"
+	"httpffomtcp.pinglu.dev/internal/proxy"
 	"httpffomtcp.pinglu.dev/internal/request"
 	"httpffomtcp.pinglu.dev/internal/response"
 	"httpffomtcp.pinglu.dev/internal/server"
+	"httpffomtcp.pinglu.dev/internal/sse"
+	"httpffomtcp.pinglu.dev/internal/websocket"
 )
 
 const PORT = 42069
@@ -67,117 +71,62 @@ func responseBody200() []byte {
 	return []byte(s)
 }
 
-var sumTrailerKey = strings.ToLower("X-Content-SHA256")
-var contentLengthTrailerKey = strings.ToLower("X-Content-Length")
+// httpbin forwards /httpbin/... to https://httpbin.org/..., streaming the
+// response back as it arrives.
+var httpbin *proxy.ReverseProxy
 
-func proxyHandler(w *response.Writer) {
-	resp, err := http.Get("https://httpbin.org/stream/100")
-	if err != nil {
-		msg := []byte(err.Error())
-
-		w.WriteStatusLine(response.STATUS_INTERNAL_ERROR)
-
-		h := response.GetDefaultHeaders(len(msg))
-		w.WriteHeaders(h)
-
-		w.WriteBody(msg)
-		return
-	}
-	defer resp.Body.Close()
+// assets serves the files next to the binary, without ever reading a whole
+// file into memory.
+var assets = fileserver.New("assets", fileserver.Options{})
 
-	err = w.WriteStatusLine(response.STATUS_OK)
-	if err != nil {
-		log.Printf("ERROR: %s\n", err.Error())
-	}
-
-	h := response.GetDefaultHeaders(0)
-	h.Delete("Content-Length")
-	h.Set("Transfer-Encoding", "chunked")
-	h.Replace("Content-Type", "application/json")
-	h.Set("Trailer", sumTrailerKey)
-	h.Set("Trailer", contentLengthTrailerKey)
-	err = w.WriteHeaders(h)
-	if err != nil {
-		log.Printf("ERROR: %s\n", err.Error())
-	}
+func videoHandler(w *response.Writer, req *request.Request) {
+	assets.ServeFile(w, req, "vim.mp4")
+}
 
-	var fullBody bytes.Buffer
-	buf := make([]byte, 1024)
-	done := false
+// echo sends every WebSocket message back until the client closes.
+var echo = websocket.Handler(websocket.Options{EnableCompression: true}, func(conn *websocket.Conn) {
 	for {
-		n, err := resp.Body.Read(buf)
+		opcode, message, err := conn.ReadMessage()
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				done = true
-			}
-			break
+			return
 		}
 
-		data := buf[:n]
-		_, err = w.WriteChunkedBody(data)
+		err = conn.WriteMessage(opcode, message)
 		if err != nil {
-			log.Printf("ERROR: %s\n", err.Error())
-		}
-
-		_, err = fullBody.Write(data)
-		if err != nil {
-			log.Printf("ERROR: %s\n", err.Error())
+			return
 		}
 	}
+})
 
-	if done {
-		_, err := w.WriteChunkedBodyDone()
-		if err != nil {
-			log.Printf("ERROR: %s\n", err.Error())
-		}
-
-		sum := sha256.Sum256(fullBody.Bytes())
-		t := headers.NewHeaders()
-		t.Set(sumTrailerKey, fmt.Sprintf("%x", sum))
-		t.Set(contentLengthTrailerKey, strconv.Itoa(fullBody.Len()))
-		w.WriteTrailers(t)
-	}
-}
-
-func videoHandler(w *response.Writer) {
-	data, err := os.ReadFile("assets/vim.mp4")
-	if err != nil {
-		msg := []byte(err.Error())
-		h := response.GetDefaultHeaders(len(msg))
-		err := w.WriteStatusLine(response.STATUS_INTERNAL_ERROR)
-		if err != nil {
-			log.Printf("ERROR: %s\n", err.Error())
-		}
-
-		err = w.WriteHeaders(h)
-		if err != nil {
-			log.Printf("ERROR: %s\n", err.Error())
-		}
+// events sends the time every second until the client goes away.
+var events = sse.Handler(sse.Options{}, func(s *sse.Stream, req *request.Request) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 
-		_, err = w.WriteBody(msg)
-		if err != nil {
-			log.Printf("ERROR: %s\n", err.Error())
+	for {
+		select {
+		case <-s.Done():
+			return
+		case t := <-ticker.C:
+			err := s.Send(sse.Event{Event: "tick", Data: t.Format(time.RFC3339)})
+			if err != nil {
+				return
+			}
 		}
-		return
 	}
+})
 
-	h := response.GetDefaultHeaders(len(data))
-	h.Replace("content-type", "video/mp4")
+var registry = metrics.NewRegistry()
 
-	err = w.WriteStatusLine(response.STATUS_OK)
-	if err != nil {
-		log.Printf("ERROR: %s\n", err.Error())
-	}
+var routes = []string{"/", "/httpbin/stream/100", "/video", "/echo", "/events", "/metrics", "/yourproblem", "/myproblem"}
 
-	err = w.WriteHeaders(h)
-	if err != nil {
-		log.Printf("ERROR: %s\n", err.Error())
+// route keeps the route label of the metrics down to the paths we know.
+func route(req *request.Request) string {
+	if slices.Contains(routes, req.RequestLine.RequestTarget) {
+		return req.RequestLine.RequestTarget
 	}
 
-	_, err = w.WriteBody(data)
-	if err != nil {
-		log.Printf("ERROR: %s\n", err.Error())
-	}
+	return "other"
 }
 
 func handler(w *response.Writer, req *request.Request) {
@@ -185,12 +134,23 @@ func handler(w *response.Writer, req *request.Request) {
 	statusCode := response.STATUS_OK
 	body := responseBody200()
 
-	switch req.RequestLine.RequestTarget {
-	case "/httpbin/stream/100":
-		proxyHandler(w)
+	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/") {
+		httpbin.Handle(w, req)
 		return
+	}
+
+	switch req.RequestLine.RequestTarget {
 	case "/video":
-		videoHandler(w)
+		videoHandler(w, req)
+		return
+	case "/echo":
+		echo(w, req)
+		return
+	case "/events":
+		events(w, req)
+		return
+	case "/metrics":
+		registry.Handler()(w, req)
 		return
 	case "/yourproblem":
 		statusCode = response.STATUS_BAD_REQUEST
@@ -202,30 +162,107 @@ func handler(w *response.Writer, req *request.Request) {
 
 	h.Replace("Content-Type", "text/html")
 	h.Replace("Content-Length", strconv.Itoa(len(body)))
+	// Lets browsers revalidate with If-None-Match and get a 304.
+	h.Set("ETag", response.StrongETag(body))
 
 	err := w.WriteStatusLine(statusCode)
 	if err != nil {
-		log.Printf("ERROR: %s\n", err.Error())
+		slog.Error("error writing response", "err", err)
 	}
 
 	err = w.WriteHeaders(h)
 	if err != nil {
-		log.Printf("ERROR: %s\n", err.Error())
+		slog.Error("error writing response", "err", err)
 	}
 
 	_, err = w.WriteBody(body)
 	if err != nil {
-		log.Printf("ERROR: %s\n", err.Error())
+		slog.Error("error writing response", "err", err)
 	}
 }
 
 func main() {
-	server, err := server.Serve(PORT, handler)
+	var err error
+	httpbin, err = proxy.New("https://httpbin.org", proxy.Options{StripPrefix: "/httpbin"})
+	if err != nil {
+		log.Fatalf("Error starting server: %v", err)
+	}
+
+	config := server.Config{
+		Addr:           fmt.Sprintf(":%d", PORT),
+		ReadTimeout:    10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+		MaxBodyBytes:   10 << 20,
+		MaxConns:       1024,
+		MaxConnsPerIP:  64,
+		Metrics:        server.NewMetrics(registry),
+
+		DecodeRequestBodies: true,
+		H2C:                 true,
+	}
+	config.Metrics.Route = route
+
+	// Log every request to stdout, or to ACCESS_LOG_FILE if set, in the
+	// format named by ACCESS_LOG_FORMAT ("combined" by default).
+	var accessLogOut io.Writer = os.Stdout
+	if path := os.Getenv("ACCESS_LOG_FILE"); path != "" {
+		logFile, err := server.OpenLogFile(path)
+		if err != nil {
+			log.Fatalf("Error opening access log: %v", err)
+		}
+		defer logFile.Close()
+		defer logFile.ReopenOnSIGHUP(nil)()
+
+		accessLogOut = logFile
+	}
+
+	accessLogFormat := server.AccessLogFormat(os.Getenv("ACCESS_LOG_FORMAT"))
+	if accessLogFormat == "" {
+		accessLogFormat = server.COMBINED_LOG_FORMAT
+	}
+
+	accessLog, err := server.NewAccessLogger(accessLogOut, accessLogFormat)
+	if err != nil {
+		log.Fatalf("Error starting server: %v", err)
+	}
+	config.AccessLog = accessLog
+
+	// Serve HTTPS when a certificate is configured. Sending SIGHUP reloads
+	// it from disk, e.g. after a renewal.
+	if certFile := os.Getenv("TLS_CERT_FILE"); certFile != "" {
+		store, err := server.NewCertStore(server.CertFile{
+			CertFile: certFile,
+			KeyFile:  os.Getenv("TLS_KEY_FILE"),
+		})
+		if err != nil {
+			log.Fatalf("Error loading certificate: %v", err)
+		}
+		defer store.ReloadOnSIGHUP(nil)()
+
+		config.TLSConfig = store.TLSConfig()
+	}
+
+	// Prefer a listener handed to us by systemd socket activation.
+	listeners, err := server.SystemdListeners()
+	if err != nil {
+		log.Fatalf("Error starting server: %v", err)
+	}
+
+	// Compress HTML and JSON for clients that accept it. The video is
+	// already compressed and is left alone.
+	h := compress.Middleware(handler)
+
+	var srv *server.Server
+	if len(listeners) > 0 {
+		srv, err = server.ServeListener(listeners[0], config, h)
+	} else {
+		srv, err = server.ServeConfig(config, h)
+	}
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer server.Close()
-	log.Println("Server started on port", PORT)
+	defer srv.Close()
+	log.Println("Server started on", srv.Addr())
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -0,0 +1,167 @@
+// Package chunked parses the framing of the chunked transfer coding, RFC
+// 9112 7.1, for the request, response and client parsers.
+package chunked
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+)
+
+var ERROR_MALFORMED_CHUNK = errors.New("malformed chunk")
+
+// MAX_SIZE_LINE_BYTES bounds a chunk size line, extensions included.
+const MAX_SIZE_LINE_BYTES = 4096
+
+var CRLF = []byte("\r\n")
+
+type parserState string
+
+const (
+	PARSING_SIZE     parserState = "parsing chunk size"
+	PARSING_DATA     parserState = "parsing chunk data"
+	PARSING_END      parserState = "parsing chunk end"
+	PARSING_TRAILERS parserState = "parsing trailers"
+	DONE             parserState = "done"
+)
+
+// IsChunked reports whether the Transfer-Encoding value te is chunked, the
+// only transfer coding we support.
+func IsChunked(te string) bool {
+	return strings.EqualFold(strings.TrimSpace(te), "chunked")
+}
+
+// ParseSize parses the chunk size line at the start of data. It returns 0
+// bytes parsed if data doesn't hold the whole line yet.
+//
+// chunk-size = 1*HEXDIG
+// chunk = chunk-size [ chunk-ext ] CRLF chunk-data CRLF
+func ParseSize(data []byte) (int64, int, error) {
+	index := bytes.Index(data, CRLF)
+	if index == -1 {
+		if len(data) > MAX_SIZE_LINE_BYTES {
+			return 0, 0, ERROR_MALFORMED_CHUNK
+		}
+		return 0, 0, nil
+	}
+
+	line, _, _ := strings.Cut(string(data[:index]), ";")
+	line = strings.TrimSpace(line)
+
+	size, err := strconv.ParseInt(line, 16, 64)
+	if err != nil || size < 0 || line == "" || line[0] == '+' || line[0] == '-' {
+		return 0, 0, ERROR_MALFORMED_CHUNK
+	}
+
+	return size, index + len(CRLF), nil
+}
+
+// Parser follows the framing of a chunked body. Parse consumes chunk sizes,
+// chunk ends and trailers, and stops at chunk data, which the caller copies
+// wherever it likes and reports with Consume. That way a parser that
+// buffers the body and one that streams it share the framing.
+type Parser struct {
+	trailers     headers.Headers
+	state        parserState
+	remaining    int64
+	trailerBytes int
+}
+
+// NewParser returns a parser at the start of a chunked body that adds the
+// trailer fields to trailers.
+func NewParser(trailers headers.Headers) *Parser {
+	return &Parser{trailers: trailers, state: PARSING_SIZE}
+}
+
+func (p *Parser) Parse(data []byte) (int, error) {
+	totalBytesParsed := 0
+
+outer:
+	for {
+		switch p.state {
+		case PARSING_SIZE:
+			size, n, err := ParseSize(data[totalBytesParsed:])
+			if err != nil {
+				return 0, err
+			}
+
+			if n == 0 {
+				break outer
+			}
+
+			totalBytesParsed += n
+
+			if size == 0 {
+				p.state = PARSING_TRAILERS
+			} else {
+				p.remaining = size
+				p.state = PARSING_DATA
+			}
+		case PARSING_END:
+			rest := data[totalBytesParsed:]
+			if len(rest) < len(CRLF) {
+				break outer
+			}
+
+			if !bytes.HasPrefix(rest, CRLF) {
+				return 0, ERROR_MALFORMED_CHUNK
+			}
+
+			totalBytesParsed += len(CRLF)
+			p.state = PARSING_SIZE
+		case PARSING_TRAILERS:
+			n, done, err := p.trailers.Parse(data[totalBytesParsed:])
+			if err != nil {
+				return 0, err
+			}
+
+			if n == 0 {
+				break outer
+			}
+
+			totalBytesParsed += n
+			p.trailerBytes += n
+
+			if done {
+				p.state = DONE
+			}
+		default:
+			break outer
+		}
+	}
+
+	return totalBytesParsed, nil
+}
+
+// Remaining returns how many bytes of chunk data come before the next
+// framing; zero unless the parser stopped at chunk data.
+func (p *Parser) Remaining() int64 {
+	return p.remaining
+}
+
+// Consume records that n bytes of chunk data, at most Remaining, were
+// read.
+func (p *Parser) Consume(n int) {
+	p.remaining -= int64(n)
+	if p.remaining == 0 && p.state == PARSING_DATA {
+		p.state = PARSING_END
+	}
+}
+
+func (p *Parser) Done() bool {
+	return p.state == DONE
+}
+
+// InTrailers reports whether the parser is in the trailer section, which
+// the callers count against their header limits.
+func (p *Parser) InTrailers() bool {
+	return p.state == PARSING_TRAILERS
+}
+
+// TrailerBytes returns the size of the trailer section parsed so far.
+func (p *Parser) TrailerBytes() int {
+	return p.trailerBytes
+}
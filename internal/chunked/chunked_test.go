@@ -0,0 +1,110 @@
+package chunked
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		data string
+		size int64
+		n    int
+		err  error
+	}{
+		{"5\r\nhello", 5, 3, nil},
+		{"1A;name=value\r\n", 26, 15, nil},
+		{" f \r\n", 15, 5, nil},
+		{"0\r\n", 0, 3, nil},
+		{"5", 0, 0, nil},
+		{"zz\r\n", 0, 0, ERROR_MALFORMED_CHUNK},
+		{"\r\n", 0, 0, ERROR_MALFORMED_CHUNK},
+		{"-5\r\n", 0, 0, ERROR_MALFORMED_CHUNK},
+		{"+5\r\n", 0, 0, ERROR_MALFORMED_CHUNK},
+		{"10000000000000000\r\n", 0, 0, ERROR_MALFORMED_CHUNK},
+		{strings.Repeat("1", MAX_SIZE_LINE_BYTES+1), 0, 0, ERROR_MALFORMED_CHUNK},
+	}
+
+	for _, tt := range tests {
+		size, n, err := ParseSize([]byte(tt.data))
+		if tt.err != nil {
+			assert.ErrorIs(t, err, tt.err, tt.data)
+			continue
+		}
+
+		require.NoError(t, err, tt.data)
+		assert.Equal(t, tt.size, size, tt.data)
+		assert.Equal(t, tt.n, n, tt.data)
+	}
+
+	assert.True(t, IsChunked(" Chunked "))
+	assert.False(t, IsChunked("gzip, chunked"))
+}
+
+// readAll feeds data to a parser step bytes at a time, the way the
+// callers do, and returns the body.
+func readAll(data string, step int) (string, headers.Headers, error) {
+	trailers := headers.NewHeaders()
+	p := NewParser(trailers)
+
+	var body strings.Builder
+	var buf []byte
+
+	for i := 0; i < len(data) && !p.Done(); i += step {
+		buf = append(buf, data[i:min(i+step, len(data))]...)
+
+		for {
+			n, err := p.Parse(buf)
+			if err != nil {
+				return "", nil, err
+			}
+			buf = buf[n:]
+
+			n = min(int(p.Remaining()), len(buf))
+			if n == 0 {
+				break
+			}
+
+			body.Write(buf[:n])
+			p.Consume(n)
+			buf = buf[n:]
+		}
+	}
+
+	return body.String(), trailers, nil
+}
+
+func TestParser(t *testing.T) {
+	data := "5\r\nhello\r\n7;ext\r\n, world\r\n0\r\nX-Checksum: 42\r\n\r\n"
+
+	// Test: The result doesn't depend on how the data is split
+	for _, step := range []int{1, 2, 3, 7, len(data)} {
+		body, trailers, err := readAll(data, step)
+		require.NoError(t, err)
+		assert.Equal(t, "hello, world", body, step)
+		assert.Equal(t, "42", trailers.Get("X-Checksum"), step)
+	}
+
+	// Test: Missing CRLF after chunk data
+	_, _, err := readAll("5\r\nhelloXX0\r\n\r\n", 4)
+	assert.ErrorIs(t, err, ERROR_MALFORMED_CHUNK)
+
+	// Test: Trailers are tracked for header limits
+	p := NewParser(headers.NewHeaders())
+	n, err := p.Parse([]byte("0\r\nX-A: 1\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 11, n)
+	assert.True(t, p.InTrailers())
+	assert.Equal(t, 8, p.TrailerBytes())
+
+	n, err = p.Parse([]byte("\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.True(t, p.Done())
+	assert.False(t, p.InTrailers())
+}
@@ -0,0 +1,564 @@
+// Package client implements an HTTP/1.1 client on top of this project's
+// own parsing code, with keep-alive connection pooling.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"httpffomtcp.pinglu.dev/internal/chunked"
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/response"
+)
+
+var ERROR_INVALID_URL = errors.New("invalid request url")
+var ERROR_CLIENT_CLOSED = errors.New("client closed")
+
+const (
+	DEFAULT_DIAL_TIMEOUT              = 10 * time.Second
+	DEFAULT_IDLE_TIMEOUT              = 90 * time.Second
+	DEFAULT_MAX_IDLE_CONNS_PER_HOST   = 2
+	DEFAULT_MAX_RESPONSE_HEADER_BYTES = 1 << 20
+)
+
+// READ_BUFFER_SIZE is also the longest status line, header line or chunk
+// size line we accept.
+const READ_BUFFER_SIZE = 32 << 10
+
+// idempotentMethods can be sent again on a fresh connection if a pooled
+// one turns out to have been closed by the server, RFC 9110 9.2.2.
+var idempotentMethods = []string{"GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE"}
+
+type Options struct {
+	// Dial opens connections. Defaults to a net.Dialer.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// TLSConfig is used for https URLs. Nil means the defaults.
+	TLSConfig *tls.Config
+
+	// DialTimeout bounds connecting, TLS handshake included. Zero means
+	// DEFAULT_DIAL_TIMEOUT.
+	DialTimeout time.Duration
+
+	// ResponseHeaderTimeout bounds the wait for the response head once the
+	// request is sent. Zero means no limit other than the context.
+	ResponseHeaderTimeout time.Duration
+
+	// IdleTimeout is how long a pooled connection is kept unused. Zero
+	// means DEFAULT_IDLE_TIMEOUT.
+	IdleTimeout time.Duration
+
+	// MaxIdleConnsPerHost bounds the pool for each host. Zero means
+	// DEFAULT_MAX_IDLE_CONNS_PER_HOST, negative turns keep-alive off.
+	MaxIdleConnsPerHost int
+
+	// MaxResponseHeaderBytes bounds the status line plus headers of a
+	// response. Zero means DEFAULT_MAX_RESPONSE_HEADER_BYTES.
+	MaxResponseHeaderBytes int
+}
+
+func (o Options) withDefaults() Options {
+	if o.Dial == nil {
+		var dialer net.Dialer
+		o.Dial = dialer.DialContext
+	}
+
+	if o.DialTimeout == 0 {
+		o.DialTimeout = DEFAULT_DIAL_TIMEOUT
+	}
+
+	if o.IdleTimeout == 0 {
+		o.IdleTimeout = DEFAULT_IDLE_TIMEOUT
+	}
+
+	if o.MaxIdleConnsPerHost == 0 {
+		o.MaxIdleConnsPerHost = DEFAULT_MAX_IDLE_CONNS_PER_HOST
+	}
+
+	if o.MaxResponseHeaderBytes == 0 {
+		o.MaxResponseHeaderBytes = DEFAULT_MAX_RESPONSE_HEADER_BYTES
+	}
+
+	return o
+}
+
+type Request struct {
+	Method string
+	URL    *url.URL
+	// Headers are sent as they are. Host, Content-Length and
+	// Transfer-Encoding are filled in if missing.
+	Headers headers.Headers
+	Body    []byte
+	// Trailers are sent after the body, which then goes out chunked. A
+	// Transfer-Encoding: chunked header does the same without trailers.
+	Trailers headers.Headers
+}
+
+func NewRequest(method, rawURL string, body []byte) (*Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ERROR_INVALID_URL, err)
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w: %s", ERROR_INVALID_URL, rawURL)
+	}
+
+	return &Request{
+		Method:  method,
+		URL:     u,
+		Headers: headers.NewHeaders(),
+		Body:    body,
+	}, nil
+}
+
+func (r *Request) chunked() bool {
+	return len(r.Trailers) > 0 || chunked.IsChunked(r.Headers.Get("Transfer-Encoding"))
+}
+
+type Client struct {
+	options Options
+
+	mu     sync.Mutex
+	idle   map[string][]*conn
+	closed bool
+}
+
+func New(options Options) *Client {
+	return &Client{
+		options: options.withDefaults(),
+		idle:    make(map[string][]*conn),
+	}
+}
+
+// Get is a shorthand for a GET without a body.
+func (c *Client) Get(ctx context.Context, rawURL string) (*Response, error) {
+	req, err := NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Do(ctx, req)
+}
+
+// Do sends req and returns the response once its head is in. The body
+// streams from the connection, which goes back to the pool once the body
+// has been read to the end. ctx covers the body too.
+func (c *Client) Do(ctx context.Context, req *Request) (*Response, error) {
+	if req.URL == nil || (req.URL.Scheme != "http" && req.URL.Scheme != "https") || req.URL.Host == "" {
+		return nil, ERROR_INVALID_URL
+	}
+
+	for {
+		cn, err := c.getConn(ctx, req.URL)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.roundTrip(ctx, cn, req)
+		if err == nil {
+			return resp, nil
+		}
+
+		// A pooled connection may have been closed by the server while it
+		// sat idle. If nothing came back, try again on a new one.
+		if cn.reused && !cn.gotBytes && ctx.Err() == nil && slices.Contains(idempotentMethods, req.Method) {
+			continue
+		}
+
+		return nil, err
+	}
+}
+
+// CloseIdleConnections closes the pooled connections.
+func (c *Client) CloseIdleConnections() {
+	c.mu.Lock()
+	idle := c.idle
+	c.idle = make(map[string][]*conn)
+	c.mu.Unlock()
+
+	for _, conns := range idle {
+		for _, cn := range conns {
+			cn.Close()
+		}
+	}
+}
+
+// Close closes the pooled connections, and any that are returned later.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+
+	c.CloseIdleConnections()
+	return nil
+}
+
+type conn struct {
+	net.Conn
+	br       *bufio.Reader
+	key      string
+	idleAt   time.Time
+	reused   bool
+	gotBytes bool
+}
+
+// Read notes whether the server has sent anything, to tell a stale pooled
+// connection from a failed request.
+func (cn *conn) Read(p []byte) (int, error) {
+	n, err := cn.Conn.Read(p)
+	if n > 0 {
+		cn.gotBytes = true
+	}
+
+	return n, err
+}
+
+func poolKey(u *url.URL) string {
+	return u.Scheme + "://" + addr(u)
+}
+
+func addr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// getConn returns the most recently used idle connection for u, or dials a
+// new one.
+func (c *Client) getConn(ctx context.Context, u *url.URL) (*conn, error) {
+	key := poolKey(u)
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ERROR_CLIENT_CLOSED
+	}
+
+	var expired []*conn
+	var cn *conn
+	for len(c.idle[key]) > 0 {
+		conns := c.idle[key]
+		last := conns[len(conns)-1]
+		c.idle[key] = conns[:len(conns)-1]
+
+		if time.Since(last.idleAt) < c.options.IdleTimeout {
+			cn = last
+			break
+		}
+		expired = append(expired, last)
+	}
+	c.mu.Unlock()
+
+	for _, e := range expired {
+		e.Close()
+	}
+
+	if cn != nil {
+		cn.reused = true
+		cn.gotBytes = false
+		return cn, nil
+	}
+
+	netConn, err := c.dial(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+
+	cn = &conn{Conn: netConn, key: key}
+	cn.br = bufio.NewReaderSize(cn, READ_BUFFER_SIZE)
+
+	return cn, nil
+}
+
+// putConn returns cn to the pool, or closes it if the pool is full.
+func (c *Client) putConn(cn *conn) {
+	c.mu.Lock()
+	if c.closed || len(c.idle[cn.key]) >= c.options.MaxIdleConnsPerHost {
+		c.mu.Unlock()
+		cn.Close()
+		return
+	}
+
+	cn.idleAt = time.Now()
+	c.idle[cn.key] = append(c.idle[cn.key], cn)
+	c.mu.Unlock()
+}
+
+func (c *Client) dial(ctx context.Context, u *url.URL) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.options.DialTimeout)
+	defer cancel()
+
+	conn, err := c.options.Dial(ctx, "tcp", addr(u))
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "https" {
+		return conn, nil
+	}
+
+	var config *tls.Config
+	if c.options.TLSConfig != nil {
+		config = c.options.TLSConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+
+	if config.ServerName == "" {
+		config.ServerName = u.Hostname()
+	}
+
+	tlsConn := tls.Client(conn, config)
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+func (c *Client) keepAlive() bool {
+	return c.options.MaxIdleConnsPerHost > 0
+}
+
+// roundTrip sends req on cn and reads the response head. On error cn is
+// closed.
+func (c *Client) roundTrip(ctx context.Context, cn *conn, req *Request) (*Response, error) {
+	// Unblock reads and writes when ctx is done, until the body is
+	// released.
+	stop := context.AfterFunc(ctx, func() { cn.Close() })
+
+	fail := func(err error) (*Response, error) {
+		stop()
+		cn.Close()
+		return nil, contextError(ctx, err)
+	}
+
+	err := c.writeRequest(cn, req)
+	if err != nil {
+		return fail(err)
+	}
+
+	if c.options.ResponseHeaderTimeout > 0 {
+		cn.SetReadDeadline(time.Now().Add(c.options.ResponseHeaderTimeout))
+	}
+
+	resp, err := c.readHead(cn.br)
+	if err != nil {
+		return fail(err)
+	}
+
+	if c.options.ResponseHeaderTimeout > 0 {
+		cn.SetReadDeadline(time.Time{})
+	}
+
+	b, err := newBody(cn.br, resp, req.Method)
+	if err != nil {
+		return fail(err)
+	}
+
+	reusable := c.keepAlive() && b.state != PARSING_UNTIL_EOF && !hasCloseOption(req.Headers) && !closeRequested(resp)
+	b.release = func(done bool) {
+		// stop reports false if ctx already closed the connection.
+		if stop() && done && reusable {
+			c.putConn(cn)
+			return
+		}
+
+		cn.Close()
+	}
+
+	resp.Body = b
+	if b.state == DONE {
+		b.finish(true)
+	}
+
+	return resp, nil
+}
+
+// writeRequest sends req in one write.
+func (c *Client) writeRequest(w io.Writer, req *Request) error {
+	var b bytes.Buffer
+
+	chunked := req.chunked()
+
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\n", req.Method, req.URL.RequestURI())
+
+	h := req.Headers
+	if h == nil {
+		h = headers.NewHeaders()
+	}
+
+	if h.Get("Host") == "" {
+		fmt.Fprintf(&b, "host: %s\r\n", req.URL.Host)
+	}
+
+	for key, value := range h {
+		switch key {
+		case "content-length", "transfer-encoding":
+			continue
+		case "connection":
+			if !c.keepAlive() {
+				continue
+			}
+		}
+
+		fmt.Fprintf(&b, "%s: %s\r\n", key, value)
+	}
+
+	if chunked {
+		b.WriteString("transfer-encoding: chunked\r\n")
+	} else if len(req.Body) > 0 || h.Get("Content-Length") != "" || methodExpectsBody(req.Method) {
+		fmt.Fprintf(&b, "content-length: %d\r\n", len(req.Body))
+	}
+
+	if !c.keepAlive() {
+		b.WriteString("connection: close\r\n")
+	}
+	b.WriteString("\r\n")
+
+	if chunked {
+		if len(req.Body) > 0 {
+			fmt.Fprintf(&b, "%X\r\n", len(req.Body))
+			b.Write(req.Body)
+			b.WriteString("\r\n")
+		}
+
+		b.WriteString("0\r\n")
+		for key, value := range req.Trailers {
+			fmt.Fprintf(&b, "%s: %s\r\n", key, value)
+		}
+		b.WriteString("\r\n")
+	} else {
+		b.Write(req.Body)
+	}
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func methodExpectsBody(method string) bool {
+	return method == "POST" || method == "PUT" || method == "PATCH"
+}
+
+// readHead reads the status line and headers, skipping interim 1xx
+// responses.
+func (c *Client) readHead(br *bufio.Reader) (*Response, error) {
+	for {
+		resp := newResponse(c.options.MaxResponseHeaderBytes)
+
+		err := parseBuffered(br, resp.parse, resp.parsingHead)
+		if err != nil {
+			return nil, err
+		}
+
+		// 101 Switching Protocols is final, the others are not.
+		if resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != 101 {
+			continue
+		}
+
+		return resp, nil
+	}
+}
+
+// newBody works out how the body of resp is framed, RFC 9112 6.3.
+func newBody(br *bufio.Reader, resp *Response, method string) (*body, error) {
+	b := &body{br: br, resp: resp, state: DONE}
+	resp.ContentLength = 0
+
+	switch {
+	case resp.StatusCode == 101:
+		// What follows is another protocol, up to the end of the
+		// connection.
+		b.state = PARSING_UNTIL_EOF
+		resp.ContentLength = -1
+	case method == "HEAD" || resp.StatusCode == 204 || resp.StatusCode == response.STATUS_NOT_MODIFIED:
+	case chunked.IsChunked(resp.Headers.Get("Transfer-Encoding")):
+		b.state = PARSING_CHUNKED
+		b.chunks = chunked.NewParser(resp.Trailers)
+		resp.Chunked = true
+		resp.ContentLength = -1
+	case resp.Headers.Get("Transfer-Encoding") != "":
+		// Another coding, so only the end of the connection ends it.
+		b.state = PARSING_UNTIL_EOF
+		resp.ContentLength = -1
+	case resp.Headers.Get("Content-Length") != "":
+		n, err := strconv.ParseInt(resp.Headers.Get("Content-Length"), 10, 64)
+		if err != nil || n < 0 {
+			return nil, ERROR_MALFORMED_CONTENT_LENGTH
+		}
+
+		b.state = PARSING_FIXED_BODY
+		b.remaining = n
+		resp.ContentLength = n
+	default:
+		b.state = PARSING_UNTIL_EOF
+		resp.ContentLength = -1
+	}
+
+	if b.state == PARSING_FIXED_BODY && b.remaining == 0 {
+		b.state = DONE
+	}
+
+	return b, nil
+}
+
+// closeRequested reports whether the server will close the connection
+// after resp. HTTP/1.0 servers close it unless they say otherwise.
+func closeRequested(resp *Response) bool {
+	if hasCloseOption(resp.Headers) {
+		return true
+	}
+
+	return resp.HttpVersion == "1.0" && !hasConnectionOption(resp.Headers, "keep-alive")
+}
+
+func hasCloseOption(h headers.Headers) bool {
+	return hasConnectionOption(h, "close")
+}
+
+func hasConnectionOption(h headers.Headers, option string) bool {
+	if h == nil {
+		return false
+	}
+
+	for _, o := range strings.Split(h.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(o), option) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// contextError prefers the context's error to err, since closing the
+// connection when the context is done makes I/O fail with a less telling
+// one.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+
+	return err
+}
@@ -0,0 +1,356 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+	"httpffomtcp.pinglu.dev/internal/server"
+)
+
+// startServer runs handler on the project's own server and returns its URL.
+func startServer(t *testing.T, handler server.Handler) string {
+	t.Helper()
+
+	srv, err := server.ServeConfig(server.Config{Addr: "127.0.0.1:0"}, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+
+	return "http://" + srv.Addr().String()
+}
+
+// startRawServer answers requests with the result of respond, byte for
+// byte, and hangs up after each unless keepAlive is set or respond returns
+// "". conns counts the connections accepted.
+func startRawServer(t *testing.T, conns *atomic.Int64, keepAlive bool, respond func(req *request.Request) string) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			if conns != nil {
+				conns.Add(1)
+			}
+
+			go func() {
+				defer conn.Close()
+
+				for {
+					req, err := request.RequestFromReader(conn)
+					if err != nil {
+						return
+					}
+
+					resp := respond(req)
+					if resp == "" {
+						return
+					}
+					conn.Write([]byte(resp))
+
+					if !keepAlive {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return "http://" + listener.Addr().String()
+}
+
+func newClient(t *testing.T, options Options) *Client {
+	t.Helper()
+
+	c := New(options)
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+func get(t *testing.T, c *Client, url string) (*Response, string) {
+	t.Helper()
+
+	resp, err := c.Get(context.Background(), url)
+	require.NoError(t, err)
+
+	return resp, readBody(t, resp)
+}
+
+func readBody(t *testing.T, resp *Response) string {
+	t.Helper()
+
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return string(body)
+}
+
+func TestClient(t *testing.T) {
+	upstream := startServer(t, func(w *response.Writer, req *request.Request) {
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s %s\n", req.RequestLine.Method, req.RequestLine.RequestTarget)
+		fmt.Fprintf(&b, "host: %s\n", req.Headers.Get("Host"))
+		for key, value := range req.Trailers {
+			fmt.Fprintf(&b, "trailer %s: %s\n", key, value)
+		}
+		fmt.Fprintf(&b, "body: %s\n", req.Body)
+
+		w.WriteStatusLine(response.STATUS_OK)
+		w.WriteHeaders(response.GetDefaultHeaders(b.Len()))
+		w.WriteBody([]byte(b.String()))
+	})
+	c := newClient(t, Options{})
+
+	// Test: GET with a Content-Length body
+	resp, body := get(t, c, upstream+"/items?id=7")
+	assert.Equal(t, "1.1", resp.HttpVersion)
+	assert.Equal(t, response.STATUS_OK, resp.StatusCode)
+	assert.Equal(t, "OK", resp.ReasonPhrase)
+	assert.Equal(t, "text/plain", resp.Headers.Get("Content-Type"))
+	assert.Equal(t, int64(len(body)), resp.ContentLength)
+	assert.Contains(t, body, "GET /items?id=7\n")
+	assert.Contains(t, body, "host: "+strings.TrimPrefix(upstream, "http://")+"\n")
+
+	// Test: POST bodies are sent with their length
+	req, err := NewRequest("POST", upstream+"/", []byte("hello"))
+	require.NoError(t, err)
+	resp, err = c.Do(context.Background(), req)
+	require.NoError(t, err)
+	assert.Contains(t, readBody(t, resp), "body: hello\n")
+
+	// Test: Trailers make the request chunked
+	req, err = NewRequest("POST", upstream+"/", []byte("hello"))
+	require.NoError(t, err)
+	req.Trailers = headers.NewHeaders()
+	req.Trailers.Set("X-Checksum", "42")
+	resp, err = c.Do(context.Background(), req)
+	require.NoError(t, err)
+	body = readBody(t, resp)
+	assert.Contains(t, body, "trailer x-checksum: 42\n")
+	assert.Contains(t, body, "body: hello\n")
+
+	// Test: Chunked responses and their trailers
+	upstream = startServer(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.STATUS_OK)
+
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Checksum")
+		w.WriteHeaders(h)
+
+		w.WriteChunkedBody([]byte("hello "))
+		w.WriteChunkedBody([]byte("world"))
+		w.WriteChunkedBodyDone()
+
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Checksum", "42")
+		w.WriteTrailers(trailers)
+	})
+	resp, body = get(t, c, upstream)
+	assert.True(t, resp.Chunked)
+	assert.Equal(t, int64(-1), resp.ContentLength)
+	assert.Equal(t, "hello world", body)
+	assert.Equal(t, "42", resp.Trailers.Get("X-Checksum"))
+
+	// Test: Invalid URLs
+	_, err = c.Get(context.Background(), "ftp://example.com")
+	require.ErrorIs(t, err, ERROR_INVALID_URL)
+}
+
+func TestClientResponses(t *testing.T) {
+	c := newClient(t, Options{})
+
+	tests := []struct {
+		name string
+		resp string
+		body string
+		err  error
+	}{
+		{name: "Close-delimited body", resp: "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nuntil eof", body: "until eof"},
+		{name: "Interim responses are skipped", resp: "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 201 Created\r\nContent-Length: 4\r\n\r\ndone", body: "done"},
+		{name: "Chunk extensions", resp: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5;name=value\r\nhello\r\n0\r\n\r\n", body: "hello"},
+		{name: "HTTP/1.0", resp: "HTTP/1.0 200 OK\r\n\r\nold", body: "old"},
+		{name: "No reason phrase", resp: "HTTP/1.1 204\r\n\r\n", body: ""},
+		{name: "Malformed status line", resp: "garbage\r\n\r\n", err: ERROR_MALFORMED_STATUS_LINE},
+		{name: "Unsupported version", resp: "HTTP/2.0 200 OK\r\n\r\n", err: ERROR_UNSUPPORTED_HTTP_VERSION},
+		{name: "Malformed header", resp: "HTTP/1.1 200 OK\r\nBad Header: x\r\n\r\n", err: headers.ERROR_INVALID_FIELD_NAME},
+		{name: "Malformed Content-Length", resp: "HTTP/1.1 200 OK\r\nContent-Length: -1\r\n\r\n", err: ERROR_MALFORMED_CONTENT_LENGTH},
+		{name: "Truncated head", resp: "HTTP/1.1 200 OK\r\nContent-", err: io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		upstream := startRawServer(t, nil, false, func(req *request.Request) string { return tt.resp })
+
+		// Test: Each response
+		resp, err := c.Get(context.Background(), upstream)
+		if tt.err != nil {
+			require.ErrorIs(t, err, tt.err, tt.name)
+			continue
+		}
+		require.NoError(t, err, tt.name)
+		assert.Equal(t, tt.body, readBody(t, resp), tt.name)
+	}
+
+	// Test: Bodies cut short are an error
+	upstream := startRawServer(t, nil, false, func(req *request.Request) string {
+		return "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhel"
+	})
+	resp, err := c.Get(context.Background(), upstream)
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	resp.Body.Close()
+
+	upstream = startRawServer(t, nil, false, func(req *request.Request) string {
+		return "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhelloXX0\r\n\r\n"
+	})
+	resp, err = c.Get(context.Background(), upstream)
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	require.ErrorIs(t, err, ERROR_MALFORMED_CHUNK)
+	resp.Body.Close()
+
+	// Test: HEAD responses have no body
+	upstream = startRawServer(t, nil, false, func(req *request.Request) string {
+		return "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n"
+	})
+	req, err := NewRequest("HEAD", upstream, nil)
+	require.NoError(t, err)
+	resp, err = c.Do(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, "", readBody(t, resp))
+
+	// Test: Oversized heads are rejected
+	small := newClient(t, Options{MaxResponseHeaderBytes: 64})
+	upstream = startRawServer(t, nil, false, func(req *request.Request) string {
+		return "HTTP/1.1 200 OK\r\nX-Big: " + strings.Repeat("a", 100) + "\r\n\r\n"
+	})
+	_, err = small.Get(context.Background(), upstream)
+	require.ErrorIs(t, err, ERROR_HEADERS_TOO_LARGE)
+}
+
+func TestClientKeepAlive(t *testing.T) {
+	var conns atomic.Int64
+	upstream := startRawServer(t, &conns, true, func(req *request.Request) string {
+		if req.RequestLine.RequestTarget == "/chunked" {
+			return "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n0\r\n\r\n"
+		}
+
+		return "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+	})
+	c := newClient(t, Options{})
+
+	// Test: Connections are reused once the body has been read
+	for _, path := range []string{"/", "/chunked", "/", "/chunked"} {
+		_, body := get(t, c, upstream+path)
+		assert.Equal(t, "ok", body)
+	}
+	assert.Equal(t, int64(1), conns.Load())
+
+	// Test: A body closed before the end takes its connection with it
+	resp, err := c.Get(context.Background(), upstream)
+	require.NoError(t, err)
+	resp.Body.Close()
+	get(t, c, upstream)
+	assert.Equal(t, int64(2), conns.Load())
+
+	// Test: Negative MaxIdleConnsPerHost turns keep-alive off
+	conns.Store(0)
+	noKeepAlive := newClient(t, Options{MaxIdleConnsPerHost: -1})
+	for range 3 {
+		get(t, noKeepAlive, upstream)
+	}
+	assert.Equal(t, int64(3), conns.Load())
+
+	// Test: Idle connections expire
+	conns.Store(0)
+	short := newClient(t, Options{IdleTimeout: time.Millisecond})
+	get(t, short, upstream)
+	time.Sleep(5 * time.Millisecond)
+	get(t, short, upstream)
+	assert.Equal(t, int64(2), conns.Load())
+
+	// Test: A connection the server closed while idle is replaced
+	conns.Store(0)
+	var served atomic.Int64
+	upstream = startRawServer(t, &conns, true, func(req *request.Request) string {
+		if served.Add(1)%2 == 0 {
+			// Hang up without answering, as if the connection timed out.
+			return ""
+		}
+
+		return "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+	})
+	get(t, c, upstream)
+	_, body := get(t, c, upstream)
+	assert.Equal(t, "ok", body)
+	assert.Equal(t, int64(2), conns.Load())
+
+	// Test: Connection: close is honoured
+	conns.Store(0)
+	upstream = startRawServer(t, &conns, true, func(req *request.Request) string {
+		return "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok"
+	})
+	get(t, c, upstream)
+	get(t, c, upstream)
+	assert.Equal(t, int64(2), conns.Load())
+}
+
+func TestClientTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	upstream := startRawServer(t, nil, false, func(req *request.Request) string {
+		<-release
+		return ""
+	})
+
+	// Test: ResponseHeaderTimeout
+	c := newClient(t, Options{ResponseHeaderTimeout: 20 * time.Millisecond})
+	_, err := c.Get(context.Background(), upstream)
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+
+	// Test: The context bounds the whole request
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = newClient(t, Options{}).Get(ctx, upstream)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Test: And the body
+	upstream = startRawServer(t, nil, true, func(req *request.Request) string {
+		return "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nhello"
+	})
+	ctx, cancel = context.WithCancel(context.Background())
+	resp, err := newClient(t, Options{}).Get(ctx, upstream)
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(resp.Body, buf)
+	require.NoError(t, err)
+	cancel()
+	_, err = io.ReadAll(bufio.NewReader(resp.Body))
+	require.Error(t, err)
+	resp.Body.Close()
+}
@@ -0,0 +1,278 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"io"
+
+	"httpffomtcp.pinglu.dev/internal/chunked"
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/response"
+)
+
+var ERROR_MALFORMED_STATUS_LINE = response.ERROR_MALFORMED_STATUS_LINE
+var ERROR_UNSUPPORTED_HTTP_VERSION = response.ERROR_UNSUPPORTED_HTTP_VERSION
+var ERROR_HEADERS_TOO_LARGE = response.ERROR_HEADERS_TOO_LARGE
+var ERROR_MALFORMED_CHUNK = chunked.ERROR_MALFORMED_CHUNK
+var ERROR_MALFORMED_CONTENT_LENGTH = response.ERROR_MALFORMED_CONTENT_LENGTH
+var ERROR_BODY_CLOSED = errors.New("read on closed body")
+
+type parserState string
+
+const (
+	PARSING_STATUS_LINE parserState = "parsing status line"
+	PARSING_HEADERS     parserState = "parsing headers"
+	PARSING_BODY        parserState = "parsing body"
+	PARSING_FIXED_BODY  parserState = "parsing fixed body"
+	PARSING_CHUNKED     parserState = "parsing chunked body"
+	PARSING_UNTIL_EOF   parserState = "parsing until eof"
+	DONE                parserState = "done"
+)
+
+type Response struct {
+	// HttpVersion is "1.1" or "1.0".
+	HttpVersion  string
+	StatusCode   response.StatusCode
+	ReasonPhrase string
+	Headers      headers.Headers
+	// Trailers is filled in once Body has been read to the end.
+	Trailers headers.Headers
+	// ContentLength is the length of Body, or -1 if it isn't known up
+	// front.
+	ContentLength int64
+	// Chunked reports whether the body was sent with chunked encoding.
+	Chunked bool
+	// Body streams the body. It must be closed, and it must be read to
+	// the end for the connection to be reused.
+	Body io.ReadCloser
+
+	parserState parserState
+	headerBytes int
+	maxHeader   int
+}
+
+func newResponse(maxHeader int) *Response {
+	return &Response{
+		Headers:     headers.NewHeaders(),
+		Trailers:    headers.NewHeaders(),
+		parserState: PARSING_STATUS_LINE,
+		maxHeader:   maxHeader,
+	}
+}
+
+// parse parses the status line and headers, with the same pieces as
+// response.ResponseFromReader. It stops at the body, which is left to the
+// body reader: unlike that parser, the client streams bodies.
+func (r *Response) parse(data []byte) (int, error) {
+	totalBytesParsed := 0
+
+outer:
+	for {
+		switch r.parserState {
+		case PARSING_STATUS_LINE:
+			sl, n, err := response.ParseStatusLine(data[totalBytesParsed:])
+			if err != nil {
+				return 0, err
+			}
+
+			if n == 0 {
+				break outer
+			}
+
+			r.HttpVersion = sl.HttpVersion
+			r.StatusCode = sl.StatusCode
+			r.ReasonPhrase = sl.ReasonPhrase
+			totalBytesParsed += n
+			r.parserState = PARSING_HEADERS
+		case PARSING_HEADERS:
+			n, done, err := r.Headers.Parse(data[totalBytesParsed:])
+			if err != nil {
+				return 0, err
+			}
+
+			if n == 0 {
+				break outer
+			}
+
+			totalBytesParsed += n
+
+			if done {
+				r.parserState = PARSING_BODY
+			}
+		default:
+			break outer
+		}
+	}
+
+	r.headerBytes += totalBytesParsed
+	if r.maxHeader > 0 && r.headerBytes > r.maxHeader {
+		return 0, ERROR_HEADERS_TOO_LARGE
+	}
+
+	return totalBytesParsed, nil
+}
+
+func (r *Response) parsingHead() bool {
+	return r.parserState == PARSING_STATUS_LINE || r.parserState == PARSING_HEADERS
+}
+
+// body reads a response body off the connection, undoing its framing.
+// Chunk framing and trailers go through a chunked.Parser; the data in
+// between is copied straight into the caller's buffer.
+type body struct {
+	br     *bufio.Reader
+	resp   *Response
+	state  parserState
+	chunks *chunked.Parser
+	// remaining is what is left of a body with a Content-Length.
+	remaining int64
+	// release is called once, when the body has been read to the end or
+	// closed. done tells which.
+	release func(done bool)
+	closed  bool
+	err     error
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, ERROR_BODY_CLOSED
+	}
+
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	n, err := b.read(p)
+	if err != nil {
+		b.err = err
+		if errors.Is(err, io.EOF) {
+			b.finish(true)
+		} else {
+			b.finish(false)
+		}
+	}
+
+	return n, err
+}
+
+func (b *body) read(p []byte) (int, error) {
+	for {
+		switch b.state {
+		case PARSING_FIXED_BODY:
+			if b.remaining == 0 {
+				b.state = DONE
+				continue
+			}
+
+			if len(p) == 0 {
+				return 0, nil
+			}
+
+			n, err := b.br.Read(p[:min(int64(len(p)), b.remaining)])
+			b.remaining -= int64(n)
+			if errors.Is(err, io.EOF) {
+				return n, io.ErrUnexpectedEOF
+			}
+
+			return n, err
+		case PARSING_CHUNKED:
+			if b.chunks.Done() {
+				b.state = DONE
+				continue
+			}
+
+			remaining := b.chunks.Remaining()
+			if remaining == 0 {
+				err := parseBuffered(b.br, b.chunks.Parse, b.parsingFraming)
+				if err != nil {
+					return 0, err
+				}
+				continue
+			}
+
+			if len(p) == 0 {
+				return 0, nil
+			}
+
+			n, err := b.br.Read(p[:min(int64(len(p)), remaining)])
+			b.chunks.Consume(n)
+			if errors.Is(err, io.EOF) {
+				return n, io.ErrUnexpectedEOF
+			}
+
+			return n, err
+		case PARSING_UNTIL_EOF:
+			n, err := b.br.Read(p)
+			if errors.Is(err, io.EOF) {
+				b.state = DONE
+			}
+
+			return n, err
+		default:
+			return 0, io.EOF
+		}
+	}
+}
+
+// parsingFraming reports whether the chunk parser needs more framing before
+// the next chunk data.
+func (b *body) parsingFraming() bool {
+	return !b.chunks.Done() && b.chunks.Remaining() == 0
+}
+
+func (b *body) Close() error {
+	if b.closed {
+		return nil
+	}
+
+	b.finish(b.state == DONE)
+	b.closed = true
+
+	return nil
+}
+
+func (b *body) finish(done bool) {
+	if b.release != nil {
+		b.release(done)
+		b.release = nil
+	}
+}
+
+// parseBuffered feeds what br has buffered to parse, reading more from the
+// connection whenever parse needs it, for as long as more reports true. A
+// line that doesn't fit in br's buffer fails with ERROR_HEADERS_TOO_LARGE.
+func parseBuffered(br *bufio.Reader, parse func(data []byte) (int, error), more func() bool) error {
+	need := 1
+
+	for more() {
+		if br.Buffered() < need {
+			if need > br.Size() {
+				return ERROR_HEADERS_TOO_LARGE
+			}
+
+			_, err := br.Peek(need)
+			if errors.Is(err, io.EOF) {
+				return io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		data, _ := br.Peek(br.Buffered())
+
+		n, err := parse(data)
+		if err != nil {
+			return err
+		}
+		br.Discard(n)
+
+		// parse wants more than what was buffered.
+		need = 1
+		if n == 0 {
+			need = len(data) + 1
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,249 @@
+// Package compress provides middleware that compresses responses with gzip
+// or deflate, whichever the client prefers according to Accept-Encoding.
+package compress
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+	"httpffomtcp.pinglu.dev/internal/server"
+)
+
+const (
+	GZIP    = "gzip"
+	DEFLATE = "deflate"
+)
+
+// DEFAULT_MIN_SIZE is the smallest Content-Length worth compressing. Below
+// it, the gzip header and trailer eat up most of the savings.
+const DEFAULT_MIN_SIZE = 1024
+
+// supportedEncodings is in order of preference, for when the client likes
+// several of them equally.
+var supportedEncodings = []string{GZIP, DEFLATE}
+
+// incompressibleTypes are content types, or prefixes of them, whose data
+// is already compressed.
+var incompressibleTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zstd",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/octet-stream",
+}
+
+// compressibleImages are the exceptions to the "image/" prefix above.
+var compressibleImages = []string{"image/svg+xml", "image/bmp", "image/x-icon"}
+
+type Options struct {
+	// Level is the compression level, from gzip.BestSpeed to
+	// gzip.BestCompression. Zero means gzip.DefaultCompression.
+	Level int
+
+	// MinSize is the smallest Content-Length that gets compressed. Zero
+	// means DEFAULT_MIN_SIZE. Responses without a Content-Length are
+	// always compressed.
+	MinSize int
+}
+
+func (o Options) withDefaults() Options {
+	if o.Level == 0 || o.Level < gzip.HuffmanOnly || o.Level > gzip.BestCompression {
+		o.Level = gzip.DefaultCompression
+	}
+
+	if o.MinSize == 0 {
+		o.MinSize = DEFAULT_MIN_SIZE
+	}
+
+	return o
+}
+
+// Middleware compresses the responses of next with the default Options.
+func Middleware(next server.Handler) server.Handler {
+	return MiddlewareWithOptions(next, Options{})
+}
+
+// MiddlewareWithOptions compresses the responses of next. A compressed
+// response loses its Content-Length and is sent with chunked encoding, and
+// its ETag is made weak and its Accept-Ranges dropped, since the bytes
+// differ from the uncompressed representation. Handlers can call w.Flush to push out what has been
+// compressed so far.
+func MiddlewareWithOptions(next server.Handler, options Options) server.Handler {
+	options = options.withDefaults()
+
+	return func(w *response.Writer, req *request.Request) {
+		encoding := Negotiate(req.Headers.Get("Accept-Encoding"))
+
+		w.AddHeaderHook(func(statusCode response.StatusCode, h headers.Headers) response.StatusCode {
+			if !compressible(statusCode, h, options) {
+				return statusCode
+			}
+
+			// Whether we compress depends on Accept-Encoding from here on,
+			// so caches must keep the variants apart.
+			addVary(h, "Accept-Encoding")
+
+			if encoding == "" {
+				return statusCode
+			}
+
+			h.Delete("Content-Length")
+			h.Replace("Content-Encoding", encoding)
+			if !isChunked(h) {
+				h.Set("Transfer-Encoding", "chunked")
+			}
+
+			if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				h.Replace("ETag", "W/"+etag)
+			}
+
+			// Ranges would be taken from the uncompressed content, not
+			// from the bytes we send.
+			h.Delete("Accept-Ranges")
+
+			// A HEAD response has no body to compress, but its headers
+			// must match those of GET.
+			if req.RequestLine.Method != "HEAD" {
+				w.SetBodyEncoder(func(dst io.Writer) response.BodyEncoder {
+					return newEncoder(dst, encoding, options.Level)
+				})
+			}
+
+			return statusCode
+		})
+
+		next(w, req)
+	}
+}
+
+// Negotiate returns the encoding in supportedEncodings that the
+// Accept-Encoding header value accept prefers, or "" if it accepts none of
+// them.
+func Negotiate(accept string) string {
+	qValues := map[string]float64{}
+	wildcard := -1.0
+
+	for _, part := range strings.Split(accept, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, found := strings.Cut(strings.TrimSpace(param), "=")
+			if !found || strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+
+			v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || v < 0 || v > 1 {
+				v = 0
+			}
+			q = v
+		}
+
+		// x-gzip is an alias of gzip, RFC 9110 8.4.1.3.
+		if coding == "x-gzip" {
+			coding = GZIP
+		}
+
+		if coding == "*" {
+			wildcard = q
+		} else {
+			qValues[coding] = q
+		}
+	}
+
+	best := ""
+	bestQ := 0.0
+
+	for _, encoding := range supportedEncodings {
+		q, found := qValues[encoding]
+		if !found {
+			q = wildcard
+		}
+
+		if q > bestQ {
+			best = encoding
+			bestQ = q
+		}
+	}
+
+	return best
+}
+
+func compressible(statusCode response.StatusCode, h headers.Headers, options Options) bool {
+	// These responses have no body, or one that must not change.
+	if statusCode < 200 || statusCode == 204 || statusCode == response.STATUS_PARTIAL_CONTENT || statusCode == response.STATUS_NOT_MODIFIED {
+		return false
+	}
+
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+
+	if contentLen := h.Get("Content-Length"); contentLen != "" {
+		n, err := strconv.Atoi(contentLen)
+		if err != nil || n < options.MinSize {
+			return false
+		}
+	}
+
+	mediaType, _, _ := strings.Cut(h.Get("Content-Type"), ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+	if slices.Contains(compressibleImages, mediaType) {
+		return true
+	}
+
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(mediaType, prefix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isChunked(h headers.Headers) bool {
+	return strings.Contains(strings.ToLower(h.Get("Transfer-Encoding")), "chunked")
+}
+
+func addVary(h headers.Headers, field string) {
+	for _, v := range strings.Split(h.Get("Vary"), ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.EqualFold(v, field) {
+			return
+		}
+	}
+
+	h.Set("Vary", field)
+}
+
+func newEncoder(dst io.Writer, encoding string, level int) response.BodyEncoder {
+	if encoding == DEFLATE {
+		// HTTP's "deflate" is the zlib format, RFC 9110 8.4.1.2.
+		zw, _ := zlib.NewWriterLevel(dst, level)
+		return zw
+	}
+
+	gw, _ := gzip.NewWriterLevel(dst, level)
+	return gw
+}
@@ -0,0 +1,244 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+	"httpffomtcp.pinglu.dev/internal/server"
+)
+
+var largeBody = strings.Repeat("<p>hello world</p>\n", 200)
+
+func do(t *testing.T, handler server.Handler, method string, extraHeaders ...string) (string, string) {
+	t.Helper()
+
+	data := method + " / HTTP/1.1\r\nHost: localhost\r\n" + strings.Join(extraHeaders, "") + "\r\n"
+	req, err := request.RequestFromReader(strings.NewReader(data))
+	require.NoError(t, err)
+
+	var b bytes.Buffer
+	w := response.NewWriter(&b)
+	handler(w, req)
+	require.NoError(t, w.Finish())
+
+	head, body, found := strings.Cut(b.String(), "\r\n\r\n")
+	require.True(t, found)
+
+	return head + "\r\n", body
+}
+
+// decodeChunked returns the data and the trailer section of a chunked body.
+func decodeChunked(t *testing.T, body string) (string, string) {
+	t.Helper()
+
+	r := bufio.NewReader(strings.NewReader(body))
+	var data bytes.Buffer
+
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+
+		size, err := strconv.ParseInt(strings.TrimSuffix(line, "\r\n"), 16, 64)
+		require.NoError(t, err)
+		if size == 0 {
+			break
+		}
+
+		_, err = io.CopyN(&data, r, size)
+		require.NoError(t, err)
+
+		crlf := make([]byte, 2)
+		_, err = io.ReadFull(r, crlf)
+		require.NoError(t, err)
+		require.Equal(t, "\r\n", string(crlf))
+	}
+
+	trailers, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(string(trailers), "\r\n"))
+
+	return data.String(), string(trailers)
+}
+
+func gunzip(t *testing.T, data string) string {
+	t.Helper()
+
+	r, err := gzip.NewReader(strings.NewReader(data))
+	require.NoError(t, err)
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+
+	return string(b)
+}
+
+func fixedHandler(contentType, body string) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.STATUS_OK)
+
+		h := response.GetDefaultHeaders(len(body))
+		h.Replace("Content-Type", contentType)
+		h.Set("ETag", `"abc"`)
+		h.Set("Accept-Ranges", "bytes")
+		w.WriteHeaders(h)
+
+		if req.RequestLine.Method != "HEAD" {
+			w.WriteBody([]byte(body))
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	// Test: Plain lists
+	assert.Equal(t, GZIP, Negotiate("gzip, deflate, br"))
+	assert.Equal(t, DEFLATE, Negotiate("deflate"))
+	assert.Equal(t, GZIP, Negotiate("x-gzip"))
+	assert.Equal(t, "", Negotiate("br"))
+	assert.Equal(t, "", Negotiate(""))
+
+	// Test: q-values
+	assert.Equal(t, DEFLATE, Negotiate("gzip;q=0.5, deflate;q=0.8"))
+	assert.Equal(t, DEFLATE, Negotiate("gzip;q=0, deflate"))
+	assert.Equal(t, "", Negotiate("gzip;q=0, deflate;q=0"))
+	assert.Equal(t, GZIP, Negotiate("GZIP ; Q=1.0"))
+
+	// Test: Wildcard
+	assert.Equal(t, GZIP, Negotiate("*"))
+	assert.Equal(t, DEFLATE, Negotiate("gzip;q=0, *"))
+	assert.Equal(t, "", Negotiate("*;q=0"))
+	assert.Equal(t, GZIP, Negotiate("gzip, *;q=0"))
+}
+
+func TestMiddleware(t *testing.T) {
+	handler := Middleware(fixedHandler("text/html", largeBody))
+
+	// Test: gzip switches to chunked encoding
+	head, body := do(t, handler, "GET", "Accept-Encoding: gzip, deflate\r\n")
+	assert.Contains(t, head, "content-encoding: gzip\r\n")
+	assert.Contains(t, head, "transfer-encoding: chunked\r\n")
+	assert.Contains(t, head, "vary: Accept-Encoding\r\n")
+	assert.Contains(t, head, "etag: W/\"abc\"\r\n")
+	assert.NotContains(t, head, "content-length")
+	assert.NotContains(t, head, "accept-ranges")
+	data, trailers := decodeChunked(t, body)
+	assert.Equal(t, "\r\n", trailers)
+	assert.Equal(t, largeBody, gunzip(t, data))
+
+	// Test: deflate uses the zlib format
+	head, body = do(t, handler, "GET", "Accept-Encoding: gzip;q=0.1, deflate\r\n")
+	assert.Contains(t, head, "content-encoding: deflate\r\n")
+	data, _ = decodeChunked(t, body)
+	zr, err := zlib.NewReader(strings.NewReader(data))
+	require.NoError(t, err)
+	inflated, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, largeBody, string(inflated))
+
+	// Test: No acceptable encoding still varies on Accept-Encoding
+	head, body = do(t, handler, "GET")
+	assert.NotContains(t, head, "content-encoding")
+	assert.Contains(t, head, "vary: Accept-Encoding\r\n")
+	assert.Contains(t, head, "content-length: "+strconv.Itoa(len(largeBody))+"\r\n")
+	assert.Contains(t, head, "accept-ranges: bytes\r\n")
+	assert.Equal(t, largeBody, body)
+
+	// Test: HEAD gets the headers of GET and no body
+	head, body = do(t, handler, "HEAD", "Accept-Encoding: gzip\r\n")
+	assert.Contains(t, head, "content-encoding: gzip\r\n")
+	assert.NotContains(t, head, "accept-ranges")
+	assert.Equal(t, "", body)
+
+	// Test: Small bodies are left alone
+	head, body = do(t, Middleware(fixedHandler("text/html", "tiny")), "GET", "Accept-Encoding: gzip\r\n")
+	assert.NotContains(t, head, "content-encoding")
+	assert.NotContains(t, head, "vary")
+	assert.Equal(t, "tiny", body)
+
+	// Test: Already compressed content types are left alone
+	head, body = do(t, Middleware(fixedHandler("image/png", largeBody)), "GET", "Accept-Encoding: gzip\r\n")
+	assert.NotContains(t, head, "content-encoding")
+	assert.Equal(t, largeBody, body)
+
+	head, _ = do(t, Middleware(fixedHandler("image/svg+xml", largeBody)), "GET", "Accept-Encoding: gzip\r\n")
+	assert.Contains(t, head, "content-encoding: gzip\r\n")
+
+	// Test: MinSize is configurable
+	head, _ = do(t, MiddlewareWithOptions(fixedHandler("text/plain", "tiny"), Options{MinSize: 1}), "GET", "Accept-Encoding: gzip\r\n")
+	assert.Contains(t, head, "content-encoding: gzip\r\n")
+}
+
+func TestMiddlewareChunked(t *testing.T) {
+	flushed := 0
+	handler := Middleware(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.STATUS_OK)
+
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Content-Length")
+		w.WriteHeaders(h)
+
+		for range 3 {
+			w.WriteChunkedBody([]byte(largeBody))
+			require.NoError(t, w.Flush())
+			flushed++
+		}
+		w.WriteChunkedBodyDone()
+
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Content-Length", strconv.Itoa(3*len(largeBody)))
+		w.WriteTrailers(trailers)
+	})
+
+	// Test: Chunked responses with trailers are compressed
+	head, body := do(t, handler, "GET", "Accept-Encoding: gzip\r\n")
+	assert.Equal(t, 3, flushed)
+	assert.Contains(t, head, "content-encoding: gzip\r\n")
+	assert.Equal(t, 1, strings.Count(head, "chunked"))
+	data, trailers := decodeChunked(t, body)
+	assert.Equal(t, strings.Repeat(largeBody, 3), gunzip(t, data))
+	assert.Equal(t, "x-content-length: "+strconv.Itoa(3*len(largeBody))+"\r\n\r\n", trailers)
+
+	// Test: Without compression the framing is the same
+	head, body = do(t, handler, "GET")
+	assert.NotContains(t, head, "content-encoding")
+	data, trailers = decodeChunked(t, body)
+	assert.Equal(t, strings.Repeat(largeBody, 3), data)
+	assert.Equal(t, "x-content-length: "+strconv.Itoa(3*len(largeBody))+"\r\n\r\n", trailers)
+}
+
+func TestMiddlewareFlush(t *testing.T) {
+	// Test: Flush sends what has been compressed so far
+	var b bytes.Buffer
+	w := response.NewWriter(&b)
+
+	data := "GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n"
+	req, err := request.RequestFromReader(strings.NewReader(data))
+	require.NoError(t, err)
+
+	Middleware(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.STATUS_OK)
+		w.WriteHeaders(headers.Headers{"content-type": "text/event-stream"})
+		w.WriteBody([]byte("data: hello\n\n"))
+
+		before := b.Len()
+		require.NoError(t, w.Flush())
+		assert.Greater(t, b.Len(), before)
+	})(w, req)
+
+	require.NoError(t, w.Finish())
+	_, body, _ := strings.Cut(b.String(), "\r\n\r\n")
+	data, _ = decodeChunked(t, body)
+	assert.Equal(t, "data: hello\n\n", gunzip(t, data))
+}
@@ -0,0 +1,264 @@
+// Package fileserver serves files from a directory, streaming them to the
+// client rather than loading them into memory. Conditional and Range
+// requests are supported, see response.ServeContent.
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+)
+
+const INDEX_FILE = "index.html"
+
+type Options struct {
+	// StripPrefix is removed from the request path before it is resolved
+	// against the root. Requests outside of it get a 404.
+	StripPrefix string
+
+	// ListDirectories renders an HTML listing of directories that have no
+	// index.html. Otherwise such directories get a 404.
+	ListDirectories bool
+}
+
+type FileServer struct {
+	root    string
+	options Options
+}
+
+// New returns a file server for the directory root. Nothing outside of
+// root is ever served: ".." segments are rejected, and so are symlinks
+// that point outside of it.
+func New(root string, options Options) *FileServer {
+	return &FileServer{root: root, options: options}
+}
+
+// Handle serves the file named by the request target.
+func (fsrv *FileServer) Handle(w *response.Writer, req *request.Request) {
+	if !allowedMethod(w, req) {
+		return
+	}
+
+	target, _, _ := strings.Cut(req.RequestLine.RequestTarget, "?")
+
+	p, found := strings.CutPrefix(target, fsrv.options.StripPrefix)
+	if !found {
+		writeError(w, response.STATUS_NOT_FOUND)
+		return
+	}
+
+	p, err := url.PathUnescape(p)
+	if err != nil || strings.ContainsRune(p, 0) {
+		writeError(w, response.STATUS_BAD_REQUEST)
+		return
+	}
+
+	if slices.Contains(strings.Split(p, "/"), "..") {
+		writeError(w, response.STATUS_FORBIDDEN)
+		return
+	}
+
+	fsrv.serve(w, req, p, true)
+}
+
+// ServeFile serves name, a slash separated path relative to the root,
+// regardless of the request target.
+func (fsrv *FileServer) ServeFile(w *response.Writer, req *request.Request, name string) {
+	if !allowedMethod(w, req) {
+		return
+	}
+
+	if slices.Contains(strings.Split(name, "/"), "..") {
+		writeError(w, response.STATUS_FORBIDDEN)
+		return
+	}
+
+	fsrv.serve(w, req, name, false)
+}
+
+func (fsrv *FileServer) serve(w *response.Writer, req *request.Request, name string, allowDirs bool) {
+	// os.Root refuses to follow anything, including symlinks, out of the
+	// root directory.
+	root, err := os.OpenRoot(fsrv.root)
+	if err != nil {
+		writeError(w, statusForError(err))
+		return
+	}
+	defer root.Close()
+
+	rel := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if rel == "" {
+		rel = "."
+	}
+
+	f, err := root.Open(rel)
+	if err != nil {
+		writeError(w, statusForError(err))
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		writeError(w, statusForError(err))
+		return
+	}
+
+	if info.IsDir() {
+		if !allowDirs {
+			writeError(w, response.STATUS_NOT_FOUND)
+			return
+		}
+
+		// Relative links in index.html and in listings only work if the
+		// directory URL ends with a slash.
+		if !strings.HasSuffix(name, "/") && rel != "." {
+			redirect(w, req.RequestLine.RequestTarget, name)
+			return
+		}
+
+		index, err := root.Open(path.Join(rel, INDEX_FILE))
+		if err == nil {
+			defer index.Close()
+
+			indexInfo, err := index.Stat()
+			if err == nil && indexInfo.Mode().IsRegular() {
+				serveFile(w, req, index, indexInfo)
+				return
+			}
+		}
+
+		if !fsrv.options.ListDirectories {
+			writeError(w, response.STATUS_NOT_FOUND)
+			return
+		}
+
+		serveListing(w, req, f, name)
+		return
+	}
+
+	if !info.Mode().IsRegular() {
+		writeError(w, response.STATUS_FORBIDDEN)
+		return
+	}
+
+	serveFile(w, req, f, info)
+}
+
+func serveFile(w *response.Writer, req *request.Request, f *os.File, info fs.FileInfo) {
+	h := headers.NewHeaders()
+	h.Set("ETag", response.FileETag(info.Size(), info.ModTime()))
+	response.SetLastModified(h, info.ModTime())
+
+	response.ServeContent(w, req, info.Name(), h, f)
+}
+
+func serveListing(w *response.Writer, req *request.Request, dir *os.File, name string) {
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		writeError(w, response.STATUS_INTERNAL_ERROR)
+		return
+	}
+
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	title := html.EscapeString("Index of /" + strings.TrimPrefix(name, "/"))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html>\n<head><title>%s</title></head>\n<body>\n<h1>%s</h1>\n<ul>\n", title, title)
+	for _, e := range entries {
+		entryName := e.Name()
+		if e.IsDir() {
+			entryName += "/"
+		}
+
+		href := (&url.URL{Path: entryName}).EscapedPath()
+		// A name like "a:b" would otherwise be read as a URL scheme.
+		if strings.Contains(entryName, ":") {
+			href = "./" + href
+		}
+
+		fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(entryName))
+	}
+	b.WriteString("</ul>\n</body>\n</html>\n")
+
+	body := []byte(b.String())
+
+	h := response.GetDefaultHeaders(len(body))
+	h.Replace("Content-Type", "text/html; charset=utf-8")
+
+	w.WriteStatusLine(response.STATUS_OK)
+	w.WriteHeaders(h)
+
+	if req.RequestLine.Method != "HEAD" {
+		w.WriteBody(body)
+	}
+}
+
+func allowedMethod(w *response.Writer, req *request.Request) bool {
+	method := req.RequestLine.Method
+	if method == "GET" || method == "HEAD" {
+		return true
+	}
+
+	h := response.GetDefaultHeaders(0)
+	h.Set("Allow", "GET, HEAD")
+
+	w.WriteStatusLine(response.STATUS_METHOD_NOT_ALLOWED)
+	w.WriteHeaders(h)
+
+	return false
+}
+
+func redirect(w *response.Writer, target, name string) {
+	location := "./" + (&url.URL{Path: path.Base(name) + "/"}).EscapedPath()
+	if _, query, found := strings.Cut(target, "?"); found {
+		location += "?" + query
+	}
+
+	h := response.GetDefaultHeaders(0)
+	h.Set("Location", location)
+
+	w.WriteStatusLine(response.STATUS_MOVED_PERMANENTLY)
+	w.WriteHeaders(h)
+}
+
+func statusForError(err error) response.StatusCode {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return response.STATUS_NOT_FOUND
+	case errors.Is(err, fs.ErrPermission), isPathEscape(err):
+		return response.STATUS_FORBIDDEN
+	default:
+		return response.STATUS_INTERNAL_ERROR
+	}
+}
+
+// isPathEscape reports whether err is os.Root refusing a path, such as a
+// symlink, that leads out of the root. os doesn't export that error, so
+// all we have to go on is its message.
+func isPathEscape(err error) bool {
+	var pathErr *fs.PathError
+	return errors.As(err, &pathErr) && pathErr.Err.Error() == "path escapes from parent"
+}
+
+func writeError(w *response.Writer, statusCode response.StatusCode) {
+	msg := []byte(strconv.Itoa(int(statusCode)) + "\n")
+
+	w.WriteStatusLine(statusCode)
+	w.WriteHeaders(response.GetDefaultHeaders(len(msg)))
+	w.WriteBody(msg)
+}
@@ -0,0 +1,157 @@
+package fileserver
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+)
+
+func do(t *testing.T, handle func(w *response.Writer, req *request.Request), method, target string, extraHeaders ...string) string {
+	t.Helper()
+
+	data := method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n" + strings.Join(extraHeaders, "") + "\r\n"
+	req, err := request.RequestFromReader(strings.NewReader(data))
+	require.NoError(t, err)
+
+	var b bytes.Buffer
+	handle(response.NewWriter(&b), req)
+
+	return b.String()
+}
+
+func writeFile(t *testing.T, name, content string) {
+	t.Helper()
+
+	require.NoError(t, os.MkdirAll(filepath.Dir(name), 0o755))
+	require.NoError(t, os.WriteFile(name, []byte(content), 0o644))
+}
+
+func TestFileServer(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	writeFile(t, filepath.Join(root, "hello.txt"), "hello world\n")
+	writeFile(t, filepath.Join(root, "noext"), "\x89PNG\r\n\x1a\n....")
+	writeFile(t, filepath.Join(root, "site", "index.html"), "<html>index</html>")
+	writeFile(t, filepath.Join(root, "files", "b.css"), "body{}")
+	writeFile(t, filepath.Join(root, "files", "a <&>.txt"), "a")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "files", "sub"), 0o755))
+	writeFile(t, filepath.Join(dir, "secret.txt"), "top secret")
+	require.NoError(t, os.Symlink(filepath.Join(dir, "secret.txt"), filepath.Join(root, "escape.txt")))
+	require.NoError(t, os.Symlink("hello.txt", filepath.Join(root, "inside.txt")))
+
+	fsrv := New(root, Options{ListDirectories: true})
+
+	// Test: Regular file with a content type from its extension
+	resp := do(t, fsrv.Handle, "GET", "/hello.txt")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, resp, "content-type: text/plain; charset=utf-8\r\n")
+	assert.Contains(t, resp, "content-length: 12\r\n")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\nhello world\n"))
+
+	// Test: Byte range of a file
+	resp = do(t, fsrv.Handle, "GET", "/hello.txt", "Range: bytes=6-\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 206 Partial Content\r\n"))
+	assert.Contains(t, resp, "content-range: bytes 6-11/12\r\n")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\nworld\n"))
+
+	// Test: Revalidation with the ETag of the file
+	etag := regexp.MustCompile(`etag: ("[^"]+")\r\n`).FindStringSubmatch(resp)
+	require.Len(t, etag, 2)
+	resp = do(t, fsrv.Handle, "GET", "/hello.txt", "If-None-Match: "+etag[1]+"\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 304 Not Modified\r\n"))
+	assert.Contains(t, resp, "last-modified: ")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n"))
+
+	// Test: Content type sniffed from the content
+	resp = do(t, fsrv.Handle, "GET", "/noext")
+	assert.Contains(t, resp, "content-type: image/png\r\n")
+
+	// Test: HEAD sends no body
+	resp = do(t, fsrv.Handle, "HEAD", "/hello.txt")
+	assert.Contains(t, resp, "content-length: 12\r\n")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n"))
+
+	// Test: Other methods
+	resp = do(t, fsrv.Handle, "POST", "/hello.txt")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.Contains(t, resp, "allow: GET, HEAD\r\n")
+
+	// Test: index.html
+	resp = do(t, fsrv.Handle, "GET", "/site/")
+	assert.Contains(t, resp, "content-type: text/html; charset=utf-8\r\n")
+	assert.True(t, strings.HasSuffix(resp, "<html>index</html>"))
+
+	// Test: Directory without trailing slash
+	resp = do(t, fsrv.Handle, "GET", "/site?x=1")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 301 Moved Permanently\r\n"))
+	assert.Contains(t, resp, "location: ./site/?x=1\r\n")
+
+	// Test: Directory listing escapes names
+	resp = do(t, fsrv.Handle, "GET", "/files/")
+	assert.Contains(t, resp, `<li><a href="a%20%3C&amp;%3E.txt">a &lt;&amp;&gt;.txt</a></li>`)
+	assert.Contains(t, resp, `<li><a href="b.css">b.css</a></li>`)
+	assert.Contains(t, resp, `<li><a href="sub/">sub/</a></li>`)
+
+	// Test: No listing unless enabled
+	resp = do(t, New(root, Options{}).Handle, "GET", "/files/")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 404 Not Found\r\n"))
+
+	// Test: Missing file
+	resp = do(t, fsrv.Handle, "GET", "/missing.txt")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 404 Not Found\r\n"))
+
+	// Test: Path traversal, plain and percent-encoded
+	for _, target := range []string{"/../secret.txt", "/files/../../secret.txt", "/%2e%2e/secret.txt", "/..%2fsecret.txt"} {
+		resp = do(t, fsrv.Handle, "GET", target)
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 403 Forbidden\r\n"), target)
+		assert.NotContains(t, resp, "top secret")
+	}
+
+	// Test: Symlinks may not escape the root, but may stay inside it
+	resp = do(t, fsrv.Handle, "GET", "/escape.txt")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 403 Forbidden\r\n"))
+	assert.NotContains(t, resp, "top secret")
+	resp = do(t, fsrv.Handle, "GET", "/inside.txt")
+	assert.True(t, strings.HasSuffix(resp, "hello world\n"))
+
+	// Test: Prefix stripping
+	prefixed := New(root, Options{StripPrefix: "/static"})
+	resp = do(t, prefixed.Handle, "GET", "/static/hello.txt")
+	assert.True(t, strings.HasSuffix(resp, "hello world\n"))
+	resp = do(t, prefixed.Handle, "GET", "/hello.txt")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 404 Not Found\r\n"))
+
+	// Test: ServeFile ignores the target
+	resp = do(t, func(w *response.Writer, req *request.Request) { fsrv.ServeFile(w, req, "hello.txt") }, "GET", "/video")
+	assert.True(t, strings.HasSuffix(resp, "hello world\n"))
+}
+
+func TestStatusForError(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected response.StatusCode
+	}{
+		{&fs.PathError{Op: "openat", Path: "missing.txt", Err: fs.ErrNotExist}, response.STATUS_NOT_FOUND},
+		{&fs.PathError{Op: "openat", Path: "secret.txt", Err: syscall.EACCES}, response.STATUS_FORBIDDEN},
+		{&fs.PathError{Op: "openat", Path: "escape.txt", Err: errors.New("path escapes from parent")}, response.STATUS_FORBIDDEN},
+		{&fs.PathError{Op: "read", Path: "broken.txt", Err: syscall.EIO}, response.STATUS_INTERNAL_ERROR},
+		{&fs.PathError{Op: "openat", Path: "a.txt", Err: syscall.EMFILE}, response.STATUS_INTERNAL_ERROR},
+	}
+
+	// Test: Only missing files and refused paths are the client's fault
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, statusForError(tt.err), tt.err.Error())
+	}
+}
@@ -0,0 +1,196 @@
+// Package form parses HTML form submissions: application/x-www-form-urlencoded
+// bodies, and multipart/form-data bodies with file uploads, RFC 7578.
+// Multipart bodies can be read a part at a time with a Reader, or all at
+// once with Parse, which keeps large files in temporary files instead of
+// memory.
+package form
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/request"
+)
+
+var ERROR_NOT_FORM = errors.New("content type is not a form")
+var ERROR_MALFORMED_FORM = errors.New("malformed form")
+
+// The limits wrap request.ERROR_BODY_TOO_LARGE, so that
+// server.DefaultErrorHandler answers them with a 413.
+var ERROR_TOO_MANY_PARTS = fmt.Errorf("%w: too many form fields", request.ERROR_BODY_TOO_LARGE)
+var ERROR_PART_TOO_LARGE = fmt.Errorf("%w: form field too large", request.ERROR_BODY_TOO_LARGE)
+var ERROR_FORM_TOO_LARGE = fmt.Errorf("%w: form values too large", request.ERROR_BODY_TOO_LARGE)
+
+const DEFAULT_MAX_PARTS = 1000
+const DEFAULT_MAX_MEMORY = 10 << 20
+
+type Options struct {
+	// MaxParts caps the fields of a form, files included. Zero means
+	// DEFAULT_MAX_PARTS, negative means no limit.
+	MaxParts int
+
+	// MaxPartBytes caps the size of one field or file. Zero means no
+	// limit beyond the request's own.
+	MaxPartBytes int64
+
+	// MaxMemory is how many bytes of values and files Parse keeps in
+	// memory. Files past it go to temporary files; values past it fail
+	// with ERROR_FORM_TOO_LARGE. Zero means DEFAULT_MAX_MEMORY.
+	MaxMemory int64
+
+	// TempDir is where files go once MaxMemory is used up. Defaults to
+	// os.TempDir().
+	TempDir string
+}
+
+func (o Options) withDefaults() Options {
+	if o.MaxParts == 0 {
+		o.MaxParts = DEFAULT_MAX_PARTS
+	}
+
+	if o.MaxMemory == 0 {
+		o.MaxMemory = DEFAULT_MAX_MEMORY
+	}
+
+	return o
+}
+
+// Form holds the fields of a parsed form. Files are keyed by field name,
+// like Values.
+type Form struct {
+	Values url.Values
+	Files  map[string][]*File
+}
+
+// File returns the first file uploaded as name, or nil.
+func (f *Form) File(name string) *File {
+	if files := f.Files[name]; len(files) > 0 {
+		return files[0]
+	}
+
+	return nil
+}
+
+// RemoveAll deletes the temporary files of the form. Handlers that parse
+// multipart forms should defer it.
+func (f *Form) RemoveAll() error {
+	var errs []error
+
+	for _, files := range f.Files {
+		for _, file := range files {
+			if file.path == "" {
+				continue
+			}
+
+			err := os.Remove(file.path)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// File is an uploaded file, kept in memory or in a temporary file.
+type File struct {
+	Filename string
+	Header   headers.Headers
+	Size     int64
+
+	content []byte
+	path    string
+}
+
+// Open returns the contents of the file.
+func (f *File) Open() (io.ReadSeekCloser, error) {
+	if f.path != "" {
+		return os.Open(f.path)
+	}
+
+	return memoryFile{bytes.NewReader(f.content)}, nil
+}
+
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (memoryFile) Close() error {
+	return nil
+}
+
+// Parse parses the body of req as a urlencoded or multipart form,
+// depending on its Content-Type. Other content types fail with
+// ERROR_NOT_FORM.
+func Parse(req *request.Request, options Options) (*Form, error) {
+	mediaType, params, err := mime.ParseMediaType(req.Headers.Get("Content-Type"))
+	if err != nil {
+		return nil, ERROR_NOT_FORM
+	}
+
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		values, err := ParseURLEncoded(req.Body, options)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Form{Values: values, Files: map[string][]*File{}}, nil
+	case "multipart/form-data":
+		r, err := NewReader(bytes.NewReader(req.Body), params["boundary"], options)
+		if err != nil {
+			return nil, err
+		}
+
+		return r.ReadForm()
+	default:
+		return nil, ERROR_NOT_FORM
+	}
+}
+
+// ParseURLEncoded parses an application/x-www-form-urlencoded body, as
+// the URL living standard describes it.
+func ParseURLEncoded(data []byte, options Options) (url.Values, error) {
+	options = options.withDefaults()
+	values := url.Values{}
+	parts := 0
+
+	for len(data) > 0 {
+		var pair []byte
+		pair, data, _ = bytes.Cut(data, []byte("&"))
+		if len(pair) == 0 {
+			continue
+		}
+
+		parts++
+		if options.MaxParts > 0 && parts > options.MaxParts {
+			return nil, ERROR_TOO_MANY_PARTS
+		}
+
+		if options.MaxPartBytes > 0 && int64(len(pair)) > options.MaxPartBytes {
+			return nil, ERROR_PART_TOO_LARGE
+		}
+
+		name, value, _ := bytes.Cut(pair, []byte("="))
+
+		unescapedName, err := url.QueryUnescape(string(name))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ERROR_MALFORMED_FORM, err)
+		}
+
+		unescapedValue, err := url.QueryUnescape(string(value))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ERROR_MALFORMED_FORM, err)
+		}
+
+		values.Add(unescapedName, unescapedValue)
+	}
+
+	return values, nil
+}
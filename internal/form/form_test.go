@@ -0,0 +1,273 @@
+package form
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+	"httpffomtcp.pinglu.dev/internal/server"
+)
+
+const BOUNDARY = "----formboundary7MA4YWxk"
+
+const MULTIPART_BODY = "This is the preamble.\r\n" +
+	"------formboundary7MA4YWxk\r\n" +
+	"Content-Disposition: form-data; name=\"title\"\r\n" +
+	"\r\n" +
+	"Hello, world\r\n" +
+	"------formboundary7MA4YWxk  \r\n" +
+	"Content-Disposition: form-data; name=\"upload\"; filename=\"C:\\Users\\me\\notes.txt\"\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"line one\r\n--not the boundary\r\nline two\r\n" +
+	"------formboundary7MA4YWxk\r\n" +
+	"Content-Disposition: form-data; name=\"title\"\r\n" +
+	"\r\n" +
+	"\r\n" +
+	"------formboundary7MA4YWxk--\r\n" +
+	"This is the epilogue.\r\n"
+
+func newFormRequest(t *testing.T, contentType, body string) *request.Request {
+	t.Helper()
+
+	h := headers.NewHeaders()
+	h.Set("Host", "localhost")
+	h.Set("Content-Type", contentType)
+
+	req, err := request.NewRequest(request.RequestLine{Method: "POST", RequestTarget: "/", HttpVersion: "1.1"}, h, nil, []byte(body), request.Options{})
+	require.NoError(t, err)
+
+	return req
+}
+
+func readFile(t *testing.T, f *File) string {
+	t.Helper()
+
+	r, err := f.Open()
+	require.NoError(t, err)
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+
+	return string(b)
+}
+
+func TestParseURLEncoded(t *testing.T) {
+	// Test: Fields, escapes and repeated names
+	req := newFormRequest(t, "application/x-www-form-urlencoded", "name=Jane+Doe&tags=a&tags=b%26c&empty=&flag&&x%3Dy=1")
+	form, err := Parse(req, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, "Jane Doe", form.Values.Get("name"))
+	assert.Equal(t, []string{"a", "b&c"}, form.Values["tags"])
+	assert.Equal(t, []string{""}, form.Values["empty"])
+	assert.Equal(t, []string{""}, form.Values["flag"])
+	assert.Equal(t, "1", form.Values.Get("x=y"))
+	assert.Empty(t, form.Files)
+
+	// Test: Bad escapes
+	_, err = ParseURLEncoded([]byte("a=%zz"), Options{})
+	assert.ErrorIs(t, err, ERROR_MALFORMED_FORM)
+
+	// Test: Too many fields
+	_, err = ParseURLEncoded([]byte("a=1&b=2&c=3"), Options{MaxParts: 2})
+	assert.ErrorIs(t, err, ERROR_TOO_MANY_PARTS)
+	assert.Equal(t, response.STATUS_CONTENT_TOO_LARGE, server.StatusForError(err))
+
+	values, err := ParseURLEncoded([]byte("a=1&b=2&c=3"), Options{MaxParts: -1})
+	require.NoError(t, err)
+	assert.Len(t, values, 3)
+
+	// Test: A field too large
+	_, err = ParseURLEncoded([]byte("a=1&b=22222"), Options{MaxPartBytes: 4})
+	assert.ErrorIs(t, err, ERROR_PART_TOO_LARGE)
+	assert.Equal(t, response.STATUS_CONTENT_TOO_LARGE, server.StatusForError(err))
+
+	// Test: Other content types
+	_, err = Parse(newFormRequest(t, "application/json", "{}"), Options{})
+	assert.ErrorIs(t, err, ERROR_NOT_FORM)
+	_, err = Parse(newFormRequest(t, "", ""), Options{})
+	assert.ErrorIs(t, err, ERROR_NOT_FORM)
+}
+
+func TestReader(t *testing.T) {
+	// Test: Parts are read one at a time, a byte at a time
+	r, err := NewReader(iotest.OneByteReader(strings.NewReader(MULTIPART_BODY)), BOUNDARY, Options{})
+	require.NoError(t, err)
+
+	part, err := r.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "title", part.Name)
+	assert.Empty(t, part.Filename)
+	content, err := io.ReadAll(part)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello, world", string(content))
+
+	part, err = r.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "upload", part.Name)
+	assert.Equal(t, "notes.txt", part.Filename)
+	assert.Equal(t, "text/plain", part.Header.Get("Content-Type"))
+	content, err = io.ReadAll(part)
+	require.NoError(t, err)
+	assert.Equal(t, "line one\r\n--not the boundary\r\nline two", string(content))
+
+	// Test: Unread parts are skipped
+	part, err = r.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "title", part.Name)
+
+	_, err = r.NextPart()
+	assert.ErrorIs(t, err, io.EOF)
+	_, err = r.NextPart()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: From a request
+	r, err = MultipartReader(newFormRequest(t, "multipart/form-data; boundary="+BOUNDARY, MULTIPART_BODY), Options{})
+	require.NoError(t, err)
+	part, err = r.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "title", part.Name)
+
+	_, err = MultipartReader(newFormRequest(t, "application/x-www-form-urlencoded", ""), Options{})
+	assert.ErrorIs(t, err, ERROR_NOT_FORM)
+}
+
+func TestReaderErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		boundary string
+		options  Options
+		err      error
+	}{
+		{
+			name:     "Missing boundary",
+			body:     MULTIPART_BODY,
+			boundary: "",
+			err:      ERROR_MALFORMED_FORM,
+		},
+		{
+			name:     "No close delimiter",
+			body:     strings.TrimSuffix(MULTIPART_BODY[:strings.Index(MULTIPART_BODY, "------formboundary7MA4YWxk--")], "\r\n"),
+			boundary: BOUNDARY,
+			err:      ERROR_MALFORMED_FORM,
+		},
+		{
+			name:     "No boundary at all",
+			body:     "just some text\r\n",
+			boundary: BOUNDARY,
+			err:      ERROR_MALFORMED_FORM,
+		},
+		{
+			name:     "Malformed part headers",
+			body:     "--" + BOUNDARY + "\r\nno colon here\r\n\r\nvalue\r\n--" + BOUNDARY + "--\r\n",
+			boundary: BOUNDARY,
+			err:      ERROR_MALFORMED_FORM,
+		},
+		{
+			name:     "Too many parts",
+			body:     MULTIPART_BODY,
+			boundary: BOUNDARY,
+			options:  Options{MaxParts: 2},
+			err:      ERROR_TOO_MANY_PARTS,
+		},
+		{
+			name:     "Part too large",
+			body:     MULTIPART_BODY,
+			boundary: BOUNDARY,
+			options:  Options{MaxPartBytes: 16},
+			err:      ERROR_PART_TOO_LARGE,
+		},
+		{
+			name:     "Values past the memory limit",
+			body:     MULTIPART_BODY,
+			boundary: BOUNDARY,
+			options:  Options{MaxMemory: 4},
+			err:      ERROR_FORM_TOO_LARGE,
+		},
+	}
+
+	for _, tt := range tests {
+		var form *Form
+		r, err := NewReader(strings.NewReader(tt.body), tt.boundary, tt.options)
+		if err == nil {
+			form, err = r.ReadForm()
+		}
+
+		assert.Nil(t, form, tt.name)
+		assert.ErrorIs(t, err, tt.err, tt.name)
+	}
+
+	// Test: Limits are answered with a 413
+	r, err := NewReader(strings.NewReader(MULTIPART_BODY), BOUNDARY, Options{MaxParts: 1})
+	require.NoError(t, err)
+	_, err = r.ReadForm()
+	assert.Equal(t, response.STATUS_CONTENT_TOO_LARGE, server.StatusForError(err))
+}
+
+func TestParseMultipart(t *testing.T) {
+	req := newFormRequest(t, "multipart/form-data; boundary=\""+BOUNDARY+"\"", MULTIPART_BODY)
+
+	// Test: Values and files in memory
+	form, err := Parse(req, Options{})
+	require.NoError(t, err)
+	defer form.RemoveAll()
+
+	assert.Equal(t, []string{"Hello, world", ""}, form.Values["title"])
+	file := form.File("upload")
+	require.NotNil(t, file)
+	assert.Equal(t, "notes.txt", file.Filename)
+	assert.Equal(t, "text/plain", file.Header.Get("Content-Type"))
+	assert.Equal(t, int64(38), file.Size)
+	assert.Empty(t, file.path)
+	assert.Equal(t, "line one\r\n--not the boundary\r\nline two", readFile(t, file))
+	assert.Nil(t, form.File("missing"))
+
+	// Test: Files past the memory limit spill to disk
+	dir := t.TempDir()
+	form, err = Parse(req, Options{MaxMemory: 20, TempDir: dir})
+	require.NoError(t, err)
+
+	file = form.File("upload")
+	require.NotNil(t, file)
+	assert.Equal(t, int64(38), file.Size)
+	require.NotEmpty(t, file.path)
+	assert.Equal(t, "line one\r\n--not the boundary\r\nline two", readFile(t, file))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// Test: RemoveAll deletes them
+	require.NoError(t, form.RemoveAll())
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Test: Temporary files are removed when parsing fails
+	body := strings.Replace(MULTIPART_BODY, "------formboundary7MA4YWxk--", "------formboundary7MA4YWxk\r\n"+
+		"Content-Disposition: form-data; name=\"extra\"\r\n\r\nvalue\r\n------formboundary7MA4YWxk--", 1)
+	r, err := NewReader(bytes.NewReader([]byte(body)), BOUNDARY, Options{MaxMemory: 20, MaxParts: 3, TempDir: dir})
+	require.NoError(t, err)
+	_, err = r.ReadForm()
+	assert.ErrorIs(t, err, ERROR_TOO_MANY_PARTS)
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Test: An empty form
+	form, err = Parse(newFormRequest(t, "multipart/form-data; boundary="+BOUNDARY, "--"+BOUNDARY+"--\r\n"), Options{})
+	require.NoError(t, err)
+	assert.Empty(t, form.Values)
+	assert.Empty(t, form.Files)
+}
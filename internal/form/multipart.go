@@ -0,0 +1,368 @@
+package form
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"strings"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/request"
+)
+
+// MAX_BOUNDARY_LEN is the longest boundary RFC 2046 5.1.1 allows.
+const MAX_BOUNDARY_LEN = 70
+
+// MAX_PART_HEADER_BYTES bounds the headers of one part.
+const MAX_PART_HEADER_BYTES = 16 << 10
+
+// Reader reads the parts of a multipart/form-data body one at a time,
+// without holding more than a buffer of it in memory.
+type Reader struct {
+	br      *bufio.Reader
+	options Options
+	// dashBoundary starts the first part. delimiter ends each part and
+	// starts the next, or closes the body when followed by "--".
+	dashBoundary []byte
+	delimiter    []byte
+	part         *Part
+	parts        int
+	// err is returned by every call once the body is done with, io.EOF
+	// after the close delimiter.
+	err error
+}
+
+// Part is one field or file of a multipart form. Reading it returns its
+// content, and io.EOF at the end of it.
+type Part struct {
+	Header headers.Headers
+	// Name is the field name from the Content-Disposition header.
+	Name string
+	// Filename is set for file uploads, without any directories the
+	// client sent along.
+	Filename string
+
+	r    *Reader
+	size int64
+	err  error
+}
+
+// NewReader returns a Reader for a multipart body with the given boundary,
+// the boundary parameter of its Content-Type.
+func NewReader(r io.Reader, boundary string, options Options) (*Reader, error) {
+	if boundary == "" || len(boundary) > MAX_BOUNDARY_LEN || strings.ContainsAny(boundary, "\r\n") {
+		return nil, fmt.Errorf("%w: invalid boundary", ERROR_MALFORMED_FORM)
+	}
+
+	return &Reader{
+		br:           bufio.NewReader(r),
+		options:      options.withDefaults(),
+		dashBoundary: []byte("--" + boundary),
+		delimiter:    []byte("\r\n--" + boundary),
+	}, nil
+}
+
+// MultipartReader returns a Reader for the body of req, which must be a
+// multipart/form-data request.
+func MultipartReader(req *request.Request, options Options) (*Reader, error) {
+	mediaType, params, err := mime.ParseMediaType(req.Headers.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		return nil, ERROR_NOT_FORM
+	}
+
+	return NewReader(bytes.NewReader(req.Body), params["boundary"], options)
+}
+
+// NextPart skips what is left of the current part and returns the next
+// one. It returns io.EOF after the last part.
+func (r *Reader) NextPart() (*Part, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	err := r.nextBoundary()
+	if err != nil {
+		r.err = err
+		return nil, err
+	}
+
+	r.parts++
+	if r.options.MaxParts > 0 && r.parts > r.options.MaxParts {
+		r.err = ERROR_TOO_MANY_PARTS
+		return nil, r.err
+	}
+
+	h, err := r.readHeaders()
+	if err != nil {
+		r.err = err
+		return nil, err
+	}
+
+	part := &Part{Header: h, r: r}
+
+	disposition, params, err := mime.ParseMediaType(h.Get("Content-Disposition"))
+	if err == nil && disposition == "form-data" {
+		part.Name = params["name"]
+		part.Filename = baseName(params["filename"])
+	}
+
+	r.part = part
+
+	return part, nil
+}
+
+// nextBoundary moves past the boundary that starts the next part, and
+// returns io.EOF if it is the close delimiter.
+func (r *Reader) nextBoundary() error {
+	if r.part == nil {
+		return r.skipPreamble()
+	}
+
+	_, err := io.Copy(io.Discard, r.part)
+	if err != nil {
+		return err
+	}
+
+	// The part ended right before a delimiter.
+	r.br.Discard(len(r.delimiter))
+
+	line, err := r.readLine()
+	if err != nil {
+		return err
+	}
+
+	rest := bytes.TrimLeft(line, " \t")
+	if bytes.HasPrefix(rest, []byte("--")) {
+		return io.EOF
+	}
+
+	// Transport padding may follow a delimiter, RFC 2046 5.1.1.
+	if len(bytes.TrimRight(rest, " \t\r\n")) > 0 {
+		return fmt.Errorf("%w: garbage after boundary", ERROR_MALFORMED_FORM)
+	}
+
+	return nil
+}
+
+// skipPreamble discards what comes before the first boundary.
+func (r *Reader) skipPreamble() error {
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return err
+		}
+
+		line = bytes.TrimRight(line, " \t\r\n")
+		if !bytes.HasPrefix(line, r.dashBoundary) {
+			continue
+		}
+
+		switch string(line[len(r.dashBoundary):]) {
+		case "":
+			return nil
+		case "--":
+			return io.EOF
+		}
+	}
+}
+
+// readLine reads up to and including the next LF. Lines longer than the
+// buffer are returned in pieces, which is fine for the lines we look at.
+func (r *Reader) readLine() ([]byte, error) {
+	line, err := r.br.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return line, nil
+	}
+	if errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: unexpected end of body", ERROR_MALFORMED_FORM)
+	}
+
+	return line, err
+}
+
+func (r *Reader) readHeaders() (headers.Headers, error) {
+	h := headers.NewHeaders()
+	total := 0
+
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		total += len(line)
+		if total > MAX_PART_HEADER_BYTES {
+			return nil, ERROR_PART_TOO_LARGE
+		}
+
+		_, done, err := h.Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ERROR_MALFORMED_FORM, err)
+		}
+		if done {
+			return h, nil
+		}
+		if !bytes.HasSuffix(line, headers.CRLF) {
+			return nil, fmt.Errorf("%w: header line without CRLF", ERROR_MALFORMED_FORM)
+		}
+	}
+}
+
+// readPart reads the content of the current part, which ends at the next
+// delimiter.
+func (r *Reader) readPart(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	// Fill the buffer with at least a delimiter's worth, unless the body
+	// ends first.
+	_, err := r.br.Peek(len(r.delimiter))
+	buf, _ := r.br.Peek(r.br.Buffered())
+
+	if i := bytes.Index(buf, r.delimiter); i >= 0 {
+		if i == 0 {
+			return 0, io.EOF
+		}
+
+		n := copy(p, buf[:i])
+		r.br.Discard(n)
+		return n, nil
+	}
+
+	if errors.Is(err, io.EOF) {
+		return 0, fmt.Errorf("%w: unexpected end of body", ERROR_MALFORMED_FORM)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// The end of the buffer could be the start of a delimiter.
+	n := copy(p, buf[:len(buf)-len(r.delimiter)+1])
+	r.br.Discard(n)
+
+	return n, nil
+}
+
+func (p *Part) Read(b []byte) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+
+	n, err := p.r.readPart(b)
+	p.size += int64(n)
+
+	if max := p.r.options.MaxPartBytes; max > 0 && p.size > max {
+		err = ERROR_PART_TOO_LARGE
+	}
+
+	if err != nil {
+		p.err = err
+		if !errors.Is(err, io.EOF) {
+			p.r.err = err
+		}
+	}
+
+	return n, err
+}
+
+// ReadForm reads all the parts of the body into a Form, keeping files in
+// memory until Options.MaxMemory is used up. Parts without a field name
+// are skipped.
+func (r *Reader) ReadForm() (*Form, error) {
+	form := &Form{Values: url.Values{}, Files: map[string][]*File{}}
+
+	err := r.readForm(form)
+	if err != nil {
+		form.RemoveAll()
+		return nil, err
+	}
+
+	return form, nil
+}
+
+func (r *Reader) readForm(form *Form) error {
+	memory := r.options.MaxMemory
+
+	for {
+		part, err := r.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if part.Name == "" {
+			continue
+		}
+
+		var buf bytes.Buffer
+		n, err := io.CopyN(&buf, part, memory+1)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		if part.Filename == "" {
+			if n > memory {
+				return ERROR_FORM_TOO_LARGE
+			}
+			memory -= n
+
+			form.Values.Add(part.Name, buf.String())
+			continue
+		}
+
+		file := &File{Filename: part.Filename, Header: part.Header}
+		form.Files[part.Name] = append(form.Files[part.Name], file)
+
+		if n <= memory {
+			memory -= n
+			file.content = buf.Bytes()
+			file.Size = n
+			continue
+		}
+
+		// The file won't fit, so it goes to disk with the rest of it.
+		file.path, file.Size, err = r.spill(io.MultiReader(&buf, part))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// spill writes the rest of a file part to a temporary file.
+func (r *Reader) spill(src io.Reader) (string, int64, error) {
+	f, err := os.CreateTemp(r.options.TempDir, "form-*")
+	if err != nil {
+		return "", 0, err
+	}
+
+	size, err := io.Copy(f, src)
+	closeErr := f.Close()
+
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+
+	return f.Name(), size, nil
+}
+
+// baseName drops the directories some clients put in filenames, with
+// either kind of slash.
+func baseName(filename string) string {
+	if i := strings.LastIndexAny(filename, `/\`); i >= 0 {
+		filename = filename[i+1:]
+	}
+
+	return filename
+}
@@ -25,14 +25,43 @@ func (h Headers) Get(key string) string {
 	return h[lowercasedKey]
 }
 
+// Set adds value to the field named key. Repeated fields are joined with a
+// comma, except Cookie, whose pairs are joined with "; ", RFC 6265 5.4,
+// and Set-Cookie, which can't be joined and is kept one value per line.
 func (h Headers) Set(key, value string) {
 	lowercasedKey := strings.ToLower(key)
 
-	if existingValue, found := h[lowercasedKey]; found {
-		h[lowercasedKey] = existingValue + "," + value
-	} else {
+	existingValue, found := h[lowercasedKey]
+	if !found {
 		h[lowercasedKey] = value
+		return
+	}
+
+	switch lowercasedKey {
+	case "cookie":
+		h[lowercasedKey] = existingValue + "; " + value
+	case "set-cookie":
+		h[lowercasedKey] = existingValue + "\n" + value
+	default:
+		h[lowercasedKey] = existingValue + "," + value
+	}
+}
+
+// Values returns each value of the field named key, which is one value
+// for every field but Set-Cookie.
+func (h Headers) Values(key string) []string {
+	lowercasedKey := strings.ToLower(key)
+
+	value, found := h[lowercasedKey]
+	if !found {
+		return nil
+	}
+
+	if lowercasedKey == "set-cookie" {
+		return strings.Split(value, "\n")
 	}
+
+	return []string{value}
 }
 
 func (h Headers) Replace(key, value string) {
@@ -76,6 +105,12 @@ func (h Headers) Parse(data []byte) (int, bool, error) {
 	return len(s) + CRLF_LEN, false, nil
 }
 
+// IsToken reports whether s is a token, RFC 9110 5.6.2, like field names
+// and cookie names.
+func IsToken(s string) bool {
+	return validHeaderKey(s)
+}
+
 func validHeaderKey(key string) bool {
 	if len(key) == 0 {
 		return false
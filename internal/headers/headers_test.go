@@ -87,3 +87,34 @@ func TestHeadersParse(t *testing.T) {
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 }
+
+func TestHeadersSet(t *testing.T) {
+	h := NewHeaders()
+
+	// Test: Repeated fields are joined with a comma
+	h.Set("Accept", "text/html")
+	h.Set("accept", "*/*")
+	assert.Equal(t, "text/html,*/*", h.Get("Accept"))
+	assert.Equal(t, []string{"text/html,*/*"}, h.Values("Accept"))
+
+	// Test: Cookie pairs are joined with a semicolon
+	h.Set("Cookie", "a=1")
+	h.Set("Cookie", "b=2")
+	assert.Equal(t, "a=1; b=2", h.Get("Cookie"))
+
+	// Test: Set-Cookie keeps one value per field
+	data := []byte("Set-Cookie: a=1; Path=/\r\nSet-Cookie: b=2; Expires=Wed, 21 Oct 2015 07:28:00 GMT\r\n")
+	n, _, err := h.Parse(data)
+	require.NoError(t, err)
+	_, _, err = h.Parse(data[n:])
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a=1; Path=/", "b=2; Expires=Wed, 21 Oct 2015 07:28:00 GMT"}, h.Values("set-cookie"))
+
+	// Test: Missing fields have no values
+	assert.Nil(t, h.Values("Location"))
+
+	// Test: Tokens
+	assert.True(t, IsToken("session_id"))
+	assert.False(t, IsToken("session id"))
+	assert.False(t, IsToken(""))
+}
@@ -0,0 +1,152 @@
+package hpack
+
+import (
+	"fmt"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+)
+
+// Decoder decodes header blocks from one Encoder.
+type Decoder struct {
+	table dynamicTable
+	// maxTableSize is the most the encoder may make its table, e.g. what
+	// we announced with SETTINGS_HEADER_TABLE_SIZE. Size updates can't go
+	// past it.
+	maxTableSize int
+}
+
+// NewDecoder returns a decoder whose table starts at maxTableSize.
+func NewDecoder(maxTableSize int) *Decoder {
+	return &Decoder{
+		table:        dynamicTable{maxSize: maxTableSize},
+		maxTableSize: maxTableSize,
+	}
+}
+
+// SetMaxTableSize changes the limit on the encoder's table. A table over
+// the new limit shrinks to it at once.
+func (d *Decoder) SetMaxTableSize(size int) {
+	d.maxTableSize = size
+	if d.table.maxSize > size {
+		d.table.setMaxSize(size)
+	}
+}
+
+// Decode decodes a complete header block into headers. Repeated fields
+// are joined as Headers.Set joins them, and pseudo-headers are kept under
+// their own names.
+func (d *Decoder) Decode(block []byte) (headers.Headers, error) {
+	fields, err := d.DecodeFields(block)
+	if err != nil {
+		return nil, err
+	}
+
+	h := headers.NewHeaders()
+	for _, f := range fields {
+		h.Set(f.Name, f.Value)
+	}
+
+	return h, nil
+}
+
+// DecodeFields decodes a complete header block into its fields, in order,
+// RFC 7541 6.
+func (d *Decoder) DecodeFields(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	sawField := false
+
+	for len(block) > 0 {
+		b := block[0]
+
+		switch {
+		case b&0x80 != 0:
+			// Indexed field, 6.1.
+			index, n, err := decodeInteger(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			block = block[n:]
+
+			f, ok := d.table.field(index)
+			if !ok {
+				return nil, fmt.Errorf("%w: index %d out of range", ERROR_COMPRESSION, index)
+			}
+			fields = append(fields, HeaderField{Name: f.Name, Value: f.Value})
+		case b&0xC0 == 0x40:
+			// Literal with incremental indexing, 6.2.1.
+			f, n, err := d.decodeLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			block = block[n:]
+
+			d.table.add(f)
+			fields = append(fields, f)
+		case b&0xE0 == 0x20:
+			// Dynamic table size update, 6.3. It may only start a block.
+			if sawField {
+				return nil, fmt.Errorf("%w: table size update after a field", ERROR_COMPRESSION)
+			}
+
+			size, n, err := decodeInteger(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			block = block[n:]
+
+			if size > uint64(d.maxTableSize) {
+				return nil, fmt.Errorf("%w: table size %d over the limit", ERROR_COMPRESSION, size)
+			}
+			d.table.setMaxSize(int(size))
+			continue
+		default:
+			// Literal without indexing, 6.2.2, or never indexed, 6.2.3.
+			f, n, err := d.decodeLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			block = block[n:]
+
+			f.Sensitive = b&0xF0 == 0x10
+			fields = append(fields, f)
+		}
+
+		sawField = true
+	}
+
+	return fields, nil
+}
+
+// decodeLiteral decodes a literal field whose name index has a prefix of
+// prefixBits, and returns it with the number of bytes it took up.
+func (d *Decoder) decodeLiteral(block []byte, prefixBits int) (HeaderField, int, error) {
+	var f HeaderField
+
+	index, n, err := decodeInteger(block, prefixBits)
+	if err != nil {
+		return f, 0, err
+	}
+	total := n
+
+	if index == 0 {
+		f.Name, n, err = decodeString(block[total:])
+		if err != nil {
+			return f, 0, err
+		}
+		total += n
+	} else {
+		indexed, ok := d.table.field(index)
+		if !ok {
+			return f, 0, fmt.Errorf("%w: index %d out of range", ERROR_COMPRESSION, index)
+		}
+		f.Name = indexed.Name
+	}
+
+	f.Value, n, err = decodeString(block[total:])
+	if err != nil {
+		return f, 0, err
+	}
+	total += n
+
+	return f, total, nil
+}
@@ -0,0 +1,88 @@
+package hpack
+
+import (
+	"maps"
+	"slices"
+	"strings"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+)
+
+// Encoder encodes header blocks for one Decoder.
+type Encoder struct {
+	table dynamicTable
+	// pendingSizeUpdate is set when the table size changed, so that the
+	// next block tells the decoder about it.
+	pendingSizeUpdate bool
+}
+
+// NewEncoder returns an encoder whose table starts at maxTableSize, which
+// must be what the decoder's starts at.
+func NewEncoder(maxTableSize int) *Encoder {
+	return &Encoder{table: dynamicTable{maxSize: maxTableSize}}
+}
+
+// SetMaxTableSize resizes the table, e.g. to follow a
+// SETTINGS_HEADER_TABLE_SIZE from the peer. The next block starts with a
+// size update.
+func (e *Encoder) SetMaxTableSize(size int) {
+	if size == e.table.maxSize {
+		return
+	}
+
+	e.table.setMaxSize(size)
+	e.pendingSizeUpdate = true
+}
+
+// Encode appends the header block for h to dst, in order of field name,
+// with a field for each of Headers.Values. Fields IsSensitive reports on
+// are never indexed.
+func (e *Encoder) Encode(dst []byte, h headers.Headers) []byte {
+	fields := make([]HeaderField, 0, len(h))
+	for _, name := range slices.Sorted(maps.Keys(h)) {
+		values := h.Values(name)
+		name = strings.ToLower(name)
+
+		for _, value := range values {
+			fields = append(fields, HeaderField{Name: name, Value: value, Sensitive: IsSensitive(name)})
+		}
+	}
+
+	return e.EncodeFields(dst, fields)
+}
+
+// EncodeFields appends the header block for fields to dst.
+func (e *Encoder) EncodeFields(dst []byte, fields []HeaderField) []byte {
+	if e.pendingSizeUpdate {
+		dst = encodeInteger(dst, 0x20, 5, uint64(e.table.maxSize))
+		e.pendingSizeUpdate = false
+	}
+
+	for _, f := range fields {
+		dst = e.encodeField(dst, f)
+	}
+
+	return dst
+}
+
+func (e *Encoder) encodeField(dst []byte, f HeaderField) []byte {
+	index, exact := e.table.search(f)
+
+	if f.Sensitive {
+		dst = encodeInteger(dst, 0x10, 4, index)
+	} else if exact {
+		return encodeInteger(dst, 0x80, 7, index)
+	} else if f.Size() > e.table.maxSize {
+		// It would only empty the table.
+		dst = encodeInteger(dst, 0x00, 4, index)
+	} else {
+		dst = encodeInteger(dst, 0x40, 6, index)
+		e.table.add(HeaderField{Name: f.Name, Value: f.Value})
+	}
+
+	if index == 0 {
+		dst = encodeString(dst, f.Name)
+	}
+
+	return encodeString(dst, f.Value)
+}
@@ -0,0 +1,282 @@
+// Package hpack compresses header fields as HTTP/2 does, RFC 7541. An
+// Encoder and a Decoder each keep a dynamic table of recently sent fields,
+// so they must see the same header blocks in the same order, e.g. those of
+// one direction of a connection.
+package hpack
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ERROR_COMPRESSION = errors.New("invalid header block")
+
+// DEFAULT_TABLE_SIZE is the size of the dynamic table until the decoder
+// says otherwise, e.g. with SETTINGS_HEADER_TABLE_SIZE in HTTP/2.
+const DEFAULT_TABLE_SIZE = 4096
+
+// ENTRY_OVERHEAD is added to the length of the name and value of an entry
+// to get its size in the dynamic table, RFC 7541 4.1.
+const ENTRY_OVERHEAD = 32
+
+// sensitiveFields carry credentials, which are kept out of the compression
+// context, RFC 7541 7.1.3.
+var sensitiveFields = []string{"authorization", "proxy-authorization", "set-cookie"}
+
+// HeaderField is a header or pseudo-header as HPACK sees it.
+type HeaderField struct {
+	Name  string
+	Value string
+	// Sensitive fields are never added to a dynamic table, ours or any
+	// intermediary's.
+	Sensitive bool
+}
+
+// Size is the room f takes up in a dynamic table.
+func (f HeaderField) Size() int {
+	return len(f.Name) + len(f.Value) + ENTRY_OVERHEAD
+}
+
+// IsSensitive reports whether fields named name should be encoded as never
+// indexed. name must be in lowercase.
+func IsSensitive(name string) bool {
+	for _, s := range sensitiveFields {
+		if name == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// staticTable is RFC 7541 Appendix A. Index 1 is staticTable[0].
+var staticTable = []HeaderField{
+	{Name: ":authority"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language"},
+	{Name: "accept-ranges"},
+	{Name: "accept"},
+	{Name: "access-control-allow-origin"},
+	{Name: "age"},
+	{Name: "allow"},
+	{Name: "authorization"},
+	{Name: "cache-control"},
+	{Name: "content-disposition"},
+	{Name: "content-encoding"},
+	{Name: "content-language"},
+	{Name: "content-length"},
+	{Name: "content-location"},
+	{Name: "content-range"},
+	{Name: "content-type"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "expect"},
+	{Name: "expires"},
+	{Name: "from"},
+	{Name: "host"},
+	{Name: "if-match"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "if-range"},
+	{Name: "if-unmodified-since"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "max-forwards"},
+	{Name: "proxy-authenticate"},
+	{Name: "proxy-authorization"},
+	{Name: "range"},
+	{Name: "referer"},
+	{Name: "refresh"},
+	{Name: "retry-after"},
+	{Name: "server"},
+	{Name: "set-cookie"},
+	{Name: "strict-transport-security"},
+	{Name: "transfer-encoding"},
+	{Name: "user-agent"},
+	{Name: "vary"},
+	{Name: "via"},
+	{Name: "www-authenticate"},
+}
+
+// dynamicTable holds the fields added while coding header blocks, newest
+// first, RFC 7541 2.3.2.
+type dynamicTable struct {
+	entries []HeaderField
+	size    int
+	maxSize int
+}
+
+func (t *dynamicTable) add(f HeaderField) {
+	t.entries = append([]HeaderField{f}, t.entries...)
+	t.size += f.Size()
+	t.evict()
+}
+
+func (t *dynamicTable) setMaxSize(maxSize int) {
+	t.maxSize = maxSize
+	t.evict()
+}
+
+// evict drops the oldest entries until the table fits. An entry larger
+// than the whole table empties it, RFC 7541 4.4.
+func (t *dynamicTable) evict() {
+	for t.size > t.maxSize {
+		last := t.entries[len(t.entries)-1]
+		t.entries = t.entries[:len(t.entries)-1]
+		t.size -= last.Size()
+	}
+}
+
+// field returns the entry at index in the combined static and dynamic
+// index space, RFC 7541 2.3.3.
+func (t *dynamicTable) field(index uint64) (HeaderField, bool) {
+	switch {
+	case index == 0:
+		return HeaderField{}, false
+	case index <= uint64(len(staticTable)):
+		return staticTable[index-1], true
+	case index-uint64(len(staticTable)) <= uint64(len(t.entries)):
+		return t.entries[index-uint64(len(staticTable))-1], true
+	default:
+		return HeaderField{}, false
+	}
+}
+
+// search returns the index of an entry matching f, and whether its value
+// matches too. Zero means no entry has the name.
+func (t *dynamicTable) search(f HeaderField) (uint64, bool) {
+	var nameIndex uint64
+
+	for i, e := range staticTable {
+		if e.Name != f.Name {
+			continue
+		}
+		if e.Value == f.Value {
+			return uint64(i + 1), true
+		}
+		if nameIndex == 0 {
+			nameIndex = uint64(i + 1)
+		}
+	}
+
+	for i, e := range t.entries {
+		if e.Name != f.Name {
+			continue
+		}
+		if e.Value == f.Value {
+			return uint64(len(staticTable) + i + 1), true
+		}
+		if nameIndex == 0 {
+			nameIndex = uint64(len(staticTable) + i + 1)
+		}
+	}
+
+	return nameIndex, false
+}
+
+// decodeInteger decodes an integer with an N-bit prefix, RFC 7541 5.1.
+func decodeInteger(b []byte, prefixBits int) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, fmt.Errorf("%w: truncated integer", ERROR_COMPRESSION)
+	}
+
+	max := uint64(1)<<prefixBits - 1
+	value := uint64(b[0]) & max
+	if value < max {
+		return value, 1, nil
+	}
+
+	var shift uint
+	for i := 1; i < len(b); i++ {
+		// Anything past 62 bits is longer than any header block we take.
+		if shift > 56 {
+			return 0, 0, fmt.Errorf("%w: integer too large", ERROR_COMPRESSION)
+		}
+
+		value += uint64(b[i]&0x7F) << shift
+		shift += 7
+
+		if b[i]&0x80 == 0 {
+			return value, i + 1, nil
+		}
+	}
+
+	return 0, 0, fmt.Errorf("%w: truncated integer", ERROR_COMPRESSION)
+}
+
+// encodeInteger appends value with an N-bit prefix, the rest of the first
+// byte being first.
+func encodeInteger(dst []byte, first byte, prefixBits int, value uint64) []byte {
+	max := uint64(1)<<prefixBits - 1
+	if value < max {
+		return append(dst, first|byte(value))
+	}
+
+	dst = append(dst, first|byte(max))
+	value -= max
+
+	for value >= 0x80 {
+		dst = append(dst, byte(value&0x7F)|0x80)
+		value >>= 7
+	}
+
+	return append(dst, byte(value))
+}
+
+// decodeString decodes a string literal, RFC 7541 5.2.
+func decodeString(b []byte) (string, int, error) {
+	if len(b) == 0 {
+		return "", 0, fmt.Errorf("%w: truncated string", ERROR_COMPRESSION)
+	}
+
+	huffman := b[0]&0x80 != 0
+
+	length, n, err := decodeInteger(b, 7)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if uint64(len(b)-n) < length {
+		return "", 0, fmt.Errorf("%w: truncated string", ERROR_COMPRESSION)
+	}
+	data := b[n : n+int(length)]
+
+	if !huffman {
+		return string(data), n + int(length), nil
+	}
+
+	decoded, err := HuffmanDecode(nil, data)
+	if err != nil {
+		return "", 0, fmt.Errorf("%w: %w", ERROR_COMPRESSION, err)
+	}
+
+	return string(decoded), n + int(length), nil
+}
+
+// encodeString appends s as a string literal, Huffman-coded unless that
+// would make it longer.
+func encodeString(dst []byte, s string) []byte {
+	if n := HuffmanEncodedLen(s); n <= len(s) {
+		dst = encodeInteger(dst, 0x80, 7, uint64(n))
+		return HuffmanEncode(dst, s)
+	}
+
+	dst = encodeInteger(dst, 0x00, 7, uint64(len(s)))
+	return append(dst, s...)
+}
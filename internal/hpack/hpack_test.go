@@ -0,0 +1,277 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+)
+
+// unhex decodes a hex dump as RFC 7541 prints them.
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	require.NoError(t, err)
+
+	return b
+}
+
+func fields(pairs ...string) []HeaderField {
+	var fields []HeaderField
+	for i := 0; i+1 < len(pairs); i += 2 {
+		fields = append(fields, HeaderField{Name: pairs[i], Value: pairs[i+1]})
+	}
+
+	return fields
+}
+
+type example struct {
+	block     string
+	fields    []HeaderField
+	tableSize int
+}
+
+var requestExamples = [][]HeaderField{
+	fields(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com"),
+	fields(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com", "cache-control", "no-cache"),
+	fields(":method", "GET", ":scheme", "https", ":path", "/index.html", ":authority", "www.example.com", "custom-key", "custom-value"),
+}
+
+var responseExamples = [][]HeaderField{
+	fields(":status", "302", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:21 GMT", "location", "https://www.example.com"),
+	fields(":status", "307", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:21 GMT", "location", "https://www.example.com"),
+	fields(":status", "200", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:22 GMT", "location", "https://www.example.com",
+		"content-encoding", "gzip", "set-cookie", "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"),
+}
+
+func TestAppendixC(t *testing.T) {
+	tests := []struct {
+		name      string
+		tableSize int
+		// huffman examples are encoded as we would encode them, so the
+		// encoder must reproduce them too.
+		huffman  bool
+		examples []example
+	}{
+		{
+			name:      "C.2 Header field representations",
+			tableSize: DEFAULT_TABLE_SIZE,
+			examples: []example{
+				{"400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572", fields("custom-key", "custom-header"), 55},
+				{"040c 2f73 616d 706c 652f 7061 7468", fields(":path", "/sample/path"), 55},
+				{"1008 7061 7373 776f 7264 0673 6563 7265 74", []HeaderField{{Name: "password", Value: "secret", Sensitive: true}}, 55},
+				{"82", fields(":method", "GET"), 55},
+			},
+		},
+		{
+			name:      "C.3 Requests without Huffman coding",
+			tableSize: DEFAULT_TABLE_SIZE,
+			examples: []example{
+				{"8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d", requestExamples[0], 57},
+				{"8286 84be 5808 6e6f 2d63 6163 6865", requestExamples[1], 110},
+				{"8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65", requestExamples[2], 164},
+			},
+		},
+		{
+			name:      "C.4 Requests with Huffman coding",
+			tableSize: DEFAULT_TABLE_SIZE,
+			huffman:   true,
+			examples: []example{
+				{"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff", requestExamples[0], 57},
+				{"8286 84be 5886 a8eb 1064 9cbf", requestExamples[1], 110},
+				{"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf", requestExamples[2], 164},
+			},
+		},
+		{
+			name:      "C.5 Responses without Huffman coding",
+			tableSize: 256,
+			examples: []example{
+				{`4803 3330 3258 0770 7269 7661 7465 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3120
+				474d 546e 1768 7474 7073 3a2f 2f77 7777 2e65 7861 6d70 6c65 2e63 6f6d`, responseExamples[0], 222},
+				{"4803 3330 37c1 c0bf", responseExamples[1], 222},
+				{`88c1 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3220 474d 54c0 5a04 677a 6970 7738
+				666f 6f3d 4153 444a 4b48 514b 425a 584f 5157 454f 5049 5541 5851 5745 4f49 553b 206d 6178 2d61 6765 3d33
+				3630 303b 2076 6572 7369 6f6e 3d31`, responseExamples[2], 215},
+			},
+		},
+		{
+			name:      "C.6 Responses with Huffman coding",
+			tableSize: 256,
+			huffman:   true,
+			examples: []example{
+				{`4882 6402 5885 aec3 771a 4b61 96d0 7abe 9410 54d4 44a8 2005 9504 0b81 66e0 82a6 2d1b ff6e 919d 29ad 1718
+				63c7 8f0b 97c8 e9ae 82ae 43d3`, responseExamples[0], 222},
+				{"4883 640e ffc1 c0bf", responseExamples[1], 222},
+				{`88c1 6196 d07a be94 1054 d444 a820 0595 040b 8166 e084 a62d 1bff c05a 839b d9ab 77ad 94e7 821d d7f2 e6c7
+				b335 dfdf cd5b 3960 d5af 2708 7f36 72c1 ab27 0fb5 291f 9587 3160 65c0 03ed 4ee5 b106 3d50 07`, responseExamples[2], 215},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoder := NewDecoder(tt.tableSize)
+			encoder := NewEncoder(tt.tableSize)
+
+			for _, ex := range tt.examples {
+				block := unhex(t, ex.block)
+
+				decoded, err := decoder.DecodeFields(block)
+				require.NoError(t, err)
+				assert.Equal(t, ex.fields, decoded)
+				assert.Equal(t, ex.tableSize, decoder.table.size)
+
+				if tt.huffman {
+					assert.Equal(t, hex.EncodeToString(block), hex.EncodeToString(encoder.EncodeFields(nil, ex.fields)))
+					assert.Equal(t, decoder.table.entries, encoder.table.entries)
+				}
+			}
+		})
+	}
+}
+
+func TestHuffman(t *testing.T) {
+	// Test: RFC 7541 C.4.1
+	encoded := HuffmanEncode(nil, "www.example.com")
+	assert.Equal(t, "f1e3c2e5f23a6ba0ab90f4ff", hex.EncodeToString(encoded))
+	assert.Equal(t, len(encoded), HuffmanEncodedLen("www.example.com"))
+
+	decoded, err := HuffmanDecode(nil, encoded)
+	require.NoError(t, err)
+	assert.Equal(t, "www.example.com", string(decoded))
+
+	// Test: Every byte value survives a round trip
+	var all []byte
+	for i := range 256 {
+		all = append(all, byte(i))
+	}
+	decoded, err = HuffmanDecode(nil, HuffmanEncode(nil, string(all)))
+	require.NoError(t, err)
+	assert.Equal(t, all, decoded)
+
+	// Test: Padding must be short and all ones
+	_, err = HuffmanDecode(nil, []byte{0xff, 0xff})
+	require.ErrorIs(t, err, ERROR_INVALID_HUFFMAN)
+	_, err = HuffmanDecode(nil, []byte{0x00})
+	require.ErrorIs(t, err, ERROR_INVALID_HUFFMAN)
+}
+
+func TestEncoder(t *testing.T) {
+	encoder := NewEncoder(DEFAULT_TABLE_SIZE)
+	decoder := NewDecoder(DEFAULT_TABLE_SIZE)
+
+	first := []HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":path", Value: "/"},
+		{Name: "custom-key", Value: "custom-value"},
+		{Name: "authorization", Value: "secret", Sensitive: true},
+	}
+
+	// Test: Round trips, with fields the table picked up along the way
+	for range 3 {
+		block := encoder.EncodeFields(nil, first)
+		decoded, err := decoder.DecodeFields(block)
+		require.NoError(t, err)
+		assert.Equal(t, first, decoded)
+	}
+
+	// Test: Repeated fields come from the table
+	block := encoder.EncodeFields(nil, first[:3])
+	assert.Len(t, block, 3)
+
+	// Test: Sensitive fields never enter the table
+	for _, e := range encoder.table.entries {
+		assert.NotEqual(t, "authorization", e.Name)
+	}
+
+	// Test: A smaller table is announced to the decoder
+	encoder.SetMaxTableSize(0)
+	decoded, err := decoder.DecodeFields(encoder.EncodeFields(nil, first))
+	require.NoError(t, err)
+	assert.Equal(t, first, decoded)
+	assert.Empty(t, decoder.table.entries)
+
+	// Test: Fields larger than the table are sent as literals
+	encoder = NewEncoder(64)
+	block = encoder.EncodeFields(nil, fields("x-large", strings.Repeat("a", 64)))
+	assert.Equal(t, byte(0x00), block[0])
+	assert.Empty(t, encoder.table.entries)
+}
+
+func TestHeaders(t *testing.T) {
+	encoder := NewEncoder(DEFAULT_TABLE_SIZE)
+	decoder := NewDecoder(DEFAULT_TABLE_SIZE)
+
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain")
+	h.Set("Authorization", "Bearer token")
+	h.Set("X-Request-Id", "abc")
+
+	// Test: Headers round trip, in order of name
+	block := encoder.Encode(nil, h)
+	decoded, err := decoder.DecodeFields(block)
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{
+		{Name: "authorization", Value: "Bearer token", Sensitive: true},
+		{Name: "content-type", Value: "text/plain"},
+		{Name: "x-request-id", Value: "abc"},
+	}, decoded)
+
+	// Test: Credentials are never indexed
+	assert.Equal(t, byte(0x10), block[0]&0xF0)
+	assert.True(t, IsSensitive("set-cookie"))
+	assert.False(t, IsSensitive("cookie"))
+
+	// Test: Each Set-Cookie is a field of its own
+	h = headers.NewHeaders()
+	h.Set("Set-Cookie", "a=1")
+	h.Set("Set-Cookie", "b=2")
+	decoded, err = decoder.DecodeFields(encoder.Encode(nil, h))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{
+		{Name: "set-cookie", Value: "a=1", Sensitive: true},
+		{Name: "set-cookie", Value: "b=2", Sensitive: true},
+	}, decoded)
+
+	// Test: Repeated fields are joined
+	decoder = NewDecoder(DEFAULT_TABLE_SIZE)
+	decodedHeaders, err := decoder.Decode(NewEncoder(DEFAULT_TABLE_SIZE).EncodeFields(nil, fields("accept", "text/html", "accept", "*/*")))
+	require.NoError(t, err)
+	assert.Equal(t, "text/html,*/*", decodedHeaders.Get("Accept"))
+}
+
+func TestDecoderErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		block []byte
+	}{
+		{"Index past the end of the table", []byte{0xff, 0x00}},
+		{"Index zero", []byte{0x80}},
+		{"Size update above the limit", encodeInteger(nil, 0x20, 5, DEFAULT_TABLE_SIZE+1)},
+		{"Size update after a field", []byte{0x82, 0x20}},
+		{"Truncated string", []byte{0x40, 0x05, 'a'}},
+		{"Truncated integer", []byte{0x7f, 0x80}},
+		{"Integer too large", []byte{0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{"Invalid Huffman", []byte{0x00, 0x81, 0x00, 0x00}},
+	}
+
+	for _, tt := range tests {
+		_, err := NewDecoder(DEFAULT_TABLE_SIZE).DecodeFields(tt.block)
+		assert.ErrorIs(t, err, ERROR_COMPRESSION, tt.name)
+	}
+
+	// Test: Lowering the limit shrinks the table, and later updates
+	// can't go past it
+	decoder := NewDecoder(DEFAULT_TABLE_SIZE)
+	_, err := decoder.DecodeFields(unhex(t, "400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572"))
+	require.NoError(t, err)
+	decoder.SetMaxTableSize(0)
+	assert.Empty(t, decoder.table.entries)
+	_, err = decoder.DecodeFields(encodeInteger(nil, 0x20, 5, 100))
+	assert.ErrorIs(t, err, ERROR_COMPRESSION)
+}
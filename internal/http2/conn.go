@@ -0,0 +1,978 @@
+package http2
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/hpack"
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+)
+
+// serverConn is the server side of one HTTP/2 connection. A single read
+// loop handles every frame the client sends; handlers write their
+// responses from their own goroutines.
+type serverConn struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	handler Handler
+	options Options
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	// Owned by the read loop.
+	decoder      *hpack.Decoder
+	sawSettings  bool
+	recvWindow   int
+	recvUnacked  int
+	maxBlockSize int
+	// A header block being continued in CONTINUATION frames.
+	continuing     bool
+	blockStreamID  uint32
+	blockEndStream bool
+	headerBlock    []byte
+
+	// wmu keeps frames from interleaving and guards the encoder, whose
+	// state must follow the order header blocks go out in.
+	wmu     sync.Mutex
+	encoder *hpack.Encoder
+	wbuf    []byte
+
+	// mu guards the streams and the send windows. cond is signalled when
+	// a window opens up or a stream goes away.
+	mu                sync.Mutex
+	cond              *sync.Cond
+	streams           map[uint32]*stream
+	lastStreamID      uint32
+	sendWindow        int64
+	peerInitialWindow int64
+	peerMaxFrameSize  int
+	// draining is set once either side sent a GOAWAY. The connection is
+	// closed when its last stream is done.
+	draining   bool
+	goAwaySent bool
+	closed     bool
+}
+
+func newServerConn(ctx context.Context, conn net.Conn, handler Handler, options Options) *serverConn {
+	options = options.withDefaults()
+	ctx, cancel := context.WithCancel(ctx)
+
+	sc := &serverConn{
+		conn:              conn,
+		br:                bufio.NewReader(conn),
+		handler:           handler,
+		options:           options,
+		ctx:               ctx,
+		cancel:            cancel,
+		decoder:           hpack.NewDecoder(hpack.DEFAULT_TABLE_SIZE),
+		recvWindow:        options.InitialWindowSize,
+		maxBlockSize:      max(options.Request.MaxHeaderBytes, DEFAULT_MAX_HEADER_BLOCK_SIZE),
+		encoder:           hpack.NewEncoder(hpack.DEFAULT_TABLE_SIZE),
+		streams:           map[uint32]*stream{},
+		sendWindow:        DEFAULT_WINDOW_SIZE,
+		peerInitialWindow: DEFAULT_WINDOW_SIZE,
+		peerMaxFrameSize:  DEFAULT_MAX_FRAME_SIZE,
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+
+	return sc
+}
+
+// serve runs the connection until it ends. upgrade is the request of an
+// h2c upgrade, and settings those the client sent along with it.
+func (sc *serverConn) serve(upgrade *request.Request, settings []setting) error {
+	defer sc.close()
+
+	stop := context.AfterFunc(sc.ctx, sc.shutdown)
+	defer stop()
+
+	err := sc.writeSettings()
+	if err != nil {
+		return err
+	}
+
+	if upgrade != nil {
+		err = sc.applySettings(settings)
+		if err != nil {
+			return err
+		}
+
+		// The request has already arrived in full.
+		st := sc.newStream(1)
+		sc.mu.Lock()
+		st.closeRemote()
+		sc.mu.Unlock()
+		st.head = upgrade.RequestLine.Method == "HEAD"
+		sc.startHandler(st, upgrade, nil)
+	}
+
+	err = sc.readPreface()
+	if err != nil {
+		sc.goAway(PROTOCOL_ERROR, "invalid preface")
+		return err
+	}
+
+	err = sc.readLoop()
+
+	var ce connError
+	if errors.As(err, &ce) {
+		sc.options.Logger.Debug("http2: connection error", "remote_addr", sc.conn.RemoteAddr().String(), "err", err)
+		sc.goAway(ce.code, ce.reason)
+		return err
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+
+	return err
+}
+
+func (sc *serverConn) readPreface() error {
+	preface := make([]byte, len(CLIENT_PREFACE))
+
+	_, err := io.ReadFull(sc.br, preface)
+	if err != nil {
+		return err
+	}
+
+	if string(preface) != CLIENT_PREFACE {
+		return ERROR_BAD_PREFACE
+	}
+
+	return nil
+}
+
+func (sc *serverConn) readLoop() error {
+	for {
+		if sc.drained() {
+			return nil
+		}
+
+		f, err := readFrame(sc.br, uint32(sc.options.MaxFrameSize))
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if sc.drained() {
+				return nil
+			}
+
+			// We were idle for too long.
+			sc.goAway(NO_ERROR, "")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = sc.handleFrame(f)
+
+		var se streamError
+		if errors.As(err, &se) {
+			sc.resetStream(se.streamID, se.code)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// drained reports whether the connection is done, and otherwise sets the
+// read deadline for the next frame: the idle timeout while no streams are
+// open, none while some are.
+func (sc *serverConn) drained() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.draining && len(sc.streams) == 0 {
+		return true
+	}
+
+	var deadline time.Time
+	if len(sc.streams) == 0 && sc.options.IdleTimeout > 0 {
+		deadline = time.Now().Add(sc.options.IdleTimeout)
+	}
+	sc.conn.SetReadDeadline(deadline)
+
+	return false
+}
+
+// wake interrupts the read loop once the connection has drained. Call it
+// with mu held.
+func (sc *serverConn) wake() {
+	if sc.draining && len(sc.streams) == 0 {
+		sc.conn.SetReadDeadline(time.Now())
+	}
+}
+
+// shutdown starts a graceful close when the server goes away.
+func (sc *serverConn) shutdown() {
+	sc.goAway(NO_ERROR, "")
+
+	sc.mu.Lock()
+	sc.draining = true
+	sc.wake()
+	sc.mu.Unlock()
+}
+
+func (sc *serverConn) close() {
+	sc.cancel()
+
+	sc.mu.Lock()
+	sc.closed = true
+	sc.mu.Unlock()
+	sc.cond.Broadcast()
+
+	// Closing first unblocks handlers stuck writing to a client that
+	// stopped reading.
+	sc.conn.Close()
+	sc.wg.Wait()
+}
+
+func (sc *serverConn) handleFrame(f frame) error {
+	if !sc.sawSettings {
+		if f.typ != FRAME_SETTINGS || f.has(FLAG_ACK) {
+			return connError{PROTOCOL_ERROR, "first frame must be SETTINGS"}
+		}
+		sc.sawSettings = true
+	}
+
+	if sc.continuing && f.typ != FRAME_CONTINUATION {
+		return connError{PROTOCOL_ERROR, "expected CONTINUATION"}
+	}
+
+	switch f.typ {
+	case FRAME_DATA:
+		return sc.handleData(f)
+	case FRAME_HEADERS:
+		return sc.handleHeaders(f)
+	case FRAME_CONTINUATION:
+		return sc.handleContinuation(f)
+	case FRAME_PRIORITY:
+		if f.streamID == 0 {
+			return connError{PROTOCOL_ERROR, "PRIORITY on stream 0"}
+		}
+		if len(f.payload) != 5 {
+			return streamError{f.streamID, FRAME_SIZE_ERROR}
+		}
+		// Priorities are only a hint, RFC 9113 5.3.
+		return nil
+	case FRAME_RST_STREAM:
+		return sc.handleRSTStream(f)
+	case FRAME_SETTINGS:
+		return sc.handleSettings(f)
+	case FRAME_PUSH_PROMISE:
+		return connError{PROTOCOL_ERROR, "PUSH_PROMISE from a client"}
+	case FRAME_PING:
+		return sc.handlePing(f)
+	case FRAME_GOAWAY:
+		if f.streamID != 0 {
+			return connError{PROTOCOL_ERROR, "GOAWAY on a stream"}
+		}
+		if len(f.payload) < 8 {
+			return connError{FRAME_SIZE_ERROR, "short GOAWAY"}
+		}
+
+		sc.mu.Lock()
+		sc.draining = true
+		sc.mu.Unlock()
+		return nil
+	case FRAME_WINDOW_UPDATE:
+		return sc.handleWindowUpdate(f)
+	default:
+		// Unknown frame types are ignored, RFC 9113 4.1.
+		return nil
+	}
+}
+
+func (sc *serverConn) handleData(f frame) error {
+	if f.streamID == 0 {
+		return connError{PROTOCOL_ERROR, "DATA on stream 0"}
+	}
+
+	st, lastStreamID := sc.stream(f.streamID)
+	if f.streamID > lastStreamID {
+		return connError{PROTOCOL_ERROR, "DATA on an idle stream"}
+	}
+
+	data, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+
+	// Padding counts towards flow control too.
+	n := len(f.payload)
+	if n > sc.recvWindow {
+		return connError{FLOW_CONTROL_ERROR, "connection window exceeded"}
+	}
+	sc.recvWindow -= n
+
+	// The data is either buffered or thrown away right here, so the
+	// connection window can be given back at once.
+	sc.recvUnacked += n
+	if sc.recvUnacked >= sc.options.InitialWindowSize/2 {
+		err = sc.writeWindowUpdate(0, sc.recvUnacked)
+		if err != nil {
+			return err
+		}
+		sc.recvWindow += sc.recvUnacked
+		sc.recvUnacked = 0
+	}
+
+	// Frames may still arrive on a stream we have reset.
+	if st == nil {
+		return nil
+	}
+
+	if sc.streamState(st) != STATE_OPEN && sc.streamState(st) != STATE_HALF_CLOSED_LOCAL {
+		return streamError{st.id, STREAM_CLOSED}
+	}
+
+	if n > st.recvWindow {
+		return streamError{st.id, FLOW_CONTROL_ERROR}
+	}
+	st.recvWindow -= n
+
+	if !st.rejected {
+		st.body = append(st.body, data...)
+
+		if st.contentLength >= 0 && len(st.body) > st.contentLength {
+			return streamError{st.id, PROTOCOL_ERROR}
+		}
+
+		maxBody := sc.options.Request.MaxBodyBytes
+		if maxBody > 0 && len(st.body) > maxBody {
+			sc.reject(st, request.ERROR_BODY_TOO_LARGE)
+		}
+	}
+
+	if f.has(FLAG_END_STREAM) {
+		return sc.endRequest(st, nil)
+	}
+
+	st.recvUnacked += n
+	if st.recvUnacked >= sc.options.InitialWindowSize/2 {
+		err = sc.writeWindowUpdate(st.id, st.recvUnacked)
+		if err != nil {
+			return err
+		}
+		st.recvWindow += st.recvUnacked
+		st.recvUnacked = 0
+	}
+
+	return nil
+}
+
+func (sc *serverConn) handleHeaders(f frame) error {
+	if f.streamID == 0 || f.streamID%2 == 0 {
+		return connError{PROTOCOL_ERROR, "HEADERS on an invalid stream"}
+	}
+
+	block, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+
+	if f.has(FLAG_PRIORITY) {
+		if len(block) < 5 {
+			return connError{FRAME_SIZE_ERROR, "short HEADERS"}
+		}
+		block = block[5:]
+	}
+
+	if len(block) > sc.maxBlockSize {
+		return connError{ENHANCE_YOUR_CALM, "header block too large"}
+	}
+
+	sc.blockStreamID = f.streamID
+	sc.blockEndStream = f.has(FLAG_END_STREAM)
+	sc.headerBlock = append(sc.headerBlock[:0], block...)
+
+	if !f.has(FLAG_END_HEADERS) {
+		sc.continuing = true
+		return nil
+	}
+
+	return sc.endHeaderBlock()
+}
+
+func (sc *serverConn) handleContinuation(f frame) error {
+	if !sc.continuing || f.streamID != sc.blockStreamID {
+		return connError{PROTOCOL_ERROR, "unexpected CONTINUATION"}
+	}
+
+	if len(sc.headerBlock)+len(f.payload) > sc.maxBlockSize {
+		return connError{ENHANCE_YOUR_CALM, "header block too large"}
+	}
+	sc.headerBlock = append(sc.headerBlock, f.payload...)
+
+	if !f.has(FLAG_END_HEADERS) {
+		return nil
+	}
+	sc.continuing = false
+
+	return sc.endHeaderBlock()
+}
+
+// endHeaderBlock handles a complete header block: the start of a request,
+// or its trailers.
+func (sc *serverConn) endHeaderBlock() error {
+	id := sc.blockStreamID
+	endStream := sc.blockEndStream
+
+	// Blocks have to be decoded even for streams we refuse, to keep our
+	// table in step with the client's.
+	fields, err := sc.decoder.DecodeFields(sc.headerBlock)
+	if err != nil {
+		return connError{COMPRESSION_ERROR, err.Error()}
+	}
+
+	st, lastStreamID := sc.stream(id)
+
+	if st != nil {
+		state := sc.streamState(st)
+		if state != STATE_OPEN && state != STATE_HALF_CLOSED_LOCAL {
+			return streamError{id, STREAM_CLOSED}
+		}
+
+		// Trailers must end the stream, RFC 9113 8.1.
+		if !endStream {
+			return streamError{id, PROTOCOL_ERROR}
+		}
+
+		st.fields = fields
+		trailers, err := st.trailers()
+		if err != nil {
+			return err
+		}
+
+		return sc.endRequest(st, trailers)
+	}
+
+	if id <= lastStreamID {
+		return connError{STREAM_CLOSED, "HEADERS on a closed stream"}
+	}
+
+	sc.mu.Lock()
+	sc.lastStreamID = id
+	refused := len(sc.streams) >= sc.options.MaxConcurrentStreams
+	draining := sc.draining
+	sc.mu.Unlock()
+
+	// Streams the GOAWAY didn't cover are ignored, RFC 9113 6.8.
+	if draining {
+		return nil
+	}
+
+	if refused {
+		return streamError{id, REFUSED_STREAM}
+	}
+
+	st = sc.newStream(id)
+	st.fields = fields
+
+	rl, h, err := st.newRequest()
+	if err != nil {
+		return err
+	}
+	st.requestLine = rl
+	st.header = h
+	st.head = rl.Method == "HEAD"
+
+	for _, f := range fields {
+		st.headerBytes += f.Size()
+	}
+
+	maxHeader := sc.options.Request.MaxHeaderBytes
+	maxBody := sc.options.Request.MaxBodyBytes
+
+	switch {
+	case maxHeader > 0 && st.headerBytes > maxHeader:
+		sc.reject(st, request.ERROR_HEADERS_TOO_LARGE)
+	case h.Get("host") == "":
+		sc.reject(st, request.ERROR_MISSING_HOST_HEADER)
+	case maxBody > 0 && st.contentLength > maxBody:
+		sc.reject(st, request.ERROR_BODY_TOO_LARGE)
+	}
+
+	if endStream {
+		return sc.endRequest(st, nil)
+	}
+
+	return nil
+}
+
+// endRequest is called once the client has sent all of a request, and
+// hands it to the handler.
+func (sc *serverConn) endRequest(st *stream, trailers headers.Headers) error {
+	sc.mu.Lock()
+	st.closeRemote()
+	sc.mu.Unlock()
+
+	if st.rejected {
+		return nil
+	}
+
+	if st.contentLength >= 0 && len(st.body) != st.contentLength {
+		return streamError{st.id, PROTOCOL_ERROR}
+	}
+
+	req, err := request.NewRequest(st.requestLine, st.header, trailers, st.body, sc.options.Request)
+	if req != nil {
+		req.RemoteAddr = sc.conn.RemoteAddr().String()
+	}
+
+	sc.startHandler(st, req, err)
+
+	return nil
+}
+
+// reject answers a request with an error before all of it has arrived.
+// The rest of its body is thrown away.
+func (sc *serverConn) reject(st *stream, err error) {
+	st.rejected = true
+	st.body = nil
+
+	sc.startHandler(st, nil, err)
+}
+
+func (sc *serverConn) startHandler(st *stream, req *request.Request, err error) {
+	sc.wg.Add(1)
+	go sc.runStream(st, req, err)
+}
+
+func (sc *serverConn) runStream(st *stream, req *request.Request, err error) {
+	defer sc.wg.Done()
+	defer sc.streamDone(st)
+
+	w := response.NewFramedWriter(st)
+
+	if err != nil {
+		sc.options.ErrorHandler(w, err)
+	} else {
+		sc.handler(w, req.WithContext(st.ctx))
+	}
+
+	// The status line goes out with the headers, so send it if the
+	// handler never got that far.
+	if w.StatusCode() != 0 && !w.HeadersWritten() {
+		w.WriteHeaders(headers.NewHeaders())
+	}
+
+	w.Finish()
+}
+
+// streamDone forgets a stream whose response is complete. If the client
+// is still sending the request, it is told to stop, RFC 9113 8.1.
+func (sc *serverConn) streamDone(st *stream) {
+	sc.mu.Lock()
+	remoteOpen := st.state == STATE_HALF_CLOSED_LOCAL
+	sc.mu.Unlock()
+
+	if remoteOpen {
+		sc.resetStream(st.id, NO_ERROR)
+		return
+	}
+
+	sc.removeStream(st.id)
+}
+
+func (sc *serverConn) handleRSTStream(f frame) error {
+	if f.streamID == 0 {
+		return connError{PROTOCOL_ERROR, "RST_STREAM on stream 0"}
+	}
+
+	if len(f.payload) != 4 {
+		return connError{FRAME_SIZE_ERROR, "RST_STREAM length"}
+	}
+
+	_, lastStreamID := sc.stream(f.streamID)
+	if f.streamID > lastStreamID {
+		return connError{PROTOCOL_ERROR, "RST_STREAM on an idle stream"}
+	}
+
+	sc.removeStream(f.streamID)
+
+	return nil
+}
+
+func (sc *serverConn) handleSettings(f frame) error {
+	if f.streamID != 0 {
+		return connError{PROTOCOL_ERROR, "SETTINGS on a stream"}
+	}
+
+	if f.has(FLAG_ACK) {
+		if len(f.payload) != 0 {
+			return connError{FRAME_SIZE_ERROR, "SETTINGS ACK with a payload"}
+		}
+		return nil
+	}
+
+	settings, err := parseSettings(f.payload)
+	if err != nil {
+		return err
+	}
+
+	err = sc.applySettings(settings)
+	if err != nil {
+		return err
+	}
+
+	return sc.writeFrame(FRAME_SETTINGS, FLAG_ACK, 0, nil)
+}
+
+func (sc *serverConn) applySettings(settings []setting) error {
+	for _, s := range settings {
+		switch s.id {
+		case SETTINGS_HEADER_TABLE_SIZE:
+			sc.wmu.Lock()
+			// There is no need to use more than the default.
+			sc.encoder.SetMaxTableSize(min(int(s.value), hpack.DEFAULT_TABLE_SIZE))
+			sc.wmu.Unlock()
+		case SETTINGS_ENABLE_PUSH:
+			if s.value > 1 {
+				return connError{PROTOCOL_ERROR, "invalid SETTINGS_ENABLE_PUSH"}
+			}
+		case SETTINGS_INITIAL_WINDOW_SIZE:
+			if s.value > MAX_WINDOW_SIZE {
+				return connError{FLOW_CONTROL_ERROR, "invalid SETTINGS_INITIAL_WINDOW_SIZE"}
+			}
+
+			err := sc.setPeerInitialWindow(int64(s.value))
+			if err != nil {
+				return err
+			}
+		case SETTINGS_MAX_FRAME_SIZE:
+			if s.value < DEFAULT_MAX_FRAME_SIZE || s.value > MAX_FRAME_SIZE {
+				return connError{PROTOCOL_ERROR, "invalid SETTINGS_MAX_FRAME_SIZE"}
+			}
+
+			sc.mu.Lock()
+			sc.peerMaxFrameSize = int(s.value)
+			sc.mu.Unlock()
+		}
+		// The rest only matter to a server that pushes, or are advisory.
+	}
+
+	return nil
+}
+
+// setPeerInitialWindow changes the send window of every open stream by
+// the difference to the previous initial size, RFC 9113 6.9.2.
+func (sc *serverConn) setPeerInitialWindow(size int64) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	delta := size - sc.peerInitialWindow
+	sc.peerInitialWindow = size
+
+	for _, st := range sc.streams {
+		st.sendWindow += delta
+		if st.sendWindow > MAX_WINDOW_SIZE {
+			return connError{FLOW_CONTROL_ERROR, "stream window too large"}
+		}
+	}
+	sc.cond.Broadcast()
+
+	return nil
+}
+
+func (sc *serverConn) handlePing(f frame) error {
+	if f.streamID != 0 {
+		return connError{PROTOCOL_ERROR, "PING on a stream"}
+	}
+
+	if len(f.payload) != 8 {
+		return connError{FRAME_SIZE_ERROR, "PING length"}
+	}
+
+	if f.has(FLAG_ACK) {
+		return nil
+	}
+
+	return sc.writeFrame(FRAME_PING, FLAG_ACK, 0, f.payload)
+}
+
+func (sc *serverConn) handleWindowUpdate(f frame) error {
+	if len(f.payload) != 4 {
+		return connError{FRAME_SIZE_ERROR, "WINDOW_UPDATE length"}
+	}
+
+	increment := int64(binary.BigEndian.Uint32(f.payload) & MAX_WINDOW_SIZE)
+
+	if f.streamID == 0 {
+		if increment == 0 {
+			return connError{PROTOCOL_ERROR, "WINDOW_UPDATE of 0"}
+		}
+
+		sc.mu.Lock()
+		defer sc.mu.Unlock()
+
+		sc.sendWindow += increment
+		if sc.sendWindow > MAX_WINDOW_SIZE {
+			return connError{FLOW_CONTROL_ERROR, "connection window too large"}
+		}
+		sc.cond.Broadcast()
+
+		return nil
+	}
+
+	st, lastStreamID := sc.stream(f.streamID)
+	if f.streamID > lastStreamID {
+		return connError{PROTOCOL_ERROR, "WINDOW_UPDATE on an idle stream"}
+	}
+
+	if increment == 0 {
+		return streamError{f.streamID, PROTOCOL_ERROR}
+	}
+
+	if st == nil {
+		return nil
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	st.sendWindow += increment
+	if st.sendWindow > MAX_WINDOW_SIZE {
+		return streamError{f.streamID, FLOW_CONTROL_ERROR}
+	}
+	sc.cond.Broadcast()
+
+	return nil
+}
+
+func (sc *serverConn) newStream(id uint32) *stream {
+	ctx, cancel := context.WithCancel(sc.ctx)
+
+	st := &stream{
+		sc:            sc,
+		id:            id,
+		ctx:           ctx,
+		cancel:        cancel,
+		state:         STATE_OPEN,
+		contentLength: -1,
+		recvWindow:    sc.options.InitialWindowSize,
+	}
+
+	sc.mu.Lock()
+	st.sendWindow = sc.peerInitialWindow
+	sc.streams[id] = st
+	sc.lastStreamID = max(sc.lastStreamID, id)
+	sc.mu.Unlock()
+
+	return st
+}
+
+// stream returns the open stream with id, or nil, along with the highest
+// stream ID the client has used so far.
+func (sc *serverConn) stream(id uint32) (*stream, uint32) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	return sc.streams[id], sc.lastStreamID
+}
+
+func (sc *serverConn) streamState(st *stream) streamState {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	return st.state
+}
+
+// removeStream closes the stream with id and cancels its context. It
+// returns false if the stream was already gone.
+func (sc *serverConn) removeStream(id uint32) bool {
+	sc.mu.Lock()
+	st := sc.streams[id]
+	if st != nil {
+		delete(sc.streams, id)
+		st.state = STATE_CLOSED
+		sc.wake()
+	}
+	sc.mu.Unlock()
+
+	if st == nil {
+		return false
+	}
+
+	st.cancel()
+	sc.cond.Broadcast()
+
+	return true
+}
+
+func (sc *serverConn) resetStream(id uint32, code ErrorCode) {
+	sc.removeStream(id)
+	sc.writeFrame(FRAME_RST_STREAM, 0, id, binary.BigEndian.AppendUint32(nil, uint32(code)))
+}
+
+// awaitWindow blocks until st may send some data, and takes up to want
+// bytes of both its window and the connection's.
+func (sc *serverConn) awaitWindow(st *stream, want int) (int, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for {
+		if sc.closed {
+			return 0, ERROR_CONN_CLOSED
+		}
+
+		if st.state == STATE_CLOSED || st.state == STATE_HALF_CLOSED_LOCAL {
+			return 0, ERROR_STREAM_RESET
+		}
+
+		available := min(st.sendWindow, sc.sendWindow)
+		if available > 0 {
+			n := int(min(int64(want), available, int64(sc.peerMaxFrameSize)))
+			st.sendWindow -= int64(n)
+			sc.sendWindow -= int64(n)
+
+			return n, nil
+		}
+
+		sc.cond.Wait()
+	}
+}
+
+// sendable reports whether st may still send frames, and closes its
+// sending side if endStream is set.
+func (sc *serverConn) sendable(st *stream, endStream bool) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if st.state == STATE_CLOSED || st.state == STATE_HALF_CLOSED_LOCAL {
+		return false
+	}
+
+	if endStream {
+		st.closeLocal()
+	}
+
+	return true
+}
+
+func (sc *serverConn) writeData(st *stream, data []byte, endStream bool) error {
+	if !sc.sendable(st, endStream) {
+		return ERROR_STREAM_RESET
+	}
+
+	var flags uint8
+	if endStream {
+		flags = FLAG_END_STREAM
+	}
+
+	return sc.writeFrame(FRAME_DATA, flags, st.id, data)
+}
+
+// writeHeaders sends a header block, split into CONTINUATION frames if it
+// doesn't fit in one.
+func (sc *serverConn) writeHeaders(st *stream, fields []hpack.HeaderField, endStream bool) error {
+	if !sc.sendable(st, endStream) {
+		return ERROR_STREAM_RESET
+	}
+
+	sc.mu.Lock()
+	maxFrameSize := sc.peerMaxFrameSize
+	sc.mu.Unlock()
+
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+
+	block := sc.encoder.EncodeFields(nil, fields)
+	typ := FRAME_HEADERS
+
+	for {
+		n := min(len(block), maxFrameSize)
+		chunk := block[:n]
+		block = block[n:]
+
+		var flags uint8
+		if typ == FRAME_HEADERS && endStream {
+			flags |= FLAG_END_STREAM
+		}
+		if len(block) == 0 {
+			flags |= FLAG_END_HEADERS
+		}
+
+		err := sc.writeFrameLocked(typ, flags, st.id, chunk)
+		if err != nil {
+			return err
+		}
+
+		if len(block) == 0 {
+			return nil
+		}
+		typ = FRAME_CONTINUATION
+	}
+}
+
+func (sc *serverConn) writeSettings() error {
+	settings := []setting{
+		{SETTINGS_MAX_CONCURRENT_STREAMS, uint32(sc.options.MaxConcurrentStreams)},
+		{SETTINGS_INITIAL_WINDOW_SIZE, uint32(sc.options.InitialWindowSize)},
+		{SETTINGS_MAX_FRAME_SIZE, uint32(sc.options.MaxFrameSize)},
+	}
+
+	if maxHeader := sc.options.Request.MaxHeaderBytes; maxHeader > 0 {
+		settings = append(settings, setting{SETTINGS_MAX_HEADER_LIST_SIZE, uint32(maxHeader)})
+	}
+
+	err := sc.writeFrame(FRAME_SETTINGS, 0, 0, appendSettings(nil, settings))
+	if err != nil {
+		return err
+	}
+
+	// SETTINGS_INITIAL_WINDOW_SIZE doesn't cover the connection window.
+	if increment := sc.options.InitialWindowSize - DEFAULT_WINDOW_SIZE; increment > 0 {
+		return sc.writeWindowUpdate(0, increment)
+	}
+
+	return nil
+}
+
+func (sc *serverConn) writeWindowUpdate(streamID uint32, increment int) error {
+	return sc.writeFrame(FRAME_WINDOW_UPDATE, 0, streamID, binary.BigEndian.AppendUint32(nil, uint32(increment)))
+}
+
+// goAway tells the client which streams we will still answer, and why we
+// are closing the connection. It is sent once.
+func (sc *serverConn) goAway(code ErrorCode, reason string) {
+	sc.mu.Lock()
+	if sc.goAwaySent {
+		sc.mu.Unlock()
+		return
+	}
+	sc.goAwaySent = true
+	lastStreamID := sc.lastStreamID
+	sc.mu.Unlock()
+
+	payload := binary.BigEndian.AppendUint32(nil, lastStreamID)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	payload = append(payload, reason...)
+
+	sc.writeFrame(FRAME_GOAWAY, 0, 0, payload)
+}
+
+func (sc *serverConn) writeFrame(typ FrameType, flags uint8, streamID uint32, payload []byte) error {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+
+	return sc.writeFrameLocked(typ, flags, streamID, payload)
+}
+
+func (sc *serverConn) writeFrameLocked(typ FrameType, flags uint8, streamID uint32, payload []byte) error {
+	sc.wbuf = appendFrame(sc.wbuf[:0], typ, flags, streamID, payload)
+
+	_, err := sc.conn.Write(sc.wbuf)
+	return err
+}
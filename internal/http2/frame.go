@@ -0,0 +1,201 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// FRAME_HEADER_LEN is the size of the header every frame starts with,
+// RFC 9113 4.1.
+const FRAME_HEADER_LEN = 9
+
+// DEFAULT_MAX_FRAME_SIZE is the largest frame payload either side may send
+// until the other raises SETTINGS_MAX_FRAME_SIZE. MAX_FRAME_SIZE is the
+// highest value the setting can take.
+const DEFAULT_MAX_FRAME_SIZE = 16384
+const MAX_FRAME_SIZE = 1<<24 - 1
+
+// DEFAULT_WINDOW_SIZE is the initial flow control window of the connection
+// and of every stream, RFC 9113 6.9.2. MAX_WINDOW_SIZE is the largest
+// window flow control allows.
+const DEFAULT_WINDOW_SIZE = 65535
+const MAX_WINDOW_SIZE = 1<<31 - 1
+
+type FrameType uint8
+
+const (
+	FRAME_DATA          FrameType = 0x0
+	FRAME_HEADERS       FrameType = 0x1
+	FRAME_PRIORITY      FrameType = 0x2
+	FRAME_RST_STREAM    FrameType = 0x3
+	FRAME_SETTINGS      FrameType = 0x4
+	FRAME_PUSH_PROMISE  FrameType = 0x5
+	FRAME_PING          FrameType = 0x6
+	FRAME_GOAWAY        FrameType = 0x7
+	FRAME_WINDOW_UPDATE FrameType = 0x8
+	FRAME_CONTINUATION  FrameType = 0x9
+)
+
+// Frame flags. ACK shares its bit with END_STREAM; which one a flag means
+// depends on the frame type.
+const (
+	FLAG_END_STREAM  uint8 = 0x1
+	FLAG_ACK         uint8 = 0x1
+	FLAG_END_HEADERS uint8 = 0x4
+	FLAG_PADDED      uint8 = 0x8
+	FLAG_PRIORITY    uint8 = 0x20
+)
+
+// ErrorCode tells the peer why a stream was reset or the connection closed,
+// RFC 9113 7.
+type ErrorCode uint32
+
+const (
+	NO_ERROR            ErrorCode = 0x0
+	PROTOCOL_ERROR      ErrorCode = 0x1
+	INTERNAL_ERROR      ErrorCode = 0x2
+	FLOW_CONTROL_ERROR  ErrorCode = 0x3
+	SETTINGS_TIMEOUT    ErrorCode = 0x4
+	STREAM_CLOSED       ErrorCode = 0x5
+	FRAME_SIZE_ERROR    ErrorCode = 0x6
+	REFUSED_STREAM      ErrorCode = 0x7
+	CANCEL              ErrorCode = 0x8
+	COMPRESSION_ERROR   ErrorCode = 0x9
+	CONNECT_ERROR       ErrorCode = 0xa
+	ENHANCE_YOUR_CALM   ErrorCode = 0xb
+	INADEQUATE_SECURITY ErrorCode = 0xc
+	HTTP_1_1_REQUIRED   ErrorCode = 0xd
+)
+
+type SettingID uint16
+
+const (
+	SETTINGS_HEADER_TABLE_SIZE      SettingID = 0x1
+	SETTINGS_ENABLE_PUSH            SettingID = 0x2
+	SETTINGS_MAX_CONCURRENT_STREAMS SettingID = 0x3
+	SETTINGS_INITIAL_WINDOW_SIZE    SettingID = 0x4
+	SETTINGS_MAX_FRAME_SIZE         SettingID = 0x5
+	SETTINGS_MAX_HEADER_LIST_SIZE   SettingID = 0x6
+)
+
+type setting struct {
+	id    SettingID
+	value uint32
+}
+
+type frame struct {
+	typ      FrameType
+	flags    uint8
+	streamID uint32
+	payload  []byte
+}
+
+func (f frame) has(flag uint8) bool {
+	return f.flags&flag != 0
+}
+
+// connError ends the whole connection with a GOAWAY.
+type connError struct {
+	code   ErrorCode
+	reason string
+}
+
+func (e connError) Error() string {
+	return fmt.Sprintf("http2: connection error %d: %s", e.code, e.reason)
+}
+
+// streamError resets a single stream with RST_STREAM.
+type streamError struct {
+	streamID uint32
+	code     ErrorCode
+}
+
+func (e streamError) Error() string {
+	return fmt.Sprintf("http2: stream %d error %d", e.streamID, e.code)
+}
+
+// readFrame reads the next frame from r. Its payload may be no longer than
+// maxSize, the SETTINGS_MAX_FRAME_SIZE we announced.
+func readFrame(r io.Reader, maxSize uint32) (frame, error) {
+	var header [FRAME_HEADER_LEN]byte
+
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return frame{}, err
+	}
+
+	length := uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+	if length > maxSize {
+		return frame{}, connError{FRAME_SIZE_ERROR, "frame too large"}
+	}
+
+	f := frame{
+		typ:   FrameType(header[3]),
+		flags: header[4],
+		// The reserved bit is ignored, RFC 9113 4.1.
+		streamID: binary.BigEndian.Uint32(header[5:]) & MAX_WINDOW_SIZE,
+		payload:  make([]byte, length),
+	}
+
+	_, err = io.ReadFull(r, f.payload)
+	if err != nil {
+		return frame{}, err
+	}
+
+	return f, nil
+}
+
+// appendFrame appends a frame with payload to dst.
+func appendFrame(dst []byte, typ FrameType, flags uint8, streamID uint32, payload []byte) []byte {
+	length := len(payload)
+
+	dst = append(dst, byte(length>>16), byte(length>>8), byte(length), byte(typ), flags)
+	dst = binary.BigEndian.AppendUint32(dst, streamID)
+
+	return append(dst, payload...)
+}
+
+// stripPadding removes the padding of a DATA or HEADERS frame, RFC 9113
+// 6.1.
+func stripPadding(f frame) ([]byte, error) {
+	if !f.has(FLAG_PADDED) {
+		return f.payload, nil
+	}
+
+	if len(f.payload) == 0 {
+		return nil, connError{FRAME_SIZE_ERROR, "missing pad length"}
+	}
+
+	padLen := int(f.payload[0])
+	if padLen >= len(f.payload) {
+		return nil, connError{PROTOCOL_ERROR, "padding longer than payload"}
+	}
+
+	return f.payload[1 : len(f.payload)-padLen], nil
+}
+
+func parseSettings(payload []byte) ([]setting, error) {
+	if len(payload)%6 != 0 {
+		return nil, connError{FRAME_SIZE_ERROR, "SETTINGS length not a multiple of 6"}
+	}
+
+	settings := make([]setting, 0, len(payload)/6)
+	for i := 0; i < len(payload); i += 6 {
+		settings = append(settings, setting{
+			id:    SettingID(binary.BigEndian.Uint16(payload[i:])),
+			value: binary.BigEndian.Uint32(payload[i+2:]),
+		})
+	}
+
+	return settings, nil
+}
+
+func appendSettings(dst []byte, settings []setting) []byte {
+	for _, s := range settings {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(s.id))
+		dst = binary.BigEndian.AppendUint32(dst, s.value)
+	}
+
+	return dst
+}
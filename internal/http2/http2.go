@@ -0,0 +1,191 @@
+// Package http2 serves HTTP/2 over cleartext connections (h2c), RFC 9113,
+// either from the first byte when the client knows the server speaks it,
+// or after an HTTP/1.1 request asks to upgrade. Requests and responses go
+// through request.Request and response.Writer, so handlers work the same
+// as they do over HTTP/1.1.
+package http2
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+)
+
+var ERROR_BAD_PREFACE = errors.New("http2: invalid connection preface")
+var ERROR_NOT_UPGRADE = errors.New("http2: not an h2c upgrade request")
+
+// CLIENT_PREFACE is what a client sends first on an HTTP/2 connection,
+// RFC 9113 3.4. It reads as an HTTP/1 request that no server would accept.
+const CLIENT_PREFACE = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const DEFAULT_MAX_CONCURRENT_STREAMS = 100
+const DEFAULT_INITIAL_WINDOW_SIZE = 1 << 20
+
+// DEFAULT_MAX_HEADER_BLOCK_SIZE bounds the encoded header block of a
+// request when no MaxHeaderBytes is set, so that endless CONTINUATION
+// frames can't exhaust memory.
+const DEFAULT_MAX_HEADER_BLOCK_SIZE = 1 << 20
+
+// Handler serves the requests of a connection. Each one runs in its own
+// goroutine, as requests on different streams are independent.
+type Handler func(w *response.Writer, req *request.Request)
+
+// ErrorHandler writes the response for a request that could not be
+// accepted, e.g. because its headers or body are too large.
+type ErrorHandler func(w *response.Writer, err error)
+
+type Options struct {
+	// MaxConcurrentStreams caps the requests a client may have open at
+	// once. Zero means DEFAULT_MAX_CONCURRENT_STREAMS.
+	MaxConcurrentStreams int
+
+	// InitialWindowSize is how many body bytes a client may send on a
+	// stream, and on the whole connection, before we acknowledge them.
+	// Zero means DEFAULT_INITIAL_WINDOW_SIZE.
+	InitialWindowSize int
+
+	// MaxFrameSize is the largest frame payload we accept. Zero means
+	// DEFAULT_MAX_FRAME_SIZE.
+	MaxFrameSize int
+
+	// IdleTimeout closes a connection that has had no open streams for
+	// that long. Zero means no timeout.
+	IdleTimeout time.Duration
+
+	// Request limits the headers and body of each request, as it does
+	// over HTTP/1.1.
+	Request request.Options
+
+	// ErrorHandler responds to requests that could not be accepted.
+	// Defaults to a plain text 400, or 413 or 431 for requests over a
+	// limit.
+	ErrorHandler ErrorHandler
+
+	// Logger receives connection errors. Defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+func (o Options) withDefaults() Options {
+	if o.MaxConcurrentStreams == 0 {
+		o.MaxConcurrentStreams = DEFAULT_MAX_CONCURRENT_STREAMS
+	}
+
+	if o.InitialWindowSize == 0 {
+		o.InitialWindowSize = DEFAULT_INITIAL_WINDOW_SIZE
+	}
+	o.InitialWindowSize = min(max(o.InitialWindowSize, DEFAULT_WINDOW_SIZE), MAX_WINDOW_SIZE)
+
+	if o.MaxFrameSize == 0 {
+		o.MaxFrameSize = DEFAULT_MAX_FRAME_SIZE
+	}
+	o.MaxFrameSize = min(max(o.MaxFrameSize, DEFAULT_MAX_FRAME_SIZE), MAX_FRAME_SIZE)
+
+	if o.ErrorHandler == nil {
+		o.ErrorHandler = defaultErrorHandler
+	}
+
+	if o.Logger == nil {
+		o.Logger = slog.Default()
+	}
+
+	return o
+}
+
+func defaultErrorHandler(w *response.Writer, err error) {
+	statusCode := response.STATUS_BAD_REQUEST
+
+	switch {
+	case errors.Is(err, request.ERROR_HEADERS_TOO_LARGE):
+		statusCode = response.STATUS_REQUEST_HEADER_FIELDS_TOO_LARGE
+	case errors.Is(err, request.ERROR_BODY_TOO_LARGE):
+		statusCode = response.STATUS_CONTENT_TOO_LARGE
+	case errors.Is(err, request.ERROR_UNSUPPORTED_CONTENT_ENCODING):
+		statusCode = response.STATUS_UNSUPPORTED_MEDIA_TYPE
+	}
+
+	msg := []byte(err.Error())
+
+	w.WriteStatusLine(statusCode)
+	w.WriteHeaders(response.GetDefaultHeaders(len(msg)))
+	w.WriteBody(msg)
+}
+
+// ServeConn speaks HTTP/2 on conn, whose first bytes must be the client
+// preface, until the client goes away or ctx is cancelled. Cancelling ctx
+// sends a GOAWAY and cancels the requests in flight. ServeConn closes conn
+// before it returns.
+func ServeConn(ctx context.Context, conn net.Conn, handler Handler, options Options) error {
+	sc := newServerConn(ctx, conn, handler, options)
+	return sc.serve(nil, nil)
+}
+
+// ServeUpgrade takes over conn after a 101 Switching Protocols response to
+// req, an HTTP/1.1 request that IsUpgrade accepted. req is served as
+// stream 1, as RFC 7540 3.2 describes, and the client's next bytes must be
+// the preface. ServeUpgrade closes conn before it returns.
+func ServeUpgrade(ctx context.Context, conn net.Conn, req *request.Request, handler Handler, options Options) error {
+	settings, err := upgradeSettings(req)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	sc := newServerConn(ctx, conn, handler, options)
+	return sc.serve(req, settings)
+}
+
+// IsUpgrade reports whether req asks to switch to h2c, with the
+// Upgrade, Connection and HTTP2-Settings headers RFC 7540 3.2 requires.
+func IsUpgrade(req *request.Request) bool {
+	if !hasToken(req.Headers.Get("Upgrade"), "h2c") {
+		return false
+	}
+
+	connection := req.Headers.Get("Connection")
+	if !hasToken(connection, "upgrade") || !hasToken(connection, "http2-settings") {
+		return false
+	}
+
+	_, err := upgradeSettings(req)
+	return err == nil
+}
+
+// upgradeSettings decodes the SETTINGS payload a client sends in the
+// HTTP2-Settings header of an upgrade request.
+func upgradeSettings(req *request.Request) ([]setting, error) {
+	value := req.Headers.Get("HTTP2-Settings")
+	// Headers.Set joins repeated fields with a comma, which base64url
+	// doesn't use, and there must be exactly one.
+	if strings.Contains(value, ",") {
+		return nil, ERROR_NOT_UPGRADE
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(value), "="))
+	if err != nil {
+		return nil, ERROR_NOT_UPGRADE
+	}
+
+	settings, err := parseSettings(payload)
+	if err != nil {
+		return nil, ERROR_NOT_UPGRADE
+	}
+
+	return settings, nil
+}
+
+func hasToken(value, token string) bool {
+	for _, t := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,720 @@
+package http2
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/hpack"
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+)
+
+// testClient speaks just enough HTTP/2 to drive a server connection frame
+// by frame.
+type testClient struct {
+	t       *testing.T
+	conn    net.Conn
+	encoder *hpack.Encoder
+	decoder *hpack.Decoder
+	done    chan error
+}
+
+// startConn serves one connection with handler and returns a client that
+// has sent the preface and its SETTINGS, and read the server's.
+func startConn(t *testing.T, handler Handler, options Options) *testClient {
+	t.Helper()
+
+	c := newTestClient(t, handler, options)
+	c.handshake()
+
+	return c
+}
+
+func newTestClient(t *testing.T, handler Handler, options Options) *testClient {
+	t.Helper()
+
+	if options.Logger == nil {
+		options.Logger = slog.New(slog.DiscardHandler)
+	}
+
+	server, client := tcpPipe(t)
+
+	c := &testClient{
+		t:       t,
+		conn:    client,
+		encoder: hpack.NewEncoder(hpack.DEFAULT_TABLE_SIZE),
+		decoder: hpack.NewDecoder(hpack.DEFAULT_TABLE_SIZE),
+		done:    make(chan error, 1),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		client.Close()
+		<-c.done
+	})
+
+	go func() {
+		c.done <- ServeConn(ctx, server, handler, options)
+	}()
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return c
+}
+
+// tcpPipe returns both ends of a loopback TCP connection, which unlike
+// net.Pipe buffers writes.
+func tcpPipe(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+
+	server, err := listener.Accept()
+	require.NoError(t, err)
+
+	return server, client
+}
+
+func (c *testClient) handshake() {
+	c.t.Helper()
+
+	_, err := c.conn.Write([]byte(CLIENT_PREFACE))
+	require.NoError(c.t, err)
+	c.writeFrame(FRAME_SETTINGS, 0, 0, nil)
+
+	f := c.readFrame()
+	require.Equal(c.t, FRAME_SETTINGS, f.typ)
+	require.False(c.t, f.has(FLAG_ACK))
+	c.writeFrame(FRAME_SETTINGS, FLAG_ACK, 0, nil)
+
+	f = c.readFrame()
+	require.Equal(c.t, FRAME_WINDOW_UPDATE, f.typ)
+
+	f = c.readFrame()
+	require.Equal(c.t, FRAME_SETTINGS, f.typ)
+	require.True(c.t, f.has(FLAG_ACK))
+}
+
+func (c *testClient) writeFrame(typ FrameType, flags uint8, streamID uint32, payload []byte) {
+	c.t.Helper()
+
+	_, err := c.conn.Write(appendFrame(nil, typ, flags, streamID, payload))
+	require.NoError(c.t, err)
+}
+
+func (c *testClient) readFrame() frame {
+	c.t.Helper()
+
+	f, err := readFrame(c.conn, MAX_FRAME_SIZE)
+	require.NoError(c.t, err)
+
+	return f
+}
+
+// writeRequest sends the header block of a request; pairs alternate names
+// and values.
+func (c *testClient) writeRequest(streamID uint32, endStream bool, pairs ...string) {
+	c.t.Helper()
+
+	var fields []hpack.HeaderField
+	for i := 0; i < len(pairs); i += 2 {
+		fields = append(fields, hpack.HeaderField{Name: pairs[i], Value: pairs[i+1]})
+	}
+
+	flags := FLAG_END_HEADERS
+	if endStream {
+		flags |= FLAG_END_STREAM
+	}
+
+	c.writeFrame(FRAME_HEADERS, flags, streamID, c.encoder.EncodeFields(nil, fields))
+}
+
+func (c *testClient) get(streamID uint32, path string) {
+	c.t.Helper()
+
+	c.writeRequest(streamID, true, ":method", "GET", ":scheme", "http", ":path", path, ":authority", "localhost")
+}
+
+type testResponse struct {
+	status   string
+	headers  map[string]string
+	body     string
+	trailers map[string]string
+}
+
+// readResponses reads frames until n streams have ended, and returns
+// their responses by stream ID. Other frames are skipped.
+func (c *testClient) readResponses(n int) map[uint32]*testResponse {
+	c.t.Helper()
+
+	responses := map[uint32]*testResponse{}
+	ended := 0
+
+	for ended < n {
+		f := c.readFrame()
+
+		switch f.typ {
+		case FRAME_HEADERS:
+			fields, err := c.decoder.DecodeFields(f.payload)
+			require.NoError(c.t, err)
+
+			resp := responses[f.streamID]
+			target := map[string]string{}
+			if resp == nil {
+				resp = &testResponse{headers: target}
+				responses[f.streamID] = resp
+			} else {
+				resp.trailers = target
+			}
+
+			for _, field := range fields {
+				if field.Name == ":status" {
+					resp.status = field.Value
+					continue
+				}
+				target[field.Name] = field.Value
+			}
+		case FRAME_DATA:
+			responses[f.streamID].body += string(f.payload)
+		case FRAME_RST_STREAM:
+			c.t.Fatalf("stream %d reset with %d", f.streamID, binary.BigEndian.Uint32(f.payload))
+		case FRAME_GOAWAY:
+			c.t.Fatalf("GOAWAY %d", binary.BigEndian.Uint32(f.payload[4:]))
+		default:
+			continue
+		}
+
+		if f.has(FLAG_END_STREAM) {
+			ended++
+		}
+	}
+
+	return responses
+}
+
+// expectFrame skips frames until one of type typ arrives.
+func (c *testClient) expectFrame(typ FrameType) frame {
+	c.t.Helper()
+
+	for {
+		f := c.readFrame()
+		if f.typ == typ {
+			return f
+		}
+	}
+}
+
+func (c *testClient) expectGoAway(code ErrorCode) {
+	c.t.Helper()
+
+	f := c.expectFrame(FRAME_GOAWAY)
+	assert.Equal(c.t, code, ErrorCode(binary.BigEndian.Uint32(f.payload[4:])))
+}
+
+func (c *testClient) expectReset(streamID uint32, code ErrorCode) {
+	c.t.Helper()
+
+	f := c.expectFrame(FRAME_RST_STREAM)
+	assert.Equal(c.t, streamID, f.streamID)
+	assert.Equal(c.t, code, ErrorCode(binary.BigEndian.Uint32(f.payload)))
+}
+
+func echoHandler(w *response.Writer, req *request.Request) {
+	body := req.RequestLine.Method + " " + req.RequestLine.RequestTarget + " HTTP/" + req.RequestLine.HttpVersion + "\n" +
+		"host: " + req.Headers.Get("Host") + "\n" +
+		"cookie: " + req.Headers.Get("Cookie") + "\n" +
+		"body: " + string(req.Body) + "\n"
+
+	w.WriteStatusLine(response.STATUS_OK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody([]byte(body))
+}
+
+func TestServeConn(t *testing.T) {
+	c := startConn(t, echoHandler, Options{})
+
+	// Test: GET
+	c.get(1, "/hello")
+	resp := c.readResponses(1)[1]
+	require.NotNil(t, resp)
+	assert.Equal(t, "200", resp.status)
+	assert.Equal(t, "GET /hello HTTP/2\nhost: localhost\ncookie: \nbody: \n", resp.body)
+	assert.Equal(t, "text/plain", resp.headers["content-type"])
+
+	// Test: Connection-specific headers are dropped
+	assert.NotContains(t, resp.headers, "connection")
+
+	// Test: POST with a body and split cookies
+	c.writeRequest(3, false, ":method", "POST", ":scheme", "http", ":path", "/submit", ":authority", "localhost",
+		"cookie", "a=1", "cookie", "b=2", "content-length", "11")
+	c.writeFrame(FRAME_DATA, 0, 3, []byte("hello "))
+	c.writeFrame(FRAME_DATA, FLAG_END_STREAM, 3, []byte("world"))
+	resp = c.readResponses(1)[3]
+	require.NotNil(t, resp)
+	assert.Equal(t, "POST /submit HTTP/2\nhost: localhost\ncookie: a=1; b=2\nbody: hello world\n", resp.body)
+
+	// Test: PING is answered
+	c.writeFrame(FRAME_PING, 0, 0, []byte("12345678"))
+	f := c.expectFrame(FRAME_PING)
+	assert.True(t, f.has(FLAG_ACK))
+	assert.Equal(t, "12345678", string(f.payload))
+}
+
+func TestServeConnMultiplexing(t *testing.T) {
+	release := make(chan struct{})
+
+	handler := func(w *response.Writer, req *request.Request) {
+		// The first request waits for the second, so that they have to
+		// be in flight together.
+		if req.RequestLine.RequestTarget == "/slow" {
+			<-release
+		} else {
+			close(release)
+		}
+
+		echoHandler(w, req)
+	}
+
+	c := startConn(t, handler, Options{})
+
+	// Test: Responses come back on their own streams, in any order
+	c.get(1, "/slow")
+	c.get(3, "/fast")
+	responses := c.readResponses(2)
+	assert.Contains(t, responses[1].body, "GET /slow")
+	assert.Contains(t, responses[3].body, "GET /fast")
+}
+
+func TestServeConnStreamLimit(t *testing.T) {
+	release := make(chan struct{})
+	var once sync.Once
+	t.Cleanup(func() { once.Do(func() { close(release) }) })
+
+	handler := func(w *response.Writer, req *request.Request) {
+		<-release
+		echoHandler(w, req)
+	}
+
+	c := startConn(t, handler, Options{MaxConcurrentStreams: 1})
+
+	// Test: Streams past the limit are refused
+	c.get(1, "/first")
+	c.get(3, "/second")
+	c.expectReset(3, REFUSED_STREAM)
+
+	// Test: The header block of a refused stream still counts for HPACK
+	once.Do(func() { close(release) })
+	resp := c.readResponses(1)[1]
+	assert.Contains(t, resp.body, "GET /first")
+
+	c.get(5, "/third")
+	resp = c.readResponses(1)[5]
+	assert.Contains(t, resp.body, "GET /third")
+}
+
+func TestServeConnFlowControl(t *testing.T) {
+	body := strings.Repeat("x", 100000)
+
+	handler := func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.STATUS_OK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	}
+
+	c := startConn(t, handler, Options{})
+
+	// Test: The server stops at the client's window
+	c.get(1, "/")
+	f := c.expectFrame(FRAME_HEADERS)
+	assert.False(t, f.has(FLAG_END_STREAM))
+
+	received := 0
+	for received < DEFAULT_WINDOW_SIZE {
+		f = c.expectFrame(FRAME_DATA)
+		assert.LessOrEqual(t, len(f.payload), DEFAULT_MAX_FRAME_SIZE)
+		received += len(f.payload)
+	}
+	assert.Equal(t, DEFAULT_WINDOW_SIZE, received)
+
+	c.writeFrame(FRAME_PING, 0, 0, []byte("12345678"))
+	f = c.readFrame()
+	assert.Equal(t, FRAME_PING, f.typ, "no DATA past the window")
+
+	// Test: Opening the windows lets the rest through
+	increment := binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+	c.writeFrame(FRAME_WINDOW_UPDATE, 0, 0, increment)
+	c.writeFrame(FRAME_WINDOW_UPDATE, 0, 1, increment)
+
+	for {
+		f = c.expectFrame(FRAME_DATA)
+		received += len(f.payload)
+		if f.has(FLAG_END_STREAM) {
+			break
+		}
+	}
+	assert.Equal(t, len(body), received)
+}
+
+func TestServeConnTrailers(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Checksum")
+
+		w.WriteStatusLine(response.STATUS_OK)
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("chunk: " + req.Trailers.Get("X-Sent")))
+		w.WriteChunkedBodyDone()
+
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Checksum", "abc")
+		w.WriteTrailers(trailers)
+	}
+
+	c := startConn(t, handler, Options{})
+
+	// Test: Trailers both ways, and no chunk framing
+	c.writeRequest(1, false, ":method", "POST", ":scheme", "http", ":path", "/", ":authority", "localhost")
+	c.writeFrame(FRAME_DATA, 0, 1, []byte("data"))
+	fields := c.encoder.EncodeFields(nil, []hpack.HeaderField{{Name: "x-sent", Value: "yes"}})
+	c.writeFrame(FRAME_HEADERS, FLAG_END_HEADERS|FLAG_END_STREAM, 1, fields)
+
+	resp := c.readResponses(1)[1]
+	assert.Equal(t, "chunk: yes", resp.body)
+	assert.Equal(t, map[string]string{"x-checksum": "abc"}, resp.trailers)
+	assert.NotContains(t, resp.headers, "transfer-encoding")
+}
+
+func TestServeConnLimits(t *testing.T) {
+	c := startConn(t, echoHandler, Options{Request: request.Options{MaxBodyBytes: 10}})
+
+	// Test: Bodies over the limit get a 413, and the stream is reset
+	c.writeRequest(1, false, ":method", "POST", ":scheme", "http", ":path", "/", ":authority", "localhost")
+	c.writeFrame(FRAME_DATA, 0, 1, []byte(strings.Repeat("x", 20)))
+	resp := c.readResponses(1)[1]
+	assert.Equal(t, "413", resp.status)
+	c.expectReset(1, NO_ERROR)
+
+	// Test: So do declared lengths over it
+	c.writeRequest(3, false, ":method", "POST", ":scheme", "http", ":path", "/", ":authority", "localhost",
+		"content-length", "100")
+	resp = c.readResponses(1)[3]
+	assert.Equal(t, "413", resp.status)
+	c.expectReset(3, NO_ERROR)
+
+	// Test: Requests without any host
+	c.writeRequest(5, true, ":method", "GET", ":scheme", "http", ":path", "/")
+	resp = c.readResponses(1)[5]
+	assert.Equal(t, "400", resp.status)
+}
+
+func TestServeConnHead(t *testing.T) {
+	c := startConn(t, echoHandler, Options{})
+
+	// Test: HEAD responses keep their headers but lose their body
+	c.writeRequest(1, true, ":method", "HEAD", ":scheme", "http", ":path", "/", ":authority", "localhost")
+	resp := c.readResponses(1)[1]
+	assert.Equal(t, "200", resp.status)
+	assert.NotEmpty(t, resp.headers["content-length"])
+	assert.Empty(t, resp.body)
+}
+
+func TestServeConnMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		pairs []string
+	}{
+		{"Missing method", []string{":scheme", "http", ":path", "/"}},
+		{"Missing path", []string{":method", "GET", ":scheme", "http"}},
+		{"Unknown pseudo-header", []string{":method", "GET", ":scheme", "http", ":path", "/", ":foo", "bar"}},
+		{"Pseudo-header after a field", []string{":method", "GET", ":scheme", "http", "accept", "*/*", ":path", "/"}},
+		{"Uppercase name", []string{":method", "GET", ":scheme", "http", ":path", "/", "Accept", "*/*"}},
+		{"Connection header", []string{":method", "GET", ":scheme", "http", ":path", "/", "connection", "close"}},
+		{"TE other than trailers", []string{":method", "GET", ":scheme", "http", ":path", "/", "te", "gzip"}},
+		{"CONNECT with a path", []string{":method", "CONNECT", ":authority", "example.com:443", ":path", "/"}},
+	}
+
+	c := startConn(t, echoHandler, Options{})
+
+	streamID := uint32(1)
+	for _, tt := range tests {
+		// Test: Each malformed request resets its stream only
+		c.writeRequest(streamID, true, tt.pairs...)
+		f := c.expectFrame(FRAME_RST_STREAM)
+		assert.Equal(t, streamID, f.streamID, tt.name)
+		assert.Equal(t, PROTOCOL_ERROR, ErrorCode(binary.BigEndian.Uint32(f.payload)), tt.name)
+		streamID += 2
+	}
+
+	// Test: Content-Length must match the body
+	c.writeRequest(streamID, false, ":method", "POST", ":scheme", "http", ":path", "/", ":authority", "localhost",
+		"content-length", "5")
+	c.writeFrame(FRAME_DATA, FLAG_END_STREAM, streamID, []byte("hi"))
+	c.expectReset(streamID, PROTOCOL_ERROR)
+
+	// Test: The connection is still usable
+	streamID += 2
+	c.get(streamID, "/ok")
+	resp := c.readResponses(1)[streamID]
+	assert.Equal(t, "200", resp.status)
+}
+
+func TestServeConnProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		send func(c *testClient)
+		code ErrorCode
+	}{
+		{"DATA on stream 0", func(c *testClient) { c.writeFrame(FRAME_DATA, 0, 0, []byte("x")) }, PROTOCOL_ERROR},
+		{"Even stream ID", func(c *testClient) { c.get(2, "/") }, PROTOCOL_ERROR},
+		{"Reused stream ID", func(c *testClient) {
+			c.get(1, "/")
+			c.readResponses(1)
+			c.get(1, "/")
+		}, STREAM_CLOSED},
+		{"PUSH_PROMISE", func(c *testClient) { c.writeFrame(FRAME_PUSH_PROMISE, FLAG_END_HEADERS, 1, make([]byte, 4)) }, PROTOCOL_ERROR},
+		{"Interrupted header block", func(c *testClient) {
+			c.writeFrame(FRAME_HEADERS, 0, 1, c.encoder.EncodeFields(nil, []hpack.HeaderField{{Name: ":method", Value: "GET"}}))
+			c.writeFrame(FRAME_PING, 0, 0, make([]byte, 8))
+		}, PROTOCOL_ERROR},
+		{"Stray CONTINUATION", func(c *testClient) { c.writeFrame(FRAME_CONTINUATION, FLAG_END_HEADERS, 1, nil) }, PROTOCOL_ERROR},
+		{"Short PING", func(c *testClient) { c.writeFrame(FRAME_PING, 0, 0, []byte("1234")) }, FRAME_SIZE_ERROR},
+		{"Zero window increment", func(c *testClient) { c.writeFrame(FRAME_WINDOW_UPDATE, 0, 0, make([]byte, 4)) }, PROTOCOL_ERROR},
+		{"Window overflow", func(c *testClient) {
+			c.writeFrame(FRAME_WINDOW_UPDATE, 0, 0, binary.BigEndian.AppendUint32(nil, MAX_WINDOW_SIZE))
+		}, FLOW_CONTROL_ERROR},
+		{"Bad SETTINGS_MAX_FRAME_SIZE", func(c *testClient) {
+			c.writeFrame(FRAME_SETTINGS, 0, 0, appendSettings(nil, []setting{{SETTINGS_MAX_FRAME_SIZE, 100}}))
+		}, PROTOCOL_ERROR},
+		{"Bad SETTINGS_ENABLE_PUSH", func(c *testClient) {
+			c.writeFrame(FRAME_SETTINGS, 0, 0, appendSettings(nil, []setting{{SETTINGS_ENABLE_PUSH, 2}}))
+		}, PROTOCOL_ERROR},
+		{"Frame too large", func(c *testClient) { c.writeFrame(FRAME_DATA, 0, 1, make([]byte, DEFAULT_MAX_FRAME_SIZE+1)) }, FRAME_SIZE_ERROR},
+		{"Invalid header block", func(c *testClient) { c.writeFrame(FRAME_HEADERS, FLAG_END_HEADERS, 1, []byte{0xff, 0x00}) }, COMPRESSION_ERROR},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Test: Each error ends the connection with a GOAWAY
+			c := startConn(t, echoHandler, Options{})
+			tt.send(c)
+			c.expectGoAway(tt.code)
+
+			// The server may reset the connection if it closes with our
+			// frames still unread, but it must not leave it open.
+			_, err := io.ReadAll(c.conn)
+			require.False(t, errors.Is(err, os.ErrDeadlineExceeded))
+		})
+	}
+
+	// Test: The first frame must be SETTINGS
+	c := newTestClient(t, echoHandler, Options{})
+	_, err := c.conn.Write([]byte(CLIENT_PREFACE))
+	require.NoError(t, err)
+	c.writeFrame(FRAME_PING, 0, 0, make([]byte, 8))
+	c.expectGoAway(PROTOCOL_ERROR)
+
+	// Test: Clients that don't send the preface
+	c = newTestClient(t, echoHandler, Options{})
+	_, err = c.conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	c.expectGoAway(PROTOCOL_ERROR)
+	require.ErrorIs(t, <-c.done, ERROR_BAD_PREFACE)
+	c.done <- nil
+}
+
+func TestServeConnSettings(t *testing.T) {
+	body := strings.Repeat("x", 40000)
+
+	handler := func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.STATUS_OK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	}
+
+	c := startConn(t, handler, Options{})
+
+	// Test: SETTINGS are acknowledged, and a larger frame size is used
+	c.writeFrame(FRAME_SETTINGS, 0, 0, appendSettings(nil, []setting{
+		{SETTINGS_MAX_FRAME_SIZE, 32768},
+		{SETTINGS_HEADER_TABLE_SIZE, 0},
+	}))
+	f := c.expectFrame(FRAME_SETTINGS)
+	assert.True(t, f.has(FLAG_ACK))
+
+	c.get(1, "/")
+	f = c.expectFrame(FRAME_HEADERS)
+
+	// Test: Our table size update comes first in the next block
+	assert.Equal(t, byte(0x20), f.payload[0])
+
+	f = c.expectFrame(FRAME_DATA)
+	assert.Equal(t, 32768, len(f.payload))
+}
+
+func TestServeConnShutdown(t *testing.T) {
+	started := make(chan struct{})
+
+	handler := func(w *response.Writer, req *request.Request) {
+		close(started)
+		<-req.Context().Done()
+		echoHandler(w, req)
+	}
+
+	server, client := tcpPipe(t)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- ServeConn(ctx, server, handler, Options{Logger: slog.New(slog.DiscardHandler)})
+	}()
+
+	c := &testClient{t: t, conn: client, encoder: hpack.NewEncoder(hpack.DEFAULT_TABLE_SIZE), decoder: hpack.NewDecoder(hpack.DEFAULT_TABLE_SIZE)}
+	c.handshake()
+	c.get(1, "/")
+	<-started
+
+	// Test: Cancelling the context sends a GOAWAY that covers the stream
+	// in flight, which still gets its response
+	cancel()
+
+	var goAway []byte
+	var status string
+	ended := false
+
+	// The GOAWAY and the response race each other.
+	for goAway == nil || !ended {
+		f := c.readFrame()
+
+		switch f.typ {
+		case FRAME_GOAWAY:
+			goAway = f.payload
+		case FRAME_HEADERS:
+			fields, err := c.decoder.DecodeFields(f.payload)
+			require.NoError(t, err)
+			status = fields[0].Value
+		}
+
+		if f.typ == FRAME_DATA || f.typ == FRAME_HEADERS {
+			ended = ended || f.has(FLAG_END_STREAM)
+		}
+	}
+
+	assert.Equal(t, uint32(1), binary.BigEndian.Uint32(goAway))
+	assert.Equal(t, NO_ERROR, ErrorCode(binary.BigEndian.Uint32(goAway[4:])))
+	assert.Equal(t, "200", status)
+
+	require.NoError(t, <-done)
+	_, err := io.ReadAll(client)
+	require.NoError(t, err)
+}
+
+func TestServeConnIdleTimeout(t *testing.T) {
+	c := startConn(t, echoHandler, Options{IdleTimeout: 50 * time.Millisecond})
+
+	// Test: An idle connection is closed with a GOAWAY
+	c.expectGoAway(NO_ERROR)
+	require.NoError(t, <-c.done)
+	c.done <- nil
+}
+
+func TestServeConnClientReset(t *testing.T) {
+	cancelled := make(chan struct{})
+
+	handler := func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+		close(cancelled)
+	}
+
+	c := startConn(t, handler, Options{})
+
+	// Test: RST_STREAM cancels the request context
+	c.get(1, "/")
+	c.writeFrame(FRAME_RST_STREAM, 0, 1, binary.BigEndian.AppendUint32(nil, uint32(CANCEL)))
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request context not cancelled")
+	}
+}
+
+func TestServeUpgrade(t *testing.T) {
+	server, client := tcpPipe(t)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	settings := base64.RawURLEncoding.EncodeToString(appendSettings(nil, []setting{{SETTINGS_INITIAL_WINDOW_SIZE, 27}}))
+	raw := "POST /upgrade HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\n" +
+		"Upgrade: h2c\r\nHTTP2-Settings: " + settings + "\r\nContent-Length: 4\r\n\r\nping"
+
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+
+	// Test: Recognizing upgrade requests
+	require.True(t, IsUpgrade(req))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- ServeUpgrade(context.Background(), server, req, echoHandler, Options{Logger: slog.New(slog.DiscardHandler)})
+	}()
+
+	c := &testClient{t: t, conn: client, encoder: hpack.NewEncoder(hpack.DEFAULT_TABLE_SIZE), decoder: hpack.NewDecoder(hpack.DEFAULT_TABLE_SIZE)}
+	c.handshake()
+
+	// Test: The request is answered on stream 1, within the window
+	// HTTP2-Settings set
+	f := c.expectFrame(FRAME_HEADERS)
+	require.Equal(t, uint32(1), f.streamID)
+	_, err = c.decoder.DecodeFields(f.payload)
+	require.NoError(t, err)
+
+	f = c.expectFrame(FRAME_DATA)
+	require.Equal(t, uint32(1), f.streamID)
+	assert.Equal(t, "POST /upgrade HTTP/1.1\nhost", string(f.payload))
+
+	c.writeFrame(FRAME_WINDOW_UPDATE, 0, 1, binary.BigEndian.AppendUint32(nil, 1000))
+	body := string(f.payload)
+	for !f.has(FLAG_END_STREAM) {
+		f = c.expectFrame(FRAME_DATA)
+		body += string(f.payload)
+	}
+	assert.Contains(t, body, "body: ping\n")
+
+	// Test: New streams continue from 3, with the window raised again
+	c.writeFrame(FRAME_SETTINGS, 0, 0, appendSettings(nil, []setting{{SETTINGS_INITIAL_WINDOW_SIZE, DEFAULT_WINDOW_SIZE}}))
+	c.get(3, "/next")
+	resp := c.readResponses(1)[3]
+	assert.Contains(t, resp.body, "GET /next HTTP/2")
+
+	client.Close()
+	require.NoError(t, <-done)
+
+	// Test: Requests that aren't upgrades
+	req, err = request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: h2c\r\nConnection: Upgrade\r\n\r\n"))
+	require.NoError(t, err)
+	assert.False(t, IsUpgrade(req))
+}
@@ -0,0 +1,281 @@
+package http2
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/hpack"
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+)
+
+var ERROR_STREAM_RESET = errors.New("http2: stream reset")
+var ERROR_CONN_CLOSED = errors.New("http2: connection closed")
+
+type streamState string
+
+// A stream is idle until its HEADERS arrive, and half closed once one side
+// has sent END_STREAM, RFC 9113 5.1. We only answer requests, so streams
+// never go through the reserved states.
+const (
+	STATE_OPEN               streamState = "open"
+	STATE_HALF_CLOSED_REMOTE streamState = "half closed (remote)"
+	STATE_HALF_CLOSED_LOCAL  streamState = "half closed (local)"
+	STATE_CLOSED             streamState = "closed"
+)
+
+// connectionHeaders are the fields HTTP/2 leaves to its framing, RFC 9113
+// 8.2.2. Requests must not carry them, and they are dropped from responses.
+var connectionHeaders = []string{"connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade"}
+
+// A stream carries one request and its response. The read loop fills in
+// the request; the handler goroutine writes the response through the
+// response.Framer methods.
+type stream struct {
+	sc     *serverConn
+	id     uint32
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Guarded by sc.mu.
+	state      streamState
+	sendWindow int64
+
+	// Owned by the read loop until the handler starts.
+	requestLine   request.RequestLine
+	header        headers.Headers
+	head          bool
+	fields        []hpack.HeaderField
+	headerBytes   int
+	body          []byte
+	contentLength int
+	recvWindow    int
+	recvUnacked   int
+	// rejected is set once the request has been answered without its
+	// body, which is then thrown away.
+	rejected bool
+
+	// Owned by the handler goroutine.
+	noBody   bool
+	headSent bool
+}
+
+// closeRemote records that the client has sent END_STREAM. Call it with
+// sc.mu held.
+func (st *stream) closeRemote() {
+	switch st.state {
+	case STATE_OPEN:
+		st.state = STATE_HALF_CLOSED_REMOTE
+	case STATE_HALF_CLOSED_LOCAL:
+		st.state = STATE_CLOSED
+	}
+}
+
+// closeLocal records that we have sent END_STREAM. Call it with sc.mu
+// held.
+func (st *stream) closeLocal() {
+	switch st.state {
+	case STATE_OPEN:
+		st.state = STATE_HALF_CLOSED_LOCAL
+	case STATE_HALF_CLOSED_REMOTE:
+		st.state = STATE_CLOSED
+	}
+}
+
+func (st *stream) WriteHead(statusCode response.StatusCode, h headers.Headers) error {
+	if st.headSent {
+		return response.ERROR_WRONG_WRITE_ORDER
+	}
+	st.headSent = true
+
+	// HEAD responses and these statuses have no content, RFC 9110 6.4.1,
+	// whatever the handler writes.
+	st.noBody = st.head || statusCode == response.STATUS_NOT_MODIFIED || statusCode == 204 || statusCode < 200
+
+	fields := []hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(int(statusCode))}}
+	fields = appendHeaderFields(fields, h)
+
+	return st.sc.writeHeaders(st, fields, false)
+}
+
+func (st *stream) Write(p []byte) (int, error) {
+	if st.noBody {
+		return len(p), nil
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n, err := st.sc.awaitWindow(st, len(p))
+		if err != nil {
+			return written, err
+		}
+
+		err = st.sc.writeData(st, p[:n], false)
+		if err != nil {
+			return written, err
+		}
+
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+func (st *stream) End(trailers headers.Headers) error {
+	if len(trailers) > 0 && !st.noBody {
+		return st.sc.writeHeaders(st, appendHeaderFields(nil, trailers), true)
+	}
+
+	return st.sc.writeData(st, nil, true)
+}
+
+func (st *stream) Reset() {
+	if st.sc.removeStream(st.id) {
+		st.sc.writeFrame(FRAME_RST_STREAM, 0, st.id, binary.BigEndian.AppendUint32(nil, uint32(INTERNAL_ERROR)))
+	}
+}
+
+// appendHeaderFields appends the fields of h, leaving out those HTTP/2
+// doesn't allow.
+func appendHeaderFields(fields []hpack.HeaderField, h headers.Headers) []hpack.HeaderField {
+	for name := range h {
+		values := h.Values(name)
+
+		name = strings.ToLower(name)
+		if isConnectionHeader(name) {
+			continue
+		}
+
+		for _, value := range values {
+			fields = append(fields, hpack.HeaderField{Name: name, Value: value, Sensitive: hpack.IsSensitive(name)})
+		}
+	}
+
+	return fields
+}
+
+func isConnectionHeader(name string) bool {
+	for _, h := range connectionHeaders {
+		if name == h {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newRequest checks the fields of a request header block and turns them
+// into a request line and headers, RFC 9113 8.3.1. Malformed requests are
+// a stream error.
+func (st *stream) newRequest() (request.RequestLine, headers.Headers, error) {
+	var rl request.RequestLine
+	var scheme, authority string
+	h := headers.NewHeaders()
+	seen := map[string]bool{}
+	pseudoDone := false
+
+	malformed := streamError{st.id, PROTOCOL_ERROR}
+
+	for _, f := range st.fields {
+		if strings.HasPrefix(f.Name, ":") {
+			if pseudoDone || seen[f.Name] {
+				return rl, nil, malformed
+			}
+			seen[f.Name] = true
+
+			switch f.Name {
+			case ":method":
+				rl.Method = f.Value
+			case ":scheme":
+				scheme = f.Value
+			case ":authority":
+				authority = f.Value
+			case ":path":
+				rl.RequestTarget = f.Value
+			default:
+				return rl, nil, malformed
+			}
+			continue
+		}
+		pseudoDone = true
+
+		if !validFieldName(f.Name) || isConnectionHeader(f.Name) {
+			return rl, nil, malformed
+		}
+
+		if f.Name == "te" && f.Value != "trailers" {
+			return rl, nil, malformed
+		}
+
+		// Cookies may be split into several fields to compress better,
+		// RFC 9113 8.2.3, which Set joins back together.
+		h.Set(f.Name, f.Value)
+	}
+
+	if rl.Method == "" {
+		return rl, nil, malformed
+	}
+
+	if rl.Method == "CONNECT" {
+		if scheme != "" || rl.RequestTarget != "" || authority == "" {
+			return rl, nil, malformed
+		}
+		rl.RequestTarget = authority
+	} else if scheme == "" || rl.RequestTarget == "" {
+		return rl, nil, malformed
+	}
+
+	// :authority takes the place of Host, RFC 9113 8.3.1.
+	if authority != "" {
+		h.Replace("host", authority)
+	}
+
+	if cl := h.Get("content-length"); cl != "" {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n < 0 {
+			return rl, nil, malformed
+		}
+		st.contentLength = n
+	}
+
+	rl.HttpVersion = "2"
+
+	return rl, h, nil
+}
+
+// trailers checks the fields of a trailer block, which may not contain
+// pseudo-headers.
+func (st *stream) trailers() (headers.Headers, error) {
+	h := headers.NewHeaders()
+
+	for _, f := range st.fields {
+		if strings.HasPrefix(f.Name, ":") || !validFieldName(f.Name) {
+			return nil, streamError{st.id, PROTOCOL_ERROR}
+		}
+
+		h.Set(f.Name, f.Value)
+	}
+
+	return h, nil
+}
+
+// validFieldName reports whether name is a token in lowercase, as HTTP/2
+// requires, RFC 9113 8.2.1.
+func validFieldName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, c := range []byte(name) {
+		if c >= 'A' && c <= 'Z' || c <= ' ' || c >= 0x7F || strings.IndexByte("\"(),/:;<=>?@[\\]{}", c) >= 0 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,294 @@
+// Package metrics implements counters, gauges and histograms, and exposes
+// them in the Prometheus text format (version 0.0.4).
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+)
+
+const CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// DEFAULT_BUCKETS suit request latencies measured in seconds.
+var DEFAULT_BUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metricType string
+
+const (
+	COUNTER   metricType = "counter"
+	GAUGE     metricType = "gauge"
+	HISTOGRAM metricType = "histogram"
+)
+
+// labelSeparator can't appear in valid UTF-8, so it safely joins label
+// values into a map key.
+const labelSeparator = "\xff"
+
+// family is a metric name with all of its labelled series.
+type family struct {
+	name       string
+	help       string
+	typ        metricType
+	labelNames []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// Histograms only: counts[i] is the number of observations that fell
+	// into buckets[i], i.e. not cumulative.
+	counts []uint64
+	count  uint64
+}
+
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", f.name, len(labelValues), len(f.labelNames)))
+	}
+
+	key := strings.Join(labelValues, labelSeparator)
+
+	s, found := f.series[key]
+	if !found {
+		s = &series{labelValues: slices.Clone(labelValues)}
+		if f.typ == HISTOGRAM {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+
+	return s
+}
+
+func (f *family) add(v float64, labelValues []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.get(labelValues).value += v
+}
+
+func (f *family) set(v float64, labelValues []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.get(labelValues).value = v
+}
+
+type Counter struct{ f *family }
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.f.add(1, labelValues)
+}
+
+// Add increases the counter by v, which must not be negative.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic("metrics: counters can't decrease")
+	}
+
+	c.f.add(v, labelValues)
+}
+
+type Gauge struct{ f *family }
+
+func (g *Gauge) Inc(labelValues ...string) {
+	g.f.add(1, labelValues)
+}
+
+func (g *Gauge) Dec(labelValues ...string) {
+	g.f.add(-1, labelValues)
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.f.add(v, labelValues)
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.f.set(v, labelValues)
+}
+
+type Histogram struct{ f *family }
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+
+	s := h.f.get(labelValues)
+	s.value += v
+	s.count++
+
+	if i, _ := slices.BinarySearch(h.f.buckets, v); i < len(s.counts) {
+		s.counts[i]++
+	}
+}
+
+// Registry holds metric families and renders them.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(name, help string, typ metricType, buckets []float64, labelNames []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, f := range r.families {
+		if f.name == name {
+			panic("metrics: duplicate metric " + name)
+		}
+	}
+
+	f := &family{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     map[string]*series{},
+	}
+	r.families = append(r.families, f)
+
+	return f
+}
+
+func (r *Registry) NewCounter(name, help string, labelNames ...string) *Counter {
+	return &Counter{r.register(name, help, COUNTER, nil, labelNames)}
+}
+
+func (r *Registry) NewGauge(name, help string, labelNames ...string) *Gauge {
+	return &Gauge{r.register(name, help, GAUGE, nil, labelNames)}
+}
+
+// NewHistogram registers a histogram with the given upper bucket bounds.
+// A nil buckets means DEFAULT_BUCKETS.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	if buckets == nil {
+		buckets = DEFAULT_BUCKETS
+	}
+
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+
+	return &Histogram{r.register(name, help, HISTOGRAM, buckets, labelNames)}
+}
+
+// WriteText writes every metric in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	families := slices.Clone(r.families)
+	r.mu.Unlock()
+
+	var b bytes.Buffer
+	for _, f := range families {
+		f.writeText(&b)
+	}
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func (f *family) writeText(b *bytes.Buffer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.typ)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+
+		if f.typ != HISTOGRAM {
+			writeSample(b, f.name, f.labelNames, s.labelValues, "", "", s.value)
+			continue
+		}
+
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += s.counts[i]
+			writeSample(b, f.name+"_bucket", f.labelNames, s.labelValues, "le", formatFloat(bound), float64(cumulative))
+		}
+		writeSample(b, f.name+"_bucket", f.labelNames, s.labelValues, "le", "+Inf", float64(s.count))
+		writeSample(b, f.name+"_sum", f.labelNames, s.labelValues, "", "", s.value)
+		writeSample(b, f.name+"_count", f.labelNames, s.labelValues, "", "", float64(s.count))
+	}
+}
+
+func writeSample(b *bytes.Buffer, name string, labelNames, labelValues []string, extraName, extraValue string, v float64) {
+	b.WriteString(name)
+
+	if len(labelNames) > 0 || extraName != "" {
+		pairs := []string{}
+		for i, n := range labelNames {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", n, escapeLabelValue(labelValues[i])))
+		}
+		if extraName != "" {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extraName, extraValue))
+		}
+
+		b.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+
+	b.WriteString(" " + formatFloat(v) + "\n")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueReplacer.Replace(s)
+}
+
+// Handler serves the registry's metrics, typically mounted at /metrics.
+func (r *Registry) Handler() func(w *response.Writer, req *request.Request) {
+	return func(w *response.Writer, req *request.Request) {
+		var b bytes.Buffer
+		r.WriteText(&b)
+
+		h := response.GetDefaultHeaders(b.Len())
+		h.Replace("Content-Type", CONTENT_TYPE)
+
+		w.WriteStatusLine(response.STATUS_OK)
+		w.WriteHeaders(h)
+		w.WriteBody(b.Bytes())
+	}
+}
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+
+	requests := r.NewCounter("requests_total", "Requests served.", "method", "status")
+	requests.Inc("GET", "200")
+	requests.Inc("GET", "200")
+	requests.Add(3, "POST", "500")
+
+	inFlight := r.NewGauge("in_flight", "Requests in flight.\nNow.")
+	inFlight.Inc()
+	inFlight.Inc()
+	inFlight.Dec()
+
+	latency := r.NewHistogram("latency_seconds", "Latency.", []float64{0.5, 0.1, 1})
+	latency.Observe(0.05)
+	latency.Observe(0.1)
+	latency.Observe(0.7)
+	latency.Observe(3)
+
+	escaped := r.NewCounter("escaped_total", "Escaping.", "path")
+	escaped.Inc("a\"b\\c\nd")
+
+	var b bytes.Buffer
+	require.NoError(t, r.WriteText(&b))
+
+	expected := `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{method="GET",status="200"} 2
+requests_total{method="POST",status="500"} 3
+# HELP in_flight Requests in flight.\nNow.
+# TYPE in_flight gauge
+in_flight 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="0.5"} 2
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum 3.85
+latency_seconds_count 4
+# HELP escaped_total Escaping.
+# TYPE escaped_total counter
+escaped_total{path="a\"b\\c\nd"} 1
+`
+	assert.Equal(t, expected, b.String())
+
+	// Test: Wrong number of label values
+	assert.Panics(t, func() { requests.Inc("GET") })
+
+	// Test: Duplicate names
+	assert.Panics(t, func() { r.NewGauge("in_flight", "again") })
+
+	// Test: Counters only go up
+	assert.Panics(t, func() { requests.Add(-1, "GET", "200") })
+}
@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"httpffomtcp.pinglu.dev/internal/client"
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/request"
+)
+
+var ERROR_NO_BACKENDS = errors.New("no healthy backends")
+var ERROR_UNHEALTHY_STATUS = errors.New("health check failed with status")
+
+const HEALTH_CHECK_USER_AGENT = "httpfromtcp-health-check"
+
+// Strategy decides which backend of a pool gets a request.
+type Strategy string
+
+const (
+	ROUND_ROBIN       Strategy = "round robin"
+	LEAST_CONNECTIONS Strategy = "least connections"
+	// CONSISTENT_HASH sends requests with the same key to the same backend,
+	// for as long as it is available. The key is Options.HashHeader, or the
+	// client IP.
+	CONSISTENT_HASH Strategy = "consistent hash"
+)
+
+// HASH_RING_REPLICAS is the number of points each backend gets on the hash
+// ring. More points spread the keys more evenly.
+const HASH_RING_REPLICAS = 128
+
+type backend struct {
+	url *url.URL
+
+	activeConns atomic.Int64
+	// healthy is the verdict of the last active health check.
+	healthy atomic.Bool
+	// fails counts consecutive failed requests, for passive ejection.
+	fails atomic.Int64
+	// ejectedUntil is a UnixNano time, zero if not ejected.
+	ejectedUntil atomic.Int64
+}
+
+func newBackend(u *url.URL) *backend {
+	b := &backend{url: u}
+	b.healthy.Store(true)
+
+	return b
+}
+
+func (b *backend) available(now time.Time) bool {
+	return b.healthy.Load() && now.UnixNano() >= b.ejectedUntil.Load()
+}
+
+// succeeded and failed feed passive health checking: maxFails failures in a
+// row eject the backend for ejectFor.
+func (b *backend) succeeded() {
+	b.fails.Store(0)
+}
+
+func (b *backend) failed(maxFails int, ejectFor time.Duration) {
+	if b.fails.Add(1) < int64(maxFails) {
+		return
+	}
+
+	b.fails.Store(0)
+	b.ejectedUntil.Store(time.Now().Add(ejectFor).UnixNano())
+}
+
+type ringPoint struct {
+	hash    uint64
+	backend *backend
+}
+
+type pool struct {
+	backends []*backend
+	strategy Strategy
+	// hashHeader names the header that keys CONSISTENT_HASH.
+	hashHeader string
+	next       atomic.Uint64
+	ring       []ringPoint
+}
+
+func newPool(backends []*backend, strategy Strategy, hashHeader string) *pool {
+	p := &pool{backends: backends, strategy: strategy, hashHeader: hashHeader}
+
+	if strategy == CONSISTENT_HASH {
+		for _, b := range backends {
+			for i := range HASH_RING_REPLICAS {
+				p.ring = append(p.ring, ringPoint{hash: hashKey(b.url.String() + "#" + strconv.Itoa(i)), backend: b})
+			}
+		}
+
+		slices.SortFunc(p.ring, func(a, b ringPoint) int {
+			return cmp.Compare(a.hash, b.hash)
+		})
+	}
+
+	return p
+}
+
+// pick returns the backend for req, preferring ones not in tried, or nil
+// if none is available.
+func (p *pool) pick(req *request.Request, tried []*backend) *backend {
+	now := time.Now()
+
+	candidates := p.candidates(now, tried)
+	if len(candidates) == 0 {
+		// Better to try a backend again than to give up.
+		candidates = p.candidates(now, nil)
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch p.strategy {
+	case LEAST_CONNECTIONS:
+		return p.pickLeastConnections(candidates)
+	case CONSISTENT_HASH:
+		return p.pickConsistentHash(req, candidates)
+	default:
+		return candidates[p.next.Add(1)%uint64(len(candidates))]
+	}
+}
+
+func (p *pool) candidates(now time.Time, exclude []*backend) []*backend {
+	var candidates []*backend
+
+	for _, b := range p.backends {
+		if b.available(now) && !slices.Contains(exclude, b) {
+			candidates = append(candidates, b)
+		}
+	}
+
+	return candidates
+}
+
+func (p *pool) pickLeastConnections(candidates []*backend) *backend {
+	var least []*backend
+	leastConns := int64(-1)
+
+	for _, b := range candidates {
+		conns := b.activeConns.Load()
+		switch {
+		case leastConns == -1 || conns < leastConns:
+			least = []*backend{b}
+			leastConns = conns
+		case conns == leastConns:
+			least = append(least, b)
+		}
+	}
+
+	// Take turns between backends that are tied.
+	return least[p.next.Add(1)%uint64(len(least))]
+}
+
+func (p *pool) pickConsistentHash(req *request.Request, candidates []*backend) *backend {
+	key := ""
+	if p.hashHeader != "" {
+		key = req.Headers.Get(p.hashHeader)
+	}
+
+	if key == "" {
+		key = clientIP(req.RemoteAddr)
+	}
+
+	h := hashKey(key)
+	start, _ := slices.BinarySearchFunc(p.ring, h, func(point ringPoint, h uint64) int {
+		return cmp.Compare(point.hash, h)
+	})
+
+	// Walk the ring clockwise to the first backend that can take it.
+	for i := range p.ring {
+		b := p.ring[(start+i)%len(p.ring)].backend
+		if slices.Contains(candidates, b) {
+			return b
+		}
+	}
+
+	return candidates[0]
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+
+	return h.Sum64()
+}
+
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+
+	return host
+}
+
+// healthCheck probes every backend each HealthCheckInterval until ctx is
+// done.
+func (p *ReverseProxy) healthCheck(ctx context.Context) {
+	ticker := time.NewTicker(p.options.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, b := range p.pool.backends {
+			go p.probe(ctx, b)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe marks b healthy if a GET for HealthCheckPath gets a 2xx or 3xx.
+func (p *ReverseProxy) probe(ctx context.Context, b *backend) {
+	ctx, cancel := context.WithTimeout(ctx, p.options.HealthCheckTimeout)
+	defer cancel()
+
+	err := p.probeErr(ctx, b)
+	if errors.Is(ctx.Err(), context.Canceled) {
+		// The proxy is closing; that says nothing about b.
+		return
+	}
+
+	healthy := err == nil
+	if b.healthy.Swap(healthy) != healthy {
+		p.options.Logger.Info("proxy: backend health changed", "backend", b.url.String(), "healthy", healthy, "err", err)
+	}
+}
+
+func (p *ReverseProxy) probeErr(ctx context.Context, b *backend) error {
+	u, err := url.ParseRequestURI(p.options.HealthCheckPath)
+	if err != nil {
+		return err
+	}
+	u.Scheme = b.url.Scheme
+	u.Host = b.url.Host
+
+	resp, err := p.client.Do(ctx, &client.Request{
+		Method:  "GET",
+		URL:     u,
+		Headers: headers.Headers{"user-agent": HEALTH_CHECK_USER_AGENT},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Drain the body so the connection can be reused.
+	_, err = io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("%w: %d", ERROR_UNHEALTHY_STATUS, resp.StatusCode)
+	}
+
+	return nil
+}
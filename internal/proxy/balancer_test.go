@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+)
+
+// startNamedUpstream starts a backend that answers with its name, and with
+// a 503 on /healthz while unhealthy is set.
+func startNamedUpstream(t *testing.T, name string, unhealthy *atomic.Bool) string {
+	t.Helper()
+
+	return startUpstream(t, func(w *response.Writer, req *request.Request) {
+		statusCode := response.STATUS_OK
+		if req.RequestLine.RequestTarget == "/healthz" && unhealthy != nil && unhealthy.Load() {
+			statusCode = response.STATUS_SERVICE_UNAVAILABLE
+		}
+
+		w.WriteStatusLine(statusCode)
+		w.WriteHeaders(response.GetDefaultHeaders(len(name)))
+		w.WriteBody([]byte(name))
+	})
+}
+
+// deadUpstream returns the URL of a port nobody listens on.
+func deadUpstream(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+
+	return "http://" + addr
+}
+
+func newBalancedProxy(t *testing.T, targets []string, options Options) *ReverseProxy {
+	t.Helper()
+
+	if options.Logger == nil {
+		options.Logger = slog.New(slog.DiscardHandler)
+	}
+
+	p, err := NewBalanced(targets, options)
+	require.NoError(t, err)
+	t.Cleanup(func() { p.Close() })
+
+	return p
+}
+
+// backendName returns the body of a proxied response, i.e. the name of the
+// backend that served it.
+func backendName(t *testing.T, p *ReverseProxy, data string) string {
+	t.Helper()
+
+	resp := do(t, p, data)
+	_, body, _ := strings.Cut(resp, "\r\n\r\n")
+
+	return body
+}
+
+func newTestRequest(t *testing.T, data string) *request.Request {
+	t.Helper()
+
+	req, err := request.RequestFromReader(strings.NewReader(data))
+	require.NoError(t, err)
+	req.RemoteAddr = "192.0.2.1:1234"
+
+	return req
+}
+
+func TestRoundRobin(t *testing.T) {
+	targets := []string{
+		startNamedUpstream(t, "a", nil),
+		startNamedUpstream(t, "b", nil),
+		startNamedUpstream(t, "c", nil),
+	}
+	p := newBalancedProxy(t, targets, Options{})
+
+	// Test: Requests are spread evenly
+	counts := map[string]int{}
+	for range 9 {
+		counts[backendName(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")]++
+	}
+	assert.Equal(t, map[string]int{"a": 3, "b": 3, "c": 3}, counts)
+
+	// Test: No targets
+	_, err := NewBalanced(nil, Options{})
+	require.ErrorIs(t, err, ERROR_INVALID_TARGET)
+}
+
+func TestLeastConnections(t *testing.T) {
+	p := newBalancedProxy(t, []string{"http://a", "http://b", "http://c"}, Options{Strategy: LEAST_CONNECTIONS})
+	a, b, c := p.pool.backends[0], p.pool.backends[1], p.pool.backends[2]
+	req := newTestRequest(t, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	// Test: The backend with the fewest active connections wins
+	a.activeConns.Store(3)
+	b.activeConns.Store(1)
+	c.activeConns.Store(2)
+	for range 5 {
+		assert.Equal(t, b, p.pool.pick(req, nil))
+	}
+
+	// Test: Ties are shared out
+	b.activeConns.Store(2)
+	picked := map[*backend]int{}
+	for range 10 {
+		picked[p.pool.pick(req, nil)]++
+	}
+	assert.Equal(t, 0, picked[a])
+	assert.Equal(t, 5, picked[b])
+	assert.Equal(t, 5, picked[c])
+
+	// Test: Backends already tried are skipped
+	assert.Equal(t, c, p.pool.pick(req, []*backend{b}))
+}
+
+func TestConsistentHash(t *testing.T) {
+	targets := []string{"http://a", "http://b", "http://c", "http://d"}
+	p := newBalancedProxy(t, targets, Options{Strategy: CONSISTENT_HASH, HashHeader: "X-User"})
+
+	pickFor := func(user string) *backend {
+		return p.pool.pick(newTestRequest(t, "GET / HTTP/1.1\r\nHost: example.com\r\nX-User: "+user+"\r\n\r\n"), nil)
+	}
+
+	// Test: The same key always gets the same backend
+	users := []string{"alice", "bob", "carol", "dave", "erin", "frank", "grace", "heidi", "ivan", "judy"}
+	assignment := map[string]*backend{}
+	used := map[*backend]bool{}
+	for _, user := range users {
+		assignment[user] = pickFor(user)
+		used[assignment[user]] = true
+		for range 3 {
+			assert.Equal(t, assignment[user], pickFor(user))
+		}
+	}
+	assert.Greater(t, len(used), 1)
+
+	// Test: Ejecting a backend only moves its own keys
+	ejected := assignment["alice"]
+	ejected.ejectedUntil.Store(time.Now().Add(time.Hour).UnixNano())
+	for _, user := range users {
+		if assignment[user] == ejected {
+			assert.NotEqual(t, ejected, pickFor(user))
+		} else {
+			assert.Equal(t, assignment[user], pickFor(user))
+		}
+	}
+
+	// Test: Without the header the client IP is the key
+	req := newTestRequest(t, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	first := p.pool.pick(req, nil)
+	assert.Equal(t, first, p.pool.pick(req, nil))
+}
+
+func TestRetriesAndEjection(t *testing.T) {
+	dead := deadUpstream(t)
+	live := startNamedUpstream(t, "live", nil)
+
+	// Test: Idempotent requests are retried on another backend
+	p := newBalancedProxy(t, []string{dead, live}, Options{MaxFails: 100, RetryBackoff: time.Millisecond})
+	for range 4 {
+		assert.Equal(t, "live", backendName(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	}
+
+	// Test: Other requests are not
+	badGateways := 0
+	for range 4 {
+		resp := do(t, p, "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 2\r\n\r\nhi")
+		if strings.HasPrefix(resp, "HTTP/1.1 502 Bad Gateway\r\n") {
+			badGateways++
+		}
+	}
+	assert.Equal(t, 2, badGateways)
+
+	// Test: Consecutive failures eject a backend
+	p = newBalancedProxy(t, []string{dead, live}, Options{MaxFails: 2, MaxRetries: -1, EjectDuration: time.Hour})
+	for range 4 {
+		do(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	}
+	assert.Greater(t, p.pool.backends[0].ejectedUntil.Load(), time.Now().UnixNano())
+	for range 4 {
+		assert.Equal(t, "live", backendName(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	}
+
+	// Test: No backend left
+	p = newBalancedProxy(t, []string{dead}, Options{MaxFails: 1, MaxRetries: -1, EjectDuration: time.Hour})
+	do(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	resp := do(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 502 Bad Gateway\r\n"))
+}
+
+func TestActiveHealthChecks(t *testing.T) {
+	var unhealthy atomic.Bool
+	targets := []string{
+		startNamedUpstream(t, "flaky", &unhealthy),
+		startNamedUpstream(t, "steady", nil),
+	}
+	p := newBalancedProxy(t, targets, Options{
+		HealthCheckPath:     "/healthz",
+		HealthCheckInterval: 10 * time.Millisecond,
+	})
+	flaky := p.pool.backends[0]
+
+	// Test: A failing health check takes the backend out
+	unhealthy.Store(true)
+	require.Eventually(t, func() bool { return !flaky.healthy.Load() }, 5*time.Second, 5*time.Millisecond)
+	for range 4 {
+		assert.Equal(t, "steady", backendName(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	}
+
+	// Test: And a passing one brings it back
+	unhealthy.Store(false)
+	require.Eventually(t, func() bool { return flaky.healthy.Load() }, 5*time.Second, 5*time.Millisecond)
+	names := map[string]bool{}
+	for range 4 {
+		names[backendName(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")] = true
+	}
+	assert.Equal(t, map[string]bool{"flaky": true, "steady": true}, names)
+}
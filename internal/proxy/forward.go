@@ -0,0 +1,412 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"httpffomtcp.pinglu.dev/internal/client"
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+	"httpffomtcp.pinglu.dev/internal/server"
+)
+
+var ERROR_DESTINATION_NOT_ALLOWED = errors.New("destination not allowed")
+var ERROR_INVALID_RULE = errors.New("invalid destination rule")
+
+const DEFAULT_PROXY_REALM = "proxy"
+
+type ForwardOptions struct {
+	// Allow and Deny list the destinations clients may and may not reach.
+	// An entry is a host name, "*.example.com" for any subdomain, an IP
+	// address or a CIDR prefix, optionally followed by ":port". Deny wins;
+	// an empty Allow allows everything not denied. Besides the name the
+	// client asked for, the address actually connected to is checked, so
+	// that a name can't be used to reach a denied network.
+	Allow []string
+	Deny  []string
+
+	// Authenticate checks the Basic credentials in Proxy-Authorization.
+	// Clients without valid ones get a 407. Nil lets everyone through.
+	Authenticate func(user, password string) bool
+	// Realm goes into the Proxy-Authenticate challenge. Empty means
+	// DEFAULT_PROXY_REALM.
+	Realm string
+
+	// DialTimeout bounds connecting to a destination. Zero means
+	// DEFAULT_DIAL_TIMEOUT.
+	DialTimeout time.Duration
+
+	// Dial opens connections to destinations. Defaults to a net.Dialer.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Logger receives upstream errors. Defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+func (o ForwardOptions) withDefaults() ForwardOptions {
+	if o.Realm == "" {
+		o.Realm = DEFAULT_PROXY_REALM
+	}
+
+	if o.DialTimeout == 0 {
+		o.DialTimeout = DEFAULT_DIAL_TIMEOUT
+	}
+
+	if o.Dial == nil {
+		var dialer net.Dialer
+		o.Dial = dialer.DialContext
+	}
+
+	if o.Logger == nil {
+		o.Logger = slog.Default()
+	}
+
+	return o
+}
+
+// ForwardProxy is a proxy clients configure themselves to use. It tunnels
+// CONNECT requests, which is how clients reach https URLs through it, and
+// forwards plain http requests whose target is an absolute URL.
+type ForwardProxy struct {
+	client  *client.Client
+	options ForwardOptions
+	allow   []rule
+	deny    []rule
+}
+
+// NewForward returns a forward proxy. It fails if an entry of Allow or Deny
+// can't be parsed.
+func NewForward(options ForwardOptions) (*ForwardProxy, error) {
+	options = options.withDefaults()
+
+	allow, err := parseRules(options.Allow)
+	if err != nil {
+		return nil, err
+	}
+
+	deny, err := parseRules(options.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ForwardProxy{
+		options: options,
+		allow:   allow,
+		deny:    deny,
+	}
+
+	p.client = client.New(client.Options{
+		Dial:        p.dial,
+		DialTimeout: options.DialTimeout,
+	})
+
+	return p, nil
+}
+
+// Close closes idle upstream connections.
+func (p *ForwardProxy) Close() error {
+	return p.client.Close()
+}
+
+func (p *ForwardProxy) Handle(w *response.Writer, req *request.Request) {
+	if !p.authorized(req) {
+		msg := []byte("proxy authentication required")
+
+		h := response.GetDefaultHeaders(len(msg))
+		h.Set("Proxy-Authenticate", "Basic realm="+strconv.Quote(p.options.Realm))
+
+		w.WriteStatusLine(response.STATUS_PROXY_AUTH_REQUIRED)
+		w.WriteHeaders(h)
+		w.WriteBody(msg)
+		return
+	}
+
+	if req.RequestLine.Method == "CONNECT" {
+		p.tunnel(w, req)
+		return
+	}
+
+	p.forward(w, req)
+}
+
+func (p *ForwardProxy) authorized(req *request.Request) bool {
+	if p.options.Authenticate == nil {
+		return true
+	}
+
+	scheme, credentials, _ := strings.Cut(req.Headers.Get("Proxy-Authorization"), " ")
+	if !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return false
+	}
+
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return false
+	}
+
+	return p.options.Authenticate(user, password)
+}
+
+// tunnel connects to the host:port in the target of a CONNECT request and
+// copies bytes both ways until either side is done, RFC 9110 9.3.6.
+func (p *ForwardProxy) tunnel(w *response.Writer, req *request.Request) {
+	ctx := req.Context()
+	target := req.RequestLine.RequestTarget
+
+	_, port, err := net.SplitHostPort(target)
+	if err != nil || port == "" {
+		p.writeError(w, fmt.Errorf("%w: %s", ERROR_INVALID_TARGET, target))
+		return
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, p.options.DialTimeout)
+	upstream, err := p.dial(dialCtx, "tcp", target)
+	cancel()
+	if err != nil {
+		p.writeError(w, contextError(ctx, err))
+		return
+	}
+	defer upstream.Close()
+
+	// A 2xx to CONNECT has no body, so no framing headers either.
+	w.WriteStatusLine(response.STATUS_OK)
+	w.WriteHeaders(headers.NewHeaders())
+
+	conn, buffered, err := server.Hijack(req)
+	if err != nil {
+		p.options.Logger.Error("proxy: can't tunnel", "err", err)
+		w.Abort()
+		return
+	}
+	defer conn.Close()
+
+	// Once hijacked, the request context is only cancelled when the server
+	// shuts down, so a tunnel lasts as long as both ends want it to.
+	// Closing both ends stops the copying.
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+		upstream.Close()
+	})
+	defer stop()
+
+	if len(buffered) > 0 {
+		_, err = upstream.Write(buffered)
+		if err != nil {
+			return
+		}
+	}
+
+	done := make(chan struct{}, 2)
+	go pipe(upstream, conn, done)
+	go pipe(conn, upstream, done)
+	<-done
+	<-done
+}
+
+// pipe copies src to dst, then passes the end of the stream on to dst.
+func pipe(dst, src net.Conn, done chan<- struct{}) {
+	io.Copy(dst, src)
+
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		// Without half-close, the other direction has to end too.
+		dst.Close()
+		src.Close()
+	}
+
+	done <- struct{}{}
+}
+
+// forward sends a request with an absolute-form target, RFC 9112 3.2.2, on
+// to its origin server.
+func (p *ForwardProxy) forward(w *response.Writer, req *request.Request) {
+	ctx := req.Context()
+	target := req.RequestLine.RequestTarget
+
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "http" || u.Host == "" {
+		p.writeError(w, fmt.Errorf("%w: %s", ERROR_INVALID_TARGET, target))
+		return
+	}
+
+	h := headers.NewHeaders()
+	for key, value := range req.Headers {
+		h[key] = value
+	}
+	removeHopByHopHeaders(h)
+	h.Replace("Host", u.Host)
+
+	out := &client.Request{
+		Method:  req.RequestLine.Method,
+		URL:     u,
+		Headers: h,
+	}
+	setBody(out, req)
+
+	resp, err := p.client.Do(ctx, out)
+	if err != nil {
+		p.writeError(w, contextError(ctx, err))
+		return
+	}
+	defer resp.Body.Close()
+
+	err = copyResponse(w, req, resp)
+	if err != nil && !w.HeadersWritten() {
+		p.writeError(w, err)
+		return
+	}
+
+	if err != nil {
+		p.options.Logger.Error("proxy: error copying response", "target", target, "err", contextError(ctx, err))
+		w.Abort()
+	}
+}
+
+func (p *ForwardProxy) writeError(w *response.Writer, err error) {
+	var statusCode response.StatusCode
+	var msg []byte
+
+	switch {
+	case errors.Is(err, ERROR_DESTINATION_NOT_ALLOWED):
+		statusCode = response.STATUS_FORBIDDEN
+		msg = []byte("destination not allowed")
+	case errors.Is(err, ERROR_INVALID_TARGET):
+		statusCode = response.STATUS_BAD_REQUEST
+		msg = []byte("not a proxy request")
+	default:
+		p.options.Logger.Error("proxy: upstream error", "err", err)
+		writeUpstreamError(w, err)
+		return
+	}
+
+	w.WriteStatusLine(statusCode)
+	w.WriteHeaders(response.GetDefaultHeaders(len(msg)))
+	w.WriteBody(msg)
+}
+
+// dial connects to addr if the rules allow it. Denied names are turned away
+// before they are even resolved; the address connected to is checked once
+// it is known.
+func (p *ForwardProxy) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ERROR_INVALID_TARGET, err)
+	}
+	host = strings.ToLower(host)
+
+	ip, _ := netip.ParseAddr(host)
+	if matchRules(p.deny, host, ip, port) {
+		return nil, fmt.Errorf("%w: %s", ERROR_DESTINATION_NOT_ALLOWED, addr)
+	}
+
+	conn, err := p.options.Dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if remote, err := netip.ParseAddrPort(conn.RemoteAddr().String()); err == nil {
+		ip = remote.Addr().Unmap()
+	}
+
+	if matchRules(p.deny, host, ip, port) || (len(p.allow) > 0 && !matchRules(p.allow, host, ip, port)) {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %s", ERROR_DESTINATION_NOT_ALLOWED, addr)
+	}
+
+	return conn, nil
+}
+
+// A rule matches destinations by name, or by address if prefix is valid,
+// and by port unless port is empty.
+type rule struct {
+	host   string
+	prefix netip.Prefix
+	port   string
+}
+
+func parseRules(entries []string) ([]rule, error) {
+	var rules []rule
+
+	for _, entry := range entries {
+		r, err := parseRule(strings.ToLower(strings.TrimSpace(entry)))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ERROR_INVALID_RULE, entry)
+		}
+
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+func parseRule(entry string) (rule, error) {
+	var r rule
+
+	if prefix, err := netip.ParsePrefix(entry); err == nil {
+		r.prefix = prefix.Masked()
+		return r, nil
+	}
+
+	host := entry
+	if h, port, err := net.SplitHostPort(entry); err == nil {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return r, err
+		}
+		host, r.port = h, port
+	}
+
+	if host == "" {
+		return r, ERROR_INVALID_RULE
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		r.prefix = netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen())
+		return r, nil
+	}
+
+	r.host = host
+	return r, nil
+}
+
+func (r rule) matches(host string, ip netip.Addr, port string) bool {
+	if r.port != "" && r.port != port {
+		return false
+	}
+
+	if r.prefix.IsValid() {
+		return ip.IsValid() && r.prefix.Contains(ip.Unmap())
+	}
+
+	if suffix, ok := strings.CutPrefix(r.host, "*"); ok {
+		return strings.HasSuffix(host, suffix)
+	}
+
+	return host == r.host
+}
+
+func matchRules(rules []rule, host string, ip netip.Addr, port string) bool {
+	for _, r := range rules {
+		if r.matches(host, ip, port) {
+			return true
+		}
+	}
+
+	return false
+}
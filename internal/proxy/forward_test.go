@@ -0,0 +1,315 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpffomtcp.pinglu.dev/internal/server"
+)
+
+// startForward runs a forward proxy on the project's own server and returns
+// its address.
+func startForward(t *testing.T, options ForwardOptions) string {
+	t.Helper()
+
+	return startForwardConfig(t, options, server.Config{})
+}
+
+func startForwardConfig(t *testing.T, options ForwardOptions, config server.Config) string {
+	t.Helper()
+
+	if options.Logger == nil {
+		options.Logger = slog.New(slog.DiscardHandler)
+	}
+
+	p, err := NewForward(options)
+	require.NoError(t, err)
+	t.Cleanup(func() { p.Close() })
+
+	config.Addr = "127.0.0.1:0"
+	srv, err := server.ServeConfig(config, p.Handle)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+
+	return srv.Addr().String()
+}
+
+// startEchoServer sends back whatever it reads on each connection, and
+// closes the connection once the client is done sending.
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// send writes data to the proxy at addr and returns everything it answers.
+func send(t *testing.T, addr, data string) string {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Write([]byte(data))
+	require.NoError(t, err)
+
+	resp, err := io.ReadAll(conn)
+	require.NoError(t, err)
+
+	return string(resp)
+}
+
+// connect sends a CONNECT for target to the proxy at addr and returns the
+// status line it answers with, leaving any tunnel to be torn down.
+func connect(t *testing.T, addr, target, extra string) string {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Write([]byte(connectRequest(target, extra)))
+	require.NoError(t, err)
+
+	statusLine, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+
+	return statusLine
+}
+
+func connectRequest(target, extra string) string {
+	return "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n" + extra + "\r\n"
+}
+
+func TestForwardProxyTunnel(t *testing.T) {
+	echo := startEchoServer(t)
+	addr := startForward(t, ForwardOptions{})
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Test: Bytes sent along with the CONNECT make it through the tunnel
+	_, err = conn.Write([]byte(connectRequest(echo, "") + "hello"))
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	statusLine, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", statusLine)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "\r\n", line)
+
+	got := make([]byte, len("hello"))
+	_, err = io.ReadFull(br, got)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(got))
+
+	// Test: Both directions keep going
+	_, err = conn.Write([]byte(" world"))
+	require.NoError(t, err)
+	got = make([]byte, len(" world"))
+	_, err = io.ReadFull(br, got)
+	require.NoError(t, err)
+	assert.Equal(t, " world", string(got))
+
+	// Test: Closing our side ends the tunnel
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Empty(t, rest)
+
+	// Test: Targets must be host:port
+	resp := send(t, addr, connectRequest("example.com", ""))
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 400 Bad Request\r\n"), resp)
+
+	// Test: Unreachable destinations
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	deadAddr := dead.Addr().String()
+	dead.Close()
+	resp = send(t, addr, connectRequest(deadAddr, ""))
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 502 Bad Gateway\r\n"), resp)
+}
+
+func TestForwardProxyTunnelTimeout(t *testing.T) {
+	echo := startEchoServer(t)
+	addr := startForwardConfig(t, ForwardOptions{}, server.Config{RequestTimeout: 50 * time.Millisecond})
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Write([]byte(connectRequest(echo, "")))
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	statusLine, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", statusLine)
+	_, err = br.ReadString('\n')
+	require.NoError(t, err)
+
+	// Test: The tunnel outlives the request timeout
+	time.Sleep(150 * time.Millisecond)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	got := make([]byte, len("hello"))
+	_, err = io.ReadFull(br, got)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(got))
+}
+
+func TestForwardProxyAbsoluteForm(t *testing.T) {
+	upstream := startUpstream(t, echoHandler)
+	addr := startForward(t, ForwardOptions{})
+
+	// Test: The request goes to the origin in origin-form, without the
+	// headers meant for the proxy
+	resp := send(t, addr, "POST "+upstream+"/submit?x=1 HTTP/1.1\r\n"+
+		"Host: "+strings.TrimPrefix(upstream, "http://")+"\r\n"+
+		"Proxy-Connection: keep-alive\r\n"+
+		"Content-Length: 5\r\n"+
+		"\r\n"+
+		"hello")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+	assert.Contains(t, resp, "POST /submit?x=1\n")
+	assert.Contains(t, resp, "body: hello\n")
+	assert.NotContains(t, resp, "proxy-connection")
+
+	// Test: Requests that aren't meant for a proxy
+	resp = send(t, addr, "GET /submit HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 400 Bad Request\r\n"), resp)
+
+	resp = send(t, addr, "GET https://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 400 Bad Request\r\n"), resp)
+}
+
+func TestForwardProxyRules(t *testing.T) {
+	echo := startEchoServer(t)
+	_, echoPort, err := net.SplitHostPort(echo)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		options ForwardOptions
+		target  string
+		allowed bool
+	}{
+		{name: "No rules", target: echo, allowed: true},
+		{name: "Denied network", options: ForwardOptions{Deny: []string{"127.0.0.0/8"}}, target: echo},
+		{name: "Denied network by name", options: ForwardOptions{Deny: []string{"127.0.0.0/8"}}, target: "localhost:" + echoPort},
+		{name: "Denied name", options: ForwardOptions{Deny: []string{"localhost"}}, target: "localhost:" + echoPort},
+		{name: "Denied port", options: ForwardOptions{Deny: []string{"127.0.0.1:" + echoPort}}, target: echo},
+		{name: "Other port denied", options: ForwardOptions{Deny: []string{"127.0.0.1:1"}}, target: echo, allowed: true},
+		{name: "Not allowed", options: ForwardOptions{Allow: []string{"*.example.com"}}, target: echo},
+		{name: "Allowed address", options: ForwardOptions{Allow: []string{"127.0.0.1"}}, target: echo, allowed: true},
+		{name: "Allowed name", options: ForwardOptions{Allow: []string{"localhost:" + echoPort}}, target: "localhost:" + echoPort, allowed: true},
+		{name: "Deny wins", options: ForwardOptions{Allow: []string{"127.0.0.0/8"}, Deny: []string{"127.0.0.1"}}, target: echo},
+	}
+
+	for _, tt := range tests {
+		// Test: Each set of rules
+		addr := startForward(t, tt.options)
+		resp := connect(t, addr, tt.target, "")
+
+		if tt.allowed {
+			assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), tt.name)
+		} else {
+			assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 403 Forbidden\r\n"), tt.name)
+		}
+	}
+
+	// Test: Rules apply to absolute-form requests too
+	addr := startForward(t, ForwardOptions{Deny: []string{"127.0.0.1"}})
+	resp := send(t, addr, "GET http://"+echo+"/ HTTP/1.1\r\nHost: "+echo+"\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 403 Forbidden\r\n"), resp)
+
+	// Test: Bad rules
+	_, err = NewForward(ForwardOptions{Allow: []string{"example.com:http"}})
+	require.ErrorIs(t, err, ERROR_INVALID_RULE)
+	_, err = NewForward(ForwardOptions{Deny: []string{":443"}})
+	require.ErrorIs(t, err, ERROR_INVALID_RULE)
+}
+
+func TestRuleMatches(t *testing.T) {
+	ip := netip.MustParseAddr("10.1.2.3")
+
+	rules, err := parseRules([]string{"*.Example.com", "10.0.0.0/8", "[::1]:443"})
+	require.NoError(t, err)
+
+	// Test: Wildcards match subdomains only
+	assert.True(t, rules[0].matches("api.example.com", netip.Addr{}, "443"))
+	assert.False(t, rules[0].matches("example.com", netip.Addr{}, "443"))
+
+	// Test: Prefixes match addresses, not names
+	assert.True(t, rules[1].matches("internal", ip, "80"))
+	assert.False(t, rules[1].matches("10.1.2.3", netip.Addr{}, "80"))
+
+	// Test: Ports
+	assert.True(t, rules[2].matches("::1", netip.MustParseAddr("::1"), "443"))
+	assert.False(t, rules[2].matches("::1", netip.MustParseAddr("::1"), "80"))
+}
+
+func TestForwardProxyAuth(t *testing.T) {
+	echo := startEchoServer(t)
+	addr := startForward(t, ForwardOptions{
+		Realm: "test",
+		Authenticate: func(user, password string) bool {
+			return user == "alice" && password == "secret"
+		},
+	})
+
+	basic := func(credentials string) string {
+		return "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(credentials)) + "\r\n"
+	}
+
+	// Test: No credentials
+	resp := send(t, addr, connectRequest(echo, ""))
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 407 Proxy Authentication Required\r\n"), resp)
+	assert.Contains(t, resp, "proxy-authenticate: Basic realm=\"test\"\r\n")
+
+	// Test: Wrong credentials
+	resp = send(t, addr, connectRequest(echo, basic("alice:wrong")))
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 407 "), resp)
+
+	resp = send(t, addr, connectRequest(echo, "Proxy-Authorization: Bearer token\r\n"))
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 407 "), resp)
+
+	// Test: Right credentials
+	resp = connect(t, addr, echo, basic("alice:secret"))
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+}
@@ -0,0 +1,600 @@
+// Package proxy implements a reverse proxy that forwards requests to an
+// upstream HTTP/1.1 server, and a forward proxy for clients to reach any
+// server through, speaking HTTP with this project's own code on both sides.
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"httpffomtcp.pinglu.dev/internal/chunked"
+	"httpffomtcp.pinglu.dev/internal/client"
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+)
+
+var ERROR_INVALID_TARGET = errors.New("invalid proxy target")
+
+const (
+	DEFAULT_DIAL_TIMEOUT          = 10 * time.Second
+	DEFAULT_MAX_RETRIES           = 2
+	DEFAULT_RETRY_BACKOFF         = 50 * time.Millisecond
+	MAX_RETRY_BACKOFF             = time.Second
+	DEFAULT_MAX_FAILS             = 3
+	DEFAULT_EJECT_DURATION        = 30 * time.Second
+	DEFAULT_HEALTH_CHECK_INTERVAL = 10 * time.Second
+	DEFAULT_HEALTH_CHECK_TIMEOUT  = 2 * time.Second
+)
+
+// COPY_BUFFER_SIZE is the largest chunk we forward at once.
+const COPY_BUFFER_SIZE = 32 << 10
+
+// idempotentMethods can be retried on another backend without the risk of
+// doing something twice, RFC 9110 9.2.2.
+var idempotentMethods = []string{"GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE"}
+
+// hopByHopHeaders only apply to a single connection, so a proxy must not
+// forward them, RFC 9110 7.6.1. Expect goes too, since the server has
+// already read the body by the time we get the request.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Expect",
+}
+
+type Options struct {
+	// StripPrefix is removed from the request path before it is joined to
+	// the path of the target.
+	StripPrefix string
+
+	// PreserveHost sends the client's Host header upstream, instead of the
+	// host of the target.
+	PreserveHost bool
+
+	// TLSConfig is used for https targets. Nil means the defaults.
+	TLSConfig *tls.Config
+
+	// DialTimeout bounds connecting to the upstream, TLS handshake
+	// included. Zero means DEFAULT_DIAL_TIMEOUT.
+	DialTimeout time.Duration
+
+	// Dial opens connections to the upstream. Defaults to a net.Dialer.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Logger receives upstream errors. Defaults to slog.Default().
+	Logger *slog.Logger
+
+	// Strategy spreads requests over the targets of NewBalanced. Defaults
+	// to ROUND_ROBIN. HashHeader names the header that keys
+	// CONSISTENT_HASH; empty means the client IP.
+	Strategy   Strategy
+	HashHeader string
+
+	// MaxRetries is how many other backends an idempotent request is
+	// retried on if its backend can't be reached, waiting RetryBackoff
+	// before the first retry and twice as long before each next one. Zero
+	// means DEFAULT_MAX_RETRIES and DEFAULT_RETRY_BACKOFF, a negative
+	// MaxRetries means no retries.
+	MaxRetries   int
+	RetryBackoff time.Duration
+
+	// MaxFails failed requests in a row take a backend out of the pool for
+	// EjectDuration. Zero means DEFAULT_MAX_FAILS and
+	// DEFAULT_EJECT_DURATION.
+	MaxFails      int
+	EjectDuration time.Duration
+
+	// HealthCheckPath turns on active health checks: every
+	// HealthCheckInterval, each backend gets a GET for it, and is only
+	// used while that gets a 2xx or 3xx within HealthCheckTimeout. The
+	// zero durations mean DEFAULT_HEALTH_CHECK_INTERVAL and
+	// DEFAULT_HEALTH_CHECK_TIMEOUT.
+	HealthCheckPath     string
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+}
+
+func (o Options) withDefaults() Options {
+	if o.DialTimeout == 0 {
+		o.DialTimeout = DEFAULT_DIAL_TIMEOUT
+	}
+
+	if o.Dial == nil {
+		var dialer net.Dialer
+		o.Dial = dialer.DialContext
+	}
+
+	if o.Logger == nil {
+		o.Logger = slog.Default()
+	}
+
+	if o.Strategy == "" {
+		o.Strategy = ROUND_ROBIN
+	}
+
+	if o.MaxRetries == 0 {
+		o.MaxRetries = DEFAULT_MAX_RETRIES
+	}
+
+	if o.RetryBackoff == 0 {
+		o.RetryBackoff = DEFAULT_RETRY_BACKOFF
+	}
+
+	if o.MaxFails == 0 {
+		o.MaxFails = DEFAULT_MAX_FAILS
+	}
+
+	if o.EjectDuration == 0 {
+		o.EjectDuration = DEFAULT_EJECT_DURATION
+	}
+
+	if o.HealthCheckInterval == 0 {
+		o.HealthCheckInterval = DEFAULT_HEALTH_CHECK_INTERVAL
+	}
+
+	if o.HealthCheckTimeout == 0 {
+		o.HealthCheckTimeout = DEFAULT_HEALTH_CHECK_TIMEOUT
+	}
+
+	return o
+}
+
+type ReverseProxy struct {
+	pool    *pool
+	client  *client.Client
+	options Options
+	cancel  context.CancelFunc
+}
+
+// New returns a reverse proxy that forwards requests to target, an http or
+// https URL. The request path is appended to the path of target.
+func New(target string, options Options) (*ReverseProxy, error) {
+	return NewBalanced([]string{target}, options)
+}
+
+// NewBalanced returns a reverse proxy that spreads requests over targets
+// according to options.Strategy. Call Close to stop its health checks.
+func NewBalanced(targets []string, options Options) (*ReverseProxy, error) {
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("%w: no targets", ERROR_INVALID_TARGET)
+	}
+
+	var backends []*backend
+	for _, target := range targets {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ERROR_INVALID_TARGET, err)
+		}
+
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%w: %s", ERROR_INVALID_TARGET, target)
+		}
+
+		backends = append(backends, newBackend(u))
+	}
+
+	options = options.withDefaults()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	p := &ReverseProxy{
+		pool: newPool(backends, options.Strategy, options.HashHeader),
+		client: client.New(client.Options{
+			Dial:        options.Dial,
+			TLSConfig:   options.TLSConfig,
+			DialTimeout: options.DialTimeout,
+		}),
+		options: options,
+		cancel:  cancel,
+	}
+
+	if options.HealthCheckPath != "" {
+		go p.healthCheck(ctx)
+	}
+
+	return p, nil
+}
+
+// Close stops the health checks and closes idle upstream connections.
+func (p *ReverseProxy) Close() error {
+	p.cancel()
+	return p.client.Close()
+}
+
+// Handle forwards req to a backend and streams the response back to w.
+// Idempotent requests whose backend can't be reached are retried on
+// another one. If none works out the client gets a 502, or a 504 if it
+// took too long.
+func (p *ReverseProxy) Handle(w *response.Writer, req *request.Request) {
+	ctx := req.Context()
+
+	attempts := 1
+	if slices.Contains(idempotentMethods, req.RequestLine.Method) && p.options.MaxRetries > 0 {
+		attempts += p.options.MaxRetries
+	}
+
+	var tried []*backend
+	var err error
+	backoff := p.options.RetryBackoff
+
+	for attempt := range attempts {
+		if attempt > 0 {
+			if !sleep(ctx, backoff) {
+				err = ctx.Err()
+				break
+			}
+			backoff = min(2*backoff, MAX_RETRY_BACKOFF)
+		}
+
+		b := p.pool.pick(req, tried)
+		if b == nil {
+			err = ERROR_NO_BACKENDS
+			break
+		}
+		tried = append(tried, b)
+
+		err = p.forward(w, req, b)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+
+		p.options.Logger.Warn("proxy: backend failed", "backend", b.url.String(), "attempt", attempt+1, "err", err)
+	}
+
+	if err != nil {
+		p.writeError(w, err)
+	}
+}
+
+// forward sends req to b and copies the response to w. It only returns an
+// error if nothing has been written to w yet.
+func (p *ReverseProxy) forward(w *response.Writer, req *request.Request, b *backend) error {
+	ctx := req.Context()
+
+	b.activeConns.Add(1)
+	defer b.activeConns.Add(-1)
+
+	out, err := p.outgoingRequest(req, b)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.client.Do(ctx, out)
+	if err != nil {
+		p.failed(ctx, b)
+		return contextError(ctx, err)
+	}
+	defer resp.Body.Close()
+	b.succeeded()
+
+	err = copyResponse(w, req, resp)
+	if err != nil && !w.HeadersWritten() {
+		return err
+	}
+
+	if err != nil {
+		// The status line is out, so all we can do is cut the response
+		// short.
+		p.options.Logger.Error("proxy: error copying response", "backend", b.url.String(), "err", contextError(ctx, err))
+		w.Abort()
+	}
+
+	return nil
+}
+
+// failed counts a failure against b, unless it was our own request that
+// gave up.
+func (p *ReverseProxy) failed(ctx context.Context, b *backend) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	b.failed(p.options.MaxFails, p.options.EjectDuration)
+}
+
+// sleep waits for d, and reports false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func (p *ReverseProxy) outgoingRequest(req *request.Request, b *backend) (*client.Request, error) {
+	u, err := url.ParseRequestURI(b.rewriteTarget(p.options.StripPrefix, req.RequestLine.RequestTarget))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ERROR_INVALID_TARGET, err)
+	}
+	u.Scheme = b.url.Scheme
+	u.Host = b.url.Host
+
+	h := headers.NewHeaders()
+	for key, value := range req.Headers {
+		h[key] = value
+	}
+	removeHopByHopHeaders(h)
+
+	host := req.Headers.Get("Host")
+	if !p.options.PreserveHost {
+		h.Replace("Host", b.url.Host)
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	addForwardedHeaders(h, req.RemoteAddr, host, proto)
+
+	out := &client.Request{
+		Method:  req.RequestLine.Method,
+		URL:     u,
+		Headers: h,
+	}
+	setBody(out, req)
+
+	return out, nil
+}
+
+// setBody gives out the body of req, framed the way the client framed it.
+func setBody(out *client.Request, req *request.Request) {
+	out.Body = req.Body
+
+	if chunked.IsChunked(req.Headers.Get("Transfer-Encoding")) {
+		out.Trailers = req.Trailers
+		out.Headers.Replace("Transfer-Encoding", "chunked")
+	} else if len(req.Body) > 0 || req.Headers.Get("Content-Length") != "" {
+		out.Headers.Replace("Content-Length", strconv.Itoa(len(req.Body)))
+	}
+}
+
+// rewriteTarget strips prefix from the path of target and joins what is
+// left to the path and query of the backend URL.
+func (b *backend) rewriteTarget(prefix, target string) string {
+	path, query, _ := strings.Cut(target, "?")
+
+	path = strings.TrimPrefix(path, prefix)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	base := strings.TrimSuffix(b.url.EscapedPath(), "/")
+	path = base + path
+
+	switch {
+	case b.url.RawQuery != "" && query != "":
+		query = b.url.RawQuery + "&" + query
+	case b.url.RawQuery != "":
+		query = b.url.RawQuery
+	}
+
+	if query != "" {
+		return path + "?" + query
+	}
+
+	return path
+}
+
+// copyResponse sends resp to the client as the response to req.
+func copyResponse(w *response.Writer, req *request.Request, resp *client.Response) error {
+	h := resp.Headers
+	removeHopByHopHeaders(h)
+	h.Replace("Connection", "close")
+
+	bodyAllowed := hasBody(req.RequestLine.Method, resp.StatusCode)
+
+	// Without a length, because it was chunked or runs until the upstream
+	// closes, the body goes out in chunks.
+	if bodyAllowed && resp.ContentLength < 0 {
+		h.Delete("Content-Length")
+		h.Replace("Transfer-Encoding", "chunked")
+	}
+
+	err := w.WriteStatusLine(resp.StatusCode)
+	if err != nil {
+		return err
+	}
+
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return err
+	}
+
+	if !bodyAllowed || w.BodyDiscarded() {
+		return nil
+	}
+
+	if resp.ContentLength >= 0 {
+		_, err = io.CopyN(w, resp.Body, resp.ContentLength)
+		return err
+	}
+
+	return copyChunked(w, resp)
+}
+
+// copyChunked forwards the body of resp to w as chunks, followed by its
+// trailers.
+func copyChunked(w *response.Writer, resp *client.Response) error {
+	buf := make([]byte, COPY_BUFFER_SIZE)
+
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			_, werr := w.WriteChunkedBody(buf[:n])
+			if werr != nil {
+				return werr
+			}
+
+			// Let streams through even if a middleware buffers the body.
+			werr = w.Flush()
+			if werr != nil {
+				return werr
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := w.WriteChunkedBodyDone()
+	if err != nil {
+		return err
+	}
+
+	if len(resp.Trailers) == 0 {
+		return nil
+	}
+
+	return w.WriteTrailers(resp.Trailers)
+}
+
+// hasBody reports whether a response to method with statusCode has a body,
+// RFC 9112 6.3.
+func hasBody(method string, statusCode response.StatusCode) bool {
+	if method == "HEAD" {
+		return false
+	}
+
+	return statusCode >= 200 && statusCode != 204 && statusCode != response.STATUS_NOT_MODIFIED
+}
+
+func (p *ReverseProxy) writeError(w *response.Writer, err error) {
+	p.options.Logger.Error("proxy: upstream error", "err", err)
+	writeUpstreamError(w, err)
+}
+
+// writeUpstreamError answers with a 502, or a 504 if err is a timeout.
+func writeUpstreamError(w *response.Writer, err error) {
+	statusCode := response.STATUS_BAD_GATEWAY
+	msg := []byte("upstream unavailable")
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		statusCode = response.STATUS_GATEWAY_TIMEOUT
+		msg = []byte("upstream timed out")
+	}
+
+	w.WriteStatusLine(statusCode)
+	w.WriteHeaders(response.GetDefaultHeaders(len(msg)))
+	w.WriteBody(msg)
+}
+
+// contextError prefers the context's error to err, since closing the
+// connection when the context is done makes I/O fail with a less telling
+// one.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+
+	return err
+}
+
+// removeHopByHopHeaders deletes hopByHopHeaders from h, along with the
+// headers listed in Connection.
+func removeHopByHopHeaders(h headers.Headers) {
+	for _, name := range strings.Split(h.Get("Connection"), ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			h.Delete(name)
+		}
+	}
+
+	for _, name := range hopByHopHeaders {
+		h.Delete(name)
+	}
+}
+
+// addForwardedHeaders tells the upstream who the client is, both with
+// Forwarded, RFC 7239, and the older X-Forwarded-* headers.
+func addForwardedHeaders(h headers.Headers, remoteAddr, host, proto string) {
+	clientIP, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		clientIP = remoteAddr
+	}
+
+	if clientIP != "" {
+		if prior := h.Get("X-Forwarded-For"); prior != "" {
+			h.Replace("X-Forwarded-For", prior+", "+clientIP)
+		} else {
+			h.Replace("X-Forwarded-For", clientIP)
+		}
+	}
+
+	if host != "" {
+		h.Replace("X-Forwarded-Host", host)
+	}
+	h.Replace("X-Forwarded-Proto", proto)
+
+	forwardedFor := clientIP
+	if strings.Contains(clientIP, ":") {
+		forwardedFor = "[" + clientIP + "]"
+	}
+
+	var elements []string
+	if value, ok := forwardedValue(forwardedFor); forwardedFor != "" && ok {
+		elements = append(elements, "for="+value)
+	}
+	if value, ok := forwardedValue(host); host != "" && ok {
+		elements = append(elements, "host="+value)
+	}
+	elements = append(elements, "proto="+proto)
+
+	if prior := h.Get("Forwarded"); prior != "" {
+		h.Replace("Forwarded", prior+", "+strings.Join(elements, ";"))
+	} else {
+		h.Replace("Forwarded", strings.Join(elements, ";"))
+	}
+}
+
+// forwardedValue formats v as a Forwarded parameter value, RFC 7239 4: a
+// token as it is, anything else as a quoted-string. It reports false if v
+// has control characters, which a quoted-string can't hold.
+func forwardedValue(v string) (string, bool) {
+	if headers.IsToken(v) {
+		return v, true
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return "", false
+		}
+
+		if c == '"' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+
+	b.WriteByte('"')
+	return b.String(), true
+}
@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+	"httpffomtcp.pinglu.dev/internal/server"
+)
+
+// startUpstream runs handler on a local stand-in upstream and returns its
+// URL.
+func startUpstream(t *testing.T, handler server.Handler) string {
+	t.Helper()
+
+	srv, err := server.ServeConfig(server.Config{Addr: "127.0.0.1:0"}, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+
+	return "http://" + srv.Addr().String()
+}
+
+// startRawUpstream answers every connection with resp, byte for byte, once
+// it has read the request head.
+func startRawUpstream(t *testing.T, resp string) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				br := bufio.NewReader(conn)
+				for {
+					line, err := br.ReadString('\n')
+					if err != nil || line == "\r\n" {
+						break
+					}
+				}
+				conn.Write([]byte(resp))
+			}()
+		}
+	}()
+
+	return "http://" + listener.Addr().String()
+}
+
+func newProxy(t *testing.T, target string, options Options) *ReverseProxy {
+	t.Helper()
+
+	if options.Logger == nil {
+		options.Logger = slog.New(slog.DiscardHandler)
+	}
+
+	p, err := New(target, options)
+	require.NoError(t, err)
+	t.Cleanup(func() { p.Close() })
+
+	return p
+}
+
+func do(t *testing.T, p *ReverseProxy, data string) string {
+	t.Helper()
+
+	return doContext(t, p, context.Background(), data)
+}
+
+func doContext(t *testing.T, p *ReverseProxy, ctx context.Context, data string) string {
+	t.Helper()
+
+	req, err := request.RequestFromReader(strings.NewReader(data))
+	require.NoError(t, err)
+	req.RemoteAddr = "192.0.2.1:1234"
+
+	var b bytes.Buffer
+	w := response.NewWriter(&b)
+	p.Handle(w, req.WithContext(ctx))
+	require.NoError(t, w.Finish())
+
+	return b.String()
+}
+
+// echoHandler answers with the request line, headers and body it got.
+func echoHandler(w *response.Writer, req *request.Request) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s\n", req.RequestLine.Method, req.RequestLine.RequestTarget)
+	for key, value := range req.Headers {
+		fmt.Fprintf(&b, "%s: %s\n", key, value)
+	}
+	for key, value := range req.Trailers {
+		fmt.Fprintf(&b, "trailer %s: %s\n", key, value)
+	}
+	fmt.Fprintf(&b, "body: %s\n", req.Body)
+
+	w.WriteStatusLine(response.STATUS_OK)
+	w.WriteHeaders(response.GetDefaultHeaders(b.Len()))
+	w.WriteBody(b.Bytes())
+}
+
+func TestNew(t *testing.T) {
+	// Test: Invalid targets
+	_, err := New("ftp://example.com", Options{})
+	require.ErrorIs(t, err, ERROR_INVALID_TARGET)
+
+	_, err = New("/just/a/path", Options{})
+	require.ErrorIs(t, err, ERROR_INVALID_TARGET)
+
+	// Test: Paths and queries are joined
+	p := newProxy(t, "http://example.com/api/?key=1", Options{})
+	b := p.pool.backends[0]
+	assert.Equal(t, "/api/users?key=1&page=2", b.rewriteTarget("/proxy", "/proxy/users?page=2"))
+	assert.Equal(t, "/api/?key=1", b.rewriteTarget("/proxy", "/proxy"))
+}
+
+func TestReverseProxy(t *testing.T) {
+	upstream := startUpstream(t, echoHandler)
+	p := newProxy(t, upstream+"/base", Options{StripPrefix: "/app"})
+	upstreamHost := strings.TrimPrefix(upstream, "http://")
+
+	// Test: Path and Host are rewritten, forwarding headers added
+	resp := do(t, p, "GET /app/items?id=7 HTTP/1.1\r\n"+
+		"Host: example.com\r\n"+
+		"Connection: keep-alive, X-Secret\r\n"+
+		"X-Secret: hop\r\n"+
+		"Keep-Alive: timeout=5\r\n"+
+		"X-Forwarded-For: 203.0.113.9\r\n"+
+		"\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, resp, "GET /base/items?id=7\n")
+	assert.Contains(t, resp, "host: "+upstreamHost+"\n")
+	assert.Contains(t, resp, "x-forwarded-for: 203.0.113.9, 192.0.2.1\n")
+	assert.Contains(t, resp, "x-forwarded-host: example.com\n")
+	assert.Contains(t, resp, "x-forwarded-proto: http\n")
+	assert.Contains(t, resp, "forwarded: for=192.0.2.1;host=example.com;proto=http\n")
+	assert.NotContains(t, resp, "x-secret")
+	assert.NotContains(t, resp, "keep-alive")
+
+	// Test: PreserveHost keeps the client's Host
+	resp = do(t, newProxy(t, upstream, Options{PreserveHost: true}), "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Contains(t, resp, "host: example.com\n")
+
+	// Test: Request bodies are forwarded
+	resp = do(t, p, "POST /app/ HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello")
+	assert.Contains(t, resp, "content-length: 5\n")
+	assert.Contains(t, resp, "body: hello\n")
+
+	// Test: Chunked request bodies are forwarded with their trailers
+	resp = do(t, p, "POST /app/ HTTP/1.1\r\n"+
+		"Host: example.com\r\n"+
+		"Transfer-Encoding: chunked\r\n"+
+		"Trailer: X-Checksum\r\n"+
+		"\r\n"+
+		"3\r\nhel\r\n2\r\nlo\r\n0\r\nX-Checksum: 42\r\n\r\n")
+	assert.Contains(t, resp, "transfer-encoding: chunked\n")
+	assert.Contains(t, resp, "trailer x-checksum: 42\n")
+	assert.Contains(t, resp, "body: hello\n")
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	forwarded := func(remoteAddr, host string) string {
+		h := headers.NewHeaders()
+		addForwardedHeaders(h, remoteAddr, host, "https")
+		return h.Get("Forwarded")
+	}
+
+	// Test: Tokens are left unquoted
+	assert.Equal(t, "for=192.0.2.1;host=example.com;proto=https", forwarded("192.0.2.1:1234", "example.com"))
+
+	// Test: Other values are quoted-strings
+	assert.Equal(t, `for="[2001:db8::1]";host="example.com:8080";proto=https`, forwarded("[2001:db8::1]:1234", "example.com:8080"))
+
+	// Test: Only quotes and backslashes are escaped
+	assert.Equal(t, `for=192.0.2.1;host="a\"b\\c";proto=https`, forwarded("192.0.2.1:1234", `a"b\c`))
+	assert.Equal(t, "for=192.0.2.1;host=\"caf\u00e9.example\";proto=https", forwarded("192.0.2.1:1234", "caf\u00e9.example"))
+
+	// Test: Values with control characters are left out
+	assert.Equal(t, "for=192.0.2.1;proto=https", forwarded("192.0.2.1:1234", "evil\x00.example"))
+}
+
+func TestReverseProxyResponses(t *testing.T) {
+	// Test: Chunked responses are streamed along with their trailers
+	upstream := startUpstream(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.STATUS_OK)
+
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Checksum")
+		w.WriteHeaders(h)
+
+		w.WriteChunkedBody([]byte("hello "))
+		w.WriteChunkedBody([]byte("world"))
+		w.WriteChunkedBodyDone()
+
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Checksum", "42")
+		w.WriteTrailers(trailers)
+	})
+	resp := do(t, newProxy(t, upstream, Options{}), "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, resp, "transfer-encoding: chunked\r\n")
+	assert.Contains(t, resp, "trailer: X-Checksum\r\n")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n6\r\nhello \r\n5\r\nworld\r\n0\r\nx-checksum: 42\r\n\r\n"))
+
+	// Test: Bodies delimited by the connection closing become chunked
+	upstream = startRawUpstream(t, "HTTP/1.1 200 OK\r\nConnection: close\r\nKeep-Alive: timeout=5\r\n\r\nuntil eof")
+	resp = do(t, newProxy(t, upstream, Options{}), "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Contains(t, resp, "transfer-encoding: chunked\r\n")
+	assert.NotContains(t, resp, "keep-alive")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n9\r\nuntil eof\r\n0\r\n\r\n"))
+
+	// Test: Interim responses are skipped and Content-Length is kept
+	upstream = startRawUpstream(t, "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 201 Created\r\nContent-Length: 4\r\n\r\ndone")
+	resp = do(t, newProxy(t, upstream, Options{}), "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 201 Created\r\n"))
+	assert.Contains(t, resp, "content-length: 4\r\n")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\ndone"))
+
+	// Test: HEAD responses have no body
+	upstream = startRawUpstream(t, "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n")
+	resp = do(t, newProxy(t, upstream, Options{}), "HEAD / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Contains(t, resp, "content-length: 100\r\n")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n"))
+
+	// Test: A malformed upstream response is a 502
+	upstream = startRawUpstream(t, "garbage\r\n\r\n")
+	resp = do(t, newProxy(t, upstream, Options{}), "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 502 Bad Gateway\r\n"))
+
+	// Test: A truncated body is not terminated
+	upstream = startRawUpstream(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhel")
+	resp = do(t, newProxy(t, upstream, Options{}), "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+	assert.False(t, strings.HasSuffix(resp, "0\r\n\r\n"))
+}
+
+func TestReverseProxyErrors(t *testing.T) {
+	// Test: An unreachable upstream is a 502
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+
+	resp := do(t, newProxy(t, "http://"+addr, Options{}), "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 502 Bad Gateway\r\n"))
+
+	// Test: A slow upstream is a 504 once the request times out
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	upstream := startUpstream(t, func(w *response.Writer, req *request.Request) {
+		<-release
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	resp = doContext(t, newProxy(t, upstream, Options{}), ctx, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 504 Gateway Timeout\r\n"))
+	assert.Contains(t, resp, "content-length: "+strconv.Itoa(len("upstream timed out"))+"\r\n")
+}
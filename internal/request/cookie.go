@@ -0,0 +1,71 @@
+package request
+
+import (
+	"errors"
+	"strings"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+)
+
+var ERROR_NO_COOKIE = errors.New("named cookie not present")
+
+// Cookie is a name-value pair from the Cookie header.
+type Cookie struct {
+	Name  string
+	Value string
+}
+
+// Cookies returns the cookies the client sent, in order. Pairs that aren't
+// valid by RFC 6265 4.2.1 are skipped.
+func (r *Request) Cookies() []Cookie {
+	return ParseCookies(r.Headers.Get("Cookie"))
+}
+
+// Cookie returns the first cookie named name, or ERROR_NO_COOKIE.
+func (r *Request) Cookie(name string) (Cookie, error) {
+	for _, c := range r.Cookies() {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+
+	return Cookie{}, ERROR_NO_COOKIE
+}
+
+// ParseCookies parses the value of a Cookie header, RFC 6265 5.4. Values
+// lose their surrounding quotes, if any.
+func ParseCookies(header string) []Cookie {
+	var cookies []Cookie
+
+	for _, pair := range strings.Split(header, ";") {
+		name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || !headers.IsToken(name) || !ValidCookieValue(value) {
+			continue
+		}
+
+		if len(value) >= 2 && value[0] == '"' {
+			value = value[1 : len(value)-1]
+		}
+
+		cookies = append(cookies, Cookie{Name: name, Value: value})
+	}
+
+	return cookies
+}
+
+// ValidCookieValue reports whether value is a cookie-value of RFC 6265
+// 4.1.1: printable ASCII other than whitespace, DQUOTE, comma, semicolon
+// and backslash, optionally in double quotes.
+func ValidCookieValue(value string) bool {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+
+	for _, c := range []byte(value) {
+		if c <= ' ' || c >= 0x7F || c == '"' || c == ',' || c == ';' || c == '\\' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,105 @@
+package request
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var ERROR_UNSUPPORTED_CONTENT_ENCODING = errors.New("unsupported content encoding")
+var ERROR_MALFORMED_BODY = errors.New("malformed body")
+
+// DEFAULT_MAX_DECODED_BODY_BYTES limits decoded bodies when no limit is
+// configured. Compression ratios of 1000:1 are easy to reach, so an
+// unlimited body size must not mean unlimited decoded size.
+const DEFAULT_MAX_DECODED_BODY_BYTES = 10 << 20
+
+// decodeBody undoes the Content-Encoding of the body, so that handlers see
+// the same bytes whether or not the client compressed them. The decoded
+// body replaces Body, and the headers are updated to match it.
+func (r *Request) decodeBody() error {
+	contentEncoding := r.Headers.Get("Content-Encoding")
+	if contentEncoding == "" {
+		return nil
+	}
+
+	var codings []string
+	for _, coding := range strings.Split(contentEncoding, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "" && coding != "identity" {
+			codings = append(codings, coding)
+		}
+	}
+
+	maxDecoded := r.options.MaxDecodedBodyBytes
+	if maxDecoded == 0 {
+		maxDecoded = DEFAULT_MAX_DECODED_BODY_BYTES
+		if r.options.MaxBodyBytes > 0 {
+			maxDecoded = r.options.MaxBodyBytes
+		}
+	}
+
+	body := r.Body
+
+	// Codings are listed in the order they were applied.
+	for _, coding := range slices.Backward(codings) {
+		decoded, err := decode(body, coding, maxDecoded)
+		if err != nil {
+			return err
+		}
+
+		body = decoded
+	}
+
+	r.Body = body
+	r.Headers.Delete("Content-Encoding")
+	r.Headers.Replace("Content-Length", strconv.Itoa(len(body)))
+
+	return nil
+}
+
+// decode decodes data, which has been encoded with coding. If max is
+// positive, it refuses to produce more than max bytes, so that a small
+// compressed body can't blow up in memory.
+func decode(data []byte, coding string, max int) ([]byte, error) {
+	var zr io.ReadCloser
+	var err error
+
+	switch coding {
+	case "gzip", "x-gzip":
+		zr, err = gzip.NewReader(bytes.NewReader(data))
+	case "deflate":
+		// HTTP's "deflate" is the zlib format, RFC 9110 8.4.1.2.
+		zr, err = zlib.NewReader(bytes.NewReader(data))
+	default:
+		return nil, fmt.Errorf("%w: %s", ERROR_UNSUPPORTED_CONTENT_ENCODING, coding)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ERROR_MALFORMED_BODY, err)
+	}
+	defer zr.Close()
+
+	var src io.Reader = zr
+	if max > 0 {
+		// Read one byte past the limit to tell a body of exactly max
+		// bytes from a longer one.
+		src = io.LimitReader(zr, int64(max)+1)
+	}
+
+	decoded, err := io.ReadAll(src)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ERROR_MALFORMED_BODY, err)
+	}
+
+	if max > 0 && len(decoded) > max {
+		return nil, ERROR_BODY_TOO_LARGE
+	}
+
+	return decoded, nil
+}
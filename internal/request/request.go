@@ -2,12 +2,15 @@ package request
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"io"
 	"strconv"
 	"strings"
 	"unicode"
 
+	"httpffomtcp.pinglu.dev/internal/chunked"
 	"httpffomtcp.pinglu.dev/internal/headers"
 )
 
@@ -16,10 +19,34 @@ var ERROR_INVALID_METHOD = errors.New("invalid method")
 var ERROR_UNSUPPORTED_HTTP_VERSION = errors.New("unsupported http version")
 var ERROR_MISSING_HOST_HEADER = errors.New("missing host header")
 var ERROR_CONTENT_LENGTH_EXCEEDED = errors.New("content length exceeded")
+var ERROR_HEADERS_TOO_LARGE = errors.New("request line and headers too large")
+var ERROR_BODY_TOO_LARGE = errors.New("body too large")
+var ERROR_MALFORMED_CHUNK = chunked.ERROR_MALFORMED_CHUNK
+var ERROR_UNSUPPORTED_TRANSFER_ENCODING = errors.New("unsupported transfer encoding")
 var CRLF = []byte("\r\n")
 
 const BUFFER_SIZE = 8
 
+// MAX_CHUNK_SIZE_LINE_BYTES bounds a chunk size line, extensions included.
+const MAX_CHUNK_SIZE_LINE_BYTES = chunked.MAX_SIZE_LINE_BYTES
+
+// Options limits how much RequestFromReaderWithOptions is willing to read.
+// A zero value means no limit.
+type Options struct {
+	MaxHeaderBytes int
+	MaxBodyBytes   int
+
+	// DecodeBody decodes bodies sent with a gzip or deflate
+	// Content-Encoding. Other encodings fail with
+	// ERROR_UNSUPPORTED_CONTENT_ENCODING.
+	DecodeBody bool
+
+	// MaxDecodedBodyBytes limits the size of a decoded body. Zero means
+	// MaxBodyBytes, or DEFAULT_MAX_DECODED_BODY_BYTES if that is zero too,
+	// and a negative value means no limit.
+	MaxDecodedBodyBytes int
+}
+
 type RequestLine struct {
 	HttpVersion   string
 	RequestTarget string
@@ -32,6 +59,7 @@ const (
 	INITIALIZED     parserState = "initialized"
 	PARSING_HEADERS parserState = "parsing headers"
 	PARSING_BODY    parserState = "parsing body"
+	PARSING_CHUNKED parserState = "parsing chunked body"
 	DONE            parserState = "done"
 )
 
@@ -39,14 +67,86 @@ type Request struct {
 	RequestLine RequestLine
 	Headers     headers.Headers
 	Body        []byte
+	// Trailers holds the trailer fields of a chunked body.
+	Trailers headers.Headers
+	// RemoteAddr is the client's network address, set by the server.
+	RemoteAddr string
+	// TLS is set by the server for requests received over HTTPS.
+	TLS         *tls.ConnectionState
 	parserState parserState
+	ctx         context.Context
+	options     Options
+	headerBytes int
+	chunks      *chunked.Parser
+	buffered    []byte
 }
 
-func newRequest() *Request {
+func newRequest(options Options) *Request {
 	return &Request{
 		Headers:     headers.NewHeaders(),
+		Trailers:    headers.NewHeaders(),
 		parserState: INITIALIZED,
+		options:     options,
+	}
+}
+
+// NewRequest builds a request from parts a protocol other than HTTP/1.1
+// has already parsed, such as an HTTP/2 stream. It applies the same limits
+// and body decoding as RequestFromReaderWithOptions.
+func NewRequest(rl RequestLine, h, trailers headers.Headers, body []byte, options Options) (*Request, error) {
+	request := newRequest(options)
+	request.RequestLine = rl
+	request.Headers = h
+	request.Body = body
+	request.parserState = DONE
+
+	if trailers != nil {
+		request.Trailers = trailers
+	}
+
+	if options.MaxBodyBytes > 0 && len(body) > options.MaxBodyBytes {
+		return nil, ERROR_BODY_TOO_LARGE
+	}
+
+	if options.DecodeBody {
+		err := request.decodeBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return request, nil
+}
+
+// Context returns the request's context. The server cancels it when the
+// client disconnects, when the server shuts down, or when the request
+// times out. It is never nil; it defaults to context.Background().
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
 	}
+
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx.
+// Handlers can use it to attach values to a request before passing it on.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+
+	r2 := new(Request)
+	*r2 = *r
+	r2.ctx = ctx
+
+	return r2
+}
+
+// Buffered returns the bytes read past the end of the request, which
+// belong to whatever the client sent next.
+func (r *Request) Buffered() []byte {
+	return r.buffered
 }
 
 func (r *Request) parse(data []byte) (int, error) {
@@ -79,6 +179,7 @@ outer:
 			}
 
 			r.RequestLine = *rl
+			r.headerBytes += n
 			totalBytesParsed += n
 			startIndex = totalBytesParsed
 			r.parserState = PARSING_HEADERS
@@ -92,6 +193,7 @@ outer:
 				break outer
 			}
 
+			r.headerBytes += n
 			totalBytesParsed += n
 			startIndex = totalBytesParsed
 
@@ -102,6 +204,17 @@ outer:
 				r.parserState = PARSING_BODY
 			}
 		case PARSING_BODY:
+			if te := r.Headers.Get("transfer-encoding"); te != "" {
+				if !chunked.IsChunked(te) {
+					return 0, ERROR_UNSUPPORTED_TRANSFER_ENCODING
+				}
+
+				// Transfer-Encoding overrides Content-Length, RFC 9112 6.3.
+				r.chunks = chunked.NewParser(r.Trailers)
+				r.parserState = PARSING_CHUNKED
+				continue
+			}
+
 			contentLen := r.Headers.Get("content-length")
 			if contentLen == "" || contentLen == "0" {
 				r.parserState = DONE
@@ -113,6 +226,11 @@ outer:
 				return 0, err
 			}
 
+			maxBody := r.options.MaxBodyBytes
+			if maxBody > 0 && specifiedBodyLen > maxBody {
+				return 0, ERROR_BODY_TOO_LARGE
+			}
+
 			oldLen := len(r.Body)
 
 			r.Body = append(r.Body, data[startIndex:]...)
@@ -129,6 +247,39 @@ outer:
 			} else {
 				break outer
 			}
+		case PARSING_CHUNKED:
+			n, err := r.chunks.Parse(data[startIndex:])
+			if err != nil {
+				return 0, err
+			}
+
+			totalBytesParsed += n
+			startIndex = totalBytesParsed
+
+			if r.chunks.Done() {
+				r.parserState = DONE
+				continue
+			}
+
+			remaining := r.chunks.Remaining()
+			if remaining == 0 {
+				break outer
+			}
+
+			maxBody := r.options.MaxBodyBytes
+			if maxBody > 0 && int64(len(r.Body))+remaining > int64(maxBody) {
+				return 0, ERROR_BODY_TOO_LARGE
+			}
+
+			n = int(min(remaining, int64(len(data)-startIndex)))
+			if n == 0 {
+				break outer
+			}
+
+			r.Body = append(r.Body, data[startIndex:startIndex+n]...)
+			r.chunks.Consume(n)
+			totalBytesParsed += n
+			startIndex = totalBytesParsed
 		case DONE:
 			break outer
 		}
@@ -141,6 +292,22 @@ func (r *Request) done() bool {
 	return r.parserState == DONE
 }
 
+// parsingHead reports whether the parser is in the request line, the
+// headers or the trailers, which share MaxHeaderBytes.
+func (r *Request) parsingHead() bool {
+	return r.parserState == INITIALIZED || r.parserState == PARSING_HEADERS || (r.parserState == PARSING_CHUNKED && r.chunks.InTrailers())
+}
+
+// headBytes returns the size of the request line, headers and trailers
+// parsed so far.
+func (r *Request) headBytes() int {
+	if r.chunks == nil {
+		return r.headerBytes
+	}
+
+	return r.headerBytes + r.chunks.TrailerBytes()
+}
+
 // HTTP-version = HTTP-name "/" DIGIT "." DIGIT
 // HTTP-name = %s"HTTP"
 // request-line = method SP request-target SP HTTP-version
@@ -178,7 +345,11 @@ func parseRequestLine(data []byte) (*RequestLine, int, error) {
 }
 
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	request := newRequest()
+	return RequestFromReaderWithOptions(reader, Options{})
+}
+
+func RequestFromReaderWithOptions(reader io.Reader, options Options) (*Request, error) {
+	request := newRequest(options)
 
 	buf := make([]byte, BUFFER_SIZE)
 	bufLen := 0
@@ -204,6 +375,24 @@ func RequestFromReader(reader io.Reader) (*Request, error) {
 
 		copy(buf, buf[parsedN:bufLen])
 		bufLen -= parsedN
+
+		// Whatever is left in the buffer while we are still in the request
+		// line or headers belongs to them, so it counts towards the limit.
+		maxHeader := options.MaxHeaderBytes
+		if maxHeader > 0 && request.parsingHead() && request.headBytes()+bufLen > maxHeader {
+			return nil, ERROR_HEADERS_TOO_LARGE
+		}
+	}
+
+	if bufLen > 0 {
+		request.buffered = buf[:bufLen]
+	}
+
+	if options.DecodeBody {
+		err := request.decodeBody()
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return request, nil
@@ -1,6 +1,12 @@
 package request
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -207,3 +213,325 @@ func TestRequestBodyParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.Error(t, err)
 }
+
+type ctxKey struct{}
+
+func TestRequestContext(t *testing.T) {
+	// Test: Parsed request has a background context
+	reader := &chunkReader{
+		data:             "GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		byteCountPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, context.Background(), r.Context())
+
+	// Test: WithContext returns a copy carrying the new context
+	ctx := context.WithValue(context.Background(), ctxKey{}, "value")
+	r2 := r.WithContext(ctx)
+	assert.Equal(t, "value", r2.Context().Value(ctxKey{}))
+	assert.Nil(t, r.Context().Value(ctxKey{}))
+	assert.Equal(t, r.RequestLine, r2.RequestLine)
+	assert.Equal(t, r.Headers, r2.Headers)
+}
+
+func TestRequestLimits(t *testing.T) {
+	// Test: Headers within the limit
+	data := "GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"
+	reader := &chunkReader{
+		data:             data,
+		byteCountPerRead: 3,
+	}
+	r, err := RequestFromReaderWithOptions(reader, Options{MaxHeaderBytes: len(data)})
+	require.NoError(t, err)
+	require.NotNil(t, r)
+
+	// Test: Headers exceed the limit
+	reader = &chunkReader{
+		data:             "GET / HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\n\r\n",
+		byteCountPerRead: 3,
+	}
+	_, err = RequestFromReaderWithOptions(reader, Options{MaxHeaderBytes: 32})
+	require.ErrorIs(t, err, ERROR_HEADERS_TOO_LARGE)
+
+	// Test: Body within the limit
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 13\r\n" +
+			"\r\n" +
+			"hello world!\n",
+		byteCountPerRead: 3,
+	}
+	r, err = RequestFromReaderWithOptions(reader, Options{MaxBodyBytes: 13})
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(r.Body))
+
+	// Test: Body exceeds the limit
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 13\r\n" +
+			"\r\n" +
+			"hello world!\n",
+		byteCountPerRead: 3,
+	}
+	_, err = RequestFromReaderWithOptions(reader, Options{MaxBodyBytes: 12})
+	require.ErrorIs(t, err, ERROR_BODY_TOO_LARGE)
+}
+
+func gzipString(t *testing.T, s string) string {
+	t.Helper()
+
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	_, err := zw.Write([]byte(s))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	return b.String()
+}
+
+func encodedRequest(encoding, body string) *chunkReader {
+	return &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Encoding: " + encoding + "\r\n" +
+			"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+			"\r\n" +
+			body,
+		byteCountPerRead: 7,
+	}
+}
+
+func TestRequestDecodeBody(t *testing.T) {
+	body := strings.Repeat("hello world!\n", 100)
+	gzipped := gzipString(t, body)
+
+	// Test: Bodies are left encoded unless asked to decode them
+	r, err := RequestFromReader(encodedRequest("gzip", gzipped))
+	require.NoError(t, err)
+	assert.Equal(t, gzipped, string(r.Body))
+	assert.Equal(t, "gzip", r.Headers.Get("Content-Encoding"))
+
+	// Test: gzip body
+	r, err = RequestFromReaderWithOptions(encodedRequest("gzip", gzipped), Options{DecodeBody: true})
+	require.NoError(t, err)
+	assert.Equal(t, body, string(r.Body))
+	assert.Equal(t, "", r.Headers.Get("Content-Encoding"))
+	assert.Equal(t, strconv.Itoa(len(body)), r.Headers.Get("Content-Length"))
+
+	// Test: deflate body in the zlib format
+	var b bytes.Buffer
+	zw := zlib.NewWriter(&b)
+	zw.Write([]byte(body))
+	zw.Close()
+	r, err = RequestFromReaderWithOptions(encodedRequest("deflate", b.String()), Options{DecodeBody: true})
+	require.NoError(t, err)
+	assert.Equal(t, body, string(r.Body))
+
+	// Test: Several codings are undone in reverse order
+	r, err = RequestFromReaderWithOptions(encodedRequest("gzip, identity, gzip", gzipString(t, gzipped)), Options{DecodeBody: true})
+	require.NoError(t, err)
+	assert.Equal(t, body, string(r.Body))
+
+	// Test: Unsupported encoding
+	_, err = RequestFromReaderWithOptions(encodedRequest("br", "whatever"), Options{DecodeBody: true})
+	require.ErrorIs(t, err, ERROR_UNSUPPORTED_CONTENT_ENCODING)
+
+	// Test: Corrupt data
+	_, err = RequestFromReaderWithOptions(encodedRequest("gzip", "not gzip at all"), Options{DecodeBody: true})
+	require.ErrorIs(t, err, ERROR_MALFORMED_BODY)
+
+	_, err = RequestFromReaderWithOptions(encodedRequest("gzip", gzipped[:len(gzipped)-10]), Options{DecodeBody: true})
+	require.ErrorIs(t, err, ERROR_MALFORMED_BODY)
+
+	// Test: Decoded size is limited, even if the encoded body is small
+	bomb := gzipString(t, strings.Repeat("\x00", 1<<20))
+	_, err = RequestFromReaderWithOptions(encodedRequest("gzip", bomb), Options{DecodeBody: true, MaxDecodedBodyBytes: 1 << 16})
+	require.ErrorIs(t, err, ERROR_BODY_TOO_LARGE)
+
+	// Test: MaxBodyBytes applies to the decoded body by default
+	_, err = RequestFromReaderWithOptions(encodedRequest("gzip", gzipped), Options{DecodeBody: true, MaxBodyBytes: len(body) - 1})
+	require.ErrorIs(t, err, ERROR_BODY_TOO_LARGE)
+
+	r, err = RequestFromReaderWithOptions(encodedRequest("gzip", gzipped), Options{DecodeBody: true, MaxBodyBytes: len(body)})
+	require.NoError(t, err)
+	assert.Equal(t, body, string(r.Body))
+
+	// Test: Without any limit set, a small bomb still can't inflate past the
+	// default
+	bomb = gzipString(t, strings.Repeat("\x00", DEFAULT_MAX_DECODED_BODY_BYTES+1))
+	require.Less(t, len(bomb), 64<<10)
+	_, err = RequestFromReaderWithOptions(encodedRequest("gzip", bomb), Options{DecodeBody: true})
+	require.ErrorIs(t, err, ERROR_BODY_TOO_LARGE)
+
+	// Test: A negative limit turns it off
+	r, err = RequestFromReaderWithOptions(encodedRequest("gzip", bomb), Options{DecodeBody: true, MaxDecodedBodyBytes: -1})
+	require.NoError(t, err)
+	assert.Len(t, r.Body, DEFAULT_MAX_DECODED_BODY_BYTES+1)
+}
+
+func TestRequestChunkedBody(t *testing.T) {
+	// Test: Chunked body
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"6\r\nhello \r\n" +
+			"7;ext=1\r\nworld!\n\r\n" +
+			"0\r\n" +
+			"\r\n",
+		byteCountPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(r.Body))
+	assert.Empty(t, r.Trailers)
+
+	// Test: Chunked body with trailers
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Trailer: X-Checksum\r\n" +
+			"\r\n" +
+			"1A\r\nabcdefghijklmnopqrstuvwxyz\r\n" +
+			"0\r\n" +
+			"X-Checksum: 42\r\n" +
+			"\r\n",
+		byteCountPerRead: 5,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "abcdefghijklmnopqrstuvwxyz", string(r.Body))
+	assert.Equal(t, "42", r.Trailers.Get("X-Checksum"))
+
+	// Test: Transfer-Encoding overrides Content-Length
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 100\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"2\r\nhi\r\n0\r\n\r\n",
+		byteCountPerRead: 4,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(r.Body))
+
+	// Test: Malformed chunk size
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"zz\r\nhi\r\n0\r\n\r\n",
+		byteCountPerRead: 4,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ERROR_MALFORMED_CHUNK)
+
+	// Test: Chunk data longer than its size
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"2\r\nhello\r\n0\r\n\r\n",
+		byteCountPerRead: 4,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ERROR_MALFORMED_CHUNK)
+
+	// Test: Unsupported transfer coding
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: gzip, chunked\r\n" +
+			"\r\n",
+		byteCountPerRead: 4,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ERROR_UNSUPPORTED_TRANSFER_ENCODING)
+
+	// Test: Chunked bodies count towards MaxBodyBytes
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"6\r\nhello \r\n" +
+			"7\r\nworld!\n\r\n" +
+			"0\r\n\r\n",
+		byteCountPerRead: 4,
+	}
+	_, err = RequestFromReaderWithOptions(reader, Options{MaxBodyBytes: 10})
+	require.ErrorIs(t, err, ERROR_BODY_TOO_LARGE)
+}
+
+func TestRequestBuffered(t *testing.T) {
+	// Test: Bytes read past the head are kept, the rest is left unread
+	reader := &chunkReader{
+		data: "GET /chat HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Upgrade: websocket\r\n" +
+			"\r\n" +
+			"\x81\x05hello",
+		byteCountPerRead: 100,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.NotEmpty(t, r.Buffered())
+	assert.Equal(t, "\x81\x05hello", string(r.Buffered())+reader.data[reader.pos:])
+
+	// Test: And past a chunked body
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n0\r\n\r\n" +
+			"next",
+		byteCountPerRead: 100,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+	assert.Equal(t, "next", string(r.Buffered())+reader.data[reader.pos:])
+
+	// Test: Nothing buffered when the request ends the read
+	reader = &chunkReader{
+		data:             "GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		byteCountPerRead: 100,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Empty(t, r.Buffered())
+}
+
+func TestRequestCookies(t *testing.T) {
+	// Test: Cookies from the header, in order
+	r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\nCookie: session=abc123; theme=\"dark\"\r\nCookie: empty=; session=second\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []Cookie{
+		{Name: "session", Value: "abc123"},
+		{Name: "theme", Value: "dark"},
+		{Name: "empty", Value: ""},
+		{Name: "session", Value: "second"},
+	}, r.Cookies())
+
+	c, err := r.Cookie("session")
+	require.NoError(t, err)
+	assert.Equal(t, "abc123", c.Value)
+
+	_, err = r.Cookie("missing")
+	assert.ErrorIs(t, err, ERROR_NO_COOKIE)
+
+	// Test: Invalid pairs are skipped
+	assert.Equal(t, []Cookie{{Name: "ok", Value: "1"}}, ParseCookies(`no-equals; bad name=1; bad=a b; bad="unterminated; ok=1; bad=back\slash`))
+	assert.Empty(t, ParseCookies(""))
+}
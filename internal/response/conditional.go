@@ -0,0 +1,184 @@
+package response
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/request"
+)
+
+// HTTP_DATE_LAYOUT is the IMF-fixdate format of RFC 9110, always in GMT.
+const HTTP_DATE_LAYOUT = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// Obsolete date formats recipients must still accept.
+const RFC_850_DATE_LAYOUT = "Monday, 02-Jan-06 15:04:05 GMT"
+const ASCTIME_DATE_LAYOUT = "Mon Jan _2 15:04:05 2006"
+
+// StrongETag returns a strong entity tag derived from the content itself.
+func StrongETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// WeakETag returns a weak entity tag derived from data, for representations
+// that are only semantically equivalent when data is the same, e.g. data
+// that is re-rendered or compressed on every response.
+func WeakETag(data []byte) string {
+	return "W/" + StrongETag(data)
+}
+
+// FileETag returns an entity tag built from a file's size and modification
+// time, which is cheap because it doesn't read the file.
+func FileETag(size int64, modTime time.Time) string {
+	return fmt.Sprintf(`"%x-%x"`, modTime.UnixNano(), size)
+}
+
+func FormatHTTPDate(t time.Time) string {
+	return t.UTC().Format(HTTP_DATE_LAYOUT)
+}
+
+// ParseHTTPDate parses a date in any of the three formats of RFC 9110.
+func ParseHTTPDate(s string) (time.Time, error) {
+	var t time.Time
+	var err error
+
+	for _, layout := range []string{HTTP_DATE_LAYOUT, RFC_850_DATE_LAYOUT, ASCTIME_DATE_LAYOUT} {
+		t, err = time.Parse(layout, s)
+		if err == nil {
+			return t, nil
+		}
+	}
+
+	return t, err
+}
+
+// SetLastModified sets the Last-Modified header. HTTP dates have a one
+// second resolution, so t is truncated.
+func SetLastModified(h headers.Headers, t time.Time) {
+	h.Replace("Last-Modified", FormatHTTPDate(t))
+}
+
+// CheckPreconditions evaluates the conditional headers of req against the
+// ETag and Last-Modified in h, in the order of RFC 9110 section 13.2.2.
+// It returns STATUS_OK if the request should go ahead, or else
+// STATUS_NOT_MODIFIED or STATUS_PRECONDITION_FAILED.
+//
+// Preconditions are evaluated before the method is applied, RFC 9110
+// 13.2.1. PreconditionHook only does that for GET and HEAD, so handlers of
+// other methods must call CheckPreconditions themselves before they act,
+// and answer anything but STATUS_OK instead of acting.
+func CheckPreconditions(req *request.Request, h headers.Headers) StatusCode {
+	etag := h.Get("ETag")
+	lastModified, lastModifiedErr := ParseHTTPDate(h.Get("Last-Modified"))
+	hasLastModified := lastModifiedErr == nil
+
+	method := req.RequestLine.Method
+	safe := method == "GET" || method == "HEAD"
+
+	// 1. If-Match, falling back to 2. If-Unmodified-Since.
+	if ifMatch := req.Headers.Get("If-Match"); ifMatch != "" {
+		if !etagListMatches(ifMatch, etag, true) {
+			return STATUS_PRECONDITION_FAILED
+		}
+	} else if ius := req.Headers.Get("If-Unmodified-Since"); ius != "" {
+		date, err := ParseHTTPDate(ius)
+		if err == nil && hasLastModified && lastModified.After(date) {
+			return STATUS_PRECONDITION_FAILED
+		}
+	}
+
+	// 3. If-None-Match, falling back to 4. If-Modified-Since.
+	if ifNoneMatch := req.Headers.Get("If-None-Match"); ifNoneMatch != "" {
+		if etagListMatches(ifNoneMatch, etag, false) {
+			if safe {
+				return STATUS_NOT_MODIFIED
+			}
+			return STATUS_PRECONDITION_FAILED
+		}
+	} else if ims := req.Headers.Get("If-Modified-Since"); ims != "" && safe {
+		date, err := ParseHTTPDate(ims)
+		if err == nil && hasLastModified && !lastModified.After(date) {
+			return STATUS_NOT_MODIFIED
+		}
+	}
+
+	return STATUS_OK
+}
+
+// PreconditionHook returns a header hook that turns successful responses
+// to a GET or HEAD req into 304 Not Modified or 412 Precondition Failed
+// when the validators the handler sent don't satisfy the request's
+// conditions. The server installs it on every response. Other methods are
+// left alone: by the time their headers are written the change is done,
+// see CheckPreconditions.
+func PreconditionHook(req *request.Request) HeaderHook {
+	method := req.RequestLine.Method
+
+	return func(statusCode StatusCode, h headers.Headers) StatusCode {
+		if method != "GET" && method != "HEAD" {
+			return statusCode
+		}
+
+		if statusCode < 200 || statusCode > 299 {
+			return statusCode
+		}
+
+		result := CheckPreconditions(req, h)
+		switch result {
+		case STATUS_NOT_MODIFIED:
+			StripBodyHeaders(h)
+		case STATUS_PRECONDITION_FAILED:
+			StripBodyHeaders(h)
+			h.Replace("Content-Length", "0")
+		default:
+			return statusCode
+		}
+
+		return result
+	}
+}
+
+// StripBodyHeaders removes the headers that describe a body from h, for a
+// response that won't have one.
+func StripBodyHeaders(h headers.Headers) {
+	h.Delete("Content-Length")
+	h.Delete("Content-Type")
+	h.Delete("Content-Range")
+	h.Delete("Transfer-Encoding")
+	h.Delete("Trailer")
+}
+
+// etagListMatches reports whether etag is in list, a comma separated list
+// of entity tags or "*". The strong comparison requires both tags to be
+// strong, the weak one ignores the W/ prefix.
+func etagListMatches(list, etag string, strong bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return etag != ""
+	}
+
+	if etag == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if strong {
+			if !isWeakETag(candidate) && !isWeakETag(etag) && candidate == etag {
+				return true
+			}
+		} else if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isWeakETag(etag string) bool {
+	return strings.HasPrefix(etag, "W/")
+}
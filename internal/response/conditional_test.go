@@ -0,0 +1,203 @@
+package response
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/request"
+)
+
+func newTestRequest(t *testing.T, method, requestHeaders string) *request.Request {
+	t.Helper()
+
+	req, err := request.RequestFromReader(strings.NewReader(method + " / HTTP/1.1\r\nHost: localhost\r\n" + requestHeaders + "\r\n"))
+	require.NoError(t, err)
+
+	return req
+}
+
+func TestETagsAndDates(t *testing.T) {
+	// Test: Strong and weak ETags
+	etag := StrongETag([]byte("hello"))
+	assert.Regexp(t, `^"[0-9a-f]{32}"$`, etag)
+	assert.Equal(t, etag, StrongETag([]byte("hello")))
+	assert.NotEqual(t, etag, StrongETag([]byte("hello!")))
+	assert.Equal(t, "W/"+etag, WeakETag([]byte("hello")))
+
+	// Test: Dates in all three formats
+	expected := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+	for _, s := range []string{"Sun, 06 Nov 1994 08:49:37 GMT", "Sunday, 06-Nov-94 08:49:37 GMT", "Sun Nov  6 08:49:37 1994"} {
+		date, err := ParseHTTPDate(s)
+		require.NoError(t, err, s)
+		assert.True(t, expected.Equal(date), s)
+	}
+	_, err := ParseHTTPDate("yesterday")
+	require.Error(t, err)
+
+	assert.Equal(t, "Sun, 06 Nov 1994 08:49:37 GMT", FormatHTTPDate(expected.In(time.FixedZone("CET", 3600))))
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	h := headers.NewHeaders()
+	h.Set("ETag", `"v1"`)
+	h.Set("Last-Modified", "Sun, 06 Nov 1994 08:49:37 GMT")
+
+	cases := []struct {
+		method   string
+		headers  string
+		expected StatusCode
+	}{
+		{"GET", "", STATUS_OK},
+		{"GET", "If-None-Match: \"v1\"\r\n", STATUS_NOT_MODIFIED},
+		{"GET", "If-None-Match: \"v0\", W/\"v1\"\r\n", STATUS_NOT_MODIFIED},
+		{"GET", "If-None-Match: *\r\n", STATUS_NOT_MODIFIED},
+		{"GET", "If-None-Match: \"v2\"\r\n", STATUS_OK},
+		{"POST", "If-None-Match: \"v1\"\r\n", STATUS_PRECONDITION_FAILED},
+		{"PUT", "If-Match: \"v1\"\r\n", STATUS_OK},
+		{"PUT", "If-Match: \"v2\"\r\n", STATUS_PRECONDITION_FAILED},
+		{"PUT", "If-Match: W/\"v1\"\r\n", STATUS_PRECONDITION_FAILED},
+		{"PUT", "If-Match: *\r\n", STATUS_OK},
+		{"GET", "If-Modified-Since: Sun, 06 Nov 1994 08:49:37 GMT\r\n", STATUS_NOT_MODIFIED},
+		{"GET", "If-Modified-Since: Sat, 05 Nov 1994 08:49:37 GMT\r\n", STATUS_OK},
+		{"GET", "If-Modified-Since: garbage\r\n", STATUS_OK},
+		{"POST", "If-Modified-Since: Sun, 06 Nov 1994 08:49:37 GMT\r\n", STATUS_OK},
+		{"PUT", "If-Unmodified-Since: Sat, 05 Nov 1994 08:49:37 GMT\r\n", STATUS_PRECONDITION_FAILED},
+		{"PUT", "If-Unmodified-Since: Sun, 06 Nov 1994 08:49:37 GMT\r\n", STATUS_OK},
+		// If-None-Match takes precedence over If-Modified-Since.
+		{"GET", "If-None-Match: \"v2\"\r\nIf-Modified-Since: Sun, 06 Nov 1994 08:49:37 GMT\r\n", STATUS_OK},
+		// If-Match takes precedence over If-Unmodified-Since.
+		{"PUT", "If-Match: \"v1\"\r\nIf-Unmodified-Since: Sat, 05 Nov 1994 08:49:37 GMT\r\n", STATUS_OK},
+		// If-Match is evaluated before If-None-Match.
+		{"GET", "If-Match: \"v2\"\r\nIf-None-Match: \"v1\"\r\n", STATUS_PRECONDITION_FAILED},
+	}
+
+	for _, c := range cases {
+		req := newTestRequest(t, c.method, c.headers)
+		assert.Equal(t, c.expected, CheckPreconditions(req, h), c.method+" "+c.headers)
+	}
+
+	// Test: Without validators, only "*" can match
+	req := newTestRequest(t, "PUT", "If-Match: *\r\n")
+	assert.Equal(t, STATUS_PRECONDITION_FAILED, CheckPreconditions(req, headers.NewHeaders()))
+}
+
+func TestPreconditionHook(t *testing.T) {
+	body := []byte("hello")
+
+	write := func(req *request.Request, statusCode StatusCode) string {
+		var b bytes.Buffer
+		w := NewWriter(&b)
+		w.AddHeaderHook(PreconditionHook(req))
+
+		h := GetDefaultHeaders(len(body))
+		h.Set("ETag", StrongETag(body))
+		w.WriteStatusLine(statusCode)
+		w.WriteHeaders(h)
+		n, err := w.WriteBody(body)
+		require.NoError(t, err)
+		assert.Equal(t, len(body), n)
+
+		return b.String()
+	}
+
+	// Test: Matching If-None-Match turns a 200 into a bodiless 304
+	req := newTestRequest(t, "GET", "If-None-Match: "+StrongETag(body)+"\r\n")
+	resp := write(req, STATUS_OK)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 304 Not Modified\r\n"))
+	assert.Contains(t, resp, "etag: "+StrongETag(body)+"\r\n")
+	assert.NotContains(t, resp, "content-length")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n"))
+
+	// Test: Failed If-Match turns it into a 412
+	req = newTestRequest(t, "GET", "If-Match: \"other\"\r\n")
+	resp = write(req, STATUS_OK)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 412 Precondition Failed\r\n"))
+	assert.Contains(t, resp, "content-length: 0\r\n")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n"))
+
+	// Test: Error responses are left alone
+	resp = write(req, STATUS_NOT_FOUND)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 404 Not Found\r\n"))
+	assert.True(t, strings.HasSuffix(resp, "hello"))
+
+	// Test: A PUT that created the resource keeps its 201, even though
+	// the new ETag matches If-None-Match: *
+	req = newTestRequest(t, "PUT", "If-None-Match: *\r\n")
+	resp = write(req, STATUS_CREATED)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 201 Created\r\n"))
+	assert.True(t, strings.HasSuffix(resp, "hello"))
+
+	// Test: So does one answering If-Match, whatever ETag it sends
+	req = newTestRequest(t, "PUT", "If-Match: \"other\"\r\n")
+	resp = write(req, STATUS_OK)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+}
+
+func TestCheckPreconditionsBeforeActing(t *testing.T) {
+	var etag string
+
+	// put is a handler that creates or replaces a resource, checking the
+	// preconditions against its current state first.
+	put := func(req *request.Request) string {
+		var b bytes.Buffer
+		w := NewWriter(&b)
+		w.AddHeaderHook(PreconditionHook(req))
+
+		current := headers.NewHeaders()
+		if etag != "" {
+			current.Set("ETag", etag)
+		}
+
+		if statusCode := CheckPreconditions(req, current); statusCode != STATUS_OK {
+			w.WriteStatusLine(statusCode)
+			w.WriteHeaders(GetDefaultHeaders(0))
+			return b.String()
+		}
+
+		statusCode := STATUS_OK
+		if etag == "" {
+			statusCode = STATUS_CREATED
+		}
+		etag = StrongETag(req.Body)
+
+		h := GetDefaultHeaders(0)
+		h.Set("ETag", etag)
+		w.WriteStatusLine(statusCode)
+		w.WriteHeaders(h)
+
+		return b.String()
+	}
+
+	// Test: If-None-Match: * lets the first PUT create the resource
+	req := newTestRequest(t, "PUT", "If-None-Match: *\r\n")
+	resp := put(req)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 201 Created\r\n"), resp)
+	created := etag
+
+	// Test: And stops the second one before it overwrites anything
+	resp = put(req)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 412 Precondition Failed\r\n"), resp)
+	assert.Equal(t, created, etag)
+
+	// Test: If-Match against another version fails before acting
+	req = newTestRequest(t, "PUT", "If-Match: \"other\"\r\n")
+	resp = put(req)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 412 Precondition Failed\r\n"), resp)
+	assert.Equal(t, created, etag)
+}
+
+func TestServeContentConditional(t *testing.T) {
+	h := headers.NewHeaders()
+	SetLastModified(h, time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC))
+
+	// Test: 304 from If-Modified-Since
+	resp := serveContent(t, "If-Modified-Since: Sun, 06 Nov 1994 08:49:37 GMT\r\n", h, "content")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 304 Not Modified\r\n"))
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n"))
+}
@@ -0,0 +1,168 @@
+package response
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/request"
+)
+
+var ERROR_INVALID_COOKIE_NAME = errors.New("invalid cookie name")
+var ERROR_INVALID_COOKIE_VALUE = errors.New("invalid cookie value")
+var ERROR_INVALID_COOKIE_ATTRIBUTE = errors.New("invalid cookie attribute")
+
+type SameSite string
+
+// An empty SameSite leaves it to the browser, which treats the cookie as
+// Lax these days.
+const (
+	SAME_SITE_DEFAULT SameSite = ""
+	SAME_SITE_LAX     SameSite = "Lax"
+	SAME_SITE_STRICT  SameSite = "Strict"
+	SAME_SITE_NONE    SameSite = "None"
+)
+
+// Cookie is a cookie to send with Set-Cookie, RFC 6265 4.1.
+type Cookie struct {
+	Name  string
+	Value string
+
+	// Expires is left out when zero.
+	Expires time.Time
+	// MaxAge is in seconds, and left out when zero. Negative means the
+	// cookie should be deleted now, and is sent as Max-Age=0.
+	MaxAge int
+
+	Domain string
+	Path   string
+
+	Secure   bool
+	HttpOnly bool
+	SameSite SameSite
+	// Partitioned keeps the cookie to the top-level site it was set under,
+	// as CHIPS describes. It requires Secure.
+	Partitioned bool
+}
+
+// Validate checks that c can be sent as it is. The errors are
+// ERROR_INVALID_COOKIE_NAME, ERROR_INVALID_COOKIE_VALUE and
+// ERROR_INVALID_COOKIE_ATTRIBUTE.
+func (c Cookie) Validate() error {
+	if !headers.IsToken(c.Name) {
+		return ERROR_INVALID_COOKIE_NAME
+	}
+
+	if !request.ValidCookieValue(c.Value) {
+		return ERROR_INVALID_COOKIE_VALUE
+	}
+
+	if !validAttributeValue(c.Domain) || !validAttributeValue(c.Path) {
+		return ERROR_INVALID_COOKIE_ATTRIBUTE
+	}
+
+	if !c.Expires.IsZero() && c.Expires.Year() < 1601 {
+		return ERROR_INVALID_COOKIE_ATTRIBUTE
+	}
+
+	switch c.SameSite {
+	case SAME_SITE_DEFAULT, SAME_SITE_LAX, SAME_SITE_STRICT:
+	case SAME_SITE_NONE:
+		// Browsers reject SameSite=None cookies that aren't Secure.
+		if !c.Secure {
+			return ERROR_INVALID_COOKIE_ATTRIBUTE
+		}
+	default:
+		return ERROR_INVALID_COOKIE_ATTRIBUTE
+	}
+
+	if c.Partitioned && !c.Secure {
+		return ERROR_INVALID_COOKIE_ATTRIBUTE
+	}
+
+	return nil
+}
+
+// validAttributeValue reports whether s can be an attribute value: any CHAR
+// except CTLs and ";", RFC 6265 4.1.1.
+func validAttributeValue(s string) bool {
+	for _, c := range []byte(s) {
+		if c < ' ' || c >= 0x7F || c == ';' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// String returns the Set-Cookie value for c. It doesn't validate c; use
+// SetCookie for that.
+func (c Cookie) String() string {
+	var b strings.Builder
+
+	b.WriteString(c.Name)
+	b.WriteByte('=')
+	b.WriteString(c.Value)
+
+	if !c.Expires.IsZero() {
+		b.WriteString("; Expires=")
+		b.WriteString(FormatHTTPDate(c.Expires))
+	}
+
+	if c.MaxAge > 0 {
+		b.WriteString("; Max-Age=")
+		b.WriteString(strconv.Itoa(c.MaxAge))
+	} else if c.MaxAge < 0 {
+		b.WriteString("; Max-Age=0")
+	}
+
+	if c.Domain != "" {
+		b.WriteString("; Domain=")
+		// A leading dot is ignored, RFC 6265 5.2.3.
+		b.WriteString(strings.TrimPrefix(c.Domain, "."))
+	}
+
+	if c.Path != "" {
+		b.WriteString("; Path=")
+		b.WriteString(c.Path)
+	}
+
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+
+	if c.SameSite != SAME_SITE_DEFAULT {
+		b.WriteString("; SameSite=")
+		b.WriteString(string(c.SameSite))
+	}
+
+	if c.Partitioned {
+		b.WriteString("; Partitioned")
+	}
+
+	return b.String()
+}
+
+// SetCookie adds a Set-Cookie field for c to h, if c is valid.
+func SetCookie(h headers.Headers, c Cookie) error {
+	err := c.Validate()
+	if err != nil {
+		return err
+	}
+
+	h.Set("Set-Cookie", c.String())
+
+	return nil
+}
+
+// DeleteCookie adds a Set-Cookie field to h that deletes the cookie named
+// name. path and domain must match those it was set with.
+func DeleteCookie(h headers.Headers, name, path, domain string) error {
+	return SetCookie(h, Cookie{Name: name, Path: path, Domain: domain, MaxAge: -1, Expires: time.Unix(0, 0)})
+}
@@ -0,0 +1,97 @@
+package response
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCookieString(t *testing.T) {
+	// Test: Just a name and value
+	assert.Equal(t, "id=a3fWa", Cookie{Name: "id", Value: "a3fWa"}.String())
+
+	// Test: Every attribute
+	c := Cookie{
+		Name:        "session",
+		Value:       "abc123",
+		Expires:     time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC),
+		MaxAge:      3600,
+		Domain:      ".example.com",
+		Path:        "/app",
+		Secure:      true,
+		HttpOnly:    true,
+		SameSite:    SAME_SITE_NONE,
+		Partitioned: true,
+	}
+	require.NoError(t, c.Validate())
+	assert.Equal(t, "session=abc123; Expires=Wed, 21 Oct 2015 07:28:00 GMT; Max-Age=3600; Domain=example.com; Path=/app; Secure; HttpOnly; SameSite=None; Partitioned", c.String())
+
+	// Test: Negative MaxAge expires the cookie now
+	assert.Equal(t, "id=; Max-Age=0", Cookie{Name: "id", MaxAge: -1}.String())
+}
+
+func TestCookieValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		cookie Cookie
+		err    error
+	}{
+		{"Empty name", Cookie{Value: "1"}, ERROR_INVALID_COOKIE_NAME},
+		{"Name with a space", Cookie{Name: "my id", Value: "1"}, ERROR_INVALID_COOKIE_NAME},
+		{"Name with an equals sign", Cookie{Name: "a=b", Value: "1"}, ERROR_INVALID_COOKIE_NAME},
+		{"Value with a semicolon", Cookie{Name: "id", Value: "a;b"}, ERROR_INVALID_COOKIE_VALUE},
+		{"Value with a space", Cookie{Name: "id", Value: "a b"}, ERROR_INVALID_COOKIE_VALUE},
+		{"Value with a newline", Cookie{Name: "id", Value: "a\nSet-Cookie: b=c"}, ERROR_INVALID_COOKIE_VALUE},
+		{"Path with a semicolon", Cookie{Name: "id", Path: "/;Domain=evil.com"}, ERROR_INVALID_COOKIE_ATTRIBUTE},
+		{"Domain with a control character", Cookie{Name: "id", Domain: "example.com\r\n"}, ERROR_INVALID_COOKIE_ATTRIBUTE},
+		{"Unknown SameSite", Cookie{Name: "id", SameSite: "Loose"}, ERROR_INVALID_COOKIE_ATTRIBUTE},
+		{"SameSite=None without Secure", Cookie{Name: "id", SameSite: SAME_SITE_NONE}, ERROR_INVALID_COOKIE_ATTRIBUTE},
+		{"Partitioned without Secure", Cookie{Name: "id", Partitioned: true}, ERROR_INVALID_COOKIE_ATTRIBUTE},
+		{"Expires before 1601", Cookie{Name: "id", Expires: time.Date(1600, 1, 1, 0, 0, 0, 0, time.UTC)}, ERROR_INVALID_COOKIE_ATTRIBUTE},
+		{"Quoted value", Cookie{Name: "id", Value: `"quoted"`}, nil},
+		{"Strict", Cookie{Name: "id", Value: "1", SameSite: SAME_SITE_STRICT, Path: "/"}, nil},
+	}
+
+	for _, tt := range tests {
+		err := tt.cookie.Validate()
+		if tt.err == nil {
+			assert.NoError(t, err, tt.name)
+		} else {
+			assert.ErrorIs(t, err, tt.err, tt.name)
+		}
+	}
+}
+
+func TestSetCookie(t *testing.T) {
+	h := GetDefaultHeaders(0)
+
+	// Test: Invalid cookies are not added
+	err := SetCookie(h, Cookie{Name: "bad name"})
+	assert.ErrorIs(t, err, ERROR_INVALID_COOKIE_NAME)
+	assert.Empty(t, h.Get("Set-Cookie"))
+
+	// Test: Each cookie gets its own field
+	require.NoError(t, SetCookie(h, Cookie{Name: "a", Value: "1", Path: "/"}))
+	require.NoError(t, SetCookie(h, Cookie{Name: "b", Value: "2", HttpOnly: true}))
+	require.NoError(t, DeleteCookie(h, "c", "/", ""))
+	assert.Equal(t, []string{"a=1; Path=/", "b=2; HttpOnly", "c=; Expires=Thu, 01 Jan 1970 00:00:00 GMT; Max-Age=0; Path=/"}, h.Values("Set-Cookie"))
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(STATUS_OK))
+	require.NoError(t, w.WriteHeaders(h))
+
+	head := buf.String()
+	assert.Equal(t, 3, strings.Count(head, "set-cookie: "))
+	assert.Contains(t, head, "set-cookie: a=1; Path=/\r\n")
+	assert.Contains(t, head, "set-cookie: b=2; HttpOnly\r\n")
+
+	// Test: They survive a round trip through the parser
+	resp, err := ResponseFromReader(strings.NewReader(head))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, h.Values("Set-Cookie"), resp.Headers.Values("Set-Cookie"))
+}
@@ -0,0 +1,359 @@
+package response
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"httpffomtcp.pinglu.dev/internal/chunked"
+	"httpffomtcp.pinglu.dev/internal/headers"
+)
+
+var ERROR_MALFORMED_STATUS_LINE = errors.New("malformed status line")
+var ERROR_UNSUPPORTED_HTTP_VERSION = errors.New("unsupported http version")
+var ERROR_MALFORMED_CONTENT_LENGTH = errors.New("malformed content length")
+var ERROR_CONTENT_LENGTH_EXCEEDED = errors.New("content length exceeded")
+var ERROR_MALFORMED_CHUNK = chunked.ERROR_MALFORMED_CHUNK
+var ERROR_UNSUPPORTED_TRANSFER_ENCODING = errors.New("unsupported transfer encoding")
+var ERROR_HEADERS_TOO_LARGE = errors.New("status line and headers too large")
+var ERROR_BODY_TOO_LARGE = errors.New("body too large")
+
+const PARSE_BUFFER_SIZE = 8
+
+// MAX_CHUNK_SIZE_LINE_BYTES bounds a chunk size line, extensions included.
+const MAX_CHUNK_SIZE_LINE_BYTES = chunked.MAX_SIZE_LINE_BYTES
+
+// ParseOptions tells ResponseFromReaderWithOptions what it is reading. A
+// zero limit means no limit.
+type ParseOptions struct {
+	// Method is the method of the request the response answers. Responses
+	// to HEAD have no body, whatever their headers say.
+	Method string
+
+	MaxHeaderBytes int
+	MaxBodyBytes   int
+}
+
+type StatusLine struct {
+	HttpVersion  string
+	StatusCode   StatusCode
+	ReasonPhrase string
+}
+
+type parserState string
+
+const (
+	PARSING_STATUS_LINE parserState = "parsing status line"
+	PARSING_HEADERS     parserState = "parsing headers"
+	PARSING_BODY        parserState = "parsing body"
+	PARSING_CHUNKED     parserState = "parsing chunked body"
+	PARSING_UNTIL_EOF   parserState = "parsing until eof"
+	PARSING_DONE        parserState = "parsing done"
+)
+
+type Response struct {
+	StatusLine StatusLine
+	Headers    headers.Headers
+	Body       []byte
+	// Trailers holds the trailer fields of a chunked body.
+	Trailers    headers.Headers
+	parserState parserState
+	options     ParseOptions
+	headerBytes int
+	chunks      *chunked.Parser
+}
+
+func newResponse(options ParseOptions) *Response {
+	return &Response{
+		Headers:     headers.NewHeaders(),
+		Trailers:    headers.NewHeaders(),
+		parserState: PARSING_STATUS_LINE,
+		options:     options,
+	}
+}
+
+func (r *Response) parse(data []byte) (int, error) {
+	totalBytesParsed := 0
+	startIndex := 0
+
+outer:
+	for {
+		switch r.parserState {
+		case PARSING_STATUS_LINE:
+			sl, n, err := ParseStatusLine(data[startIndex:])
+			if err != nil {
+				return 0, err
+			}
+
+			if n == 0 {
+				break outer
+			}
+
+			r.StatusLine = *sl
+			r.headerBytes += n
+			totalBytesParsed += n
+			startIndex = totalBytesParsed
+			r.parserState = PARSING_HEADERS
+		case PARSING_HEADERS:
+			n, done, err := r.Headers.Parse(data[startIndex:])
+			if err != nil {
+				return 0, err
+			}
+
+			if n == 0 {
+				break outer
+			}
+
+			r.headerBytes += n
+			totalBytesParsed += n
+			startIndex = totalBytesParsed
+
+			if done {
+				r.parserState = PARSING_BODY
+			}
+		case PARSING_BODY:
+			statusCode := r.StatusLine.StatusCode
+
+			// Interim responses are followed by the real one. 101 Switching
+			// Protocols ends HTTP on the connection.
+			if statusCode < 200 && statusCode != 101 {
+				r.StatusLine = StatusLine{}
+				r.Headers = headers.NewHeaders()
+				r.parserState = PARSING_STATUS_LINE
+				continue
+			}
+
+			if !r.hasBody() {
+				r.parserState = PARSING_DONE
+				break outer
+			}
+
+			if te := r.Headers.Get("transfer-encoding"); te != "" {
+				if !chunked.IsChunked(te) {
+					return 0, ERROR_UNSUPPORTED_TRANSFER_ENCODING
+				}
+
+				// Transfer-Encoding overrides Content-Length, RFC 9112 6.3.
+				r.chunks = chunked.NewParser(r.Trailers)
+				r.parserState = PARSING_CHUNKED
+				continue
+			}
+
+			contentLen := r.Headers.Get("content-length")
+			if contentLen == "" {
+				// The body runs until the server closes the connection.
+				r.parserState = PARSING_UNTIL_EOF
+				continue
+			}
+
+			specifiedBodyLen, err := strconv.Atoi(contentLen)
+			if err != nil || specifiedBodyLen < 0 {
+				return 0, ERROR_MALFORMED_CONTENT_LENGTH
+			}
+
+			maxBody := r.options.MaxBodyBytes
+			if maxBody > 0 && specifiedBodyLen > maxBody {
+				return 0, ERROR_BODY_TOO_LARGE
+			}
+
+			oldLen := len(r.Body)
+
+			r.Body = append(r.Body, data[startIndex:]...)
+			newLen := len(r.Body)
+
+			if newLen > specifiedBodyLen {
+				return 0, ERROR_CONTENT_LENGTH_EXCEEDED
+			}
+
+			totalBytesParsed += newLen - oldLen
+
+			if newLen == specifiedBodyLen {
+				r.parserState = PARSING_DONE
+			} else {
+				break outer
+			}
+		case PARSING_CHUNKED:
+			n, err := r.chunks.Parse(data[startIndex:])
+			if err != nil {
+				return 0, err
+			}
+
+			totalBytesParsed += n
+			startIndex = totalBytesParsed
+
+			if r.chunks.Done() {
+				r.parserState = PARSING_DONE
+				continue
+			}
+
+			remaining := r.chunks.Remaining()
+			if remaining == 0 {
+				break outer
+			}
+
+			maxBody := r.options.MaxBodyBytes
+			if maxBody > 0 && int64(len(r.Body))+remaining > int64(maxBody) {
+				return 0, ERROR_BODY_TOO_LARGE
+			}
+
+			n = int(min(remaining, int64(len(data)-startIndex)))
+			if n == 0 {
+				break outer
+			}
+
+			r.Body = append(r.Body, data[startIndex:startIndex+n]...)
+			r.chunks.Consume(n)
+			totalBytesParsed += n
+			startIndex = totalBytesParsed
+		case PARSING_UNTIL_EOF:
+			n := len(data) - startIndex
+			if n == 0 {
+				break outer
+			}
+
+			maxBody := r.options.MaxBodyBytes
+			if maxBody > 0 && len(r.Body)+n > maxBody {
+				return 0, ERROR_BODY_TOO_LARGE
+			}
+
+			r.Body = append(r.Body, data[startIndex:]...)
+			totalBytesParsed += n
+			startIndex = totalBytesParsed
+		case PARSING_DONE:
+			break outer
+		}
+	}
+
+	return totalBytesParsed, nil
+}
+
+// hasBody reports whether the response can have a body, RFC 9112 6.3.
+func (r *Response) hasBody() bool {
+	statusCode := r.StatusLine.StatusCode
+
+	return r.options.Method != "HEAD" && statusCode >= 200 && statusCode != 204 && statusCode != STATUS_NOT_MODIFIED
+}
+
+func (r *Response) done() bool {
+	return r.parserState == PARSING_DONE
+}
+
+// parsingHead reports whether the parser is in the status line, the
+// headers or the trailers, which share MaxHeaderBytes.
+func (r *Response) parsingHead() bool {
+	return r.parserState == PARSING_STATUS_LINE || r.parserState == PARSING_HEADERS || (r.parserState == PARSING_CHUNKED && r.chunks.InTrailers())
+}
+
+// headBytes returns the size of the status line, headers and trailers
+// parsed so far.
+func (r *Response) headBytes() int {
+	if r.chunks == nil {
+		return r.headerBytes
+	}
+
+	return r.headerBytes + r.chunks.TrailerBytes()
+}
+
+// ParseStatusLine parses the status line at the start of data. It returns
+// 0 bytes parsed if data doesn't hold the whole line yet.
+//
+// HTTP-version = HTTP-name "/" DIGIT "." DIGIT
+// status-line = HTTP-version SP status-code SP [ reason-phrase ]
+func ParseStatusLine(data []byte) (*StatusLine, int, error) {
+	index := bytes.Index(data, []byte(CRLF))
+	if index == -1 {
+		return nil, 0, nil
+	}
+
+	line := string(data[:index])
+	bytesParsed := index + len(CRLF)
+
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 {
+		return nil, 0, ERROR_MALFORMED_STATUS_LINE
+	}
+
+	httpParts := strings.Split(parts[0], "/")
+	if len(httpParts) != 2 || httpParts[0] != "HTTP" {
+		return nil, 0, ERROR_MALFORMED_STATUS_LINE
+	}
+
+	if httpParts[1] != "1.1" && httpParts[1] != "1.0" {
+		return nil, 0, ERROR_UNSUPPORTED_HTTP_VERSION
+	}
+
+	statusCode, err := strconv.Atoi(parts[1])
+	if err != nil || len(parts[1]) != 3 || statusCode < 100 {
+		return nil, 0, ERROR_MALFORMED_STATUS_LINE
+	}
+
+	sl := &StatusLine{
+		HttpVersion: httpParts[1],
+		StatusCode:  StatusCode(statusCode),
+	}
+
+	if len(parts) == 3 {
+		sl.ReasonPhrase = parts[2]
+	}
+
+	return sl, bytesParsed, nil
+}
+
+func ResponseFromReader(reader io.Reader) (*Response, error) {
+	return ResponseFromReaderWithOptions(reader, ParseOptions{})
+}
+
+// ResponseFromReaderWithOptions reads one response from reader. A body
+// without Content-Length or chunked encoding runs until reader returns
+// io.EOF; any other body cut short is an io.ErrUnexpectedEOF.
+func ResponseFromReaderWithOptions(reader io.Reader, options ParseOptions) (*Response, error) {
+	response := newResponse(options)
+
+	buf := make([]byte, PARSE_BUFFER_SIZE)
+	bufLen := 0
+
+	for !response.done() {
+		if bufLen >= len(buf) {
+			newBuf := make([]byte, len(buf)+PARSE_BUFFER_SIZE)
+			copy(newBuf, buf)
+			buf = newBuf
+		}
+
+		n, readErr := reader.Read(buf[bufLen:])
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return nil, readErr
+		}
+
+		bufLen += n
+
+		parsedN, err := response.parse(buf[:bufLen])
+		if err != nil {
+			return nil, err
+		}
+
+		copy(buf, buf[parsedN:bufLen])
+		bufLen -= parsedN
+
+		// Whatever is left in the buffer while we are still in the status
+		// line or headers belongs to them, so it counts towards the limit.
+		maxHeader := options.MaxHeaderBytes
+		if maxHeader > 0 && response.parsingHead() && response.headBytes()+bufLen > maxHeader {
+			return nil, ERROR_HEADERS_TOO_LARGE
+		}
+
+		if errors.Is(readErr, io.EOF) {
+			if response.parserState == PARSING_UNTIL_EOF {
+				response.parserState = PARSING_DONE
+				break
+			}
+
+			if !response.done() {
+				return nil, io.ErrUnexpectedEOF
+			}
+		}
+	}
+
+	return response, nil
+}
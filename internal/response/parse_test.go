@@ -0,0 +1,198 @@
+package response
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+)
+
+// chunkReader hands out data a few bytes at a time, then io.EOF.
+type chunkReader struct {
+	data             string
+	byteCountPerRead int
+	pos              int
+}
+
+func (cr *chunkReader) Read(p []byte) (n int, err error) {
+	if cr.pos >= len(cr.data) {
+		return 0, io.EOF
+	}
+
+	endIndex := min(cr.pos+cr.byteCountPerRead, len(cr.data))
+
+	n = copy(p, cr.data[cr.pos:endIndex])
+	cr.pos += n
+
+	return n, nil
+}
+
+// roundTrip parses what write makes a Writer produce, reading it a few
+// bytes at a time.
+func roundTrip(t *testing.T, options ParseOptions, write func(w *Writer)) *Response {
+	t.Helper()
+
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	write(w)
+	require.NoError(t, w.Finish())
+
+	resp, err := ResponseFromReaderWithOptions(&chunkReader{data: b.String(), byteCountPerRead: 3}, options)
+	require.NoError(t, err)
+
+	return resp
+}
+
+func TestResponseFromReaderRoundTrip(t *testing.T) {
+	// Test: Content-Length body
+	resp := roundTrip(t, ParseOptions{}, func(w *Writer) {
+		w.WriteStatusLine(STATUS_OK)
+		w.WriteHeaders(GetDefaultHeaders(len("hello world")))
+		w.WriteBody([]byte("hello world"))
+	})
+	assert.Equal(t, StatusLine{HttpVersion: "1.1", StatusCode: STATUS_OK, ReasonPhrase: "OK"}, resp.StatusLine)
+	assert.Equal(t, "text/plain", resp.Headers.Get("Content-Type"))
+	assert.Equal(t, "close", resp.Headers.Get("Connection"))
+	assert.Equal(t, "hello world", string(resp.Body))
+
+	// Test: Chunked body with trailers
+	resp = roundTrip(t, ParseOptions{}, func(w *Writer) {
+		w.WriteStatusLine(STATUS_OK)
+
+		h := GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Checksum")
+		w.WriteHeaders(h)
+
+		w.WriteChunkedBody([]byte("hello "))
+		w.WriteChunkedBody([]byte("world"))
+		w.WriteChunkedBodyDone()
+
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Checksum", "42")
+		w.WriteTrailers(trailers)
+	})
+	assert.Equal(t, "hello world", string(resp.Body))
+	assert.Equal(t, "42", resp.Trailers.Get("X-Checksum"))
+
+	// Test: Chunked body without trailers
+	resp = roundTrip(t, ParseOptions{}, func(w *Writer) {
+		w.WriteStatusLine(STATUS_OK)
+
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		w.WriteHeaders(h)
+
+		w.WriteChunkedBody([]byte("streamed"))
+		w.WriteChunkedBodyDone()
+	})
+	assert.Equal(t, "streamed", string(resp.Body))
+	assert.Empty(t, resp.Trailers)
+
+	// Test: Body delimited by the end of the stream
+	resp = roundTrip(t, ParseOptions{}, func(w *Writer) {
+		w.WriteStatusLine(STATUS_OK)
+		w.WriteHeaders(headers.NewHeaders())
+		w.WriteBody([]byte("until eof"))
+	})
+	assert.Equal(t, "until eof", string(resp.Body))
+
+	// Test: Status codes without a reason phrase
+	resp = roundTrip(t, ParseOptions{}, func(w *Writer) {
+		w.WriteStatusLine(StatusCode(299))
+		w.WriteHeaders(GetDefaultHeaders(0))
+	})
+	assert.Equal(t, StatusCode(299), resp.StatusLine.StatusCode)
+	assert.Equal(t, "", resp.StatusLine.ReasonPhrase)
+	assert.Empty(t, resp.Body)
+
+	// Test: Header hooks are reflected
+	resp = roundTrip(t, ParseOptions{}, func(w *Writer) {
+		w.AddHeaderHook(func(statusCode StatusCode, h headers.Headers) StatusCode {
+			h.Replace("Content-Length", "0")
+			return STATUS_NOT_FOUND
+		})
+		w.WriteStatusLine(STATUS_OK)
+		w.WriteHeaders(GetDefaultHeaders(5))
+		w.WriteBody([]byte("gone!"))
+	})
+	assert.Equal(t, STATUS_NOT_FOUND, resp.StatusLine.StatusCode)
+	assert.Equal(t, "Not Found", resp.StatusLine.ReasonPhrase)
+	assert.Empty(t, resp.Body)
+
+	// Test: 304 and HEAD responses have no body
+	resp = roundTrip(t, ParseOptions{}, func(w *Writer) {
+		w.WriteStatusLine(STATUS_NOT_MODIFIED)
+		w.WriteHeaders(headers.NewHeaders())
+	})
+	assert.Equal(t, STATUS_NOT_MODIFIED, resp.StatusLine.StatusCode)
+
+	resp = roundTrip(t, ParseOptions{Method: "HEAD"}, func(w *Writer) {
+		w.WriteStatusLine(STATUS_OK)
+		w.WriteHeaders(GetDefaultHeaders(100))
+	})
+	assert.Equal(t, "100", resp.Headers.Get("Content-Length"))
+	assert.Empty(t, resp.Body)
+}
+
+func TestResponseFromReader(t *testing.T) {
+	// Test: Chunk extensions are ignored
+	resp, err := ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5;name=value\r\nhello\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(resp.Body))
+
+	// Test: Interim responses are skipped
+	resp, err = ResponseFromReader(strings.NewReader("HTTP/1.1 100 Continue\r\n\r\nHTTP/1.0 201 Created\r\nContent-Length: 4\r\n\r\ndone"))
+	require.NoError(t, err)
+	assert.Equal(t, StatusLine{HttpVersion: "1.0", StatusCode: 201, ReasonPhrase: "Created"}, resp.StatusLine)
+	assert.Equal(t, "done", string(resp.Body))
+
+	// Test: Reason phrases can contain spaces
+	resp, err = ResponseFromReader(strings.NewReader("HTTP/1.1 404 Not Found Here\r\nContent-Length: 0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "Not Found Here", resp.StatusLine.ReasonPhrase)
+
+	tests := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{name: "Missing status code", data: "HTTP/1.1\r\n\r\n", err: ERROR_MALFORMED_STATUS_LINE},
+		{name: "Status code not a number", data: "HTTP/1.1 abc OK\r\n\r\n", err: ERROR_MALFORMED_STATUS_LINE},
+		{name: "Not HTTP", data: "SPDY/3 200 OK\r\n\r\n", err: ERROR_MALFORMED_STATUS_LINE},
+		{name: "Unsupported version", data: "HTTP/2.0 200 OK\r\n\r\n", err: ERROR_UNSUPPORTED_HTTP_VERSION},
+		{name: "Malformed Content-Length", data: "HTTP/1.1 200 OK\r\nContent-Length: ten\r\n\r\n", err: ERROR_MALFORMED_CONTENT_LENGTH},
+		{name: "Body shorter than Content-Length", data: "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nhello", err: io.ErrUnexpectedEOF},
+		{name: "Malformed chunk size", data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n", err: ERROR_MALFORMED_CHUNK},
+		{name: "Missing CRLF after chunk", data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhelloXX0\r\n\r\n", err: ERROR_MALFORMED_CHUNK},
+		{name: "Truncated chunked body", data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhel", err: io.ErrUnexpectedEOF},
+		{name: "Unsupported transfer coding", data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: gzip\r\n\r\n", err: ERROR_UNSUPPORTED_TRANSFER_ENCODING},
+		{name: "Malformed header", data: "HTTP/1.1 200 OK\r\nBad Header: x\r\n\r\n", err: headers.ERROR_INVALID_FIELD_NAME},
+	}
+
+	for _, tt := range tests {
+		// Test: Each malformed response
+		_, err := ResponseFromReader(&chunkReader{data: tt.data, byteCountPerRead: 2})
+		require.ErrorIs(t, err, tt.err, tt.name)
+	}
+
+	// Test: Extra bytes after the body
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nhello"))
+	require.ErrorIs(t, err, ERROR_CONTENT_LENGTH_EXCEEDED)
+
+	// Test: Limits
+	_, err = ResponseFromReaderWithOptions(strings.NewReader("HTTP/1.1 200 OK\r\nX-Big: "+strings.Repeat("a", 100)+"\r\n\r\n"), ParseOptions{MaxHeaderBytes: 64})
+	require.ErrorIs(t, err, ERROR_HEADERS_TOO_LARGE)
+
+	_, err = ResponseFromReaderWithOptions(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n"), ParseOptions{MaxBodyBytes: 10})
+	require.ErrorIs(t, err, ERROR_BODY_TOO_LARGE)
+
+	_, err = ResponseFromReaderWithOptions(strings.NewReader("HTTP/1.1 200 OK\r\n\r\n"+strings.Repeat("a", 100)), ParseOptions{MaxBodyBytes: 10})
+	require.ErrorIs(t, err, ERROR_BODY_TOO_LARGE)
+}
@@ -0,0 +1,133 @@
+package response
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ERROR_INVALID_RANGE = errors.New("invalid range")
+var ERROR_UNSATISFIABLE_RANGE = errors.New("unsatisfiable range")
+
+// ByteRange is a range of Length bytes starting at offset Start.
+type ByteRange struct {
+	Start  int64
+	Length int64
+}
+
+// ContentRange formats r for the Content-Range header of a representation
+// that is size bytes long.
+func (r ByteRange) ContentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.Start+r.Length-1, size)
+}
+
+// ParseRange parses a Range header value such as "bytes=0-99,200-,-50"
+// against a representation that is size bytes long.
+//
+// It returns ERROR_INVALID_RANGE if the header is malformed, in which case
+// it should be ignored and the full representation sent. It returns
+// ERROR_UNSATISFIABLE_RANGE if none of the ranges overlaps the
+// representation, which calls for a 416. Ranges that don't overlap are
+// dropped, the others are clamped to size.
+func ParseRange(s string, size int64) ([]ByteRange, error) {
+	unit, spec, found := strings.Cut(s, "=")
+	if !found || strings.TrimSpace(unit) != "bytes" {
+		return nil, ERROR_INVALID_RANGE
+	}
+
+	ranges := []ByteRange{}
+	seen := false
+	satisfiable := false
+
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		seen = true
+
+		first, last, found := strings.Cut(part, "-")
+		if !found {
+			return nil, ERROR_INVALID_RANGE
+		}
+		first = strings.TrimSpace(first)
+		last = strings.TrimSpace(last)
+
+		var r ByteRange
+
+		if first == "" {
+			// A suffix range: the last N bytes.
+			n, err := parseRangeInt(last)
+			if err != nil {
+				return nil, err
+			}
+
+			if n == 0 || size == 0 {
+				continue
+			}
+
+			n = min(n, size)
+			r = ByteRange{Start: size - n, Length: n}
+		} else {
+			start, err := parseRangeInt(first)
+			if err != nil {
+				return nil, err
+			}
+
+			end := size - 1
+			if last != "" {
+				end, err = parseRangeInt(last)
+				if err != nil {
+					return nil, err
+				}
+
+				if end < start {
+					return nil, ERROR_INVALID_RANGE
+				}
+			}
+
+			if start >= size {
+				continue
+			}
+
+			end = min(end, size-1)
+			r = ByteRange{Start: start, Length: end - start + 1}
+		}
+
+		satisfiable = true
+		ranges = append(ranges, r)
+	}
+
+	if !seen {
+		return nil, ERROR_INVALID_RANGE
+	}
+
+	if !satisfiable {
+		return nil, ERROR_UNSATISFIABLE_RANGE
+	}
+
+	return ranges, nil
+}
+
+func parseRangeInt(s string) (int64, error) {
+	if s == "" || strings.ContainsAny(s, "+-") {
+		return 0, ERROR_INVALID_RANGE
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, ERROR_INVALID_RANGE
+	}
+
+	return n, nil
+}
+
+func sumRanges(ranges []ByteRange) int64 {
+	var total int64
+	for _, r := range ranges {
+		total += r.Length
+	}
+
+	return total
+}
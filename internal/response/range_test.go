@@ -0,0 +1,170 @@
+package response
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/request"
+)
+
+func TestParseRange(t *testing.T) {
+	// Test: Single ranges
+	r, err := ParseRange("bytes=0-99", 1000)
+	require.NoError(t, err)
+	assert.Equal(t, []ByteRange{{Start: 0, Length: 100}}, r)
+
+	r, err = ParseRange("bytes=900-", 1000)
+	require.NoError(t, err)
+	assert.Equal(t, []ByteRange{{Start: 900, Length: 100}}, r)
+
+	r, err = ParseRange("bytes=-50", 1000)
+	require.NoError(t, err)
+	assert.Equal(t, []ByteRange{{Start: 950, Length: 50}}, r)
+
+	// Test: Ranges are clamped to the size
+	r, err = ParseRange("bytes=990-2000", 1000)
+	require.NoError(t, err)
+	assert.Equal(t, []ByteRange{{Start: 990, Length: 10}}, r)
+
+	r, err = ParseRange("bytes=-5000", 1000)
+	require.NoError(t, err)
+	assert.Equal(t, []ByteRange{{Start: 0, Length: 1000}}, r)
+
+	// Test: Multiple ranges, unsatisfiable ones dropped
+	r, err = ParseRange("bytes=0-0, 5000-, -1", 1000)
+	require.NoError(t, err)
+	assert.Equal(t, []ByteRange{{Start: 0, Length: 1}, {Start: 999, Length: 1}}, r)
+
+	// Test: Unsatisfiable
+	_, err = ParseRange("bytes=1000-", 1000)
+	require.ErrorIs(t, err, ERROR_UNSATISFIABLE_RANGE)
+	_, err = ParseRange("bytes=-0", 1000)
+	require.ErrorIs(t, err, ERROR_UNSATISFIABLE_RANGE)
+	_, err = ParseRange("bytes=0-", 0)
+	require.ErrorIs(t, err, ERROR_UNSATISFIABLE_RANGE)
+
+	// Test: Malformed
+	for _, s := range []string{"bytes=", "items=0-1", "bytes=5-1", "bytes=a-b", "bytes=1", "bytes=--1", "bytes=+1-2", "0-1"} {
+		_, err = ParseRange(s, 1000)
+		require.ErrorIs(t, err, ERROR_INVALID_RANGE, s)
+	}
+
+	assert.Equal(t, "bytes 0-99/1000", ByteRange{Start: 0, Length: 100}.ContentRange(1000))
+}
+
+func serveContent(t *testing.T, requestHeaders string, h headers.Headers, content string) string {
+	t.Helper()
+
+	req, err := request.RequestFromReader(strings.NewReader("GET /file HTTP/1.1\r\nHost: localhost\r\n" + requestHeaders + "\r\n"))
+	require.NoError(t, err)
+
+	var b bytes.Buffer
+	ServeContent(NewWriter(&b), req, "file.txt", h, strings.NewReader(content))
+
+	return b.String()
+}
+
+func TestServeContentRanges(t *testing.T) {
+	content := "0123456789abcdefghij"
+
+	// Test: No Range, full content with Accept-Ranges
+	resp := serveContent(t, "", headers.NewHeaders(), content)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, resp, "accept-ranges: bytes\r\n")
+	assert.Contains(t, resp, "content-length: 20\r\n")
+	assert.Contains(t, resp, "content-type: text/plain; charset=utf-8\r\n")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n"+content))
+
+	// Test: Single range
+	resp = serveContent(t, "Range: bytes=2-5\r\n", headers.NewHeaders(), content)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 206 Partial Content\r\n"))
+	assert.Contains(t, resp, "content-range: bytes 2-5/20\r\n")
+	assert.Contains(t, resp, "content-length: 4\r\n")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n2345"))
+
+	// Test: Multiple ranges
+	resp = serveContent(t, "Range: bytes=0-1,-2\r\n", headers.NewHeaders(), content)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 206 Partial Content\r\n"))
+	boundary := regexp.MustCompile(`content-type: multipart/byteranges; boundary=(\w+)\r\n`).FindStringSubmatch(resp)
+	require.Len(t, boundary, 2)
+	head, body, found := strings.Cut(resp, "\r\n\r\n")
+	require.True(t, found)
+	expectedBody := "--" + boundary[1] + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Range: bytes 0-1/20\r\n" +
+		"\r\n" +
+		"01" +
+		"\r\n--" + boundary[1] + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Range: bytes 18-19/20\r\n" +
+		"\r\n" +
+		"ij" +
+		"\r\n--" + boundary[1] + "--\r\n"
+	assert.Equal(t, expectedBody, body)
+	assert.Contains(t, head, "content-length: "+strconv.Itoa(len(expectedBody)))
+
+	// Test: Unsatisfiable range
+	resp = serveContent(t, "Range: bytes=50-\r\n", headers.NewHeaders(), content)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 416 Range Not Satisfiable\r\n"))
+	assert.Contains(t, resp, "content-range: bytes */20\r\n")
+
+	// Test: Malformed range is ignored
+	resp = serveContent(t, "Range: bytes=5-1\r\n", headers.NewHeaders(), content)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+
+	// Test: If-Range with a matching and a stale ETag
+	h := headers.NewHeaders()
+	h.Set("ETag", `"v1"`)
+	resp = serveContent(t, "Range: bytes=0-0\r\nIf-Range: \"v1\"\r\n", h, content)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 206 Partial Content\r\n"))
+
+	h = headers.NewHeaders()
+	h.Set("ETag", `"v2"`)
+	resp = serveContent(t, "Range: bytes=0-0\r\nIf-Range: \"v1\"\r\n", h, content)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+
+	// Test: Weak ETags never match If-Range
+	h = headers.NewHeaders()
+	h.Set("ETag", `W/"v1"`)
+	resp = serveContent(t, "Range: bytes=0-0\r\nIf-Range: W/\"v1\"\r\n", h, content)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+
+	// Test: If-Range with a date
+	h = headers.NewHeaders()
+	h.Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+	resp = serveContent(t, "Range: bytes=0-0\r\nIf-Range: Mon, 02 Jan 2006 15:04:05 GMT\r\n", h, content)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 206 Partial Content\r\n"))
+	resp = serveContent(t, "Range: bytes=0-0\r\nIf-Range: Sun, 01 Jan 2006 15:04:05 GMT\r\n", h, content)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+
+	// Test: HEAD ignores Range
+	req, err := request.RequestFromReader(strings.NewReader("HEAD /file HTTP/1.1\r\nHost: localhost\r\nRange: bytes=0-1,-2\r\n\r\n"))
+	require.NoError(t, err)
+	var b bytes.Buffer
+	require.NoError(t, ServeContent(NewWriter(&b), req, "file.txt", headers.NewHeaders(), strings.NewReader(content)))
+	resp = b.String()
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, resp, "content-length: 20\r\n")
+	assert.NotContains(t, resp, "multipart/byteranges")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n"))
+
+	// Test: Content isn't read when a header hook drops the body
+	req, err = request.RequestFromReader(strings.NewReader("GET /file HTTP/1.1\r\nHost: localhost\r\nRange: bytes=2-5\r\n\r\n"))
+	require.NoError(t, err)
+	b.Reset()
+	w := NewWriter(&b)
+	w.AddHeaderHook(func(StatusCode, headers.Headers) StatusCode {
+		return STATUS_NOT_MODIFIED
+	})
+	src := strings.NewReader(content)
+	require.NoError(t, ServeContent(w, req, "file.txt", headers.NewHeaders(), src))
+	assert.True(t, strings.HasPrefix(b.String(), "HTTP/1.1 304 Not Modified\r\n"))
+	assert.True(t, strings.HasSuffix(b.String(), "\r\n\r\n"))
+}
@@ -13,17 +13,57 @@ import (
 type StatusCode int
 
 const (
-	STATUS_OK             StatusCode = 200
-	STATUS_BAD_REQUEST    StatusCode = 400
-	STATUS_INTERNAL_ERROR StatusCode = 500
+	STATUS_SWITCHING_PROTOCOLS             StatusCode = 101
+	STATUS_OK                              StatusCode = 200
+	STATUS_CREATED                         StatusCode = 201
+	STATUS_PARTIAL_CONTENT                 StatusCode = 206
+	STATUS_MOVED_PERMANENTLY               StatusCode = 301
+	STATUS_NOT_MODIFIED                    StatusCode = 304
+	STATUS_BAD_REQUEST                     StatusCode = 400
+	STATUS_FORBIDDEN                       StatusCode = 403
+	STATUS_NOT_FOUND                       StatusCode = 404
+	STATUS_METHOD_NOT_ALLOWED              StatusCode = 405
+	STATUS_PROXY_AUTH_REQUIRED             StatusCode = 407
+	STATUS_REQUEST_TIMEOUT                 StatusCode = 408
+	STATUS_PRECONDITION_FAILED             StatusCode = 412
+	STATUS_CONTENT_TOO_LARGE               StatusCode = 413
+	STATUS_UNSUPPORTED_MEDIA_TYPE          StatusCode = 415
+	STATUS_RANGE_NOT_SATISFIABLE           StatusCode = 416
+	STATUS_UPGRADE_REQUIRED                StatusCode = 426
+	STATUS_REQUEST_HEADER_FIELDS_TOO_LARGE StatusCode = 431
+	STATUS_INTERNAL_ERROR                  StatusCode = 500
+	STATUS_NOT_IMPLEMENTED                 StatusCode = 501
+	STATUS_BAD_GATEWAY                     StatusCode = 502
+	STATUS_SERVICE_UNAVAILABLE             StatusCode = 503
+	STATUS_GATEWAY_TIMEOUT                 StatusCode = 504
 )
 
 type ReasonPhrase string
 
 const (
-	REASON_OK             ReasonPhrase = "OK"
-	REASON_BAD_REQUEST    ReasonPhrase = "Bad Request"
-	REASON_INTERNAL_ERROR ReasonPhrase = "Interval Server Error"
+	REASON_SWITCHING_PROTOCOLS             ReasonPhrase = "Switching Protocols"
+	REASON_OK                              ReasonPhrase = "OK"
+	REASON_CREATED                         ReasonPhrase = "Created"
+	REASON_PARTIAL_CONTENT                 ReasonPhrase = "Partial Content"
+	REASON_MOVED_PERMANENTLY               ReasonPhrase = "Moved Permanently"
+	REASON_NOT_MODIFIED                    ReasonPhrase = "Not Modified"
+	REASON_BAD_REQUEST                     ReasonPhrase = "Bad Request"
+	REASON_FORBIDDEN                       ReasonPhrase = "Forbidden"
+	REASON_NOT_FOUND                       ReasonPhrase = "Not Found"
+	REASON_METHOD_NOT_ALLOWED              ReasonPhrase = "Method Not Allowed"
+	REASON_PROXY_AUTH_REQUIRED             ReasonPhrase = "Proxy Authentication Required"
+	REASON_REQUEST_TIMEOUT                 ReasonPhrase = "Request Timeout"
+	REASON_PRECONDITION_FAILED             ReasonPhrase = "Precondition Failed"
+	REASON_CONTENT_TOO_LARGE               ReasonPhrase = "Content Too Large"
+	REASON_UNSUPPORTED_MEDIA_TYPE          ReasonPhrase = "Unsupported Media Type"
+	REASON_RANGE_NOT_SATISFIABLE           ReasonPhrase = "Range Not Satisfiable"
+	REASON_UPGRADE_REQUIRED                ReasonPhrase = "Upgrade Required"
+	REASON_REQUEST_HEADER_FIELDS_TOO_LARGE ReasonPhrase = "Request Header Fields Too Large"
+	REASON_INTERNAL_ERROR                  ReasonPhrase = "Interval Server Error"
+	REASON_NOT_IMPLEMENTED                 ReasonPhrase = "Not Implemented"
+	REASON_BAD_GATEWAY                     ReasonPhrase = "Bad Gateway"
+	REASON_SERVICE_UNAVAILABLE             ReasonPhrase = "Service Unavailable"
+	REASON_GATEWAY_TIMEOUT                 ReasonPhrase = "Gateway Timeout"
 )
 
 const HTTP_VERSION = "HTTP/1.1"
@@ -40,13 +80,49 @@ const (
 	BODY             WriterState = "body"
 	BODY_DONE        WriterState = "body done"
 	TRAILERS         WriterState = "trailers"
+	DONE             WriterState = "done"
 )
 
 var ERROR_WRONG_WRITE_ORDER = errors.New("WriteStatusLine, WriteHeaders, and WriteBody should be called in the correct order.")
 
+// A HeaderHook can rewrite the status code and headers of a response right
+// before they are sent. It returns the status code to send. If it differs
+// from the one the handler asked for, the body the handler goes on to
+// write is discarded, so the hook must fix up the framing headers.
+type HeaderHook func(statusCode StatusCode, h headers.Headers) StatusCode
+
+// A BodyEncoder transforms the body on its way out, e.g. to compress it.
+// Flush writes out whatever it has buffered, and Close anything that is
+// left, without closing the writer underneath.
+type BodyEncoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// A Framer carries a response over a protocol that frames messages itself,
+// such as an HTTP/2 stream. A Writer built on one sends no status line and
+// no chunk framing; the Framer decides how the parts go out.
+type Framer interface {
+	// WriteHead sends the status code and headers.
+	WriteHead(statusCode StatusCode, h headers.Headers) error
+	// Write sends body bytes.
+	Write(p []byte) (int, error)
+	// End completes the response, with trailers if there are any.
+	End(trailers headers.Headers) error
+	// Reset gives up on an incomplete response.
+	Reset()
+}
+
 type Writer struct {
-	writerState WriterState
-	writer      io.Writer
+	writerState  WriterState
+	writer       io.Writer
+	statusCode   StatusCode
+	bytesWritten int
+	headerHooks  []HeaderHook
+	discardBody  bool
+	encoder      BodyEncoder
+	framer       Framer
+	trailers     headers.Headers
 }
 
 func NewWriter(w io.Writer) *Writer {
@@ -56,31 +132,134 @@ func NewWriter(w io.Writer) *Writer {
 	}
 }
 
+// NewFramedWriter returns a Writer that sends the response through f.
+// Handlers use it exactly as they would a Writer from NewWriter.
+func NewFramedWriter(f Framer) *Writer {
+	return &Writer{
+		writerState: INITIALIZED,
+		writer:      f,
+		framer:      f,
+		trailers:    headers.NewHeaders(),
+	}
+}
+
+// WriteStatusLine records the status code. The status line itself is sent
+// together with the headers, so that header hooks can still change it.
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
 	if w.writerState != INITIALIZED {
 		return ERROR_WRONG_WRITE_ORDER
 	}
 
+	w.writerState = STATUS_LINE_DONE
+	w.statusCode = statusCode
+
+	return nil
+}
+
+func reasonPhrase(statusCode StatusCode) ReasonPhrase {
 	var reason ReasonPhrase
 
 	switch statusCode {
+	case STATUS_SWITCHING_PROTOCOLS:
+		reason = REASON_SWITCHING_PROTOCOLS
 	case STATUS_OK:
 		reason = REASON_OK
+	case STATUS_CREATED:
+		reason = REASON_CREATED
+	case STATUS_PARTIAL_CONTENT:
+		reason = REASON_PARTIAL_CONTENT
+	case STATUS_MOVED_PERMANENTLY:
+		reason = REASON_MOVED_PERMANENTLY
+	case STATUS_NOT_MODIFIED:
+		reason = REASON_NOT_MODIFIED
 	case STATUS_BAD_REQUEST:
 		reason = REASON_BAD_REQUEST
+	case STATUS_FORBIDDEN:
+		reason = REASON_FORBIDDEN
+	case STATUS_NOT_FOUND:
+		reason = REASON_NOT_FOUND
+	case STATUS_METHOD_NOT_ALLOWED:
+		reason = REASON_METHOD_NOT_ALLOWED
+	case STATUS_PROXY_AUTH_REQUIRED:
+		reason = REASON_PROXY_AUTH_REQUIRED
+	case STATUS_REQUEST_TIMEOUT:
+		reason = REASON_REQUEST_TIMEOUT
+	case STATUS_PRECONDITION_FAILED:
+		reason = REASON_PRECONDITION_FAILED
+	case STATUS_CONTENT_TOO_LARGE:
+		reason = REASON_CONTENT_TOO_LARGE
+	case STATUS_UNSUPPORTED_MEDIA_TYPE:
+		reason = REASON_UNSUPPORTED_MEDIA_TYPE
+	case STATUS_RANGE_NOT_SATISFIABLE:
+		reason = REASON_RANGE_NOT_SATISFIABLE
+	case STATUS_UPGRADE_REQUIRED:
+		reason = REASON_UPGRADE_REQUIRED
+	case STATUS_REQUEST_HEADER_FIELDS_TOO_LARGE:
+		reason = REASON_REQUEST_HEADER_FIELDS_TOO_LARGE
 	case STATUS_INTERNAL_ERROR:
 		reason = REASON_INTERNAL_ERROR
+	case STATUS_NOT_IMPLEMENTED:
+		reason = REASON_NOT_IMPLEMENTED
+	case STATUS_BAD_GATEWAY:
+		reason = REASON_BAD_GATEWAY
+	case STATUS_SERVICE_UNAVAILABLE:
+		reason = REASON_SERVICE_UNAVAILABLE
+	case STATUS_GATEWAY_TIMEOUT:
+		reason = REASON_GATEWAY_TIMEOUT
 	default:
 		reason = ""
 	}
 
-	statusLine := fmt.Sprintf("%s %d %s%s", HTTP_VERSION, statusCode, reason, CRLF)
-	_, err := w.writer.Write([]byte(statusLine))
-	if err != nil {
-		return err
+	return reason
+}
+
+// StatusCode returns the status code written so far, or 0 if the status
+// line hasn't been written yet.
+func (w *Writer) StatusCode() StatusCode {
+	return w.statusCode
+}
+
+// HeadersWritten reports whether the status line and headers have been
+// sent.
+func (w *Writer) HeadersWritten() bool {
+	return w.writerState != INITIALIZED && w.writerState != STATUS_LINE_DONE
+}
+
+// BodyDiscarded reports whether body writes are dropped, as they are for
+// HEAD requests and for responses a header hook turned into one without a
+// body. Callers can skip producing the body then.
+func (w *Writer) BodyDiscarded() bool {
+	return w.discardBody
+}
+
+// DiscardBody makes the Writer drop the body, while the headers still go
+// out as the handler wrote them. The server calls it for HEAD requests.
+func (w *Writer) DiscardBody() {
+	w.discardBody = true
+}
+
+// BytesWritten returns the number of body bytes written so far, not
+// counting chunked encoding framing.
+func (w *Writer) BytesWritten() int {
+	return w.bytesWritten
+}
+
+// AddHeaderHook registers hook to run right before the status line and
+// headers are sent. Hooks run in the order they were added.
+func (w *Writer) AddHeaderHook(hook HeaderHook) {
+	w.headerHooks = append(w.headerHooks, hook)
+}
+
+// SetBodyEncoder makes the body go through the encoder newEncoder returns.
+// The encoded body is always sent with chunked encoding, so the caller must
+// set Transfer-Encoding and drop Content-Length. It is meant to be called
+// from a HeaderHook, and fails once the body has been started.
+func (w *Writer) SetBodyEncoder(newEncoder func(dst io.Writer) BodyEncoder) error {
+	if w.writerState != INITIALIZED && w.writerState != STATUS_LINE_DONE && w.writerState != HEADERS {
+		return ERROR_WRONG_WRITE_ORDER
 	}
 
-	w.writerState = STATUS_LINE_DONE
+	w.encoder = newEncoder(&chunkWriter{w: w})
 
 	return nil
 }
@@ -89,9 +268,31 @@ func (w *Writer) WriteHeaders(h headers.Headers) error {
 	if w.writerState != STATUS_LINE_DONE && w.writerState != HEADERS {
 		return ERROR_WRONG_WRITE_ORDER
 	}
+
+	if w.writerState == HEADERS {
+		return w.writeHeadersImpl(nil, h)
+	}
 	w.writerState = HEADERS
 
-	return w.writeHeadersImpl(h)
+	statusCode := w.statusCode
+	for _, hook := range w.headerHooks {
+		statusCode = hook(statusCode, h)
+	}
+
+	// The handler wrote its body for the status code it asked for, not
+	// for the one a hook replaced it with.
+	if statusCode != w.statusCode {
+		w.discardBody = true
+		w.statusCode = statusCode
+	}
+
+	if w.framer != nil {
+		return w.framer.WriteHead(statusCode, h)
+	}
+
+	statusLine := fmt.Sprintf("%s %d %s%s", HTTP_VERSION, statusCode, reasonPhrase(statusCode), CRLF)
+
+	return w.writeHeadersImpl([]byte(statusLine), h)
 }
 
 func (w *Writer) WriteBody(body []byte) (int, error) {
@@ -100,7 +301,16 @@ func (w *Writer) WriteBody(body []byte) (int, error) {
 	}
 	w.writerState = BODY
 
+	if w.discardBody {
+		return len(body), nil
+	}
+
+	if w.encoder != nil {
+		return w.encoder.Write(body)
+	}
+
 	n, err := w.writer.Write(body)
+	w.bytesWritten += n
 	if err != nil {
 		return n, err
 	}
@@ -108,13 +318,102 @@ func (w *Writer) WriteBody(body []byte) (int, error) {
 	return n, nil
 }
 
+// Write makes Writer an io.Writer for the body, so that it can be the
+// destination of io.Copy. It is the same as WriteBody.
+func (w *Writer) Write(p []byte) (int, error) {
+	return w.WriteBody(p)
+}
+
+// ReadFrom makes Writer an io.ReaderFrom, so that io.Copy hands it the
+// source directly. When the connection underneath implements io.ReaderFrom
+// too, as *net.TCPConn does, copying from an *os.File goes through
+// sendfile or splice, without the data ever entering user space.
+//
+// When the body is discarded, the source isn't read: an io.Seeker is
+// moved to its end and the bytes skipped are returned, anything else is
+// left as it is and 0 is returned, so callers that need the count should
+// check BodyDiscarded first.
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if w.writerState != HEADERS && w.writerState != BODY {
+		return 0, ERROR_WRONG_WRITE_ORDER
+	}
+	w.writerState = BODY
+
+	// Reading the source only to drop it would be wasted work, e.g. a
+	// whole file read from disk for a HEAD request.
+	if w.discardBody {
+		return skip(r)
+	}
+
+	if w.encoder != nil {
+		return io.Copy(w.encoder, r)
+	}
+
+	var n int64
+	var err error
+
+	if rf, ok := w.writer.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(w.writer, r)
+	}
+	w.bytesWritten += int(n)
+
+	return n, err
+}
+
+// skip moves r to its end if it is an io.Seeker, and returns how far it
+// moved.
+func skip(r io.Reader) (int64, error) {
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return 0, nil
+	}
+
+	current, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	return end - current, nil
+}
+
 func (w *Writer) WriteChunkedBody(body []byte) (int, error) {
 	if w.writerState != HEADERS && w.writerState != BODY {
 		return 0, ERROR_WRONG_WRITE_ORDER
 	}
 	w.writerState = BODY
 
+	if w.discardBody {
+		return len(body), nil
+	}
+
+	if w.encoder != nil {
+		return w.encoder.Write(body)
+	}
+
+	return w.writeChunk(body)
+}
+
+func (w *Writer) writeChunk(body []byte) (int, error) {
+	// An empty chunk would end the body.
+	if len(body) == 0 {
+		return 0, nil
+	}
+
 	bodyLen := len(body)
+
+	if w.framer != nil {
+		n, err := w.writer.Write(body)
+		w.bytesWritten += n
+		return n, err
+	}
+
 	s := fmt.Sprintf("%X%s", bodyLen, CRLF)
 	c := slices.Concat([]byte(s), body, []byte(CRLF))
 
@@ -122,18 +421,34 @@ func (w *Writer) WriteChunkedBody(body []byte) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	w.bytesWritten += bodyLen
 
 	return n, nil
 }
 
+// WriteChunkedBodyDone writes the last chunk. The message isn't complete
+// until the trailers, if any, have been written and Finish has been called.
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
-	if w.writerState != BODY {
+	if w.writerState != BODY && w.writerState != HEADERS {
 		return 0, ERROR_WRONG_WRITE_ORDER
 	}
 
-	c := slices.Concat(ZERO_CRLF, []byte(CRLF))
+	if w.discardBody {
+		w.writerState = BODY_DONE
+		return 0, nil
+	}
 
-	n, err := w.writer.Write(c)
+	err := w.closeEncoder()
+	if err != nil {
+		return 0, err
+	}
+
+	if w.framer != nil {
+		w.writerState = BODY_DONE
+		return 0, nil
+	}
+
+	n, err := w.writer.Write(ZERO_CRLF)
 	if err != nil {
 		return 0, err
 	}
@@ -148,17 +463,116 @@ func (w *Writer) WriteTrailers(h headers.Headers) error {
 	}
 	w.writerState = TRAILERS
 
-	return w.writeHeadersImpl(h)
+	if w.discardBody {
+		return nil
+	}
+
+	// The framer sends trailers all at once, when the response ends.
+	if w.framer != nil {
+		for key, value := range h {
+			w.trailers.Set(key, value)
+		}
+		return nil
+	}
+
+	_, err := w.writer.Write(appendFields(nil, h))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Flush sends whatever the body encoder has buffered, so that the client
+// gets it right away. Without an encoder nothing is buffered.
+func (w *Writer) Flush() error {
+	if w.encoder == nil || w.discardBody || w.writerState != BODY {
+		return nil
+	}
+
+	return w.encoder.Flush()
 }
 
-func (w *Writer) writeHeadersImpl(h headers.Headers) error {
-	b := []byte{}
+// Abort gives up on a response whose body can't be completed, e.g. because
+// the data source failed half way. Finish then leaves it unterminated, so
+// that the client sees the connection close instead of a short body that
+// looks whole.
+func (w *Writer) Abort() {
+	if w.framer != nil && w.writerState != DONE {
+		w.framer.Reset()
+	}
+
+	w.writerState = DONE
+}
+
+// Finish completes the response: it ends an encoded body and terminates
+// the trailer section of a chunked one. The server calls it after the
+// handler returns.
+func (w *Writer) Finish() error {
+	if w.framer != nil {
+		return w.finishFramed()
+	}
+
+	var err error
+
+	switch w.writerState {
+	case HEADERS, BODY:
+		if w.encoder != nil && !w.discardBody {
+			_, err = w.WriteChunkedBodyDone()
+			if err == nil {
+				_, err = w.writer.Write([]byte(CRLF))
+			}
+		}
+	case BODY_DONE, TRAILERS:
+		if !w.discardBody {
+			_, err = w.writer.Write([]byte(CRLF))
+		}
+	case DONE:
+		return nil
+	}
+
+	w.writerState = DONE
+	return err
+}
 
-	for key, value := range h {
-		s := fmt.Sprintf("%s: %s%s", key, value, CRLF)
-		b = fmt.Append(b, s)
+func (w *Writer) finishFramed() error {
+	if w.writerState == DONE {
+		return nil
 	}
 
+	if w.writerState == INITIALIZED || w.writerState == STATUS_LINE_DONE {
+		w.framer.Reset()
+		w.writerState = DONE
+		return nil
+	}
+
+	err := w.closeEncoder()
+	if err == nil {
+		err = w.framer.End(w.trailers)
+	}
+
+	w.writerState = DONE
+	return err
+}
+
+func (w *Writer) closeEncoder() error {
+	if w.encoder == nil {
+		return nil
+	}
+
+	encoder := w.encoder
+	w.encoder = nil
+
+	return encoder.Close()
+}
+
+func (w *Writer) writeHeadersImpl(prefix []byte, h headers.Headers) error {
+	// The head of a framed response has already gone out in one piece.
+	if w.framer != nil {
+		return ERROR_WRONG_WRITE_ORDER
+	}
+
+	b := appendFields(prefix, h)
 	b = fmt.Append(b, CRLF)
 
 	_, err := w.writer.Write(b)
@@ -169,6 +583,32 @@ func (w *Writer) writeHeadersImpl(h headers.Headers) error {
 	return nil
 }
 
+func appendFields(b []byte, h headers.Headers) []byte {
+	for key := range h {
+		for _, value := range h.Values(key) {
+			s := fmt.Sprintf("%s: %s%s", key, value, CRLF)
+			b = fmt.Append(b, s)
+		}
+	}
+
+	return b
+}
+
+// chunkWriter frames everything written to it as chunks. It sits between a
+// BodyEncoder and the connection.
+type chunkWriter struct {
+	w *Writer
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	_, err := cw.w.writeChunk(p)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
 func GetDefaultHeaders(contentLen int) headers.Headers {
 	h := headers.NewHeaders()
 
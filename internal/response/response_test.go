@@ -0,0 +1,172 @@
+package response
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+)
+
+// readFromRecorder is a writer that records whether ReadFrom was used.
+type readFromRecorder struct {
+	bytes.Buffer
+	readFromCalls int
+}
+
+func (r *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFromCalls++
+	return r.Buffer.ReadFrom(src)
+}
+
+func TestWriterReadFrom(t *testing.T) {
+	// Test: ReadFrom delegates to the underlying io.ReaderFrom
+	out := &readFromRecorder{}
+	w := NewWriter(out)
+	require.NoError(t, w.WriteStatusLine(STATUS_OK))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	out.Reset()
+
+	n, err := io.Copy(w, struct{ io.Reader }{strings.NewReader("hello world")})
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), n)
+	assert.Equal(t, "hello world", out.String())
+	assert.Equal(t, 1, out.readFromCalls)
+	assert.Equal(t, 11, w.BytesWritten())
+
+	// Test: ReadFrom falls back to a plain copy
+	var buf bytes.Buffer
+	w = NewWriter(struct{ io.Writer }{&buf})
+	require.NoError(t, w.WriteStatusLine(STATUS_OK))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	buf.Reset()
+
+	_, err = w.ReadFrom(strings.NewReader("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteBody([]byte(" world"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", buf.String())
+	assert.Equal(t, 11, w.BytesWritten())
+
+	// Test: ReadFrom before the headers is out of order
+	w = NewWriter(&buf)
+	_, err = w.ReadFrom(strings.NewReader("hello"))
+	require.ErrorIs(t, err, ERROR_WRONG_WRITE_ORDER)
+
+	// Test: ReadFrom doesn't read the source when the body is discarded
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.AddHeaderHook(func(StatusCode, headers.Headers) StatusCode {
+		return STATUS_NOT_MODIFIED
+	})
+	require.NoError(t, w.WriteStatusLine(STATUS_OK))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	headLen := buf.Len()
+
+	assert.True(t, w.BodyDiscarded())
+
+	src := struct{ io.Reader }{strings.NewReader("hello")}
+	n, err = w.ReadFrom(src)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+	assert.Equal(t, 5, src.Reader.(*strings.Reader).Len())
+	assert.Equal(t, headLen, buf.Len())
+
+	// Test: A seekable source is skipped to its end, as if copied
+	seeker := strings.NewReader("hello world")
+	seeker.Seek(6, io.SeekStart)
+	n, err = io.Copy(w, seeker)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+	assert.Equal(t, 0, seeker.Len())
+	assert.Equal(t, headLen, buf.Len())
+}
+
+func TestWriterDiscardBody(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.DiscardBody()
+
+	// Test: The headers go out as written, the body doesn't
+	require.NoError(t, w.WriteStatusLine(STATUS_OK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	n, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	require.NoError(t, w.Finish())
+
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, buf.String(), "content-length: 5\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n"))
+	assert.Zero(t, w.BytesWritten())
+}
+
+const BENCHMARK_FILE_SIZE = 100 << 20
+
+// benchmarkConn returns the server side of a loopback TCP connection whose
+// client side is drained in the background, and the path of a file of
+// BENCHMARK_FILE_SIZE bytes.
+func benchmarkConn(b *testing.B) (net.Conn, string) {
+	b.Helper()
+
+	name := filepath.Join(b.TempDir(), "payload")
+	f, err := os.Create(name)
+	require.NoError(b, err)
+	require.NoError(b, f.Truncate(BENCHMARK_FILE_SIZE))
+	require.NoError(b, f.Close())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(b, err)
+	b.Cleanup(func() { listener.Close() })
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(b, err)
+	b.Cleanup(func() { client.Close() })
+	go io.Copy(io.Discard, client)
+
+	conn, err := listener.Accept()
+	require.NoError(b, err)
+	b.Cleanup(func() { conn.Close() })
+
+	return conn, name
+}
+
+func BenchmarkWriteBodyReadFile(b *testing.B) {
+	conn, name := benchmarkConn(b)
+	b.SetBytes(BENCHMARK_FILE_SIZE)
+
+	for b.Loop() {
+		w := NewWriter(conn)
+		w.WriteStatusLine(STATUS_OK)
+		w.WriteHeaders(GetDefaultHeaders(BENCHMARK_FILE_SIZE))
+
+		body, err := os.ReadFile(name)
+		require.NoError(b, err)
+		_, err = w.WriteBody(body)
+		require.NoError(b, err)
+	}
+}
+
+func BenchmarkReadFromFile(b *testing.B) {
+	conn, name := benchmarkConn(b)
+	b.SetBytes(BENCHMARK_FILE_SIZE)
+
+	for b.Loop() {
+		w := NewWriter(conn)
+		w.WriteStatusLine(STATUS_OK)
+		w.WriteHeaders(GetDefaultHeaders(BENCHMARK_FILE_SIZE))
+
+		f, err := os.Open(name)
+		require.NoError(b, err)
+		_, err = io.Copy(w, f)
+		f.Close()
+		require.NoError(b, err)
+	}
+}
@@ -0,0 +1,225 @@
+package response
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/request"
+)
+
+// ServeContent replies to req with content, honoring conditional and Range
+// headers. Failed preconditions get a 304 or 412, see CheckPreconditions.
+// Ranges are only served for GET: a single range is sent as a 206 with
+// Content-Range, several as multipart/byteranges, and unsatisfiable ones
+// get a 416.
+//
+// h holds the headers to send along, such as ETag or Last-Modified, which
+// the conditional headers are evaluated against. If h has no Content-Type,
+// it is derived from the extension of name or sniffed from content.
+// Content-Length and Content-Range are set by ServeContent.
+func ServeContent(w *Writer, req *request.Request, name string, h headers.Headers, content io.ReadSeeker) error {
+	if statusCode := CheckPreconditions(req, h); statusCode != STATUS_OK {
+		StripBodyHeaders(h)
+		if statusCode == STATUS_PRECONDITION_FAILED {
+			h.Replace("Content-Length", "0")
+		}
+		h.Replace("Connection", "close")
+
+		if err := w.WriteStatusLine(statusCode); err != nil {
+			return err
+		}
+		return w.WriteHeaders(h)
+	}
+
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return writeServeContentError(w, err)
+	}
+
+	if h.Get("Content-Type") == "" {
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			return writeServeContentError(w, err)
+		}
+
+		sniff := make([]byte, SNIFF_LEN)
+		n, _ := io.ReadFull(content, sniff)
+		h.Replace("Content-Type", ContentTypeByName(name, sniff[:n]))
+	}
+
+	h.Replace("Accept-Ranges", "bytes")
+	h.Replace("Connection", "close")
+
+	var ranges []ByteRange
+
+	method := req.RequestLine.Method
+	rangeHeader := req.Headers.Get("Range")
+	// RFC 9110 14.2: Range is only defined for GET.
+	if rangeHeader != "" && method == "GET" && ifRangeMatches(req, h) {
+		ranges, err = ParseRange(rangeHeader, size)
+
+		if errors.Is(err, ERROR_UNSATISFIABLE_RANGE) {
+			h.Replace("Content-Range", fmt.Sprintf("bytes */%d", size))
+			h.Replace("Content-Length", "0")
+			h.Delete("Content-Type")
+
+			if err := w.WriteStatusLine(STATUS_RANGE_NOT_SATISFIABLE); err != nil {
+				return err
+			}
+			return w.WriteHeaders(h)
+		}
+
+		// Malformed ranges are ignored, and so are ranges adding up to
+		// more than the whole content, which only serve to amplify
+		// the response.
+		if err != nil || sumRanges(ranges) > size {
+			ranges = nil
+		}
+	}
+
+	withBody := method != "HEAD"
+
+	switch len(ranges) {
+	case 0:
+		return serveRanges(w, content, h, STATUS_OK, size, withBody, []ByteRange{{Start: 0, Length: size}})
+	case 1:
+		h.Replace("Content-Range", ranges[0].ContentRange(size))
+		return serveRanges(w, content, h, STATUS_PARTIAL_CONTENT, ranges[0].Length, withBody, ranges)
+	default:
+		return serveMultipartRanges(w, content, h, size, withBody, ranges)
+	}
+}
+
+func serveRanges(w *Writer, content io.ReadSeeker, h headers.Headers, statusCode StatusCode, contentLen int64, withBody bool, ranges []ByteRange) error {
+	h.Replace("Content-Length", strconv.FormatInt(contentLen, 10))
+
+	if err := w.WriteStatusLine(statusCode); err != nil {
+		return err
+	}
+
+	if err := w.WriteHeaders(h); err != nil {
+		return err
+	}
+
+	if !withBody {
+		return nil
+	}
+
+	for _, r := range ranges {
+		if err := copyRange(w, content, r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func serveMultipartRanges(w *Writer, content io.ReadSeeker, h headers.Headers, size int64, withBody bool, ranges []ByteRange) error {
+	boundary := newBoundary()
+	contentType := h.Get("Content-Type")
+
+	// Every part is preceded by its own headers. Work them all out first,
+	// so that we know the Content-Length up front.
+	partHeaders := make([]string, len(ranges))
+	contentLen := int64(0)
+	for i, r := range ranges {
+		delimiter := "--" + boundary + CRLF
+		if i > 0 {
+			delimiter = CRLF + delimiter
+		}
+
+		partHeaders[i] = delimiter +
+			"Content-Type: " + contentType + CRLF +
+			"Content-Range: " + r.ContentRange(size) + CRLF +
+			CRLF
+
+		contentLen += int64(len(partHeaders[i])) + r.Length
+	}
+
+	closeDelimiter := CRLF + "--" + boundary + "--" + CRLF
+	contentLen += int64(len(closeDelimiter))
+
+	h.Replace("Content-Type", "multipart/byteranges; boundary="+boundary)
+	h.Replace("Content-Length", strconv.FormatInt(contentLen, 10))
+
+	if err := w.WriteStatusLine(STATUS_PARTIAL_CONTENT); err != nil {
+		return err
+	}
+
+	if err := w.WriteHeaders(h); err != nil {
+		return err
+	}
+
+	if !withBody {
+		return nil
+	}
+
+	for i, r := range ranges {
+		if _, err := w.WriteBody([]byte(partHeaders[i])); err != nil {
+			return err
+		}
+
+		if err := copyRange(w, content, r); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.WriteBody([]byte(closeDelimiter))
+	return err
+}
+
+func copyRange(w *Writer, content io.ReadSeeker, r ByteRange) error {
+	if w.BodyDiscarded() {
+		return nil
+	}
+
+	if _, err := content.Seek(r.Start, io.SeekStart); err != nil {
+		return err
+	}
+
+	_, err := io.CopyN(w, content, r.Length)
+	return err
+}
+
+// ifRangeMatches reports whether the Range header of req applies, given
+// the validators in h. If-Range holds either an entity tag, which must
+// strongly match the ETag, or a date, which must equal Last-Modified.
+func ifRangeMatches(req *request.Request, h headers.Headers) bool {
+	ifRange := req.Headers.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+
+	if len(ifRange) >= 2 && (ifRange[0] == '"' || ifRange[:2] == "W/") {
+		etag := h.Get("ETag")
+		return etag != "" && etag == ifRange && ifRange[0] == '"'
+	}
+
+	date, err := ParseHTTPDate(ifRange)
+	if err != nil {
+		return false
+	}
+
+	lastModified, err := ParseHTTPDate(h.Get("Last-Modified"))
+	return err == nil && lastModified.Equal(date)
+}
+
+func newBoundary() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func writeServeContentError(w *Writer, err error) error {
+	msg := []byte(err.Error())
+
+	w.WriteStatusLine(STATUS_INTERNAL_ERROR)
+	w.WriteHeaders(GetDefaultHeaders(len(msg)))
+	w.WriteBody(msg)
+
+	return err
+}
@@ -0,0 +1,92 @@
+package response
+
+import (
+	"bytes"
+	"mime"
+	"path/filepath"
+)
+
+// SNIFF_LEN is the number of leading bytes DetectContentType looks at.
+const SNIFF_LEN = 512
+
+const DEFAULT_CONTENT_TYPE = "application/octet-stream"
+
+var magicNumbers = []struct {
+	offset      int
+	signature   []byte
+	contentType string
+}{
+	{0, []byte("%PDF-"), "application/pdf"},
+	{0, []byte("\x89PNG\r\n\x1a\n"), "image/png"},
+	{0, []byte("\xff\xd8\xff"), "image/jpeg"},
+	{0, []byte("GIF87a"), "image/gif"},
+	{0, []byte("GIF89a"), "image/gif"},
+	{0, []byte("RIFF"), "audio/wave"},
+	{0, []byte("\x1a\x45\xdf\xa3"), "video/webm"},
+	{0, []byte("OggS\x00"), "application/ogg"},
+	{0, []byte("ID3"), "audio/mpeg"},
+	{0, []byte("\x1f\x8b\x08"), "application/x-gzip"},
+	{0, []byte("PK\x03\x04"), "application/zip"},
+	{0, []byte("\x00asm"), "application/wasm"},
+	{4, []byte("ftyp"), "video/mp4"},
+}
+
+var htmlPrefixes = [][]byte{
+	[]byte("<!DOCTYPE HTML"),
+	[]byte("<HTML"),
+	[]byte("<HEAD"),
+	[]byte("<BODY"),
+	[]byte("<SCRIPT"),
+	[]byte("<TITLE"),
+	[]byte("<DIV"),
+	[]byte("<P"),
+	[]byte("<!--"),
+}
+
+// DetectContentType guesses the content type of data from its first
+// SNIFF_LEN bytes. It recognizes common binary formats by their magic
+// number and HTML by its leading tag, and otherwise tells text from
+// binary data. It always returns a valid MIME type.
+func DetectContentType(data []byte) string {
+	if len(data) > SNIFF_LEN {
+		data = data[:SNIFF_LEN]
+	}
+
+	for _, m := range magicNumbers {
+		if len(data) >= m.offset+len(m.signature) && bytes.Equal(data[m.offset:m.offset+len(m.signature)], m.signature) {
+			return m.contentType
+		}
+	}
+
+	trimmed := bytes.TrimLeft(data, "\t\n\x0c\r ")
+	for _, prefix := range htmlPrefixes {
+		if len(trimmed) > len(prefix) && bytes.EqualFold(trimmed[:len(prefix)], prefix) {
+			// The tag has to end right after its name.
+			if next := trimmed[len(prefix)]; next == ' ' || next == '>' || prefix[1] == '!' {
+				return "text/html; charset=utf-8"
+			}
+		}
+	}
+
+	for _, b := range data {
+		if isBinaryByte(b) {
+			return DEFAULT_CONTENT_TYPE
+		}
+	}
+
+	return "text/plain; charset=utf-8"
+}
+
+// ContentTypeByName returns the content type registered for the extension
+// of name, falling back to sniffing data.
+func ContentTypeByName(name string, data []byte) string {
+	if t := mime.TypeByExtension(filepath.Ext(name)); t != "" {
+		return t
+	}
+
+	return DetectContentType(data)
+}
+
+func isBinaryByte(b byte) bool {
+	return b <= 0x08 || b == 0x0b || (b >= 0x0e && b <= 0x1a) || (b >= 0x1c && b <= 0x1f)
+}
@@ -0,0 +1,27 @@
+package response
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectContentType(t *testing.T) {
+	// Test: Magic numbers
+	assert.Equal(t, "image/png", DetectContentType([]byte("\x89PNG\r\n\x1a\nrest")))
+	assert.Equal(t, "video/mp4", DetectContentType([]byte("\x00\x00\x00\x20ftypisom")))
+	assert.Equal(t, "application/pdf", DetectContentType([]byte("%PDF-1.7")))
+
+	// Test: HTML, case insensitive and after whitespace
+	assert.Equal(t, "text/html; charset=utf-8", DetectContentType([]byte("\n  <!doctype html><html>")))
+	assert.Equal(t, "text/html; charset=utf-8", DetectContentType([]byte("<p>hi</p>")))
+	assert.Equal(t, "text/plain; charset=utf-8", DetectContentType([]byte("<pre>hi</pre>")))
+
+	// Test: Text and binary
+	assert.Equal(t, "text/plain; charset=utf-8", DetectContentType([]byte("just text\n")))
+	assert.Equal(t, DEFAULT_CONTENT_TYPE, DetectContentType([]byte("bin\x00ary")))
+
+	// Test: Extension wins over content
+	assert.Equal(t, "text/css; charset=utf-8", ContentTypeByName("style.css", []byte("\x00")))
+	assert.Equal(t, "image/png", ContentTypeByName("noext", []byte("\x89PNG\r\n\x1a\n")))
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"httpffomtcp.pinglu.dev/internal/request"
+)
+
+type AccessLogFormat string
+
+const (
+	// COMMON_LOG_FORMAT is Apache's Common Log Format:
+	//   host ident authuser [date] "request" status bytes
+	COMMON_LOG_FORMAT AccessLogFormat = "common"
+	// COMBINED_LOG_FORMAT is the Common Log Format followed by the quoted
+	// referer and user agent.
+	COMBINED_LOG_FORMAT AccessLogFormat = "combined"
+	// JSON_LOG_FORMAT writes one JSON object per request, with every
+	// recorded attribute.
+	JSON_LOG_FORMAT AccessLogFormat = "json"
+)
+
+// Attribute keys of an access log record.
+const (
+	ACCESS_LOG_REMOTE_ADDR = "remote_addr"
+	ACCESS_LOG_METHOD      = "method"
+	ACCESS_LOG_TARGET      = "target"
+	ACCESS_LOG_PROTO       = "proto"
+	ACCESS_LOG_STATUS      = "status"
+	ACCESS_LOG_BYTES       = "bytes"
+	ACCESS_LOG_DURATION    = "duration"
+	ACCESS_LOG_REFERER     = "referer"
+	ACCESS_LOG_USER_AGENT  = "user_agent"
+	ACCESS_LOG_REQUEST_ID  = "request_id"
+)
+
+const CLF_TIME_LAYOUT = "02/Jan/2006:15:04:05 -0700"
+
+// NewAccessLogger returns a logger that writes access log records to w in
+// the given format. It is meant for Config.AccessLog.
+func NewAccessLogger(w io.Writer, format AccessLogFormat) (*slog.Logger, error) {
+	switch format {
+	case COMMON_LOG_FORMAT:
+		return slog.New(&clfHandler{w: w}), nil
+	case COMBINED_LOG_FORMAT:
+		return slog.New(&clfHandler{w: w, combined: true}), nil
+	case JSON_LOG_FORMAT:
+		return slog.New(slog.NewJSONHandler(w, nil)), nil
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+}
+
+// accessEntry is what the server knows about a request once it's done.
+type accessEntry struct {
+	remoteAddr string
+	method     string
+	target     string
+	proto      string
+	status     int
+	bytes      int
+	duration   time.Duration
+	referer    string
+	userAgent  string
+	requestID  string
+}
+
+// setRequest records what e needs to know about req.
+func (e *accessEntry) setRequest(req *request.Request, requestID string) {
+	e.method = req.RequestLine.Method
+	e.target = req.RequestLine.RequestTarget
+	e.proto = "HTTP/" + req.RequestLine.HttpVersion
+	e.referer = req.Headers.Get("Referer")
+	e.userAgent = req.Headers.Get("User-Agent")
+	e.requestID = requestID
+}
+
+func (s *Server) logAccess(ctx context.Context, e accessEntry) {
+	if s.config.AccessLog == nil {
+		return
+	}
+
+	s.config.AccessLog.LogAttrs(ctx, slog.LevelInfo, "request",
+		slog.String(ACCESS_LOG_REMOTE_ADDR, e.remoteAddr),
+		slog.String(ACCESS_LOG_METHOD, e.method),
+		slog.String(ACCESS_LOG_TARGET, e.target),
+		slog.String(ACCESS_LOG_PROTO, e.proto),
+		slog.Int(ACCESS_LOG_STATUS, e.status),
+		slog.Int(ACCESS_LOG_BYTES, e.bytes),
+		slog.Duration(ACCESS_LOG_DURATION, e.duration),
+		slog.String(ACCESS_LOG_REFERER, e.referer),
+		slog.String(ACCESS_LOG_USER_AGENT, e.userAgent),
+		slog.String(ACCESS_LOG_REQUEST_ID, e.requestID),
+	)
+}
+
+// clfHandler is a slog.Handler that renders access log records in the
+// Common or Combined Log Format. Attributes it doesn't know are dropped.
+type clfHandler struct {
+	mu       sync.Mutex
+	w        io.Writer
+	combined bool
+}
+
+func (h *clfHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelInfo
+}
+
+func (h *clfHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h
+}
+
+func (h *clfHandler) WithGroup(name string) slog.Handler {
+	return h
+}
+
+func (h *clfHandler) Handle(ctx context.Context, r slog.Record) error {
+	fields := map[string]string{}
+	r.Attrs(func(a slog.Attr) bool {
+		fields[a.Key] = a.Value.String()
+		return true
+	})
+
+	host := fields[ACCESS_LOG_REMOTE_ADDR]
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	requestLine := "-"
+	if fields[ACCESS_LOG_METHOD] != "" {
+		requestLine = fmt.Sprintf("%s %s %s", fields[ACCESS_LOG_METHOD], fields[ACCESS_LOG_TARGET], fields[ACCESS_LOG_PROTO])
+	}
+
+	bytes := fields[ACCESS_LOG_BYTES]
+	if bytes == "0" {
+		bytes = "-"
+	}
+
+	line := fmt.Sprintf("%s - - [%s] %s %s %s",
+		clfValue(host),
+		r.Time.Format(CLF_TIME_LAYOUT),
+		strconv.Quote(requestLine),
+		clfValue(fields[ACCESS_LOG_STATUS]),
+		clfValue(bytes),
+	)
+
+	if h.combined {
+		line += fmt.Sprintf(" %s %s",
+			strconv.Quote(clfValue(fields[ACCESS_LOG_REFERER])),
+			strconv.Quote(clfValue(fields[ACCESS_LOG_USER_AGENT])),
+		)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	_, err := io.WriteString(h.w, line+"\n")
+	return err
+}
+
+func clfValue(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+// LogFile is an append-only file that can be reopened in place, so that it
+// plays along with logrotate: after the file is moved away, Reopen (or a
+// SIGHUP with ReopenOnSIGHUP) starts a fresh file at the original path.
+type LogFile struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+func OpenLogFile(path string) (*LogFile, error) {
+	f, err := openAppend(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LogFile{path: path, f: f}, nil
+}
+
+func openAppend(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+}
+
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.f.Write(p)
+}
+
+func (l *LogFile) Reopen() error {
+	f, err := openAppend(l.path)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	old := l.f
+	l.f = f
+	l.mu.Unlock()
+
+	return old.Close()
+}
+
+func (l *LogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.f.Close()
+}
+
+// ReopenOnSIGHUP reopens the file every time the process receives SIGHUP,
+// until the returned function is called.
+func (l *LogFile) ReopenOnSIGHUP(logger *slog.Logger) (stop func()) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return onSIGHUP(func() {
+		if err := l.Reopen(); err != nil {
+			logger.Error("error reopening log file", "path", l.path, "err", err)
+		}
+	})
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// syncBuffer lets the test read what the server goroutines log.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func waitForLine(t *testing.T, b *syncBuffer) string {
+	t.Helper()
+
+	require.Eventually(t, func() bool { return strings.Contains(b.String(), "\n") }, 5*time.Second, 5*time.Millisecond)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func TestAccessLog(t *testing.T) {
+	request := "GET /hello?x=1 HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"User-Agent: curl/8.0\r\n" +
+		"Referer: http://example.test/\r\n" +
+		"X-Request-Id: abc123\r\n" +
+		"\r\n"
+
+	// Test: JSON records every attribute
+	out := &syncBuffer{}
+	logger, err := NewAccessLogger(out, JSON_LOG_FORMAT)
+	require.NoError(t, err)
+	_, l := startTestServer(t, helloHandler, Config{AccessLog: logger})
+	c, err := l.Dial()
+	require.NoError(t, err)
+	go c.Write([]byte(request))
+	io.ReadAll(c)
+
+	var record map[string]any
+	require.NoError(t, json.Unmarshal([]byte(waitForLine(t, out)), &record))
+	assert.Equal(t, "pipe", record[ACCESS_LOG_REMOTE_ADDR])
+	assert.Equal(t, "GET", record[ACCESS_LOG_METHOD])
+	assert.Equal(t, "/hello?x=1", record[ACCESS_LOG_TARGET])
+	assert.Equal(t, float64(200), record[ACCESS_LOG_STATUS])
+	assert.Equal(t, float64(len("hello from /hello?x=1")), record[ACCESS_LOG_BYTES])
+	assert.Equal(t, "curl/8.0", record[ACCESS_LOG_USER_AGENT])
+	assert.Equal(t, "abc123", record[ACCESS_LOG_REQUEST_ID])
+	assert.Contains(t, record, ACCESS_LOG_DURATION)
+
+	// Test: Combined Log Format
+	out = &syncBuffer{}
+	logger, err = NewAccessLogger(out, COMBINED_LOG_FORMAT)
+	require.NoError(t, err)
+	_, l = startTestServer(t, helloHandler, Config{AccessLog: logger})
+	c, err = l.Dial()
+	require.NoError(t, err)
+	go c.Write([]byte(request))
+	io.ReadAll(c)
+
+	line := waitForLine(t, out)
+	assert.Regexp(t, `^pipe - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /hello\?x=1 HTTP/1.1" 200 21 "http://example.test/" "curl/8.0"$`, line)
+
+	// Test: Common Log Format for a request that failed to parse
+	out = &syncBuffer{}
+	logger, err = NewAccessLogger(out, COMMON_LOG_FORMAT)
+	require.NoError(t, err)
+	_, l = startTestServer(t, helloHandler, Config{AccessLog: logger})
+	c, err = l.Dial()
+	require.NoError(t, err)
+	go c.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	io.ReadAll(c)
+
+	line = waitForLine(t, out)
+	assert.Regexp(t, `^pipe - - \[.+\] "-" 400 \d+$`, line)
+
+	// Test: Unknown format
+	_, err = NewAccessLogger(out, "apache")
+	require.Error(t, err)
+}
+
+func TestLogFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+
+	f, err := OpenLogFile(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, err = f.Write([]byte("first\n"))
+	require.NoError(t, err)
+
+	// Test: After logrotate moves the file, Reopen starts a new one
+	rotated := filepath.Join(dir, "access.log.1")
+	require.NoError(t, os.Rename(path, rotated))
+	require.NoError(t, f.Reopen())
+	_, err = f.Write([]byte("second\n"))
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(rotated)
+	require.NoError(t, err)
+	assert.Equal(t, "first\n", string(data))
+
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "second\n", string(data))
+}
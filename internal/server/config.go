@@ -0,0 +1,172 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"httpffomtcp.pinglu.dev/internal/http2"
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+)
+
+// DEFAULT_REQUEST_TIMEOUT is how long a handler may run before the request
+// context is cancelled.
+const DEFAULT_REQUEST_TIMEOUT = 30 * time.Second
+
+// ErrorHandler writes the response for a request that could not be parsed.
+type ErrorHandler func(w *response.Writer, err error)
+
+type Config struct {
+	// Network and Addr are passed to net.Listen by ServeConfig. Network
+	// defaults to "tcp"; use "unix" to listen on a Unix domain socket.
+	Network string
+	Addr    string
+
+	// TLSConfig turns on HTTPS. It needs either certificates or a
+	// GetCertificate callback, e.g. from CertStore.TLSConfig. If it doesn't
+	// set NextProtos, "http/1.1" is advertised through ALPN.
+	TLSConfig *tls.Config
+
+	// ReadTimeout bounds the time spent reading the request, WriteTimeout
+	// the time spent writing the response. Zero means no timeout.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// RequestTimeout bounds the lifetime of the request context. Zero
+	// means DEFAULT_REQUEST_TIMEOUT, a negative value means no timeout.
+	// Long-lived responses opt out with ClearTimeout.
+	RequestTimeout time.Duration
+
+	// MaxHeaderBytes and MaxBodyBytes limit the size of the request line
+	// plus headers, and of the body. Zero means no limit.
+	MaxHeaderBytes int
+	MaxBodyBytes   int
+
+	// DecodeRequestBodies hands handlers the decoded body of requests sent
+	// with a gzip or deflate Content-Encoding. Other encodings get a 415.
+	// MaxDecodedBodyBytes limits the decoded size; zero means MaxBodyBytes,
+	// or request.DEFAULT_MAX_DECODED_BODY_BYTES without one, and negative
+	// means no limit.
+	DecodeRequestBodies bool
+	MaxDecodedBodyBytes int
+
+	// MaxConns caps the number of connections served at once, and
+	// ConnLimitMode decides what happens to the ones beyond it. Zero means
+	// no limit. The mode defaults to QUEUE_CONNS.
+	MaxConns      int
+	ConnLimitMode ConnLimitMode
+
+	// MaxConnsPerIP caps the connections from a single client IP. Clients
+	// beyond it get a 503. Zero means no limit.
+	MaxConnsPerIP int
+
+	// Logger receives the server's own errors. Defaults to slog.Default().
+	Logger *slog.Logger
+
+	// AccessLog receives one record per request, see NewAccessLogger.
+	// Nil means no access log.
+	AccessLog *slog.Logger
+
+	// Metrics, if set, is updated as connections and requests come and go.
+	Metrics *Metrics
+
+	// ErrorHandler responds to requests that could not be parsed.
+	// Defaults to DefaultErrorHandler.
+	ErrorHandler ErrorHandler
+
+	// H2C serves HTTP/2 on connections without TLS, to clients that start
+	// with the HTTP/2 preface or ask to upgrade with "Upgrade: h2c".
+	H2C bool
+
+	// HTTP2 tunes HTTP/2 connections. Its Request, ErrorHandler and
+	// Logger are taken from the settings above.
+	HTTP2 http2.Options
+}
+
+func (c Config) withDefaults() Config {
+	if c.Network == "" {
+		c.Network = "tcp"
+	}
+
+	if c.ConnLimitMode == "" {
+		c.ConnLimitMode = QUEUE_CONNS
+	}
+
+	if c.RequestTimeout == 0 {
+		c.RequestTimeout = DEFAULT_REQUEST_TIMEOUT
+	}
+
+	if c.Logger == nil {
+		c.Logger = slog.Default()
+	}
+
+	if c.ErrorHandler == nil {
+		c.ErrorHandler = DefaultErrorHandler
+	}
+
+	return c
+}
+
+func (c Config) requestOptions() request.Options {
+	return request.Options{
+		MaxHeaderBytes: c.MaxHeaderBytes,
+		MaxBodyBytes:   c.MaxBodyBytes,
+
+		DecodeBody:          c.DecodeRequestBodies,
+		MaxDecodedBodyBytes: c.MaxDecodedBodyBytes,
+	}
+}
+
+func (c Config) http2Options() http2.Options {
+	o := c.HTTP2
+	o.Request = c.requestOptions()
+	o.ErrorHandler = http2.ErrorHandler(c.ErrorHandler)
+	o.Logger = c.Logger
+
+	return o
+}
+
+// DefaultErrorHandler replies with a plain text description of err and a
+// status code matching it.
+func DefaultErrorHandler(w *response.Writer, err error) {
+	statusCode := StatusForError(err)
+	w.WriteStatusLine(statusCode)
+
+	msg := []byte(err.Error())
+
+	h := response.GetDefaultHeaders(len(msg))
+	// Tell the client which encodings it could have used, RFC 9110 15.5.16.
+	if statusCode == response.STATUS_UNSUPPORTED_MEDIA_TYPE {
+		h.Set("Accept-Encoding", "gzip, deflate")
+	}
+	w.WriteHeaders(h)
+
+	w.WriteBody(msg)
+}
+
+// StatusForError maps an error returned while reading a request to the
+// status code the client should see.
+func StatusForError(err error) response.StatusCode {
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, request.ERROR_HEADERS_TOO_LARGE):
+		return response.STATUS_REQUEST_HEADER_FIELDS_TOO_LARGE
+	case errors.Is(err, request.ERROR_BODY_TOO_LARGE):
+		return response.STATUS_CONTENT_TOO_LARGE
+	case errors.Is(err, request.ERROR_UNSUPPORTED_CONTENT_ENCODING):
+		return response.STATUS_UNSUPPORTED_MEDIA_TYPE
+	case errors.Is(err, request.ERROR_UNSUPPORTED_TRANSFER_ENCODING):
+		return response.STATUS_NOT_IMPLEMENTED
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return response.STATUS_REQUEST_TIMEOUT
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return response.STATUS_REQUEST_TIMEOUT
+	default:
+		return response.STATUS_BAD_REQUEST
+	}
+}
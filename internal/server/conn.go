@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// conn wraps a client connection. Once a request has been parsed, it keeps
+// reading from the connection in the background, so that a client hanging
+// up cancels the request context while the handler is still running.
+type conn struct {
+	net.Conn
+	watchDone chan struct{}
+	// unread holds a byte the watcher read. Read returns it before reading
+	// from the connection again, so pipelined data isn't lost.
+	unread []byte
+
+	bytesRead    int
+	bytesWritten int
+}
+
+func newConn(c net.Conn) *conn {
+	return &conn{Conn: c}
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	if len(c.unread) > 0 {
+		n := copy(p, c.unread)
+		c.unread = c.unread[n:]
+		c.bytesRead += n
+		return n, nil
+	}
+
+	n, err := c.Conn.Read(p)
+	c.bytesRead += n
+	return n, err
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.bytesWritten += n
+	return n, err
+}
+
+// ReadFrom keeps the sendfile and splice fast paths of the underlying
+// connection available to response.Writer.
+func (c *conn) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	var err error
+
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(c.Conn, r)
+	}
+	c.bytesWritten += int(n)
+
+	return n, err
+}
+
+func (c *conn) watchDisconnect(cancel context.CancelFunc) {
+	c.watchDone = make(chan struct{})
+
+	go func() {
+		defer close(c.watchDone)
+
+		// One read is enough: it either fails because the client closed
+		// the connection, or returns data the client sent after the
+		// request, which is kept in unread for whoever reads next.
+		buf := make([]byte, 1)
+		n, err := c.Conn.Read(buf)
+		c.unread = buf[:n]
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			cancel()
+		}
+	}()
+}
+
+func (c *conn) stopWatching() {
+	if c.watchDone == nil {
+		return
+	}
+
+	// Unblock the pending Read in the watcher goroutine.
+	c.Conn.SetReadDeadline(time.Now())
+	<-c.watchDone
+	c.Conn.SetReadDeadline(time.Time{})
+	c.watchDone = nil
+}
+
+// takeUnread returns what the watcher read from the connection, for
+// callers that read from the underlying connection directly. Call it after
+// stopWatching.
+func (c *conn) takeUnread() []byte {
+	unread := c.unread
+	c.unread = nil
+	c.bytesRead += len(unread)
+
+	return unread
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/http2"
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+)
+
+// sniffPreface reads from r for as long as what it reads could be the
+// start of the HTTP/2 client preface. It returns the bytes read, and
+// whether they are the whole preface. An HTTP/1.1 request gives itself
+// away with its first byte.
+func sniffPreface(r io.Reader) ([]byte, bool, error) {
+	buf := make([]byte, 0, len(http2.CLIENT_PREFACE))
+
+	for len(buf) < len(http2.CLIENT_PREFACE) {
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+
+		if !strings.HasPrefix(http2.CLIENT_PREFACE, string(buf)) {
+			return buf, false, nil
+		}
+
+		if err != nil {
+			return buf, false, err
+		}
+	}
+
+	return buf, true, nil
+}
+
+// upgradeH2C switches the connection req arrived on to HTTP/2, and serves
+// req as its first stream.
+func (s *Server) upgradeH2C(conn *conn, w *response.Writer, req *request.Request) {
+	h := headers.NewHeaders()
+	h.Set("Connection", "Upgrade")
+	h.Set("Upgrade", "h2c")
+
+	w.WriteStatusLine(response.STATUS_SWITCHING_PROTOCOLS)
+	err := w.WriteHeaders(h)
+	if err != nil {
+		return
+	}
+
+	s.serveHTTP2(newBufferedConn(conn, req.Buffered()), req)
+}
+
+func (s *Server) serveHTTP2(c net.Conn, upgrade *request.Request) {
+	options := s.config.http2Options()
+
+	// Errors are the client's doing, and http2 logs those worth knowing.
+	if upgrade == nil {
+		http2.ServeConn(s.ctx, c, s.serveStream, options)
+	} else {
+		http2.ServeUpgrade(s.ctx, c, upgrade, s.serveStream, options)
+	}
+}
+
+// serveStream does for a request on an HTTP/2 stream what handle does
+// for one on an HTTP/1.1 connection.
+func (s *Server) serveStream(w *response.Writer, req *request.Request) {
+	start := time.Now()
+
+	requestID := requestIDFor(req)
+
+	entry := accessEntry{remoteAddr: req.RemoteAddr}
+	entry.setRequest(req, requestID)
+
+	timeout, cancel := s.requestContext(req.Context())
+	defer cancel()
+	ctx := context.WithValue(timeout, requestIDKey{}, requestID)
+
+	if m := s.config.Metrics; m != nil {
+		m.inFlight.Inc()
+		defer m.inFlight.Dec()
+	}
+
+	// A response to HEAD is the one to GET without its body, RFC 9110 9.3.2.
+	if req.RequestLine.Method == "HEAD" {
+		w.DiscardBody()
+	}
+	w.AddHeaderHook(response.PreconditionHook(req))
+
+	s.handler(w, req.WithContext(ctx))
+
+	if w.StatusCode() != 0 && !w.HeadersWritten() {
+		w.WriteHeaders(headers.NewHeaders())
+	}
+
+	w.Finish()
+
+	entry.status = int(w.StatusCode())
+	entry.bytes = w.BytesWritten()
+	entry.duration = time.Since(start)
+	s.logAccess(ctx, entry)
+	s.observeRequest(req, entry, nil)
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpffomtcp.pinglu.dev/internal/http2"
+)
+
+// h2Frame encodes a frame with the given type, flags and stream.
+func h2Frame(typ http2.FrameType, flags byte, streamID uint32, payload []byte) []byte {
+	b := []byte{byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), byte(typ), flags}
+	b = binary.BigEndian.AppendUint32(b, streamID)
+	return append(b, payload...)
+}
+
+// h2Literal encodes a header field as an HPACK literal without indexing,
+// which is all a test client needs.
+func h2Literal(b []byte, name, value string) []byte {
+	b = append(b, 0x00, byte(len(name)))
+	b = append(b, name...)
+	b = append(b, byte(len(value)))
+	return append(b, value...)
+}
+
+// h2ClientStart returns the preface and an empty SETTINGS frame, followed
+// by frames.
+func h2ClientStart(frames []byte) []byte {
+	b := append([]byte(http2.CLIENT_PREFACE), h2Frame(http2.FRAME_SETTINGS, 0, 0, nil)...)
+	return append(b, frames...)
+}
+
+// readH2Response reads frames until stream 1 ends, and returns the header
+// block of the response and its body.
+func readH2Response(t *testing.T, r io.Reader) ([]byte, string) {
+	t.Helper()
+
+	var block []byte
+	var body []byte
+
+	for {
+		head := make([]byte, http2.FRAME_HEADER_LEN)
+		_, err := io.ReadFull(r, head)
+		require.NoError(t, err)
+
+		payload := make([]byte, int(head[0])<<16|int(head[1])<<8|int(head[2]))
+		_, err = io.ReadFull(r, payload)
+		require.NoError(t, err)
+
+		typ, flags := http2.FrameType(head[3]), head[4]
+		if binary.BigEndian.Uint32(head[5:])&0x7FFFFFFF != 1 {
+			continue
+		}
+
+		switch typ {
+		case http2.FRAME_HEADERS:
+			block = payload
+		case http2.FRAME_DATA:
+			body = append(body, payload...)
+		}
+
+		if typ == http2.FRAME_RST_STREAM || flags&http2.FLAG_END_STREAM != 0 {
+			return block, string(body)
+		}
+	}
+}
+
+func TestH2C(t *testing.T) {
+	_, l := startTestServer(t, helloHandler, Config{H2C: true})
+
+	request := h2Literal(nil, ":method", "GET")
+	request = h2Literal(request, ":scheme", "http")
+	request = h2Literal(request, ":path", "/h2")
+	request = h2Literal(request, ":authority", "localhost")
+
+	// Test: Prior knowledge
+	c, err := l.Dial()
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Pipes are unbuffered, and the server writes its SETTINGS while we
+	// write ours.
+	go c.Write(h2ClientStart(h2Frame(http2.FRAME_HEADERS, http2.FLAG_END_STREAM|http2.FLAG_END_HEADERS, 1, request)))
+
+	block, body := readH2Response(t, c)
+	// :status 200 is entry 8 of the static table.
+	require.NotEmpty(t, block)
+	assert.Equal(t, byte(0x88), block[0])
+	assert.Equal(t, "hello from /h2", body)
+
+	// Test: Upgrade from HTTP/1.1
+	c, err = l.Dial()
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = c.Write([]byte("GET /upgrade HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: \r\n\r\n"))
+	require.NoError(t, err)
+
+	br := bufio.NewReader(c)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols", readHead(t, br))
+
+	go c.Write(h2ClientStart(nil))
+
+	block, body = readH2Response(t, br)
+	require.NotEmpty(t, block)
+	assert.Equal(t, byte(0x88), block[0])
+	assert.Equal(t, "hello from /upgrade", body)
+
+	// Test: HTTP/1.1 is still served
+	c, err = l.Dial()
+	require.NoError(t, err)
+	defer c.Close()
+
+	_, err = c.Write([]byte("GET /plain HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err := io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, string(resp), "hello from /plain")
+
+	// Test: Without H2C an upgrade request is answered over HTTP/1.1
+	_, l = startTestServer(t, helloHandler, Config{})
+	c, err = l.Dial()
+	require.NoError(t, err)
+	defer c.Close()
+
+	_, err = c.Write([]byte("GET /upgrade HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: \r\n\r\n"))
+	require.NoError(t, err)
+	resp, err = io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 200 OK\r\n")
+}
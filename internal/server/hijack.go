@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+)
+
+var ERROR_HIJACK_UNSUPPORTED = errors.New("request was not received by a server that supports hijacking")
+var ERROR_HIJACKED = errors.New("connection was already hijacked or released")
+
+type hijackKey struct{}
+
+// hijacker hands the connection of a request over to its handler. It
+// lives in the request context.
+type hijacker struct {
+	mu       sync.Mutex
+	conn     *conn
+	req      *request.Request
+	w        *response.Writer
+	hijacked bool
+	released bool
+	upgrade  UpgradeHandler
+	timeout  *timeoutContext
+}
+
+// Hijack takes over the connection req arrived on, for protocols that
+// aren't HTTP. It returns the connection and the bytes the server already
+// read past the request, which the client sent before anything still to be
+// read from the connection.
+//
+// Whatever the handler wrote to its response.Writer has been sent by then,
+// and the writer accepts nothing more. The server doesn't write anything
+// else, apply timeouts or close the connection: that is up to the caller.
+// Hijack must be called before the handler returns.
+//
+// From then on the request context is only cancelled when the server
+// shuts down or the handler returns, not by RequestTimeout or the client
+// going away.
+func Hijack(req *request.Request) (net.Conn, []byte, error) {
+	h, ok := req.Context().Value(hijackKey{}).(*hijacker)
+	if !ok {
+		return nil, nil, ERROR_HIJACK_UNSUPPORTED
+	}
+
+	return h.hijack()
+}
+
+func (h *hijacker) hijack() (net.Conn, []byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.hijacked || h.released {
+		return nil, nil, ERROR_HIJACKED
+	}
+	h.hijacked = true
+
+	conn, buffered := h.take()
+	return conn, buffered, nil
+}
+
+// take detaches the connection from the server's bookkeeping.
+func (h *hijacker) take() (net.Conn, []byte) {
+	h.w.Flush()
+	h.w.Abort()
+
+	h.conn.stopWatching()
+	h.conn.SetDeadline(time.Time{})
+	if h.timeout != nil {
+		h.timeout.clear()
+	}
+
+	buffered := append(bytes.Clone(h.req.Buffered()), h.conn.takeUnread()...)
+
+	return h.conn.Conn, buffered
+}
+
+// release is called once the handler has returned, after which Hijack
+// fails. It reports whether the server still owns the connection.
+func (h *hijacker) release() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.released = true
+	return !h.hijacked
+}
+
+// bufferedConn is a connection whose reads start with bytes that were read
+// from it earlier.
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func newBufferedConn(conn net.Conn, buffered []byte) net.Conn {
+	if len(buffered) == 0 {
+		return conn
+	}
+
+	return &bufferedConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(buffered), conn)}
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
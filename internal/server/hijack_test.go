@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+)
+
+// readHead reads a response head from br and returns its status line.
+func readHead(t *testing.T, br *bufio.Reader) string {
+	t.Helper()
+
+	statusLine, err := br.ReadString('\n')
+	require.NoError(t, err)
+
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			return strings.TrimSuffix(statusLine, "\r\n")
+		}
+	}
+}
+
+func TestHijack(t *testing.T) {
+	errs := make(chan error, 3)
+
+	_, l := startTestServer(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.STATUS_OK)
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		w.WriteHeaders(h)
+
+		conn, buffered, err := Hijack(req)
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		// Test: The writer is done once the connection is hijacked
+		_, err = w.WriteBody([]byte("too late"))
+		errs <- err
+
+		// Test: Only one hijack per request
+		_, _, err = Hijack(req)
+		errs <- err
+
+		// Echo everything back in upper case, starting with what the server
+		// had already read, until the client hangs up.
+		go func() {
+			defer conn.Close()
+
+			r := io.MultiReader(bytes.NewReader(buffered), conn)
+			buf := make([]byte, 64)
+			for {
+				n, err := r.Read(buf)
+				if err != nil {
+					return
+				}
+				conn.Write(bytes.ToUpper(buf[:n]))
+			}
+		}()
+	}, Config{WriteTimeout: 50 * time.Millisecond})
+
+	c, err := l.Dial()
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Test: Bytes sent right after the request reach the hijacker
+	go c.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\nearly data"))
+
+	br := bufio.NewReader(c)
+	assert.Equal(t, "HTTP/1.1 200 OK", readHead(t, br))
+
+	got := make([]byte, len("EARLY DATA"))
+	_, err = io.ReadFull(br, got)
+	require.NoError(t, err)
+	assert.Equal(t, "EARLY DATA", string(got))
+
+	require.ErrorIs(t, <-errs, response.ERROR_WRONG_WRITE_ORDER)
+	require.ErrorIs(t, <-errs, ERROR_HIJACKED)
+
+	// Test: The server neither closes the connection nor times it out
+	time.Sleep(100 * time.Millisecond)
+	_, err = c.Write([]byte("still here"))
+	require.NoError(t, err)
+	got = make([]byte, len("STILL HERE"))
+	_, err = io.ReadFull(br, got)
+	require.NoError(t, err)
+	assert.Equal(t, "STILL HERE", string(got))
+}
+
+func TestHijackTimeout(t *testing.T) {
+	errs := make(chan error, 1)
+
+	s, l := startTestServer(t, func(w *response.Writer, req *request.Request) {
+		conn, _, err := Hijack(req)
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+
+		ctx := req.Context()
+		select {
+		case <-ctx.Done():
+			errs <- ctx.Err()
+			return
+		case <-time.After(150 * time.Millisecond):
+		}
+
+		_, hasDeadline := ctx.Deadline()
+		assert.False(t, hasDeadline)
+
+		// Test: Only shutdown ends a hijacked request
+		<-ctx.Done()
+		errs <- ctx.Err()
+	}, Config{RequestTimeout: 50 * time.Millisecond})
+
+	c, err := l.Dial()
+	require.NoError(t, err)
+	_, err = c.Write([]byte(GET_REQUEST))
+	require.NoError(t, err)
+
+	// Test: The request timeout no longer applies, nor does the client
+	// going away
+	time.Sleep(100 * time.Millisecond)
+	c.Close()
+	select {
+	case err := <-errs:
+		t.Fatalf("request context done early: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	s.Close()
+	assert.ErrorIs(t, waitForErr(t, errs), context.Canceled)
+}
+
+func TestHijackAfterReturn(t *testing.T) {
+	reqs := make(chan *request.Request, 1)
+
+	_, l := startTestServer(t, func(w *response.Writer, req *request.Request) {
+		reqs <- req
+		w.WriteStatusLine(response.STATUS_OK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	}, Config{})
+
+	c, err := l.Dial()
+	require.NoError(t, err)
+	go c.Write([]byte(GET_REQUEST))
+	resp, err := io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 200 OK\r\n")
+
+	// Test: Too late once the handler has returned
+	_, _, err = Hijack(<-reqs)
+	require.ErrorIs(t, err, ERROR_HIJACKED)
+
+	// Test: Requests that didn't come from a server
+	r, err := request.RequestFromReader(strings.NewReader(GET_REQUEST))
+	require.NoError(t, err)
+	_, _, err = Hijack(r)
+	require.ErrorIs(t, err, ERROR_HIJACK_UNSUPPORTED)
+	require.ErrorIs(t, OnUpgrade(r, func(conn net.Conn) {}), ERROR_UPGRADE_UNSUPPORTED)
+}
+
+func TestOnUpgrade(t *testing.T) {
+	_, l := startTestServer(t, func(w *response.Writer, req *request.Request) {
+		OnUpgrade(req, func(conn net.Conn) {
+			io.Copy(conn, io.LimitReader(conn, int64(len("pipelined"))))
+		})
+
+		w.WriteStatusLine(response.STATUS_SWITCHING_PROTOCOLS)
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Replace("Connection", "Upgrade")
+		h.Set("Upgrade", "echo")
+		w.WriteHeaders(h)
+	}, Config{})
+
+	c, err := l.Dial()
+	require.NoError(t, err)
+
+	// Test: The upgraded connection starts with the bytes sent with the
+	// request, and is closed when the upgrade handler returns
+	go c.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\npipelined"))
+	br := bufio.NewReader(c)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols", readHead(t, br))
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "pipelined", string(rest))
+
+	// Test: Without a 101 the upgrade handler doesn't run
+	_, l = startTestServer(t, func(w *response.Writer, req *request.Request) {
+		OnUpgrade(req, func(conn net.Conn) { conn.Write([]byte("upgraded")) })
+		helloHandler(w, req)
+	}, Config{})
+
+	c, err = l.Dial()
+	require.NoError(t, err)
+	go c.Write([]byte(GET_REQUEST))
+	resp, err := io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 200 OK\r\n")
+	assert.NotContains(t, string(resp), "upgraded")
+}
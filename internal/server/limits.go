@@ -0,0 +1,175 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ConnLimitMode decides what happens to connections beyond Config.MaxConns.
+type ConnLimitMode string
+
+const (
+	// QUEUE_CONNS stops accepting until a connection slot frees up, leaving
+	// new connections waiting in the listen backlog.
+	QUEUE_CONNS ConnLimitMode = "queue"
+	// REJECT_CONNS accepts the connection and replies with 503.
+	REJECT_CONNS ConnLimitMode = "reject"
+)
+
+const MIN_ACCEPT_BACKOFF = 5 * time.Millisecond
+const MAX_ACCEPT_BACKOFF = 1 * time.Second
+
+// REJECT_WRITE_TIMEOUT bounds the time spent telling a rejected client to
+// go away.
+const REJECT_WRITE_TIMEOUT = 1 * time.Second
+
+// MAX_REJECTING caps the 503s being written at once, so that a flood of
+// connections beyond MaxConns can't pile up goroutines. Past it, rejected
+// connections are closed without a word.
+const MAX_REJECTING = 16
+
+type connLimiter struct {
+	// slots has one element per open connection; nil means no limit.
+	slots chan struct{}
+	mode  ConnLimitMode
+	// rejecting has one element per 503 being written.
+	rejecting chan struct{}
+
+	maxPerIP int
+	mu       sync.Mutex
+	perIP    map[string]int
+}
+
+func newConnLimiter(config Config) *connLimiter {
+	l := &connLimiter{
+		mode:      config.ConnLimitMode,
+		maxPerIP:  config.MaxConnsPerIP,
+		perIP:     map[string]int{},
+		rejecting: make(chan struct{}, MAX_REJECTING),
+	}
+
+	if config.MaxConns > 0 {
+		l.slots = make(chan struct{}, config.MaxConns)
+	}
+
+	return l
+}
+
+func (l *connLimiter) queues() bool {
+	return l.slots != nil && l.mode == QUEUE_CONNS
+}
+
+// waitSlot blocks until a connection slot is free or done is closed. It
+// reports whether a slot was taken.
+func (l *connLimiter) waitSlot(done <-chan struct{}) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// trySlot takes a connection slot if one is free.
+func (l *connLimiter) trySlot() bool {
+	if l.slots == nil {
+		return true
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *connLimiter) releaseSlot() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// tryReject takes one of the MAX_REJECTING places for writing a 503.
+func (l *connLimiter) tryReject() bool {
+	select {
+	case l.rejecting <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *connLimiter) releaseReject() {
+	<-l.rejecting
+}
+
+// acquireIP counts a connection from ip against the per-IP cap. It reports
+// false, without counting, if ip is at its cap.
+func (l *connLimiter) acquireIP(ip string) bool {
+	if l.maxPerIP <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.perIP[ip] >= l.maxPerIP {
+		return false
+	}
+	l.perIP[ip]++
+
+	return true
+}
+
+func (l *connLimiter) releaseIP(ip string) {
+	if l.maxPerIP <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.perIP[ip]--
+	if l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+func remoteIP(c net.Conn) string {
+	addr := c.RemoteAddr().String()
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
+// isTemporary reports whether an Accept error is worth retrying, e.g.
+// because the process ran out of file descriptors.
+func isTemporary(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, syscall.EMFILE) ||
+		errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ENOBUFS) ||
+		errors.Is(err, syscall.ENOMEM) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return MIN_ACCEPT_BACKOFF
+	}
+
+	return min(backoff*2, MAX_ACCEPT_BACKOFF)
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+)
+
+// blockingHandler signals on started and then holds its connection open
+// until release is closed.
+func blockingHandler(started chan<- struct{}, release <-chan struct{}) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		started <- struct{}{}
+		<-release
+
+		w.WriteStatusLine(response.STATUS_OK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	}
+}
+
+func sendGet(t *testing.T, c net.Conn) string {
+	t.Helper()
+
+	go c.Write([]byte(GET_REQUEST))
+	resp, err := io.ReadAll(c)
+	require.NoError(t, err)
+
+	return string(resp)
+}
+
+func TestConnLimits(t *testing.T) {
+	// Test: Reject mode replies 503 beyond MaxConns
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	s, l := startTestServer(t, blockingHandler(started, release), Config{
+		MaxConns:      1,
+		ConnLimitMode: REJECT_CONNS,
+	})
+
+	first, err := l.Dial()
+	require.NoError(t, err)
+	go first.Write([]byte(GET_REQUEST))
+	<-started
+
+	second, err := l.Dial()
+	require.NoError(t, err)
+	resp, err := io.ReadAll(second)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 503 Service Unavailable\r\n")
+	assert.Contains(t, string(resp), "retry-after: 1\r\n")
+
+	// Test: Once MAX_REJECTING 503s are in flight, the rest are closed
+	// right away
+	for range MAX_REJECTING {
+		require.True(t, s.limiter.tryReject())
+	}
+	third, err := l.Dial()
+	require.NoError(t, err)
+	resp, err = io.ReadAll(third)
+	require.NoError(t, err)
+	assert.Empty(t, resp)
+	for range MAX_REJECTING {
+		s.limiter.releaseReject()
+	}
+
+	close(release)
+	resp, err = io.ReadAll(first)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 200 OK\r\n")
+
+	// Test: Queue mode waits for a free slot
+	started = make(chan struct{}, 2)
+	release = make(chan struct{})
+	_, l = startTestServer(t, blockingHandler(started, release), Config{MaxConns: 1})
+
+	first, err = l.Dial()
+	require.NoError(t, err)
+	go first.Write([]byte(GET_REQUEST))
+	<-started
+
+	var secondAccepted atomic.Bool
+	secondResp := make(chan string, 1)
+	go func() {
+		c, err := l.Dial()
+		if err != nil {
+			secondResp <- err.Error()
+			return
+		}
+		secondAccepted.Store(true)
+		secondResp <- sendGet(t, c)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, secondAccepted.Load())
+
+	close(release)
+	resp, err = io.ReadAll(first)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 200 OK\r\n")
+	<-started
+	assert.Contains(t, <-secondResp, "HTTP/1.1 200 OK\r\n")
+
+	// Test: Per-IP cap
+	started = make(chan struct{}, 1)
+	release = make(chan struct{})
+	_, l = startTestServer(t, blockingHandler(started, release), Config{MaxConnsPerIP: 1})
+
+	first, err = l.Dial()
+	require.NoError(t, err)
+	go first.Write([]byte(GET_REQUEST))
+	<-started
+
+	second, err = l.Dial()
+	require.NoError(t, err)
+	resp, err = io.ReadAll(second)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 503 Service Unavailable\r\n")
+	close(release)
+	io.ReadAll(first)
+}
+
+// flakyListener fails Accept with EMFILE a few times before delegating to
+// the wrapped listener.
+type flakyListener struct {
+	*PipeListener
+	failures atomic.Int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures.Add(-1) >= 0 {
+		return nil, &net.OpError{Op: "accept", Net: "pipe", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	}
+
+	return l.PipeListener.Accept()
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	// Test: Temporary errors are retried with exponential backoff
+	assert.Equal(t, MIN_ACCEPT_BACKOFF, nextBackoff(0))
+	assert.Equal(t, 2*MIN_ACCEPT_BACKOFF, nextBackoff(MIN_ACCEPT_BACKOFF))
+	assert.Equal(t, MAX_ACCEPT_BACKOFF, nextBackoff(MAX_ACCEPT_BACKOFF))
+
+	l := &flakyListener{PipeListener: NewPipeListener()}
+	l.failures.Store(3)
+
+	s, err := ServeListener(l, Config{}, helloHandler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	start := time.Now()
+	c, err := l.Dial()
+	require.NoError(t, err)
+	assert.Contains(t, sendGet(t, c), "HTTP/1.1 200 OK\r\n")
+	// 5ms + 10ms + 20ms
+	assert.GreaterOrEqual(t, time.Since(start), 35*time.Millisecond)
+}
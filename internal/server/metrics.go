@@ -0,0 +1,102 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"strconv"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/metrics"
+	"httpffomtcp.pinglu.dev/internal/request"
+)
+
+// DEFAULT_ROUTE is the "route" label of every request when Metrics.Route is
+// not set. Labelling by path would let clients create a series per URL.
+const DEFAULT_ROUTE = "other"
+
+// Metrics instruments a Server. Create it with NewMetrics and expose the
+// registry with metrics.Registry.Handler.
+type Metrics struct {
+	// Route names the route a request belongs to, for the "route" label.
+	// It must map requests onto a small set of values. Without it, every
+	// request is labelled DEFAULT_ROUTE.
+	Route func(req *request.Request) string
+
+	requests    *metrics.Counter
+	duration    *metrics.Histogram
+	inFlight    *metrics.Gauge
+	openConns   *metrics.Gauge
+	bytesIn     *metrics.Counter
+	bytesOut    *metrics.Counter
+	parseErrors *metrics.Counter
+}
+
+func NewMetrics(registry *metrics.Registry) *Metrics {
+	return &Metrics{
+		requests: registry.NewCounter("http_requests_total",
+			"Requests served, by method, route and status code.",
+			"method", "route", "status"),
+		duration: registry.NewHistogram("http_request_duration_seconds",
+			"Time spent handling requests, by method and route.",
+			nil, "method", "route"),
+		inFlight: registry.NewGauge("http_requests_in_flight",
+			"Requests currently being handled."),
+		openConns: registry.NewGauge("http_open_connections",
+			"Client connections currently open."),
+		bytesIn: registry.NewCounter("http_received_bytes_total",
+			"Bytes read from client connections."),
+		bytesOut: registry.NewCounter("http_sent_bytes_total",
+			"Bytes written to client connections."),
+		parseErrors: registry.NewCounter("http_request_parse_errors_total",
+			"Requests that could not be parsed, by error.",
+			"error"),
+	}
+}
+
+func (m *Metrics) route(req *request.Request) string {
+	if m.Route == nil {
+		return DEFAULT_ROUTE
+	}
+
+	return m.Route(req)
+}
+
+var parseErrorNames = []struct {
+	err  error
+	name string
+}{
+	{request.ERROR_MALFORMED_REQUEST_LINE, "ERROR_MALFORMED_REQUEST_LINE"},
+	{request.ERROR_INVALID_METHOD, "ERROR_INVALID_METHOD"},
+	{request.ERROR_UNSUPPORTED_HTTP_VERSION, "ERROR_UNSUPPORTED_HTTP_VERSION"},
+	{request.ERROR_MISSING_HOST_HEADER, "ERROR_MISSING_HOST_HEADER"},
+	{request.ERROR_CONTENT_LENGTH_EXCEEDED, "ERROR_CONTENT_LENGTH_EXCEEDED"},
+	{request.ERROR_HEADERS_TOO_LARGE, "ERROR_HEADERS_TOO_LARGE"},
+	{request.ERROR_BODY_TOO_LARGE, "ERROR_BODY_TOO_LARGE"},
+	{request.ERROR_UNSUPPORTED_CONTENT_ENCODING, "ERROR_UNSUPPORTED_CONTENT_ENCODING"},
+	{request.ERROR_MALFORMED_BODY, "ERROR_MALFORMED_BODY"},
+	{request.ERROR_MALFORMED_CHUNK, "ERROR_MALFORMED_CHUNK"},
+	{request.ERROR_UNSUPPORTED_TRANSFER_ENCODING, "ERROR_UNSUPPORTED_TRANSFER_ENCODING"},
+	{headers.ERROR_MALFORMED_HEADER, "ERROR_MALFORMED_HEADER"},
+	{headers.ERROR_INVALID_FIELD_NAME, "ERROR_INVALID_FIELD_NAME"},
+}
+
+// parseErrorName names err for the "error" label of parse errors.
+func parseErrorName(err error) string {
+	for _, e := range parseErrorNames {
+		if errors.Is(err, e.err) {
+			return e.name
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "TIMEOUT"
+	}
+
+	var numErr *strconv.NumError
+	if errors.As(err, &numErr) {
+		return "ERROR_INVALID_CONTENT_LENGTH"
+	}
+
+	return "OTHER"
+}
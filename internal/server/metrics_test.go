@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpffomtcp.pinglu.dev/internal/metrics"
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+)
+
+func TestServerMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	m := NewMetrics(registry)
+
+	_, l := startTestServer(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/metrics" {
+			registry.Handler()(w, req)
+			return
+		}
+		helloHandler(w, req)
+	}, Config{Metrics: m})
+
+	get := func(data string) string {
+		c, err := l.Dial()
+		require.NoError(t, err)
+		go c.Write([]byte(data))
+		resp, err := io.ReadAll(c)
+		require.NoError(t, err)
+		return string(resp)
+	}
+
+	get("GET /hello?name=x HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	get("GET /hello HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	get("GET / HTTP/1.1\r\n\r\n")
+	for i := range 20 {
+		get("GET /random/" + strconv.Itoa(i) + " HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	}
+
+	// The metrics of a request are recorded after its response is sent.
+	text := func() string {
+		var b bytes.Buffer
+		registry.WriteText(&b)
+		return b.String()
+	}
+	require.Eventually(t, func() bool {
+		return strings.Contains(text(), "http_open_connections 0\n")
+	}, 5*time.Second, 5*time.Millisecond)
+
+	// Test: Without Route, distinct paths share one series
+	out := text()
+	assert.Contains(t, out, `http_requests_total{method="GET",route="other",status="200"} 22`)
+	assert.Contains(t, out, `http_request_duration_seconds_count{method="GET",route="other"} 22`)
+	assert.Equal(t, 1, strings.Count(out, "http_requests_total{"))
+	assert.Contains(t, out, `http_request_parse_errors_total{error="ERROR_MISSING_HOST_HEADER"} 1`)
+	assert.Contains(t, out, "http_requests_in_flight 0\n")
+	assert.NotContains(t, out, "http_received_bytes_total 0\n")
+	assert.NotContains(t, out, "http_sent_bytes_total 0\n")
+
+	// Test: Exposed over HTTP
+	resp := get("GET /metrics HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Contains(t, resp, "content-type: "+metrics.CONTENT_TYPE+"\r\n")
+	assert.Contains(t, resp, "# TYPE http_requests_total counter\n")
+
+	// Test: Route names the series
+	m.Route = func(req *request.Request) string {
+		if strings.HasPrefix(req.RequestLine.RequestTarget, "/hello") {
+			return "/hello"
+		}
+		return "other"
+	}
+	get("GET /hello?name=y HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.Eventually(t, func() bool {
+		return strings.Contains(text(), `http_requests_total{method="GET",route="/hello",status="200"} 1`)
+	}, 5*time.Second, 5*time.Millisecond)
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"httpffomtcp.pinglu.dev/internal/request"
+)
+
+const REQUEST_ID_HEADER = "X-Request-Id"
+
+type requestIDKey struct{}
+
+// RequestID returns the ID the server assigned to the request that ctx
+// belongs to. It is taken from the X-Request-Id request header if the
+// client sent one, and generated otherwise.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDFor returns the ID the client sent for req, or a new one.
+func requestIDFor(req *request.Request) string {
+	if id := req.Headers.Get(REQUEST_ID_HEADER); id != "" {
+		return id
+	}
+
+	return newRequestID()
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -1,10 +1,19 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
 
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/http2"
 	"httpffomtcp.pinglu.dev/internal/request"
 	"httpffomtcp.pinglu.dev/internal/response"
 )
@@ -12,66 +21,331 @@ import (
 type Handler func(w *response.Writer, req *request.Request)
 
 type Server struct {
-	closed   bool
+	closed   atomic.Bool
 	listener net.Listener
 	handler  Handler
+	config   Config
+	limiter  *connLimiter
+
+	// ctx is the parent of every request context; it is cancelled when
+	// the server is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newServer(listener net.Listener, config Config, handler Handler) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	config = config.withDefaults()
+
+	return &Server{
+		listener: listener,
+		handler:  handler,
+		config:   config,
+		limiter:  newConnLimiter(config),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
 }
 
 func (s *Server) Close() error {
-	s.closed = true
+	s.closed.Store(true)
+	s.cancel()
 	return s.listener.Close()
 }
 
 func (s *Server) listen() {
+	var backoff time.Duration
+
 	for {
+		// In queue mode we don't even accept a connection until there is
+		// room for it, so that the kernel backlog does the queueing.
+		queued := s.limiter.queues()
+		if queued && !s.limiter.waitSlot(s.ctx.Done()) {
+			return
+		}
+
 		conn, err := s.listener.Accept()
 
-		if s.closed {
+		if s.closed.Load() {
+			if queued {
+				s.limiter.releaseSlot()
+			}
+			if conn != nil {
+				conn.Close()
+			}
 			return
 		}
 
 		if err != nil {
-			log.Printf("Error accepting connection: %v", err)
+			if queued {
+				s.limiter.releaseSlot()
+			}
+
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			if !isTemporary(err) {
+				s.config.Logger.Error("error accepting connection, no longer listening", "err", err)
+				return
+			}
+
+			backoff = nextBackoff(backoff)
+			s.config.Logger.Error("error accepting connection", "err", err, "retry_in", backoff)
+
+			select {
+			case <-time.After(backoff):
+			case <-s.ctx.Done():
+				return
+			}
+			continue
+		}
+		backoff = 0
+
+		if !queued && !s.limiter.trySlot() {
+			if !s.limiter.tryReject() {
+				conn.Close()
+				continue
+			}
+
+			go func() {
+				defer s.limiter.releaseReject()
+				s.reject(conn)
+			}()
 			continue
 		}
 
-		go s.handle(conn)
+		go s.serve(conn)
 	}
 }
 
-func (s *Server) handle(conn net.Conn) {
+// serve handles conn, which already holds a connection slot, and releases
+// the slot once it is done.
+func (s *Server) serve(conn net.Conn) {
+	defer s.limiter.releaseSlot()
+
+	ip := remoteIP(conn)
+	if !s.limiter.acquireIP(ip) {
+		s.reject(conn)
+		return
+	}
+	defer s.limiter.releaseIP(ip)
+
+	s.handle(conn)
+}
+
+// reject tells the client we are too busy and closes conn.
+func (s *Server) reject(conn net.Conn) {
 	defer conn.Close()
 
+	conn.SetWriteDeadline(time.Now().Add(REJECT_WRITE_TIMEOUT))
+
+	msg := []byte("too many connections")
+
+	w := response.NewWriter(conn)
+	w.WriteStatusLine(response.STATUS_SERVICE_UNAVAILABLE)
+
+	h := response.GetDefaultHeaders(len(msg))
+	h.Set("Retry-After", "1")
+	w.WriteHeaders(h)
+
+	w.WriteBody(msg)
+}
+
+func (s *Server) handle(netConn net.Conn) {
+	conn := newConn(netConn)
 	w := response.NewWriter(conn)
 
-	req, err := request.RequestFromReader(conn)
+	hj := &hijacker{conn: conn, w: w}
+	defer func() {
+		if !hj.hijacked {
+			conn.Close()
+		}
+	}()
+
+	start := time.Now()
+	entry := accessEntry{remoteAddr: conn.RemoteAddr().String()}
+	logCtx := s.ctx
+
+	var req *request.Request
+
+	// HTTP/2 streams log and count their own requests.
+	var overHTTP2 bool
+
+	defer func() {
+		if overHTTP2 {
+			s.observeRequest(nil, entry, conn)
+			return
+		}
+
+		entry.status = int(w.StatusCode())
+		entry.bytes = w.BytesWritten()
+		entry.duration = time.Since(start)
+		s.logAccess(logCtx, entry)
+		s.observeRequest(req, entry, conn)
+	}()
+
+	if m := s.config.Metrics; m != nil {
+		m.openConns.Inc()
+		defer m.openConns.Dec()
+	}
+
+	if s.config.ReadTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.config.ReadTimeout))
+	}
+
+	_, isTLS := netConn.(*tls.Conn)
+
+	var reader io.Reader = conn
+	if s.config.H2C && !isTLS {
+		sniffed, isPreface, _ := sniffPreface(conn)
+		if isPreface {
+			overHTTP2 = true
+			s.serveHTTP2(newBufferedConn(conn, sniffed), nil)
+			return
+		}
+
+		// Whatever went wrong reading will go wrong again for the parser.
+		reader = io.MultiReader(bytes.NewReader(sniffed), conn)
+	}
+
+	var err error
+	req, err = request.RequestFromReaderWithOptions(reader, s.config.requestOptions())
 	if err != nil {
-		w.WriteStatusLine(response.STATUS_BAD_REQUEST)
+		// The client went away before sending a full request, so there is
+		// nobody to respond to.
+		if errors.Is(err, io.EOF) {
+			return
+		}
 
-		msg := []byte(err.Error())
+		if m := s.config.Metrics; m != nil {
+			m.parseErrors.Inc(parseErrorName(err))
+		}
+
+		s.config.ErrorHandler(w, err)
+		return
+	}
 
-		h := response.GetDefaultHeaders(len(msg))
-		w.WriteHeaders(h)
+	conn.SetReadDeadline(time.Time{})
+	if tlsConn, ok := netConn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		req.TLS = &state
+	}
 
-		w.WriteBody(msg)
+	if s.config.H2C && !isTLS && http2.IsUpgrade(req) {
+		overHTTP2 = true
+		req.RemoteAddr = entry.remoteAddr
+		s.upgradeH2C(conn, w, req)
 		return
 	}
 
-	s.handler(w, req)
+	if s.config.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
+	}
+
+	requestID := requestIDFor(req)
+
+	req.RemoteAddr = entry.remoteAddr
+	entry.setRequest(req, requestID)
+
+	timeout, cancel := s.requestContext(s.ctx)
+	defer cancel()
+	timeout.onClear = func() { conn.SetWriteDeadline(time.Time{}) }
+
+	ctx := context.WithValue(timeout, requestIDKey{}, requestID)
+	logCtx = ctx
+
+	hj.req = req
+	hj.timeout = timeout
+	ctx = context.WithValue(ctx, hijackKey{}, hj)
+
+	conn.watchDisconnect(cancel)
+	defer conn.stopWatching()
+
+	if m := s.config.Metrics; m != nil {
+		m.inFlight.Inc()
+		defer m.inFlight.Dec()
+	}
+
+	// A response to HEAD is the one to GET without its body, RFC 9110 9.3.2.
+	if req.RequestLine.Method == "HEAD" {
+		w.DiscardBody()
+	}
+	w.AddHeaderHook(response.PreconditionHook(req))
+
+	s.handler(w, req.WithContext(ctx))
+
+	// A hijacked connection is no longer ours to write to.
+	if !hj.release() {
+		return
+	}
+
+	// The status line goes out with the headers, so send it if the
+	// handler never got that far.
+	if w.StatusCode() != 0 && !w.HeadersWritten() {
+		w.WriteHeaders(headers.NewHeaders())
+	}
+
+	w.Finish()
+
+	s.runUpgrade(hj)
+}
+
+// observeRequest records a finished request, or a connection that never
+// got as far as a request when req is nil. conn is nil for requests that
+// share their connection, whose bytes are counted when it closes.
+func (s *Server) observeRequest(req *request.Request, entry accessEntry, conn *conn) {
+	m := s.config.Metrics
+	if m == nil {
+		return
+	}
+
+	if conn != nil {
+		m.bytesIn.Add(float64(conn.bytesRead))
+		m.bytesOut.Add(float64(conn.bytesWritten))
+	}
+
+	if req == nil {
+		return
+	}
+
+	route := m.route(req)
+	m.requests.Inc(entry.method, route, strconv.Itoa(entry.status))
+	m.duration.Observe(entry.duration.Seconds(), entry.method, route)
 }
 
 func Serve(port uint16, handler Handler) (*Server, error) {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	return ServeConfig(Config{Addr: fmt.Sprintf(":%d", port)}, handler)
+}
+
+// ServeConfig listens on config.Network and config.Addr and serves
+// requests in the background.
+func ServeConfig(config Config, handler Handler) (*Server, error) {
+	config = config.withDefaults()
+
+	listener, err := net.Listen(config.Network, config.Addr)
 	if err != nil {
 		return nil, err
 	}
 
-	s := &Server{
-		closed:   false,
-		listener: listener,
-		handler:  handler,
+	return ServeListener(listener, config, handler)
+}
+
+// ServeListener serves requests accepted from listener in the background.
+// config.Network and config.Addr are ignored. If config.TLSConfig is set,
+// listener is wrapped so that every connection speaks TLS.
+func ServeListener(listener net.Listener, config Config, handler Handler) (*Server, error) {
+	if config.TLSConfig != nil {
+		listener = tls.NewListener(listener, withALPN(config.TLSConfig))
 	}
 
+	s := newServer(listener, config, handler)
+
 	// Listen for requests in the background
 	go s.listen()
 
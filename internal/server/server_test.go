@@ -0,0 +1,298 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+)
+
+const GET_REQUEST = "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+
+func startTestServer(t *testing.T, handler Handler, config Config) (*Server, *PipeListener) {
+	t.Helper()
+
+	listener := NewPipeListener()
+	s, err := ServeListener(listener, config, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	return s, listener
+}
+
+// ctxErrHandler blocks until the request context is done and reports why.
+func ctxErrHandler(errs chan<- error) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+		errs <- req.Context().Err()
+	}
+}
+
+func waitForErr(t *testing.T, errs <-chan error) error {
+	t.Helper()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("request context was not cancelled")
+		return nil
+	}
+}
+
+func TestRequestContextCancellation(t *testing.T) {
+	// Test: Client disconnect cancels the context
+	errs := make(chan error, 1)
+	_, l := startTestServer(t, ctxErrHandler(errs), Config{})
+
+	c, err := l.Dial()
+	require.NoError(t, err)
+	_, err = c.Write([]byte(GET_REQUEST))
+	require.NoError(t, err)
+	c.Close()
+	assert.True(t, errors.Is(waitForErr(t, errs), context.Canceled))
+
+	// Test: Request timeout expires
+	errs = make(chan error, 1)
+	_, l = startTestServer(t, ctxErrHandler(errs), Config{RequestTimeout: 50 * time.Millisecond})
+
+	c, err = l.Dial()
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(GET_REQUEST))
+	require.NoError(t, err)
+	assert.True(t, errors.Is(waitForErr(t, errs), context.DeadlineExceeded))
+
+	// Test: Server shutdown cancels the context
+	errs = make(chan error, 1)
+	started := make(chan struct{})
+	s, l := startTestServer(t, func(w *response.Writer, req *request.Request) {
+		close(started)
+		ctxErrHandler(errs)(w, req)
+	}, Config{})
+
+	c, err = l.Dial()
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(GET_REQUEST))
+	require.NoError(t, err)
+	<-started
+	s.Close()
+	assert.True(t, errors.Is(waitForErr(t, errs), context.Canceled))
+}
+
+func helloHandler(w *response.Writer, req *request.Request) {
+	body := []byte("hello from " + req.RequestLine.RequestTarget)
+	w.WriteStatusLine(response.STATUS_OK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func TestServeListener(t *testing.T) {
+
+	// Test: In-memory listener
+	_, l := startTestServer(t, helloHandler, Config{})
+	c, err := l.Dial()
+	require.NoError(t, err)
+	_, err = c.Write([]byte("GET /pipe HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err := io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, string(resp), "hello from /pipe")
+
+	// Test: Unix domain socket
+	sock := filepath.Join(t.TempDir(), "server.sock")
+	s, err := ServeConfig(Config{Network: "unix", Addr: sock}, helloHandler)
+	require.NoError(t, err)
+	defer s.Close()
+	c, err = net.Dial("unix", sock)
+	require.NoError(t, err)
+	_, err = c.Write([]byte("GET /unix HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err = io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "hello from /unix")
+
+	// Test: Limits map to status codes
+	_, l = startTestServer(t, helloHandler, Config{MaxHeaderBytes: 16})
+	c, err = l.Dial()
+	require.NoError(t, err)
+	go c.Write([]byte("GET /a/very/long/path HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	resp, err = io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 431 ")
+
+	// Test: Custom error handler
+	_, l = startTestServer(t, helloHandler, Config{
+		ErrorHandler: func(w *response.Writer, err error) {
+			w.WriteStatusLine(response.STATUS_INTERNAL_ERROR)
+			w.WriteHeaders(response.GetDefaultHeaders(0))
+		},
+	})
+	c, err = l.Dial()
+	require.NoError(t, err)
+	go c.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	resp, err = io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 500 ")
+}
+
+func TestSystemdListeners(t *testing.T) {
+	// Test: Not socket activated
+	t.Setenv("LISTEN_PID", "")
+	t.Setenv("LISTEN_FDS", "")
+	listeners, err := SystemdListeners()
+	require.NoError(t, err)
+	assert.Empty(t, listeners)
+
+	// Test: Variables meant for another process are ignored
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	listeners, err = SystemdListeners()
+	require.NoError(t, err)
+	assert.Empty(t, listeners)
+	_, found := os.LookupEnv("LISTEN_FDS")
+	assert.False(t, found)
+}
+
+func TestConditionalRequests(t *testing.T) {
+	body := []byte("cached data")
+	_, l := startTestServer(t, func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(len(body))
+		h.Set("ETag", response.StrongETag(body))
+		if req.RequestLine.Method == "PUT" {
+			w.WriteStatusLine(response.STATUS_CREATED)
+		} else {
+			w.WriteStatusLine(response.STATUS_OK)
+		}
+		w.WriteHeaders(h)
+		w.WriteBody(body)
+	}, Config{})
+
+	send := func(method, extraHeaders string) string {
+		c, err := l.Dial()
+		require.NoError(t, err)
+		go c.Write([]byte(method + " / HTTP/1.1\r\nHost: localhost\r\n" + extraHeaders + "\r\n"))
+		resp, err := io.ReadAll(c)
+		require.NoError(t, err)
+		return string(resp)
+	}
+	get := func(extraHeaders string) string {
+		return send("GET", extraHeaders)
+	}
+
+	// Test: The server turns a matching If-None-Match into a 304
+	resp := get("If-None-Match: " + response.StrongETag(body) + "\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 304 Not Modified\r\n"))
+	assert.NotContains(t, resp, "cached data")
+
+	// Test: And a failed If-Match into a 412
+	resp = get("If-Match: \"stale\"\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 412 Precondition Failed\r\n"))
+	assert.NotContains(t, resp, "cached data")
+
+	// Test: Unconditional requests get the body
+	resp = get("")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(resp, "cached data"))
+
+	// Test: A PUT is done by the time its headers are written, so its
+	// status stands
+	resp = send("PUT", "If-None-Match: *\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 201 Created\r\n"), resp)
+}
+
+func TestHeadRequests(t *testing.T) {
+	_, l := startTestServer(t, helloHandler, Config{})
+
+	c, err := l.Dial()
+	require.NoError(t, err)
+	go c.Write([]byte("HEAD /head HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	resp, err := io.ReadAll(c)
+	require.NoError(t, err)
+
+	// Test: The body the handler writes for HEAD is dropped, its headers
+	// are not
+	assert.True(t, strings.HasPrefix(string(resp), "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, string(resp), "content-length: 16\r\n")
+	assert.True(t, strings.HasSuffix(string(resp), "\r\n\r\n"), string(resp))
+}
+
+func TestRequestBodyDecoding(t *testing.T) {
+	_, l := startTestServer(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.STATUS_OK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(req.Body)))
+		w.WriteBody(req.Body)
+	}, Config{DecodeRequestBodies: true})
+
+	post := func(encoding string, body []byte) string {
+		c, err := l.Dial()
+		require.NoError(t, err)
+		go c.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Encoding: " + encoding +
+			"\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + string(body)))
+		resp, err := io.ReadAll(c)
+		require.NoError(t, err)
+		return string(resp)
+	}
+
+	// Test: The handler sees the decoded body
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write([]byte("hello world"))
+	zw.Close()
+	resp := post("gzip", b.Bytes())
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\nhello world"))
+
+	// Test: Unsupported encodings get a 415
+	resp = post("br", []byte("whatever"))
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 415 Unsupported Media Type\r\n"))
+	assert.Contains(t, resp, "accept-encoding: gzip, deflate\r\n")
+}
+
+func TestConnWatcherKeepsData(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := newConn(server)
+	defer c.Close()
+
+	// Test: A byte the disconnect watcher reads is returned by the next Read
+	cancelled := make(chan struct{})
+	c.watchDisconnect(func() { close(cancelled) })
+
+	go client.Write([]byte(GET_REQUEST))
+	require.Eventually(t, func() bool {
+		c.stopWatching()
+		if len(c.unread) > 0 {
+			return true
+		}
+		c.watchDisconnect(func() { close(cancelled) })
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	req, err := request.RequestFromReader(c)
+	require.NoError(t, err)
+	assert.Equal(t, "GET", req.RequestLine.Method)
+	assert.Equal(t, len(GET_REQUEST), c.bytesRead)
+
+	select {
+	case <-cancelled:
+		t.Fatal("data from the client cancelled the request")
+	default:
+	}
+}
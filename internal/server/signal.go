@@ -0,0 +1,31 @@
+package server
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// onSIGHUP calls fn every time the process receives SIGHUP, until the
+// returned function is called.
+func onSIGHUP(fn func()) (stop func()) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-sigChan:
+				fn()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigChan)
+		close(done)
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"httpffomtcp.pinglu.dev/internal/request"
+)
+
+type timeoutKey struct{}
+
+// timeoutContext is the context of a request. It is done when its parent
+// is, when it is cancelled, or once RequestTimeout has passed. Unlike with
+// context.WithTimeout, the timeout can be cleared for requests that are
+// meant to last, such as event streams and hijacked connections.
+type timeoutContext struct {
+	parent context.Context
+	done   chan struct{}
+
+	mu       sync.Mutex
+	err      error
+	deadline time.Time
+	timer    *time.Timer
+	stop     func() bool
+	// onClear runs when the timeout is cleared, to lift the write
+	// deadline of the connection too.
+	onClear func()
+}
+
+func newTimeoutContext(parent context.Context, timeout time.Duration) *timeoutContext {
+	c := &timeoutContext{parent: parent, done: make(chan struct{})}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stop = context.AfterFunc(parent, func() { c.cancel(parent.Err()) })
+
+	if timeout > 0 {
+		c.deadline = time.Now().Add(timeout)
+		c.timer = time.AfterFunc(timeout, func() { c.cancel(context.DeadlineExceeded) })
+	}
+
+	return c
+}
+
+func (c *timeoutContext) Deadline() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.deadline.IsZero() {
+		return c.deadline, true
+	}
+
+	return c.parent.Deadline()
+}
+
+func (c *timeoutContext) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *timeoutContext) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+func (c *timeoutContext) Value(key any) any {
+	if key == (timeoutKey{}) {
+		return c
+	}
+
+	return c.parent.Value(key)
+}
+
+func (c *timeoutContext) cancel(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+
+	c.err = err
+	close(c.done)
+
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.stop()
+}
+
+// clear stops the timeout. It does nothing once the context is done.
+func (c *timeoutContext) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.deadline = time.Time{}
+
+	if c.onClear != nil {
+		c.onClear()
+	}
+}
+
+func (s *Server) requestContext(parent context.Context) (*timeoutContext, context.CancelFunc) {
+	c := newTimeoutContext(parent, s.config.RequestTimeout)
+
+	return c, func() { c.cancel(context.Canceled) }
+}
+
+// ClearTimeout exempts req from RequestTimeout and WriteTimeout, for
+// responses that last as long as the client listens, such as event
+// streams. The request context is still cancelled when the client
+// disconnects or the server shuts down. It does nothing for requests that
+// didn't come from a Server.
+func ClearTimeout(req *request.Request) {
+	if c, ok := req.Context().Value(timeoutKey{}).(*timeoutContext); ok {
+		c.clear()
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+const ALPN_HTTP_1_1 = "http/1.1"
+
+var ERROR_NO_CERTIFICATES = errors.New("no certificates configured")
+
+// CertFile names a PEM encoded certificate chain and its private key.
+type CertFile struct {
+	CertFile string
+	KeyFile  string
+}
+
+// CertStore holds the certificates of one or more virtual hosts and picks
+// one for each TLS handshake based on SNI. The certificates can be
+// reloaded from disk at any time; handshakes already in progress and
+// established connections keep using the certificate they started with.
+type CertStore struct {
+	files []CertFile
+	certs atomic.Pointer[certSet]
+}
+
+type certSet struct {
+	// byName maps lowercased DNS names, including wildcards such as
+	// "*.example.com", to their certificate.
+	byName map[string]*tls.Certificate
+	// fallback is used when the client sends no SNI or an unknown name.
+	fallback *tls.Certificate
+}
+
+// NewCertStore loads files. The first one is the fallback certificate for
+// clients that don't send a known server name.
+func NewCertStore(files ...CertFile) (*CertStore, error) {
+	if len(files) == 0 {
+		return nil, ERROR_NO_CERTIFICATES
+	}
+
+	s := &CertStore{files: slices.Clone(files)}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reload reads every certificate again. If any of them fails to load, the
+// current certificates are kept and the error is returned.
+func (s *CertStore) Reload() error {
+	set := &certSet{byName: map[string]*tls.Certificate{}}
+
+	for _, f := range s.files {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return err
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		cert.Leaf = leaf
+
+		if set.fallback == nil {
+			set.fallback = &cert
+		}
+
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+
+		for _, name := range names {
+			name = strings.ToLower(name)
+			// The first certificate claiming a name wins.
+			if _, found := set.byName[name]; !found {
+				set.byName[name] = &cert
+			}
+		}
+	}
+
+	s.certs.Store(set)
+
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	set := s.certs.Load()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		return set.fallback, nil
+	}
+
+	if cert, found := set.byName[name]; found {
+		return cert, nil
+	}
+
+	// A wildcard only ever stands for the leftmost label.
+	if i := strings.Index(name, "."); i != -1 {
+		if cert, found := set.byName["*"+name[i:]]; found {
+			return cert, nil
+		}
+	}
+
+	return set.fallback, nil
+}
+
+// TLSConfig returns a server configuration that serves the store's
+// certificates and advertises HTTP/1.1 through ALPN.
+func (s *CertStore) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: s.GetCertificate,
+		NextProtos:     []string{ALPN_HTTP_1_1},
+	}
+}
+
+// ReloadOnSIGHUP reloads the certificates every time the process receives
+// SIGHUP, until the returned function is called.
+func (s *CertStore) ReloadOnSIGHUP(logger *slog.Logger) (stop func()) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return onSIGHUP(func() {
+		if err := s.Reload(); err != nil {
+			logger.Error("error reloading certificates", "err", err)
+			return
+		}
+
+		logger.Info("certificates reloaded")
+	})
+}
+
+func withALPN(config *tls.Config) *tls.Config {
+	if len(config.NextProtos) > 0 {
+		return config
+	}
+
+	config = config.Clone()
+	config.NextProtos = []string{ALPN_HTTP_1_1}
+
+	return config
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+	"httpffomtcp.pinglu.dev/internal/testcert"
+)
+
+func tlsHandler(w *response.Writer, req *request.Request) {
+	body := []byte("plaintext")
+	if req.TLS != nil {
+		body = []byte("tls " + req.TLS.ServerName)
+	}
+
+	w.WriteStatusLine(response.STATUS_OK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func tlsGet(t *testing.T, l *PipeListener, ca *testcert.CA, serverName string) (*tls.ConnectionState, string) {
+	t.Helper()
+
+	raw, err := l.Dial()
+	require.NoError(t, err)
+
+	c := tls.Client(raw, &tls.Config{
+		RootCAs:    ca.Pool(),
+		ServerName: serverName,
+		NextProtos: []string{ALPN_HTTP_1_1},
+	})
+	defer c.Close()
+
+	_, err = c.Write([]byte("GET / HTTP/1.1\r\nHost: " + serverName + "\r\n\r\n"))
+	require.NoError(t, err)
+
+	resp, err := io.ReadAll(c)
+	require.NoError(t, err)
+
+	state := c.ConnectionState()
+	return &state, string(resp)
+}
+
+func TestTLS(t *testing.T) {
+	ca, err := testcert.NewCA()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	exampleCert, exampleKey, err := ca.IssueFiles(dir, "example.test")
+	require.NoError(t, err)
+	wildcardCert, wildcardKey, err := ca.IssueFiles(dir, "*.other.test")
+	require.NoError(t, err)
+
+	store, err := NewCertStore(
+		CertFile{CertFile: exampleCert, KeyFile: exampleKey},
+		CertFile{CertFile: wildcardCert, KeyFile: wildcardKey},
+	)
+	require.NoError(t, err)
+
+	_, l := startTestServer(t, tlsHandler, Config{TLSConfig: store.TLSConfig()})
+
+	// Test: SNI selects the matching certificate, ALPN picks http/1.1
+	state, resp := tlsGet(t, l, ca, "example.test")
+	assert.Equal(t, "example.test", state.PeerCertificates[0].Subject.CommonName)
+	assert.Equal(t, ALPN_HTTP_1_1, state.NegotiatedProtocol)
+	assert.Contains(t, resp, "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, resp, "tls example.test")
+
+	// Test: Wildcard certificate
+	state, _ = tlsGet(t, l, ca, "www.other.test")
+	assert.Equal(t, "*.other.test", state.PeerCertificates[0].Subject.CommonName)
+
+	// Test: Reload picks up a new certificate without restarting
+	oldSerial := state.PeerCertificates[0].SerialNumber
+	certPEM, keyPEM, err := ca.Issue("*.other.test")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(wildcardCert, certPEM, 0o644))
+	require.NoError(t, os.WriteFile(wildcardKey, keyPEM, 0o600))
+	require.NoError(t, store.Reload())
+	state, _ = tlsGet(t, l, ca, "www.other.test")
+	assert.NotEqual(t, oldSerial, state.PeerCertificates[0].SerialNumber)
+
+	// Test: A broken reload keeps the current certificates
+	require.NoError(t, os.WriteFile(exampleKey, []byte("garbage"), 0o600))
+	require.Error(t, store.Reload())
+	state, _ = tlsGet(t, l, ca, "example.test")
+	assert.Equal(t, "example.test", state.PeerCertificates[0].Subject.CommonName)
+}
+
+func TestTLSOverTCP(t *testing.T) {
+	ca, err := testcert.NewCA()
+	require.NoError(t, err)
+
+	certPEM, keyPEM, err := ca.Issue("127.0.0.1")
+	require.NoError(t, err)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+
+	// Test: A plain tls.Config gets ALPN added
+	s, err := ServeConfig(Config{
+		Addr:      "127.0.0.1:0",
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}, tlsHandler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	raw, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	c := tls.Client(raw, &tls.Config{RootCAs: ca.Pool(), ServerName: "127.0.0.1", NextProtos: []string{ALPN_HTTP_1_1}})
+	defer c.Close()
+	require.NoError(t, c.Handshake())
+	assert.Equal(t, ALPN_HTTP_1_1, c.ConnectionState().NegotiatedProtocol)
+}
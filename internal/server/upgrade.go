@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+)
+
+var ERROR_UPGRADE_UNSUPPORTED = errors.New("request was not received by a server that supports upgrades")
+
+// An UpgradeHandler takes over a connection after a 101 Switching
+// Protocols response. The server closes the connection when it returns,
+// or when the server is closed.
+type UpgradeHandler func(conn net.Conn)
+
+// OnUpgrade has handler take over the connection of req once the handler
+// serving req returns, provided it sent a 101 Switching Protocols
+// response. Otherwise the connection is closed as usual.
+func OnUpgrade(req *request.Request, handler UpgradeHandler) error {
+	h, ok := req.Context().Value(hijackKey{}).(*hijacker)
+	if !ok {
+		return ERROR_UPGRADE_UNSUPPORTED
+	}
+
+	h.mu.Lock()
+	h.upgrade = handler
+	h.mu.Unlock()
+
+	return nil
+}
+
+// runUpgrade hands the connection to the upgrade handler registered for the
+// request, if there is one and the response switched protocols. It runs
+// after release, while the server still owns the connection.
+func (s *Server) runUpgrade(h *hijacker) {
+	if h.upgrade == nil || h.w.StatusCode() != response.STATUS_SWITCHING_PROTOCOLS || !h.w.HeadersWritten() {
+		return
+	}
+
+	conn, buffered := h.take()
+
+	stop := context.AfterFunc(s.ctx, func() { conn.Close() })
+	defer stop()
+
+	h.upgrade(newBufferedConn(conn, buffered))
+}
@@ -0,0 +1,129 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var ERROR_INVALID_COOKIE = errors.New("invalid session cookie")
+var ERROR_COOKIE_TOO_LARGE = errors.New("session cookie too large")
+
+// MAX_COOKIE_LEN is the longest cookie value browsers are sure to keep,
+// RFC 6265 6.1.
+const MAX_COOKIE_LEN = 4096
+
+// derivedKeys are the keys for signing and for encrypting, derived from
+// one configured key so that neither use weakens the other.
+type derivedKeys struct {
+	sign    []byte
+	encrypt cipher.AEAD
+}
+
+func deriveKeys(key []byte) derivedKeys {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("session signing"))
+	sign := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, key)
+	mac.Write([]byte("session encryption"))
+
+	// A 32-byte key is always valid for AES-256, and GCM with the
+	// default nonce size never fails.
+	block, _ := aes.NewCipher(mac.Sum(nil))
+	aead, _ := cipher.NewGCM(block)
+
+	return derivedKeys{sign: sign, encrypt: aead}
+}
+
+// signature returns the MAC of data, bound to the cookie name so that a
+// value can't be moved to another cookie.
+func (k derivedKeys) signature(name, data string) []byte {
+	mac := hmac.New(sha256.New, k.sign)
+	mac.Write([]byte(name))
+	mac.Write([]byte{0})
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// encode turns rec into a cookie value: the record as JSON, encrypted if
+// Options.Encrypt is set, then signed with the first key.
+func (m *Manager) encode(rec record) (string, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+
+	key := m.keys[0]
+
+	if m.options.Encrypt {
+		nonce := make([]byte, key.encrypt.NonceSize())
+		rand.Read(nonce)
+		payload = key.encrypt.Seal(nonce, nonce, payload, []byte(m.options.CookieName))
+	}
+
+	data := base64.RawURLEncoding.EncodeToString(payload)
+	value := data + "." + base64.RawURLEncoding.EncodeToString(key.signature(m.options.CookieName, data))
+
+	if len(value) > MAX_COOKIE_LEN {
+		return "", ERROR_COOKIE_TOO_LARGE
+	}
+
+	return value, nil
+}
+
+// decode checks the signature of a cookie value against every key and
+// returns the record in it. rotated is set if a key other than the first
+// signed it.
+func (m *Manager) decode(value string) (rec record, rotated bool, err error) {
+	data, sig, found := strings.Cut(value, ".")
+	if !found {
+		return rec, false, ERROR_INVALID_COOKIE
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return rec, false, ERROR_INVALID_COOKIE
+	}
+
+	keyIndex := -1
+	for i, key := range m.keys {
+		if hmac.Equal(mac, key.signature(m.options.CookieName, data)) {
+			keyIndex = i
+			break
+		}
+	}
+	if keyIndex < 0 {
+		return rec, false, ERROR_INVALID_COOKIE
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(data)
+	if err != nil {
+		return rec, false, ERROR_INVALID_COOKIE
+	}
+
+	if m.options.Encrypt {
+		aead := m.keys[keyIndex].encrypt
+		if len(payload) < aead.NonceSize() {
+			return rec, false, ERROR_INVALID_COOKIE
+		}
+
+		payload, err = aead.Open(nil, payload[:aead.NonceSize()], payload[aead.NonceSize():], []byte(m.options.CookieName))
+		if err != nil {
+			return rec, false, ERROR_INVALID_COOKIE
+		}
+	}
+
+	err = json.Unmarshal(payload, &rec)
+	if err != nil || rec.ID == "" {
+		return rec, false, ERROR_INVALID_COOKIE
+	}
+
+	return rec, keyIndex > 0, nil
+}
@@ -0,0 +1,98 @@
+package session
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io"
+	"mime"
+
+	"httpffomtcp.pinglu.dev/internal/form"
+	"httpffomtcp.pinglu.dev/internal/request"
+)
+
+var ERROR_INVALID_CSRF_TOKEN = errors.New("missing or invalid CSRF token")
+
+// CSRF_KEY is the session value that holds the CSRF token.
+const CSRF_KEY = "_csrf"
+
+// Requests send the token back in the CSRF_HEADER header, or in a
+// CSRF_FIELD form field.
+const CSRF_HEADER = "X-CSRF-Token"
+const CSRF_FIELD = "csrf_token"
+
+// CSRFToken returns the session's CSRF token, creating it if needed. Pages
+// put it in the forms and scripts that make state-changing requests.
+func (s *Session) CSRFToken() string {
+	token := s.values[CSRF_KEY]
+	if token == "" {
+		token = newID()
+		s.Set(CSRF_KEY, token)
+	}
+
+	return token
+}
+
+// safeMethod reports whether method is read-only, RFC 9110 9.2.1, and so
+// needs no CSRF token.
+func safeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *Manager) checkCSRF(s *Session, req *request.Request) error {
+	want := s.values[CSRF_KEY]
+	if want == "" {
+		return ERROR_INVALID_CSRF_TOKEN
+	}
+
+	got := req.Headers.Get(CSRF_HEADER)
+	if got == "" {
+		got = formToken(req)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		return ERROR_INVALID_CSRF_TOKEN
+	}
+
+	return nil
+}
+
+// formToken returns the CSRF_FIELD field of a form body. Multipart bodies
+// are read no further than the field.
+func formToken(req *request.Request) string {
+	mediaType, _, _ := mime.ParseMediaType(req.Headers.Get("Content-Type"))
+
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		values, err := form.ParseURLEncoded(req.Body, form.Options{})
+		if err != nil {
+			return ""
+		}
+
+		return values.Get(CSRF_FIELD)
+	case "multipart/form-data":
+		r, err := form.MultipartReader(req, form.Options{})
+		if err != nil {
+			return ""
+		}
+
+		for {
+			part, err := r.NextPart()
+			if err != nil {
+				return ""
+			}
+
+			if part.Name == CSRF_FIELD && part.Filename == "" {
+				// Tokens are 64 hex digits; anything longer is wrong anyway.
+				token, _ := io.ReadAll(io.LimitReader(part, 128))
+				return string(token)
+			}
+		}
+	default:
+		return ""
+	}
+}
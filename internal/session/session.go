@@ -0,0 +1,332 @@
+// Package session provides middleware that keeps per-client sessions. A
+// session lives in a signed cookie, optionally encrypted too, or in a
+// Store with only its ID in the cookie. Requests with state-changing
+// methods must carry the session's CSRF token.
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"maps"
+	"time"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+	"httpffomtcp.pinglu.dev/internal/server"
+)
+
+var ERROR_NO_KEYS = errors.New("no session keys configured")
+var ERROR_KEY_TOO_SHORT = errors.New("session key too short")
+
+const DEFAULT_COOKIE_NAME = "session"
+const DEFAULT_MAX_AGE = 24 * time.Hour
+
+// MIN_KEY_LEN is the shortest key we take, 256 bits.
+const MIN_KEY_LEN = 32
+
+type Options struct {
+	// Keys sign session cookies, and encrypt them if Encrypt is set. The
+	// first key is used for new cookies, and the others are still
+	// accepted, so keys can be rotated by adding a new one in front.
+	// Cookies signed with an older key are reissued with the first. Each
+	// key must be at least MIN_KEY_LEN random bytes.
+	Keys [][]byte
+
+	// Encrypt keeps the contents of cookie sessions from the client with
+	// AES-GCM. It makes no difference with a Store.
+	Encrypt bool
+
+	// Store keeps sessions on the server, and the cookie only their ID.
+	// Nil keeps sessions in the cookie itself, which can hold about 4 KB.
+	Store Store
+
+	// CookieName defaults to DEFAULT_COOKIE_NAME.
+	CookieName string
+
+	// MaxAge is how long a session lasts after it was last saved. Zero
+	// means DEFAULT_MAX_AGE.
+	MaxAge time.Duration
+
+	// The attributes of the session cookie, which is always HttpOnly.
+	// Path defaults to "/" and SameSite to Lax.
+	Path     string
+	Domain   string
+	Secure   bool
+	SameSite response.SameSite
+
+	// DisableCSRF turns off the CSRF token check.
+	DisableCSRF bool
+
+	// ErrorHandler responds to requests that fail the CSRF check. Defaults
+	// to a plain text 403.
+	ErrorHandler server.ErrorHandler
+
+	// Logger receives errors saving sessions. Defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+func (o Options) withDefaults() Options {
+	if o.CookieName == "" {
+		o.CookieName = DEFAULT_COOKIE_NAME
+	}
+
+	if o.MaxAge == 0 {
+		o.MaxAge = DEFAULT_MAX_AGE
+	}
+
+	if o.Path == "" {
+		o.Path = "/"
+	}
+
+	if o.SameSite == response.SAME_SITE_DEFAULT {
+		o.SameSite = response.SAME_SITE_LAX
+	}
+
+	if o.ErrorHandler == nil {
+		o.ErrorHandler = forbidden
+	}
+
+	if o.Logger == nil {
+		o.Logger = slog.Default()
+	}
+
+	return o
+}
+
+func forbidden(w *response.Writer, err error) {
+	msg := []byte(err.Error())
+
+	w.WriteStatusLine(response.STATUS_FORBIDDEN)
+	w.WriteHeaders(response.GetDefaultHeaders(len(msg)))
+	w.WriteBody(msg)
+}
+
+// Manager loads and saves the sessions of the requests going through its
+// middleware.
+type Manager struct {
+	options Options
+	keys    []derivedKeys
+}
+
+func New(options Options) (*Manager, error) {
+	options = options.withDefaults()
+
+	if len(options.Keys) == 0 {
+		return nil, ERROR_NO_KEYS
+	}
+
+	m := &Manager{options: options}
+
+	for _, key := range options.Keys {
+		if len(key) < MIN_KEY_LEN {
+			return nil, ERROR_KEY_TOO_SHORT
+		}
+
+		m.keys = append(m.keys, deriveKeys(key))
+	}
+
+	// The cookie must fit the cookie-value syntax, and the name is bound
+	// into every signature.
+	err := response.Cookie{Name: options.CookieName, Path: options.Path, Domain: options.Domain, Secure: options.Secure, SameSite: options.SameSite}.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+type sessionKey struct{}
+
+// FromContext returns the session of the request that ctx belongs to, or
+// nil outside the middleware.
+func FromContext(ctx context.Context) *Session {
+	s, _ := ctx.Value(sessionKey{}).(*Session)
+	return s
+}
+
+// Middleware gives the requests of next a session, which handlers get with
+// FromContext. Changes are saved when the response headers are written;
+// those made afterwards are lost.
+func (m *Manager) Middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		s := m.load(req)
+
+		if !m.options.DisableCSRF && !safeMethod(req.RequestLine.Method) {
+			err := m.checkCSRF(s, req)
+			if err != nil {
+				m.options.ErrorHandler(w, err)
+				return
+			}
+		}
+
+		ctx := req.Context()
+		w.AddHeaderHook(func(statusCode response.StatusCode, h headers.Headers) response.StatusCode {
+			m.save(ctx, s, h)
+			return statusCode
+		})
+
+		next(w, req.WithContext(context.WithValue(ctx, sessionKey{}, s)))
+	}
+}
+
+// Session holds the values of one client's session. It is not safe for
+// concurrent use.
+type Session struct {
+	id     string
+	values map[string]string
+
+	// storedID is the ID the session was loaded under, which a Store must
+	// forget when the ID changes.
+	storedID  string
+	changed   bool
+	destroyed bool
+	saved     bool
+}
+
+func newSession() *Session {
+	return &Session{id: newID(), values: map[string]string{}}
+}
+
+func newID() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ID identifies the session. It changes with Regenerate.
+func (s *Session) ID() string {
+	return s.id
+}
+
+func (s *Session) Get(key string) string {
+	return s.values[key]
+}
+
+func (s *Session) Set(key, value string) {
+	s.values[key] = value
+	s.changed = true
+}
+
+func (s *Session) Delete(key string) {
+	if _, found := s.values[key]; found {
+		delete(s.values, key)
+		s.changed = true
+	}
+}
+
+// Regenerate gives the session a new ID and CSRF token, keeping its
+// values. Call it when the user logs in, so that an ID an attacker planted
+// before doesn't become a logged-in one.
+func (s *Session) Regenerate() {
+	s.id = newID()
+	if _, found := s.values[CSRF_KEY]; found {
+		s.values[CSRF_KEY] = newID()
+	}
+	s.changed = true
+}
+
+// Destroy ends the session, e.g. on logout, and deletes its cookie. The
+// session can still be used for the rest of the request.
+func (s *Session) Destroy() {
+	s.destroyed = true
+}
+
+// record is what a session cookie holds: the whole session, or only its
+// ID with a Store.
+type record struct {
+	ID      string            `json:"id"`
+	Values  map[string]string `json:"values,omitempty"`
+	Expires int64             `json:"expires"`
+}
+
+// load returns the session the request's cookie refers to, or a new one
+// if it has none, or one that is invalid or expired.
+func (m *Manager) load(req *request.Request) *Session {
+	c, err := req.Cookie(m.options.CookieName)
+	if err != nil {
+		return newSession()
+	}
+
+	rec, rotated, err := m.decode(c.Value)
+	if err != nil || time.Now().Unix() >= rec.Expires {
+		return newSession()
+	}
+
+	s := &Session{id: rec.ID, values: rec.Values, storedID: rec.ID, changed: rotated}
+
+	if m.options.Store != nil {
+		s.values, err = m.options.Store.Load(req.Context(), rec.ID)
+		if err != nil {
+			return newSession()
+		}
+	}
+
+	if s.values == nil {
+		s.values = map[string]string{}
+	}
+
+	return s
+}
+
+// save stores a changed session and sets its cookie in h, or deletes both
+// for a destroyed one. It runs once, with the first headers written.
+func (m *Manager) save(ctx context.Context, s *Session, h headers.Headers) {
+	if s.saved {
+		return
+	}
+	s.saved = true
+
+	store := m.options.Store
+
+	if store != nil && s.storedID != "" && (s.destroyed || s.storedID != s.id) {
+		err := store.Delete(ctx, s.storedID)
+		if err != nil {
+			m.options.Logger.Error("session: deleting session", "err", err)
+		}
+	}
+
+	if s.destroyed {
+		if s.storedID != "" {
+			response.DeleteCookie(h, m.options.CookieName, m.options.Path, m.options.Domain)
+		}
+		return
+	}
+
+	if !s.changed {
+		return
+	}
+
+	expires := time.Now().Add(m.options.MaxAge)
+	rec := record{ID: s.id, Expires: expires.Unix()}
+
+	if store != nil {
+		err := store.Save(ctx, s.id, maps.Clone(s.values), expires)
+		if err != nil {
+			m.options.Logger.Error("session: saving session", "err", err)
+			return
+		}
+	} else {
+		rec.Values = s.values
+	}
+
+	value, err := m.encode(rec)
+	if err != nil {
+		m.options.Logger.Error("session: saving session", "err", err)
+		return
+	}
+
+	response.SetCookie(h, response.Cookie{
+		Name:     m.options.CookieName,
+		Value:    value,
+		MaxAge:   int(m.options.MaxAge / time.Second),
+		Path:     m.options.Path,
+		Domain:   m.options.Domain,
+		Secure:   m.options.Secure,
+		HttpOnly: true,
+		SameSite: m.options.SameSite,
+	})
+}
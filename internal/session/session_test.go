@@ -0,0 +1,336 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+)
+
+var key1 = bytes.Repeat([]byte{1}, MIN_KEY_LEN)
+var key2 = bytes.Repeat([]byte{2}, MIN_KEY_LEN)
+
+// serve runs one request through m's middleware. The handler gets the
+// session, and its return value is the response body.
+func serve(t *testing.T, m *Manager, method, cookie string, handler func(s *Session) string, extraHeaders map[string]string, body string) *response.Response {
+	t.Helper()
+
+	h := headers.NewHeaders()
+	h.Set("Host", "localhost")
+	if cookie != "" {
+		h.Set("Cookie", m.options.CookieName+"="+cookie)
+	}
+	for k, v := range extraHeaders {
+		h.Set(k, v)
+	}
+
+	req, err := request.NewRequest(request.RequestLine{Method: method, RequestTarget: "/", HttpVersion: "1.1"}, h, nil, []byte(body), request.Options{})
+	require.NoError(t, err)
+
+	var b bytes.Buffer
+	w := response.NewWriter(&b)
+
+	m.Middleware(func(w *response.Writer, req *request.Request) {
+		msg := []byte(handler(FromContext(req.Context())))
+		w.WriteStatusLine(response.STATUS_OK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(msg)))
+		w.WriteBody(msg)
+	})(w, req)
+	require.NoError(t, w.Finish())
+
+	resp, err := response.ResponseFromReader(&b)
+	require.NoError(t, err)
+
+	return resp
+}
+
+// sessionCookie returns the full Set-Cookie line for the session cookie
+// and its value, or empty strings if the response doesn't set it.
+func sessionCookie(m *Manager, resp *response.Response) (string, string) {
+	prefix := m.options.CookieName + "="
+
+	for _, line := range resp.Headers.Values("Set-Cookie") {
+		if strings.HasPrefix(line, prefix) {
+			value, _, _ := strings.Cut(strings.TrimPrefix(line, prefix), ";")
+			return line, value
+		}
+	}
+
+	return "", ""
+}
+
+func get(key string) func(s *Session) string {
+	return func(s *Session) string {
+		return s.Get(key)
+	}
+}
+
+func set(key, value string) func(s *Session) string {
+	return func(s *Session) string {
+		s.Set(key, value)
+		return ""
+	}
+}
+
+func newManager(t *testing.T, options Options) *Manager {
+	t.Helper()
+
+	m, err := New(options)
+	require.NoError(t, err)
+
+	return m
+}
+
+func TestNew(t *testing.T) {
+	// Test: Keys are required
+	_, err := New(Options{})
+	assert.ErrorIs(t, err, ERROR_NO_KEYS)
+
+	// Test: Every key must be long enough
+	_, err = New(Options{Keys: [][]byte{key1, []byte("short")}})
+	assert.ErrorIs(t, err, ERROR_KEY_TOO_SHORT)
+
+	// Test: The cookie attributes are checked
+	_, err = New(Options{Keys: [][]byte{key1}, CookieName: "my session"})
+	assert.ErrorIs(t, err, response.ERROR_INVALID_COOKIE_NAME)
+
+	_, err = New(Options{Keys: [][]byte{key1}, SameSite: response.SAME_SITE_NONE})
+	assert.ErrorIs(t, err, response.ERROR_INVALID_COOKIE_ATTRIBUTE)
+}
+
+func TestCookieSession(t *testing.T) {
+	m := newManager(t, Options{Keys: [][]byte{key1}, DisableCSRF: true})
+
+	// Test: A changed session is saved in the cookie
+	resp := serve(t, m, "GET", "", set("user", "alice"), nil, "")
+	line, cookie := sessionCookie(m, resp)
+	require.NotEmpty(t, cookie)
+	assert.Contains(t, line, "; Max-Age=86400; Path=/; HttpOnly; SameSite=Lax")
+
+	data, _, _ := strings.Cut(cookie, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(data)
+	require.NoError(t, err)
+	assert.Contains(t, string(payload), `"user":"alice"`)
+
+	// Test: The next request gets it back, and nothing is reissued
+	resp = serve(t, m, "GET", cookie, get("user"), nil, "")
+	assert.Equal(t, "alice", string(resp.Body))
+	line, _ = sessionCookie(m, resp)
+	assert.Empty(t, line)
+
+	// Test: A tampered cookie starts a new session
+	tampered := strings.Replace(cookie, data, base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(string(payload), "alice", "admin", 1))), 1)
+	resp = serve(t, m, "GET", tampered, get("user"), nil, "")
+	assert.Empty(t, resp.Body)
+
+	resp = serve(t, m, "GET", "garbage", get("user"), nil, "")
+	assert.Empty(t, resp.Body)
+
+	// Test: A cookie for another cookie name is rejected
+	other := newManager(t, Options{Keys: [][]byte{key1}, CookieName: "other", DisableCSRF: true})
+	resp = serve(t, other, "GET", cookie, get("user"), nil, "")
+	assert.Empty(t, resp.Body)
+
+	// Test: An expired cookie starts a new session
+	expired, err := m.encode(record{ID: newID(), Values: map[string]string{"user": "alice"}, Expires: time.Now().Add(-time.Second).Unix()})
+	require.NoError(t, err)
+	resp = serve(t, m, "GET", expired, get("user"), nil, "")
+	assert.Empty(t, resp.Body)
+
+	// Test: Sessions too large for a cookie are not saved
+	resp = serve(t, m, "GET", "", set("big", strings.Repeat("x", MAX_COOKIE_LEN)), nil, "")
+	line, _ = sessionCookie(m, resp)
+	assert.Empty(t, line)
+}
+
+func TestEncryptedSession(t *testing.T) {
+	m := newManager(t, Options{Keys: [][]byte{key1}, Encrypt: true, DisableCSRF: true})
+
+	// Test: The values can't be read from the cookie
+	resp := serve(t, m, "GET", "", set("user", "alice"), nil, "")
+	_, cookie := sessionCookie(m, resp)
+	require.NotEmpty(t, cookie)
+
+	data, _, _ := strings.Cut(cookie, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(data)
+	require.NoError(t, err)
+	assert.NotContains(t, string(payload), "alice")
+
+	resp = serve(t, m, "GET", cookie, get("user"), nil, "")
+	assert.Equal(t, "alice", string(resp.Body))
+
+	// Test: A signed but unencrypted cookie is rejected
+	plain := newManager(t, Options{Keys: [][]byte{key1}, DisableCSRF: true})
+	_, cookie = sessionCookie(plain, serve(t, plain, "GET", "", set("user", "alice"), nil, ""))
+	resp = serve(t, m, "GET", cookie, get("user"), nil, "")
+	assert.Empty(t, resp.Body)
+}
+
+func TestKeyRotation(t *testing.T) {
+	for _, encrypt := range []bool{false, true} {
+		old := newManager(t, Options{Keys: [][]byte{key1}, Encrypt: encrypt, DisableCSRF: true})
+		rotated := newManager(t, Options{Keys: [][]byte{key2, key1}, Encrypt: encrypt, DisableCSRF: true})
+		fresh := newManager(t, Options{Keys: [][]byte{key2}, Encrypt: encrypt, DisableCSRF: true})
+
+		_, cookie := sessionCookie(old, serve(t, old, "GET", "", set("user", "alice"), nil, ""))
+
+		// Test: A cookie signed with an older key is accepted and reissued
+		resp := serve(t, rotated, "GET", cookie, get("user"), nil, "")
+		assert.Equal(t, "alice", string(resp.Body))
+		_, reissued := sessionCookie(rotated, resp)
+		require.NotEmpty(t, reissued)
+		assert.NotEqual(t, cookie, reissued)
+
+		// Test: Once the old key is dropped, only the reissued cookie works
+		resp = serve(t, fresh, "GET", cookie, get("user"), nil, "")
+		assert.Empty(t, resp.Body)
+
+		resp = serve(t, fresh, "GET", reissued, get("user"), nil, "")
+		assert.Equal(t, "alice", string(resp.Body))
+	}
+}
+
+func TestStoreSession(t *testing.T) {
+	store := NewMemoryStore()
+	m := newManager(t, Options{Keys: [][]byte{key1}, Store: store, DisableCSRF: true})
+	ctx := context.Background()
+
+	// Test: Only the ID goes in the cookie
+	_, cookie := sessionCookie(m, serve(t, m, "GET", "", set("user", "alice"), nil, ""))
+	rec, _, err := m.decode(cookie)
+	require.NoError(t, err)
+	assert.Nil(t, rec.Values)
+
+	values, err := store.Load(ctx, rec.ID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"user": "alice"}, values)
+
+	resp := serve(t, m, "GET", cookie, get("user"), nil, "")
+	assert.Equal(t, "alice", string(resp.Body))
+
+	// Test: Regenerate moves the session to a new ID
+	resp = serve(t, m, "GET", cookie, func(s *Session) string {
+		s.Regenerate()
+		return s.ID()
+	}, nil, "")
+	regeneratedID := string(resp.Body)
+	assert.NotEqual(t, rec.ID, regeneratedID)
+
+	_, err = store.Load(ctx, rec.ID)
+	assert.ErrorIs(t, err, ERROR_SESSION_NOT_FOUND)
+
+	_, regenerated := sessionCookie(m, resp)
+	rec, _, err = m.decode(regenerated)
+	require.NoError(t, err)
+	assert.Equal(t, regeneratedID, rec.ID)
+
+	resp = serve(t, m, "GET", cookie, get("user"), nil, "")
+	assert.Empty(t, resp.Body)
+
+	resp = serve(t, m, "GET", regenerated, get("user"), nil, "")
+	assert.Equal(t, "alice", string(resp.Body))
+
+	// Test: Destroy deletes the session and its cookie
+	resp = serve(t, m, "GET", regenerated, func(s *Session) string {
+		s.Destroy()
+		return ""
+	}, nil, "")
+	line, _ := sessionCookie(m, resp)
+	assert.Contains(t, line, "Max-Age=0")
+
+	_, err = store.Load(ctx, regeneratedID)
+	assert.ErrorIs(t, err, ERROR_SESSION_NOT_FOUND)
+
+	// Test: A session missing from the store starts a new one
+	resp = serve(t, m, "GET", regenerated, get("user"), nil, "")
+	assert.Empty(t, resp.Body)
+}
+
+func TestCSRF(t *testing.T) {
+	m := newManager(t, Options{Keys: [][]byte{key1}})
+	ok := func(s *Session) string { return "ok" }
+
+	// Test: Safe methods don't need a token, and can hand one out
+	resp := serve(t, m, "GET", "", func(s *Session) string { return s.CSRFToken() }, nil, "")
+	assert.Equal(t, response.STATUS_OK, resp.StatusLine.StatusCode)
+	token := string(resp.Body)
+	require.Len(t, token, 64)
+	_, cookie := sessionCookie(m, resp)
+
+	// Test: The token stays the same for the session
+	resp = serve(t, m, "HEAD", cookie, func(s *Session) string { return s.CSRFToken() }, nil, "")
+	assert.Equal(t, response.STATUS_OK, resp.StatusLine.StatusCode)
+
+	tests := []struct {
+		name    string
+		cookie  string
+		headers map[string]string
+		body    string
+		status  response.StatusCode
+	}{
+		{"No session", "", nil, "", response.STATUS_FORBIDDEN},
+		{"No token", cookie, nil, "", response.STATUS_FORBIDDEN},
+		{"Wrong token", cookie, map[string]string{CSRF_HEADER: strings.Repeat("0", 64)}, "", response.STATUS_FORBIDDEN},
+		{"Token in the header", cookie, map[string]string{CSRF_HEADER: token}, "", response.STATUS_OK},
+		{"Token without the session", "", map[string]string{CSRF_HEADER: token}, "", response.STATUS_FORBIDDEN},
+		{
+			"Token in a urlencoded form",
+			cookie,
+			map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+			"title=hello&" + CSRF_FIELD + "=" + token,
+			response.STATUS_OK,
+		},
+		{
+			"Wrong token in a urlencoded form",
+			cookie,
+			map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+			CSRF_FIELD + "=abc",
+			response.STATUS_FORBIDDEN,
+		},
+		{
+			"Token in a multipart form",
+			cookie,
+			map[string]string{"Content-Type": "multipart/form-data; boundary=xyz"},
+			"--xyz\r\nContent-Disposition: form-data; name=\"title\"\r\n\r\nhello\r\n" +
+				"--xyz\r\nContent-Disposition: form-data; name=\"" + CSRF_FIELD + "\"\r\n\r\n" + token + "\r\n--xyz--\r\n",
+			response.STATUS_OK,
+		},
+		{
+			"Token as a multipart file",
+			cookie,
+			map[string]string{"Content-Type": "multipart/form-data; boundary=xyz"},
+			"--xyz\r\nContent-Disposition: form-data; name=\"" + CSRF_FIELD + "\"; filename=\"a.txt\"\r\n\r\n" + token + "\r\n--xyz--\r\n",
+			response.STATUS_FORBIDDEN,
+		},
+	}
+
+	for _, tt := range tests {
+		resp := serve(t, m, "POST", tt.cookie, ok, tt.headers, tt.body)
+		assert.Equal(t, tt.status, resp.StatusLine.StatusCode, tt.name)
+	}
+
+	// Test: Regenerate replaces the token
+	resp = serve(t, m, "POST", cookie, func(s *Session) string {
+		s.Regenerate()
+		return s.CSRFToken()
+	}, map[string]string{CSRF_HEADER: token}, "")
+	assert.NotEqual(t, token, string(resp.Body))
+	_, regenerated := sessionCookie(m, resp)
+
+	resp = serve(t, m, "DELETE", regenerated, ok, map[string]string{CSRF_HEADER: token}, "")
+	assert.Equal(t, response.STATUS_FORBIDDEN, resp.StatusLine.StatusCode)
+
+	// Test: The check can be turned off
+	m = newManager(t, Options{Keys: [][]byte{key1}, DisableCSRF: true})
+	resp = serve(t, m, "POST", "", ok, nil, "")
+	assert.Equal(t, response.STATUS_OK, resp.StatusLine.StatusCode)
+}
@@ -0,0 +1,223 @@
+package session
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ERROR_SESSION_NOT_FOUND = errors.New("session not found")
+var ERROR_INVALID_SESSION_ID = errors.New("invalid session ID")
+
+// SWEEP_INTERVAL is how often MemoryStore drops expired sessions.
+const SWEEP_INTERVAL = time.Minute
+
+// Store keeps sessions on the server. Load returns ERROR_SESSION_NOT_FOUND
+// for sessions that don't exist or have expired. Implementations must be
+// safe for concurrent use.
+type Store interface {
+	Load(ctx context.Context, id string) (map[string]string, error)
+	Save(ctx context.Context, id string, values map[string]string, expires time.Time) error
+	Delete(ctx context.Context, id string) error
+}
+
+type storedSession struct {
+	Values  map[string]string `json:"values"`
+	Expires time.Time         `json:"expires"`
+}
+
+// MemoryStore keeps sessions in memory, so they are lost when the server
+// stops.
+type MemoryStore struct {
+	mu        sync.Mutex
+	sessions  map[string]storedSession
+	lastSweep time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: map[string]storedSession{}, lastSweep: time.Now()}
+}
+
+func (s *MemoryStore) Load(ctx context.Context, id string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, found := s.sessions[id]
+	if !found || !time.Now().Before(stored.Expires) {
+		return nil, ERROR_SESSION_NOT_FOUND
+	}
+
+	return maps.Clone(stored.Values), nil
+}
+
+func (s *MemoryStore) Save(ctx context.Context, id string, values map[string]string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) >= SWEEP_INTERVAL {
+		for id, stored := range s.sessions {
+			if !now.Before(stored.Expires) {
+				delete(s.sessions, id)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	s.sessions[id] = storedSession{Values: values, Expires: expires}
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, id)
+	return nil
+}
+
+// FileStore keeps each session in a JSON file in a directory, so sessions
+// survive restarts. Expired files are only removed by DeleteExpired.
+type FileStore struct {
+	dir string
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileStore{dir: dir}, nil
+}
+
+// path returns the file for id. IDs come from cookies, so only the hex IDs
+// newID makes are taken, which keeps them from naming other files.
+func (s *FileStore) path(id string) (string, error) {
+	_, err := hex.DecodeString(id)
+	if id == "" || err != nil {
+		return "", ERROR_INVALID_SESSION_ID
+	}
+
+	return filepath.Join(s.dir, id+".json"), nil
+}
+
+func (s *FileStore) Load(ctx context.Context, id string) (map[string]string, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := readStoredSession(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ERROR_SESSION_NOT_FOUND
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !time.Now().Before(stored.Expires) {
+		return nil, ERROR_SESSION_NOT_FOUND
+	}
+
+	return stored.Values, nil
+}
+
+func readStoredSession(path string) (storedSession, error) {
+	var stored storedSession
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return stored, err
+	}
+
+	err = json.Unmarshal(data, &stored)
+	return stored, err
+}
+
+// Save writes the session to a temporary file and renames it into place,
+// so that a concurrent Load never sees half a file.
+func (s *FileStore) Save(ctx context.Context, id string, values map[string]string, expires time.Time) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(storedSession{Values: values, Expires: expires})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(s.dir, "tmp-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return nil
+}
+
+func (s *FileStore) Delete(ctx context.Context, id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// DeleteExpired removes the files of expired sessions. Run it now and then,
+// e.g. from a time.Ticker.
+func (s *FileStore) DeleteExpired(ctx context.Context) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		path := filepath.Join(s.dir, name)
+		stored, err := readStoredSession(path)
+		if err != nil || !now.Before(stored.Expires) {
+			err = os.Remove(path)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
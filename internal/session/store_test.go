@@ -0,0 +1,93 @@
+package session
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testStore(t *testing.T, store Store) {
+	t.Helper()
+
+	ctx := context.Background()
+	id := newID()
+
+	// Test: Unknown sessions are not found
+	_, err := store.Load(ctx, id)
+	assert.ErrorIs(t, err, ERROR_SESSION_NOT_FOUND)
+
+	// Test: Saved sessions load back
+	require.NoError(t, store.Save(ctx, id, map[string]string{"user": "alice"}, time.Now().Add(time.Hour)))
+	values, err := store.Load(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"user": "alice"}, values)
+
+	// Test: Changing the loaded values doesn't change the stored ones
+	values["user"] = "mallory"
+	values, err = store.Load(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", values["user"])
+
+	// Test: Deleted sessions are gone, and deleting twice is fine
+	require.NoError(t, store.Delete(ctx, id))
+	_, err = store.Load(ctx, id)
+	assert.ErrorIs(t, err, ERROR_SESSION_NOT_FOUND)
+	require.NoError(t, store.Delete(ctx, id))
+
+	// Test: Expired sessions are not found
+	require.NoError(t, store.Save(ctx, id, map[string]string{"user": "alice"}, time.Now().Add(-time.Second)))
+	_, err = store.Load(ctx, id)
+	assert.ErrorIs(t, err, ERROR_SESSION_NOT_FOUND)
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	testStore(t, store)
+
+	// Test: Expired sessions are swept on a later save
+	ctx := context.Background()
+	require.NoError(t, store.Save(ctx, "old", nil, time.Now().Add(-time.Second)))
+	store.lastSweep = time.Now().Add(-SWEEP_INTERVAL)
+	require.NoError(t, store.Save(ctx, "new", nil, time.Now().Add(time.Hour)))
+	assert.Len(t, store.sessions, 1)
+}
+
+func TestFileStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sessions")
+	store, err := NewFileStore(dir)
+	require.NoError(t, err)
+	testStore(t, store)
+
+	ctx := context.Background()
+
+	// Test: IDs that aren't hex are rejected before touching the disk
+	for _, id := range []string{"", "../../etc/passwd", "abc/def", "zz"} {
+		_, err := store.Load(ctx, id)
+		assert.ErrorIs(t, err, ERROR_INVALID_SESSION_ID, id)
+		assert.ErrorIs(t, store.Save(ctx, id, nil, time.Now().Add(time.Hour)), ERROR_INVALID_SESSION_ID, id)
+	}
+
+	// Test: Sessions survive a new store on the same directory
+	id := newID()
+	require.NoError(t, store.Save(ctx, id, map[string]string{"user": "alice"}, time.Now().Add(time.Hour)))
+	store, err = NewFileStore(dir)
+	require.NoError(t, err)
+	values, err := store.Load(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", values["user"])
+
+	// Test: DeleteExpired removes only expired sessions
+	expiredID := newID()
+	require.NoError(t, store.Save(ctx, expiredID, nil, time.Now().Add(-time.Second)))
+	require.NoError(t, store.DeleteExpired(ctx))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, id+".json", entries[0].Name())
+}
@@ -0,0 +1,256 @@
+// Package sse streams Server-Sent Events, the text/event-stream format
+// browsers read with EventSource.
+package sse
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+	"httpffomtcp.pinglu.dev/internal/server"
+)
+
+var ERROR_INVALID_FIELD = errors.New("event and id fields must be a single line")
+var ERROR_STREAM_CLOSED = errors.New("event stream is closed")
+
+const CONTENT_TYPE = "text/event-stream"
+
+// DEFAULT_HEARTBEAT_INTERVAL keeps idle streams from being cut off by
+// proxies, most of which give up on a silent connection after a minute.
+const DEFAULT_HEARTBEAT_INTERVAL = 15 * time.Second
+
+type Options struct {
+	// HeartbeatInterval is how long the stream may be idle before a
+	// comment is sent to keep it open. Zero means
+	// DEFAULT_HEARTBEAT_INTERVAL, negative means no heartbeats.
+	HeartbeatInterval time.Duration
+}
+
+func (o Options) withDefaults() Options {
+	if o.HeartbeatInterval == 0 {
+		o.HeartbeatInterval = DEFAULT_HEARTBEAT_INTERVAL
+	}
+
+	return o
+}
+
+// An Event is one message of the stream. Data may span several lines.
+// Fields left empty aren't sent; Retry tells the client how long to wait
+// before reconnecting.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	Retry time.Duration
+}
+
+// Stream writes events to a client. Its methods are safe to call from
+// several goroutines.
+type Stream struct {
+	mu        sync.Mutex
+	w         *response.Writer
+	ctx       context.Context
+	lastID    string
+	interval  time.Duration
+	heartbeat *time.Timer
+	closed    bool
+	err       error
+}
+
+// Handler returns a handler that opens a stream for every request and
+// passes it to handler, closing it when handler returns.
+func Handler(options Options, handler func(s *Stream, req *request.Request)) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		s, err := NewStream(w, req, options)
+		if err != nil {
+			return
+		}
+		defer s.Close()
+
+		handler(s, req)
+	}
+}
+
+// NewStream sends the response headers for an event stream. From then on
+// events go through the Stream, and w must not be written to directly.
+func NewStream(w *response.Writer, req *request.Request, options Options) (*Stream, error) {
+	options = options.withDefaults()
+
+	err := w.WriteStatusLine(response.STATUS_OK)
+	if err != nil {
+		return nil, err
+	}
+
+	h := response.GetDefaultHeaders(0)
+	h.Delete("Content-Length")
+	h.Replace("Content-Type", CONTENT_TYPE)
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Cache-Control", "no-cache")
+	// Tells nginx not to buffer the stream.
+	h.Set("X-Accel-Buffering", "no")
+
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return nil, err
+	}
+
+	// The stream lasts as long as the client listens.
+	server.ClearTimeout(req)
+
+	s := &Stream{
+		w:        w,
+		ctx:      req.Context(),
+		lastID:   req.Headers.Get("Last-Event-ID"),
+		interval: options.HeartbeatInterval,
+	}
+
+	if s.interval > 0 {
+		// The first heartbeat may fire before AfterFunc has returned.
+		s.mu.Lock()
+		s.heartbeat = time.AfterFunc(s.interval, s.sendHeartbeat)
+		s.mu.Unlock()
+	}
+
+	return s, nil
+}
+
+// LastEventID returns the ID of the last event the client saw before it
+// reconnected, from the Last-Event-ID header, or "" on a first connection.
+func (s *Stream) LastEventID() string {
+	return s.lastID
+}
+
+// Done is closed when the client goes away or the server shuts down.
+func (s *Stream) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Send writes e and flushes it to the client.
+func (s *Stream) Send(e Event) error {
+	if strings.ContainsAny(e.Event, "\r\n") || strings.ContainsAny(e.ID, "\r\n\x00") {
+		return ERROR_INVALID_FIELD
+	}
+
+	return s.write(appendEvent(nil, e))
+}
+
+// Comment writes text as a comment, which clients ignore.
+func (s *Stream) Comment(text string) error {
+	var b []byte
+	for _, line := range splitLines(text) {
+		b = appendField(b, "", line)
+	}
+
+	return s.write(append(b, '\n'))
+}
+
+// Close ends the stream. It is safe to call more than once.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	if s.heartbeat != nil {
+		s.heartbeat.Stop()
+	}
+
+	if s.err != nil || s.ctx.Err() != nil {
+		// Nobody is listening, so there is no point in ending the body.
+		s.w.Abort()
+		return nil
+	}
+
+	_, err := s.w.WriteChunkedBodyDone()
+	return err
+}
+
+func (s *Stream) write(b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ERROR_STREAM_CLOSED
+	}
+
+	if s.err != nil {
+		return s.err
+	}
+
+	err := s.ctx.Err()
+	if err == nil {
+		_, err = s.w.WriteChunkedBody(b)
+	}
+	if err == nil {
+		err = s.w.Flush()
+	}
+
+	if err != nil {
+		s.err = err
+		return err
+	}
+
+	// Any write keeps the connection alive, so the next heartbeat is due a
+	// full interval from now.
+	if s.heartbeat != nil {
+		s.heartbeat.Reset(s.interval)
+	}
+
+	return nil
+}
+
+func (s *Stream) sendHeartbeat() {
+	// Errors end the stream, and Send reports them.
+	s.write([]byte(":\n\n"))
+}
+
+// appendEvent formats e as the HTML Living Standard describes in 9.2.6.
+func appendEvent(b []byte, e Event) []byte {
+	if e.ID != "" {
+		b = appendField(b, "id", e.ID)
+	}
+
+	if e.Event != "" {
+		b = appendField(b, "event", e.Event)
+	}
+
+	if e.Retry > 0 {
+		b = appendField(b, "retry", strconv.FormatInt(e.Retry.Milliseconds(), 10))
+	}
+
+	// Each line of the data is a field of its own; the client joins them
+	// back with "\n".
+	for _, line := range splitLines(e.Data) {
+		b = appendField(b, "data", line)
+	}
+
+	return append(b, '\n')
+}
+
+// appendField writes one "name: value" line. A single space after the
+// colon is dropped by the client, so one is always sent in case value
+// starts with a space itself.
+func appendField(b []byte, name, value string) []byte {
+	b = append(b, name...)
+	b = append(b, ": "...)
+	b = append(b, value...)
+
+	return append(b, '\n')
+}
+
+// splitLines splits s on any of the line endings the format allows: "\r\n",
+// "\n" and "\r".
+func splitLines(s string) []string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+
+	return strings.Split(s, "\n")
+}
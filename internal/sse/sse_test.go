@@ -0,0 +1,204 @@
+package sse
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpffomtcp.pinglu.dev/internal/client"
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/server"
+)
+
+func startServer(t *testing.T, options Options, handler func(s *Stream, req *request.Request)) string {
+	t.Helper()
+
+	return startServerConfig(t, server.Config{}, options, handler)
+}
+
+func startServerConfig(t *testing.T, config server.Config, options Options, handler func(s *Stream, req *request.Request)) string {
+	t.Helper()
+
+	config.Addr = "127.0.0.1:0"
+	srv, err := server.ServeConfig(config, Handler(options, handler))
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+
+	return "http://" + srv.Addr().String()
+}
+
+func get(t *testing.T, url string, lastEventID string) *client.Response {
+	t.Helper()
+
+	c := client.New(client.Options{})
+	t.Cleanup(func() { c.Close() })
+
+	req, err := client.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	if lastEventID != "" {
+		req.Headers.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := c.Do(context.Background(), req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+
+	return resp
+}
+
+func TestAppendEvent(t *testing.T) {
+	tests := []struct {
+		name  string
+		event Event
+		want  string
+	}{
+		{
+			name:  "Data only",
+			event: Event{Data: "hello"},
+			want:  "data: hello\n\n",
+		},
+		{
+			name:  "All fields",
+			event: Event{ID: "42", Event: "update", Data: "hello", Retry: 3 * time.Second},
+			want:  "id: 42\nevent: update\nretry: 3000\ndata: hello\n\n",
+		},
+		{
+			name:  "Multi-line data with every line ending",
+			event: Event{Data: "one\ntwo\r\nthree\rfour"},
+			want:  "data: one\ndata: two\ndata: three\ndata: four\n\n",
+		},
+		{
+			name:  "Leading space and trailing newline",
+			event: Event{Data: " indented\n"},
+			want:  "data:  indented\ndata: \n\n",
+		},
+	}
+
+	for _, tt := range tests {
+		// Test: Each event
+		assert.Equal(t, tt.want, string(appendEvent(nil, tt.event)), tt.name)
+	}
+}
+
+func TestStream(t *testing.T) {
+	url := startServer(t, Options{HeartbeatInterval: -1}, func(s *Stream, req *request.Request) {
+		s.Send(Event{ID: "1", Event: "greeting", Data: "hello\nworld"})
+		s.Comment("just saying")
+		s.Send(Event{Data: "resumed after " + s.LastEventID()})
+
+		// Test: Fields that would break the framing are rejected
+		err := s.Send(Event{Event: "bad\nevent"})
+		if err != nil {
+			s.Send(Event{Data: err.Error()})
+		}
+	})
+
+	// Test: Headers and events
+	resp := get(t, url, "41")
+	assert.Equal(t, "text/event-stream", resp.Headers.Get("Content-Type"))
+	assert.Equal(t, "no-cache", resp.Headers.Get("Cache-Control"))
+	assert.True(t, resp.Chunked)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "id: 1\nevent: greeting\ndata: hello\ndata: world\n\n"+
+		": just saying\n\n"+
+		"data: resumed after 41\n\n"+
+		"data: "+ERROR_INVALID_FIELD.Error()+"\n\n", string(body))
+}
+
+func TestStreamFlushes(t *testing.T) {
+	next := make(chan struct{})
+
+	url := startServer(t, Options{HeartbeatInterval: -1}, func(s *Stream, req *request.Request) {
+		s.Send(Event{Data: "first"})
+		<-next
+		s.Send(Event{Data: "second"})
+	})
+
+	// Test: Every event arrives before the next one is sent
+	br := bufio.NewReader(get(t, url, "").Body)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "data: first\n", line)
+
+	close(next)
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "\ndata: second\n\n", string(rest))
+}
+
+func TestStreamHeartbeat(t *testing.T) {
+	url := startServer(t, Options{HeartbeatInterval: 20 * time.Millisecond}, func(s *Stream, req *request.Request) {
+		time.Sleep(100 * time.Millisecond)
+	})
+
+	// Test: Idle streams get heartbeat comments
+	body, err := io.ReadAll(get(t, url, "").Body)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(body), ":\n\n:\n\n"), string(body))
+}
+
+func TestStreamTimeout(t *testing.T) {
+	config := server.Config{RequestTimeout: 50 * time.Millisecond, WriteTimeout: 50 * time.Millisecond}
+
+	url := startServerConfig(t, config, Options{HeartbeatInterval: -1}, func(s *Stream, req *request.Request) {
+		for range 10 {
+			select {
+			case <-s.Done():
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+
+			err := s.Send(Event{Data: "tick"})
+			if err != nil {
+				return
+			}
+		}
+	})
+
+	// Test: Streams outlive the request and write timeouts
+	body, err := io.ReadAll(get(t, url, "").Body)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("data: tick\n\n", 10), string(body))
+}
+
+func TestStreamDisconnect(t *testing.T) {
+	errs := make(chan error, 1)
+
+	url := startServer(t, Options{}, func(s *Stream, req *request.Request) {
+		for {
+			select {
+			case <-s.Done():
+				errs <- s.Send(Event{Data: "gone"})
+				return
+			case <-time.After(5 * time.Millisecond):
+				err := s.Send(Event{Data: "tick"})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}
+	})
+
+	resp := get(t, url, "")
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "data: tick\n", line)
+
+	// Test: The stream stops once the client hangs up
+	resp.Body.Close()
+	select {
+	case err := <-errs:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream kept going after the client disconnected")
+	}
+}
@@ -0,0 +1,417 @@
+package websocket
+
+import (
+	"bufio"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"slices"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var ERROR_PROTOCOL = errors.New("websocket protocol error")
+var ERROR_MESSAGE_TOO_BIG = errors.New("websocket message too big")
+var ERROR_INVALID_UTF8 = errors.New("invalid utf-8 in text message")
+var ERROR_INVALID_OPCODE = errors.New("invalid message opcode")
+var ERROR_CONTROL_TOO_LARGE = errors.New("control frame payload too large")
+var ERROR_CLOSE_SENT = errors.New("close frame already sent")
+var ERROR_CLOSED_WRITER = errors.New("write to closed message writer")
+
+// PAYLOAD_READ_SIZE is how much of a frame payload is read at a time.
+const PAYLOAD_READ_SIZE = 64 << 10
+
+// CloseCode is the status code of a close frame, RFC 6455 7.4.
+type CloseCode uint16
+
+const (
+	CLOSE_NORMAL              CloseCode = 1000
+	CLOSE_GOING_AWAY          CloseCode = 1001
+	CLOSE_PROTOCOL_ERROR      CloseCode = 1002
+	CLOSE_UNSUPPORTED_DATA    CloseCode = 1003
+	CLOSE_NO_STATUS           CloseCode = 1005
+	CLOSE_ABNORMAL            CloseCode = 1006
+	CLOSE_INVALID_PAYLOAD     CloseCode = 1007
+	CLOSE_POLICY_VIOLATION    CloseCode = 1008
+	CLOSE_MESSAGE_TOO_BIG     CloseCode = 1009
+	CLOSE_MANDATORY_EXTENSION CloseCode = 1010
+	CLOSE_INTERNAL_ERROR      CloseCode = 1011
+)
+
+// CloseError is what ReadMessage returns once the peer has closed the
+// connection. Code is CLOSE_NO_STATUS if the close frame had no code.
+type CloseError struct {
+	Code   CloseCode
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+// validReceivedCode reports whether code may appear in a close frame.
+// 1005 and 1006 are only for reporting, 1015 is reserved for TLS failures.
+func validReceivedCode(code CloseCode) bool {
+	return (code >= 1000 && code <= 1003) || (code >= 1007 && code <= 1014) || (code >= 3000 && code <= 4999)
+}
+
+// Conn is a WebSocket connection. One goroutine may read and one may write
+// messages at a time; Ping and Close can be called alongside either.
+type Conn struct {
+	conn     net.Conn
+	br       *bufio.Reader
+	isServer bool
+
+	subprotocol      string
+	compression      bool
+	compressionLevel int
+	maxMessageSize   int64
+
+	writeMu   sync.Mutex
+	closeSent bool
+
+	pongHandler func(data []byte)
+	readErr     error
+}
+
+func newConn(conn net.Conn, isServer bool, options Options) *Conn {
+	return &Conn{
+		conn:             conn,
+		br:               bufio.NewReader(conn),
+		isServer:         isServer,
+		compressionLevel: options.CompressionLevel,
+		maxMessageSize:   options.MaxMessageSize,
+	}
+}
+
+// Subprotocol returns the subprotocol picked during the handshake, or ""
+// if none was.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// Compressed reports whether messages are sent with permessage-deflate.
+func (c *Conn) Compressed() bool {
+	return c.compression
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// SetPongHandler has handler called with the payload of every pong that
+// comes in while reading.
+func (c *Conn) SetPongHandler(handler func(data []byte)) {
+	c.pongHandler = handler
+}
+
+// ReadMessage returns the next TEXT or BINARY message, put together from
+// its fragments. Pings are answered along the way. Once the peer closes
+// the connection it returns a *CloseError, after echoing the close frame.
+// Protocol violations close the connection with the matching code, and,
+// like every other error, are returned again by later calls.
+func (c *Conn) ReadMessage() (Opcode, []byte, error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+
+	opcode, message, err := c.readMessage()
+	if err != nil {
+		c.readErr = err
+		return 0, nil, err
+	}
+
+	return opcode, message, nil
+}
+
+func (c *Conn) readMessage() (Opcode, []byte, error) {
+	var opcode Opcode
+	var compressed bool
+	var message []byte
+
+	for {
+		h, err := readFrameHeader(c.br)
+		if errors.Is(err, ERROR_PROTOCOL) {
+			return 0, nil, c.fail(CLOSE_PROTOCOL_ERROR, err)
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+
+		err = c.checkFrame(h)
+		if err != nil {
+			return 0, nil, c.fail(CLOSE_PROTOCOL_ERROR, err)
+		}
+
+		if h.opcode.isControl() {
+			payload, err := c.readPayload(h, nil)
+			if err != nil {
+				return 0, nil, err
+			}
+
+			err = c.handleControl(h.opcode, payload)
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+
+		switch {
+		case h.opcode == CONTINUATION && opcode == 0:
+			return 0, nil, c.fail(CLOSE_PROTOCOL_ERROR, fmt.Errorf("%w: continuation without a message", ERROR_PROTOCOL))
+		case h.opcode != CONTINUATION && opcode != 0:
+			return 0, nil, c.fail(CLOSE_PROTOCOL_ERROR, fmt.Errorf("%w: new message before the last one ended", ERROR_PROTOCOL))
+		case h.opcode != CONTINUATION:
+			opcode = h.opcode
+			compressed = h.rsv1
+		case h.rsv1:
+			return 0, nil, c.fail(CLOSE_PROTOCOL_ERROR, fmt.Errorf("%w: RSV1 on a continuation frame", ERROR_PROTOCOL))
+		}
+
+		tooBig := h.length > math.MaxInt-int64(len(message))
+		if tooBig || c.maxMessageSize >= 0 && int64(len(message))+h.length > c.maxMessageSize {
+			return 0, nil, c.fail(CLOSE_MESSAGE_TOO_BIG, ERROR_MESSAGE_TOO_BIG)
+		}
+
+		message, err = c.readPayload(h, message)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if h.fin {
+			break
+		}
+	}
+
+	if compressed {
+		var err error
+		message, err = decompressMessage(message, c.maxMessageSize)
+		if errors.Is(err, ERROR_MESSAGE_TOO_BIG) {
+			return 0, nil, c.fail(CLOSE_MESSAGE_TOO_BIG, err)
+		}
+		if err != nil {
+			return 0, nil, c.fail(CLOSE_INVALID_PAYLOAD, err)
+		}
+	}
+
+	if opcode == TEXT && !utf8.Valid(message) {
+		return 0, nil, c.fail(CLOSE_INVALID_PAYLOAD, ERROR_INVALID_UTF8)
+	}
+
+	return opcode, message, nil
+}
+
+// checkFrame enforces the rules for frame headers of RFC 6455 5.
+func (c *Conn) checkFrame(h frameHeader) error {
+	if !h.opcode.known() {
+		return fmt.Errorf("%w: unknown opcode %d", ERROR_PROTOCOL, h.opcode)
+	}
+
+	// Clients mask every frame, servers none.
+	if h.masked != c.isServer {
+		return fmt.Errorf("%w: wrong masking", ERROR_PROTOCOL)
+	}
+
+	if h.rsv1 && (!c.compression || h.opcode.isControl()) {
+		return fmt.Errorf("%w: RSV1 set", ERROR_PROTOCOL)
+	}
+
+	if h.opcode.isControl() && (!h.fin || h.length > MAX_CONTROL_PAYLOAD) {
+		return fmt.Errorf("%w: fragmented or oversized control frame", ERROR_PROTOCOL)
+	}
+
+	return nil
+}
+
+// readPayload appends the unmasked payload of the frame h heads to b. It
+// grows b as the payload arrives, PAYLOAD_READ_SIZE at a time, so a frame
+// claiming a huge length costs no more memory than the data sent. The
+// caller makes sure the length fits in an int.
+func (c *Conn) readPayload(h frameHeader, b []byte) ([]byte, error) {
+	start := len(b)
+
+	for remaining := int(h.length); remaining > 0; {
+		n := min(remaining, PAYLOAD_READ_SIZE)
+		b = slices.Grow(b, n)
+
+		_, err := io.ReadFull(c.br, b[len(b):len(b)+n])
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		b = b[:len(b)+n]
+		remaining -= n
+	}
+
+	if h.masked {
+		maskBytes(h.maskKey, 0, b[start:])
+	}
+
+	return b, nil
+}
+
+func (c *Conn) handleControl(opcode Opcode, payload []byte) error {
+	switch opcode {
+	case PING:
+		err := c.writeControl(PONG, payload)
+		if err != nil && !errors.Is(err, ERROR_CLOSE_SENT) {
+			return err
+		}
+	case PONG:
+		if c.pongHandler != nil {
+			c.pongHandler(payload)
+		}
+	case CLOSE:
+		closeErr := &CloseError{Code: CLOSE_NO_STATUS}
+
+		switch {
+		case len(payload) == 1:
+			return c.fail(CLOSE_PROTOCOL_ERROR, fmt.Errorf("%w: truncated close code", ERROR_PROTOCOL))
+		case len(payload) >= 2:
+			closeErr.Code = CloseCode(binary.BigEndian.Uint16(payload))
+			closeErr.Reason = string(payload[2:])
+
+			if !validReceivedCode(closeErr.Code) {
+				return c.fail(CLOSE_PROTOCOL_ERROR, fmt.Errorf("%w: invalid close code %d", ERROR_PROTOCOL, closeErr.Code))
+			}
+
+			if !utf8.ValidString(closeErr.Reason) {
+				return c.fail(CLOSE_INVALID_PAYLOAD, ERROR_INVALID_UTF8)
+			}
+		}
+
+		// Echo the close, RFC 6455 5.5.1.
+		code := closeErr.Code
+		if code == CLOSE_NO_STATUS {
+			code = 0
+		}
+		err := c.Close(code, "")
+		if err != nil && !errors.Is(err, ERROR_CLOSE_SENT) {
+			return err
+		}
+
+		return closeErr
+	}
+
+	return nil
+}
+
+// fail closes the connection with code because of err, and returns err.
+func (c *Conn) fail(code CloseCode, err error) error {
+	reason := err.Error()
+	if len(reason) > MAX_CONTROL_PAYLOAD-2 {
+		reason = reason[:MAX_CONTROL_PAYLOAD-2]
+	}
+
+	c.Close(code, reason)
+	return err
+}
+
+// WriteMessage sends data as a single TEXT or BINARY frame, compressed if
+// permessage-deflate was negotiated.
+func (c *Conn) WriteMessage(opcode Opcode, data []byte) error {
+	if opcode != TEXT && opcode != BINARY {
+		return ERROR_INVALID_OPCODE
+	}
+
+	if !c.compression {
+		return c.writeFrame(true, false, opcode, data)
+	}
+
+	compressed, err := compressMessage(data, c.compressionLevel)
+	if err != nil {
+		return err
+	}
+
+	return c.writeFrame(true, true, opcode, compressed)
+}
+
+// NextWriter returns a writer for a message sent in fragments: every Write
+// goes out as a frame, and Close ends the message. Control frames may be
+// sent in between, but no other message.
+func (c *Conn) NextWriter(opcode Opcode) (io.WriteCloser, error) {
+	if opcode != TEXT && opcode != BINARY {
+		return nil, ERROR_INVALID_OPCODE
+	}
+
+	mw := &messageWriter{c: c, opcode: opcode, first: true}
+	if c.compression {
+		fw, err := flate.NewWriter(&mw.pending, c.compressionLevel)
+		if err != nil {
+			return nil, err
+		}
+		mw.flate = fw
+	}
+
+	return mw, nil
+}
+
+// Ping sends a ping with data, at most MAX_CONTROL_PAYLOAD bytes.
+func (c *Conn) Ping(data []byte) error {
+	return c.writeControl(PING, data)
+}
+
+// Close starts the closing handshake by sending a close frame with code
+// and reason; a zero code sends none. Keep calling ReadMessage until it
+// returns the peer's *CloseError. The network connection itself is closed
+// once the handler that got c returns.
+func (c *Conn) Close(code CloseCode, reason string) error {
+	var payload []byte
+	if code != 0 {
+		payload = binary.BigEndian.AppendUint16(nil, uint16(code))
+		payload = append(payload, reason...)
+	}
+
+	return c.writeControl(CLOSE, payload)
+}
+
+func (c *Conn) writeControl(opcode Opcode, payload []byte) error {
+	if len(payload) > MAX_CONTROL_PAYLOAD {
+		return ERROR_CONTROL_TOO_LARGE
+	}
+
+	return c.writeFrame(true, false, opcode, payload)
+}
+
+// writeFrame sends one frame in a single write, masked if we are the
+// client. Nothing goes out after a close frame.
+func (c *Conn) writeFrame(fin, rsv1 bool, opcode Opcode, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return ERROR_CLOSE_SENT
+	}
+
+	if opcode == CLOSE {
+		c.closeSent = true
+	}
+
+	var maskKey *[4]byte
+	if !c.isServer {
+		maskKey = new([4]byte)
+		rand.Read(maskKey[:])
+	}
+
+	b := make([]byte, 0, MAX_FRAME_HEADER_SIZE+len(payload))
+	b = appendFrameHeader(b, fin, rsv1, opcode, len(payload), maskKey)
+	start := len(b)
+	b = append(b, payload...)
+
+	if maskKey != nil {
+		maskBytes(*maskKey, 0, b[start:])
+	}
+
+	_, err := c.conn.Write(b)
+	return err
+}
@@ -0,0 +1,183 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"strings"
+)
+
+const PERMESSAGE_DEFLATE = "permessage-deflate"
+
+// deflateTail ends every compressed message; senders strip it and
+// receivers put it back, RFC 7692 7.2.1. The empty final block after it
+// lets the decompressor finish without an unexpected EOF.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// negotiateCompression picks the first permessage-deflate offer in the
+// Sec-WebSocket-Extensions header that we can accept, and returns the
+// value to answer with. We never keep the compression context between
+// messages, so we ask for no context takeover in both directions.
+func negotiateCompression(extensions string) (string, bool) {
+	for _, offer := range strings.Split(extensions, ",") {
+		params := strings.Split(offer, ";")
+		if strings.TrimSpace(params[0]) != PERMESSAGE_DEFLATE {
+			continue
+		}
+
+		if acceptableDeflateParams(params[1:]) {
+			return PERMESSAGE_DEFLATE + "; server_no_context_takeover; client_no_context_takeover", true
+		}
+	}
+
+	return "", false
+}
+
+func acceptableDeflateParams(params []string) bool {
+	seen := map[string]bool{}
+
+	for _, param := range params {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		name = strings.TrimSpace(name)
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+
+		if seen[name] {
+			return false
+		}
+		seen[name] = true
+
+		switch name {
+		case "server_no_context_takeover", "client_no_context_takeover":
+			if value != "" {
+				return false
+			}
+		case "server_max_window_bits":
+			// compress/flate always uses a 32KB window.
+			if value != "15" {
+				return false
+			}
+		case "client_max_window_bits":
+			// Any window the client uses fits in ours.
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// compressMessage compresses data as one permessage-deflate message.
+func compressMessage(data []byte, level int) ([]byte, error) {
+	var b bytes.Buffer
+
+	fw, err := flate.NewWriter(&b, level)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = fw.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fw.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(b.Bytes(), deflateTail[:4]), nil
+}
+
+// decompressMessage undoes compressMessage. A result longer than limit,
+// if limit isn't negative, fails with ERROR_MESSAGE_TOO_BIG.
+func decompressMessage(data []byte, limit int64) ([]byte, error) {
+	var r io.Reader = flate.NewReader(io.MultiReader(bytes.NewReader(data), bytes.NewReader(deflateTail)))
+	if limit >= 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+
+	out, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if limit >= 0 && int64(len(out)) > limit {
+		return nil, ERROR_MESSAGE_TOO_BIG
+	}
+
+	return out, nil
+}
+
+// messageWriter writes one message as a sequence of frames, compressing it
+// if the connection negotiated permessage-deflate.
+type messageWriter struct {
+	c       *Conn
+	opcode  Opcode
+	first   bool
+	closed  bool
+	flate   *flate.Writer
+	pending bytes.Buffer
+}
+
+// Write sends p as a fragment of the message.
+func (mw *messageWriter) Write(p []byte) (int, error) {
+	if mw.closed {
+		return 0, ERROR_CLOSED_WRITER
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if mw.flate == nil {
+		return len(p), mw.writeFrame(false, p)
+	}
+
+	_, err := mw.flate.Write(p)
+	if err != nil {
+		return 0, err
+	}
+
+	// Send deflate blocks as they come out. Only the Flush in Close ends
+	// the output with the tail we have to strip.
+	if mw.pending.Len() > 0 {
+		err = mw.writeFrame(false, mw.pending.Bytes())
+		mw.pending.Reset()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Close sends the last frame of the message.
+func (mw *messageWriter) Close() error {
+	if mw.closed {
+		return nil
+	}
+	mw.closed = true
+
+	if mw.flate == nil {
+		return mw.writeFrame(true, nil)
+	}
+
+	err := mw.flate.Flush()
+	if err != nil {
+		return err
+	}
+
+	return mw.writeFrame(true, bytes.TrimSuffix(mw.pending.Bytes(), deflateTail[:4]))
+}
+
+func (mw *messageWriter) writeFrame(fin bool, payload []byte) error {
+	opcode := CONTINUATION
+	if mw.first {
+		opcode = mw.opcode
+	}
+
+	err := mw.c.writeFrame(fin, mw.first && mw.flate != nil, opcode, payload)
+	mw.first = false
+
+	return err
+}
@@ -0,0 +1,157 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Opcode is the kind of a frame, RFC 6455 5.2. TEXT and BINARY are also
+// the kinds of messages.
+type Opcode byte
+
+const (
+	CONTINUATION Opcode = 0x0
+	TEXT         Opcode = 0x1
+	BINARY       Opcode = 0x2
+	CLOSE        Opcode = 0x8
+	PING         Opcode = 0x9
+	PONG         Opcode = 0xA
+)
+
+const (
+	FIN_BIT  = 0x80
+	RSV1_BIT = 0x40
+	RSV2_BIT = 0x20
+	RSV3_BIT = 0x10
+	MASK_BIT = 0x80
+)
+
+// MAX_CONTROL_PAYLOAD is the largest payload of a control frame.
+const MAX_CONTROL_PAYLOAD = 125
+
+// MAX_FRAME_HEADER_SIZE fits the longest length and a masking key.
+const MAX_FRAME_HEADER_SIZE = 14
+
+func (o Opcode) isControl() bool {
+	return o&0x8 != 0
+}
+
+func (o Opcode) known() bool {
+	switch o {
+	case CONTINUATION, TEXT, BINARY, CLOSE, PING, PONG:
+		return true
+	}
+
+	return false
+}
+
+type frameHeader struct {
+	fin     bool
+	rsv1    bool
+	opcode  Opcode
+	masked  bool
+	maskKey [4]byte
+	length  int64
+}
+
+func readFrameHeader(r io.Reader) (frameHeader, error) {
+	var h frameHeader
+	var buf [8]byte
+
+	_, err := io.ReadFull(r, buf[:2])
+	if err != nil {
+		return h, err
+	}
+
+	if buf[0]&(RSV2_BIT|RSV3_BIT) != 0 {
+		return h, fmt.Errorf("%w: reserved bits set", ERROR_PROTOCOL)
+	}
+
+	h.fin = buf[0]&FIN_BIT != 0
+	h.rsv1 = buf[0]&RSV1_BIT != 0
+	h.opcode = Opcode(buf[0] & 0x0F)
+	h.masked = buf[1]&MASK_BIT != 0
+	h.length = int64(buf[1] & 0x7F)
+
+	switch h.length {
+	case 126:
+		_, err = io.ReadFull(r, buf[:2])
+		if err != nil {
+			return h, unexpectedEOF(err)
+		}
+		h.length = int64(binary.BigEndian.Uint16(buf[:2]))
+	case 127:
+		_, err = io.ReadFull(r, buf[:8])
+		if err != nil {
+			return h, unexpectedEOF(err)
+		}
+
+		length := binary.BigEndian.Uint64(buf[:8])
+		if length>>63 != 0 {
+			return h, fmt.Errorf("%w: frame length out of range", ERROR_PROTOCOL)
+		}
+		h.length = int64(length)
+	}
+
+	if h.masked {
+		_, err = io.ReadFull(r, h.maskKey[:])
+		if err != nil {
+			return h, unexpectedEOF(err)
+		}
+	}
+
+	return h, nil
+}
+
+// appendFrameHeader appends the header of a frame with a payload of length
+// bytes to b, with the masking key if maskKey is set.
+func appendFrameHeader(b []byte, fin, rsv1 bool, opcode Opcode, length int, maskKey *[4]byte) []byte {
+	first := byte(opcode)
+	if fin {
+		first |= FIN_BIT
+	}
+	if rsv1 {
+		first |= RSV1_BIT
+	}
+
+	var mask byte
+	if maskKey != nil {
+		mask = MASK_BIT
+	}
+
+	switch {
+	case length <= 125:
+		b = append(b, first, mask|byte(length))
+	case length <= 0xFFFF:
+		b = append(b, first, mask|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(length))
+	default:
+		b = append(b, first, mask|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(length))
+	}
+
+	if maskKey != nil {
+		b = append(b, maskKey[:]...)
+	}
+
+	return b
+}
+
+// maskBytes XORs b with key, starting at offset pos into the payload, and
+// returns the offset past b. Masking and unmasking are the same operation.
+func maskBytes(key [4]byte, pos int, b []byte) int {
+	for i := range b {
+		b[i] ^= key[(pos+i)&3]
+	}
+
+	return pos + len(b)
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
@@ -0,0 +1,226 @@
+// Package websocket implements the server side of the WebSocket protocol,
+// RFC 6455, with permessage-deflate compression, RFC 7692.
+package websocket
+
+import (
+	"compress/flate"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+
+	"httpffomtcp.pinglu.dev/internal/request"
+	"httpffomtcp.pinglu.dev/internal/response"
+	"httpffomtcp.pinglu.dev/internal/server"
+)
+
+var ERROR_BAD_HANDSHAKE = errors.New("bad websocket handshake")
+var ERROR_UNSUPPORTED_VERSION = errors.New("unsupported websocket version")
+var ERROR_ORIGIN_NOT_ALLOWED = errors.New("websocket origin not allowed")
+
+// ACCEPT_GUID is appended to Sec-WebSocket-Key to compute
+// Sec-WebSocket-Accept, RFC 6455 1.3.
+const ACCEPT_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const PROTOCOL_VERSION = "13"
+
+const DEFAULT_MAX_MESSAGE_SIZE = 1 << 20
+
+type Options struct {
+	// Subprotocols lists the subprotocols we speak, most preferred first.
+	// The first one the client also offers is picked; if there is none,
+	// the connection goes ahead without a subprotocol.
+	Subprotocols []string
+
+	// CheckOrigin decides whether to accept a handshake. Nil accepts
+	// requests without an Origin header and ones whose Origin has the same
+	// host as the request, which keeps other sites' pages out.
+	CheckOrigin func(req *request.Request) bool
+
+	// MaxMessageSize bounds incoming messages, after decompression. Larger
+	// ones close the connection with CLOSE_MESSAGE_TOO_BIG. Zero means
+	// DEFAULT_MAX_MESSAGE_SIZE, negative means no limit.
+	MaxMessageSize int64
+
+	// EnableCompression accepts permessage-deflate if the client offers
+	// it. CompressionLevel is a compress/flate level; zero means
+	// flate.DefaultCompression.
+	EnableCompression bool
+	CompressionLevel  int
+}
+
+func (o Options) withDefaults() Options {
+	if o.CheckOrigin == nil {
+		o.CheckOrigin = sameOrigin
+	}
+
+	if o.MaxMessageSize == 0 {
+		o.MaxMessageSize = DEFAULT_MAX_MESSAGE_SIZE
+	}
+
+	if o.CompressionLevel == 0 {
+		o.CompressionLevel = flate.DefaultCompression
+	}
+
+	return o
+}
+
+// Handler returns a handler that upgrades every request to a WebSocket
+// connection and passes it to handler.
+func Handler(options Options, handler func(conn *Conn)) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		Upgrade(w, req, options, handler)
+	}
+}
+
+// Upgrade answers the opening handshake in req, RFC 6455 4.2. Once the
+// handler serving req returns, the server runs handler with the
+// connection, and closes it when handler returns. If the handshake is bad
+// Upgrade writes the error response and returns the error.
+func Upgrade(w *response.Writer, req *request.Request, options Options, handler func(conn *Conn)) error {
+	options = options.withDefaults()
+
+	statusCode, err := checkHandshake(req, options)
+	if err != nil {
+		writeHandshakeError(w, statusCode, err)
+		return err
+	}
+
+	subprotocol := pickSubprotocol(req.Headers.Get("Sec-WebSocket-Protocol"), options.Subprotocols)
+
+	extensions, compression := "", false
+	if options.EnableCompression {
+		extensions, compression = negotiateCompression(req.Headers.Get("Sec-WebSocket-Extensions"))
+	}
+
+	err = server.OnUpgrade(req, func(netConn net.Conn) {
+		conn := newConn(netConn, true, options)
+		conn.subprotocol = subprotocol
+		conn.compression = compression
+
+		handler(conn)
+	})
+	if err != nil {
+		writeHandshakeError(w, response.STATUS_INTERNAL_ERROR, err)
+		return err
+	}
+
+	h := response.GetDefaultHeaders(0)
+	h.Delete("Content-Length")
+	h.Delete("Content-Type")
+	h.Replace("Connection", "Upgrade")
+	h.Set("Upgrade", "websocket")
+	h.Set("Sec-WebSocket-Accept", AcceptKey(req.Headers.Get("Sec-WebSocket-Key")))
+
+	if subprotocol != "" {
+		h.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+
+	if compression {
+		h.Set("Sec-WebSocket-Extensions", extensions)
+	}
+
+	err = w.WriteStatusLine(response.STATUS_SWITCHING_PROTOCOLS)
+	if err != nil {
+		return err
+	}
+
+	return w.WriteHeaders(h)
+}
+
+// AcceptKey returns the Sec-WebSocket-Accept value for key.
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + ACCEPT_GUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// checkHandshake validates the opening handshake, and returns the status
+// code to reject it with if it is bad.
+func checkHandshake(req *request.Request, options Options) (response.StatusCode, error) {
+	if req.RequestLine.Method != "GET" {
+		return response.STATUS_METHOD_NOT_ALLOWED, fmt.Errorf("%w: method %s", ERROR_BAD_HANDSHAKE, req.RequestLine.Method)
+	}
+
+	if !hasToken(req.Headers.Get("Upgrade"), "websocket") {
+		return response.STATUS_BAD_REQUEST, fmt.Errorf("%w: missing Upgrade: websocket", ERROR_BAD_HANDSHAKE)
+	}
+
+	if !hasToken(req.Headers.Get("Connection"), "upgrade") {
+		return response.STATUS_BAD_REQUEST, fmt.Errorf("%w: missing Connection: upgrade", ERROR_BAD_HANDSHAKE)
+	}
+
+	if req.Headers.Get("Sec-WebSocket-Version") != PROTOCOL_VERSION {
+		return response.STATUS_UPGRADE_REQUIRED, ERROR_UNSUPPORTED_VERSION
+	}
+
+	key, err := base64.StdEncoding.DecodeString(req.Headers.Get("Sec-WebSocket-Key"))
+	if err != nil || len(key) != 16 {
+		return response.STATUS_BAD_REQUEST, fmt.Errorf("%w: invalid Sec-WebSocket-Key", ERROR_BAD_HANDSHAKE)
+	}
+
+	if !options.CheckOrigin(req) {
+		return response.STATUS_FORBIDDEN, ERROR_ORIGIN_NOT_ALLOWED
+	}
+
+	return 0, nil
+}
+
+func writeHandshakeError(w *response.Writer, statusCode response.StatusCode, err error) {
+	msg := []byte(err.Error())
+
+	h := response.GetDefaultHeaders(len(msg))
+	if statusCode == response.STATUS_UPGRADE_REQUIRED {
+		h.Set("Sec-WebSocket-Version", PROTOCOL_VERSION)
+	}
+
+	w.WriteStatusLine(statusCode)
+	w.WriteHeaders(h)
+	w.WriteBody(msg)
+}
+
+// sameOrigin accepts requests without an Origin, and ones from a page on
+// the host they are sent to.
+func sameOrigin(req *request.Request) bool {
+	origin := req.Headers.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(u.Host, req.Headers.Get("Host"))
+}
+
+func pickSubprotocol(offered string, supported []string) string {
+	var offers []string
+	for _, offer := range strings.Split(offered, ",") {
+		offers = append(offers, strings.TrimSpace(offer))
+	}
+
+	for _, protocol := range supported {
+		if slices.Contains(offers, protocol) {
+			return protocol
+		}
+	}
+
+	return ""
+}
+
+// hasToken reports whether the comma separated list value contains token,
+// ignoring case.
+func hasToken(value, token string) bool {
+	for _, t := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+
+	return false
+}
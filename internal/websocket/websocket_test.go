@@ -0,0 +1,379 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpffomtcp.pinglu.dev/internal/headers"
+	"httpffomtcp.pinglu.dev/internal/server"
+)
+
+const SAMPLE_KEY = "dGhlIHNhbXBsZSBub25jZQ=="
+
+func startServer(t *testing.T, handler server.Handler) string {
+	t.Helper()
+
+	srv, err := server.ServeConfig(server.Config{Addr: "127.0.0.1:0"}, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+
+	return srv.Addr().String()
+}
+
+func echo(conn *Conn) {
+	for {
+		opcode, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		err = conn.WriteMessage(opcode, message)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handshake sends an opening handshake with extra header lines to addr
+// and returns the connection, the status line and the response headers.
+func handshake(t *testing.T, addr string, extra string) (net.Conn, *bufio.Reader, string, headers.Headers) {
+	t.Helper()
+
+	netConn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { netConn.Close() })
+	netConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(netConn, "GET /chat HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\n"+
+		"Sec-WebSocket-Version: 13\r\n"+
+		"%s\r\n", addr, SAMPLE_KEY, extra)
+
+	br := bufio.NewReader(netConn)
+	statusLine, err := br.ReadString('\n')
+	require.NoError(t, err)
+
+	h := headers.NewHeaders()
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+
+		_, done, err := h.Parse([]byte(line))
+		require.NoError(t, err)
+		if done {
+			break
+		}
+	}
+
+	return netConn, br, strings.TrimSuffix(statusLine, "\r\n"), h
+}
+
+// dial completes a handshake and returns the client end of the connection.
+func dial(t *testing.T, addr string, extra string) *Conn {
+	t.Helper()
+
+	netConn, br, statusLine, h := handshake(t, addr, extra)
+	require.Equal(t, "HTTP/1.1 101 Switching Protocols", statusLine)
+
+	conn := newConn(netConn, false, Options{MaxMessageSize: -1})
+	conn.br = br
+	conn.compression = h.Get("Sec-WebSocket-Extensions") != ""
+
+	return conn
+}
+
+func TestHandshake(t *testing.T) {
+	addr := startServer(t, Handler(Options{Subprotocols: []string{"chat.v2", "chat.v1"}}, echo))
+
+	// Test: Accept key from RFC 6455 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", AcceptKey(SAMPLE_KEY))
+
+	// Test: A good handshake switches protocols
+	_, _, statusLine, h := handshake(t, addr, "Sec-WebSocket-Protocol: chat.v1, chat.v2\r\n")
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols", statusLine)
+	assert.Equal(t, "websocket", h.Get("Upgrade"))
+	assert.Equal(t, "Upgrade", h.Get("Connection"))
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", h.Get("Sec-WebSocket-Accept"))
+	assert.Equal(t, "chat.v2", h.Get("Sec-WebSocket-Protocol"))
+	assert.Equal(t, "", h.Get("Sec-WebSocket-Extensions"))
+
+	// Test: No common subprotocol
+	_, _, _, h = handshake(t, addr, "Sec-WebSocket-Protocol: other\r\n")
+	assert.Equal(t, "", h.Get("Sec-WebSocket-Protocol"))
+
+	tests := []struct {
+		name       string
+		request    string
+		statusLine string
+	}{
+		{
+			name:       "Wrong version",
+			request:    "GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: " + SAMPLE_KEY + "\r\nSec-WebSocket-Version: 8\r\n\r\n",
+			statusLine: "HTTP/1.1 426 Upgrade Required",
+		},
+		{
+			name:       "Missing key",
+			request:    "GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n\r\n",
+			statusLine: "HTTP/1.1 400 Bad Request",
+		},
+		{
+			name:       "Not an upgrade",
+			request:    "GET / HTTP/1.1\r\nHost: localhost\r\nSec-WebSocket-Key: " + SAMPLE_KEY + "\r\nSec-WebSocket-Version: 13\r\n\r\n",
+			statusLine: "HTTP/1.1 400 Bad Request",
+		},
+		{
+			name:       "Wrong method",
+			request:    "POST / HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: " + SAMPLE_KEY + "\r\nSec-WebSocket-Version: 13\r\n\r\n",
+			statusLine: "HTTP/1.1 405 Method Not Allowed",
+		},
+		{
+			name:       "Cross-origin",
+			request:    "GET / HTTP/1.1\r\nHost: localhost\r\nOrigin: https://evil.example\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: " + SAMPLE_KEY + "\r\nSec-WebSocket-Version: 13\r\n\r\n",
+			statusLine: "HTTP/1.1 403 Forbidden",
+		},
+	}
+
+	for _, tt := range tests {
+		// Test: Each bad handshake is rejected
+		netConn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+
+		netConn.Write([]byte(tt.request))
+		resp, err := io.ReadAll(netConn)
+		netConn.Close()
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(string(resp), tt.statusLine+"\r\n"), tt.name)
+
+		if tt.name == "Wrong version" {
+			assert.Contains(t, string(resp), "sec-websocket-version: 13\r\n")
+		}
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	tests := []struct {
+		offer    string
+		accepted bool
+	}{
+		{offer: "permessage-deflate", accepted: true},
+		{offer: "permessage-deflate; client_max_window_bits", accepted: true},
+		{offer: "permessage-deflate; server_max_window_bits=10, permessage-deflate", accepted: true},
+		{offer: "permessage-deflate; server_max_window_bits=10", accepted: false},
+		{offer: "permessage-deflate; unknown_param", accepted: false},
+		{offer: "permessage-deflate; client_no_context_takeover; client_no_context_takeover", accepted: false},
+		{offer: "x-webkit-deflate-frame", accepted: false},
+		{offer: "", accepted: false},
+	}
+
+	for _, tt := range tests {
+		// Test: Each offer
+		value, accepted := negotiateCompression(tt.offer)
+		assert.Equal(t, tt.accepted, accepted, tt.offer)
+		if accepted {
+			assert.Equal(t, "permessage-deflate; server_no_context_takeover; client_no_context_takeover", value)
+		}
+	}
+}
+
+func TestFrameHeader(t *testing.T) {
+	key := [4]byte{1, 2, 3, 4}
+
+	for _, length := range []int{0, 125, 126, 0xFFFF, 0x10000} {
+		// Test: Lengths round-trip through every encoding
+		b := appendFrameHeader(nil, true, false, BINARY, length, &key)
+		h, err := readFrameHeader(bytes.NewReader(b))
+		require.NoError(t, err)
+		assert.Equal(t, frameHeader{fin: true, opcode: BINARY, masked: true, maskKey: key, length: int64(length)}, h)
+	}
+
+	// Test: Masking twice restores the payload
+	payload := []byte("Hello")
+	maskBytes(key, 0, payload)
+	assert.NotEqual(t, "Hello", string(payload))
+	maskBytes(key, 0, payload)
+	assert.Equal(t, "Hello", string(payload))
+
+	// Test: Reserved bits are rejected
+	_, err := readFrameHeader(bytes.NewReader([]byte{0x80 | RSV2_BIT | byte(TEXT), 0}))
+	require.ErrorIs(t, err, ERROR_PROTOCOL)
+}
+
+func TestConn(t *testing.T) {
+	addr := startServer(t, Handler(Options{MaxMessageSize: 64}, echo))
+	conn := dial(t, addr, "")
+
+	// Test: Text and binary messages are echoed
+	require.NoError(t, conn.WriteMessage(TEXT, []byte("hello")))
+	opcode, message, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TEXT, opcode)
+	assert.Equal(t, "hello", string(message))
+
+	require.NoError(t, conn.WriteMessage(BINARY, []byte{0, 1, 2}))
+	opcode, message, err = conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, BINARY, opcode)
+	assert.Equal(t, []byte{0, 1, 2}, message)
+
+	// Test: Fragments are put back together, with pings in between
+	var pongs []string
+	conn.SetPongHandler(func(data []byte) { pongs = append(pongs, string(data)) })
+
+	w, err := conn.NextWriter(TEXT)
+	require.NoError(t, err)
+	w.Write([]byte("frag"))
+	require.NoError(t, conn.Ping([]byte("are you there")))
+	w.Write([]byte("mented"))
+	require.NoError(t, w.Close())
+
+	opcode, message, err = conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TEXT, opcode)
+	assert.Equal(t, "fragmented", string(message))
+	assert.Equal(t, []string{"are you there"}, pongs)
+
+	// Test: The closing handshake
+	require.NoError(t, conn.Close(CLOSE_NORMAL, "bye"))
+	_, _, err = conn.ReadMessage()
+	var closeErr *CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, CLOSE_NORMAL, closeErr.Code)
+
+	// Test: Nothing goes out after the close frame
+	require.ErrorIs(t, conn.WriteMessage(TEXT, []byte("late")), ERROR_CLOSE_SENT)
+
+	// Test: Messages over the limit close the connection
+	conn = dial(t, addr, "")
+	require.NoError(t, conn.WriteMessage(BINARY, make([]byte, 65)))
+	_, _, err = conn.ReadMessage()
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, CLOSE_MESSAGE_TOO_BIG, closeErr.Code)
+}
+
+func TestConnProtocolErrors(t *testing.T) {
+	addr := startServer(t, Handler(Options{}, echo))
+
+	tests := []struct {
+		name  string
+		frame []byte
+		code  CloseCode
+	}{
+		{name: "Unmasked frame", frame: []byte{FIN_BIT | byte(TEXT), 2, 'h', 'i'}, code: CLOSE_PROTOCOL_ERROR},
+		{name: "Unknown opcode", frame: maskedFrame(FIN_BIT|0x3, nil), code: CLOSE_PROTOCOL_ERROR},
+		{name: "Continuation without a message", frame: maskedFrame(FIN_BIT|byte(CONTINUATION), []byte("x")), code: CLOSE_PROTOCOL_ERROR},
+		{name: "Fragmented ping", frame: maskedFrame(byte(PING), nil), code: CLOSE_PROTOCOL_ERROR},
+		{name: "Compression not negotiated", frame: maskedFrame(FIN_BIT|RSV1_BIT|byte(TEXT), []byte("x")), code: CLOSE_PROTOCOL_ERROR},
+		{name: "Invalid UTF-8", frame: maskedFrame(FIN_BIT|byte(TEXT), []byte{0xff, 0xfe}), code: CLOSE_INVALID_PAYLOAD},
+		{name: "Invalid close code", frame: maskedFrame(FIN_BIT|byte(CLOSE), []byte{0x03, 0xed}), code: CLOSE_PROTOCOL_ERROR},
+	}
+
+	for _, tt := range tests {
+		// Test: Each violation closes the connection with its code
+		conn := dial(t, addr, "")
+		_, err := conn.conn.Write(tt.frame)
+		require.NoError(t, err)
+
+		_, _, err = conn.ReadMessage()
+		var closeErr *CloseError
+		require.ErrorAs(t, err, &closeErr, tt.name)
+		assert.Equal(t, tt.code, closeErr.Code, tt.name)
+	}
+}
+
+func TestHugeFrameLength(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	conn := newConn(serverConn, true, Options{MaxMessageSize: -1})
+	defer serverConn.Close()
+
+	// Test: Without a size limit, a frame claiming 2^62 bytes fails when
+	// its data runs out, without allocating for the claimed length
+	frame := []byte{FIN_BIT | byte(BINARY), MASK_BIT | 127}
+	frame = binary.BigEndian.AppendUint64(frame, 1<<62)
+	frame = append(frame, 0x12, 0x34, 0x56, 0x78)
+	frame = append(frame, "hello"...)
+
+	go func() {
+		clientConn.Write(frame)
+		clientConn.Close()
+	}()
+
+	_, _, err := conn.ReadMessage()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+// maskedFrame builds a frame the way a client sends it, with first as its
+// first byte.
+func maskedFrame(first byte, payload []byte) []byte {
+	key := [4]byte{0x12, 0x34, 0x56, 0x78}
+
+	b := appendFrameHeader(nil, false, false, 0, len(payload), &key)
+	b[0] = first
+	start := len(b)
+	b = append(b, payload...)
+	maskBytes(key, 0, b[start:])
+
+	return b
+}
+
+func TestCompression(t *testing.T) {
+	addr := startServer(t, Handler(Options{EnableCompression: true}, echo))
+
+	// Test: permessage-deflate is negotiated when offered
+	_, _, _, h := handshake(t, addr, "Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n")
+	assert.Equal(t, "permessage-deflate; server_no_context_takeover; client_no_context_takeover", h.Get("Sec-WebSocket-Extensions"))
+
+	conn := dial(t, addr, "Sec-WebSocket-Extensions: permessage-deflate\r\n")
+	require.True(t, conn.Compressed())
+
+	// Test: Compressed messages round-trip
+	long := strings.Repeat("compress me please ", 500)
+	require.NoError(t, conn.WriteMessage(TEXT, []byte(long)))
+	_, message, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, long, string(message))
+
+	// Test: So do compressed fragments
+	w, err := conn.NextWriter(BINARY)
+	require.NoError(t, err)
+	for range 50 {
+		w.Write([]byte(long[:100]))
+	}
+	require.NoError(t, w.Close())
+	opcode, message, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, BINARY, opcode)
+	assert.Equal(t, strings.Repeat(long[:100], 50), string(message))
+
+	// Test: Not negotiated unless enabled
+	addr = startServer(t, Handler(Options{}, echo))
+	_, _, _, h = handshake(t, addr, "Sec-WebSocket-Extensions: permessage-deflate\r\n")
+	assert.Equal(t, "", h.Get("Sec-WebSocket-Extensions"))
+
+	// Test: Decompressed size is limited
+	_, err = decompressMessage(mustCompress(t, bytes.Repeat([]byte("a"), 1000)), 100)
+	require.True(t, errors.Is(err, ERROR_MESSAGE_TOO_BIG))
+}
+
+func mustCompress(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	compressed, err := compressMessage(data, 6)
+	require.NoError(t, err)
+
+	return compressed
+}